@@ -0,0 +1,229 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/util"
+)
+
+const (
+	// currentFile receives the records, it is renamed with the time of the rotation once it is full
+	currentFile   = "audit.log"
+	rotatedPrefix = "audit-"
+	rotatedSuffix = ".log"
+	// rotatedLayout sorts rotated files by name in the order they were written
+	rotatedLayout = "20060102T150405.000000000Z"
+
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+var DefaultMaxSize int64 = util.Size100MB
+
+// Record is a mutating request as seen by a node, one JSON object per line in the log
+type Record struct {
+	Time      time.Time
+	User      string // Empty when authentication is disabled
+	Remote    string
+	Operation string
+	Entity    string
+	Version   string
+	Uuid      uuid.UUID
+	Status    model.Status
+	Error     string `json:",omitempty"`
+}
+
+/*
+Log is an append-only audit log stored in Dir, the records of the current file are rotated
+to a file named after the time of the rotation once the current file reaches MaxSize.
+Records are written with a single write each, they are flushed to disk on rotation and Close.
+*/
+type Log struct {
+	Dir      string
+	MaxSize  int64 // 0 never rotates
+	MaxFiles int   // Rotated files kept, 0 keeps all of them
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewLog(dir string) *Log {
+	return &Log{
+		Dir:     dir,
+		MaxSize: DefaultMaxSize,
+	}
+}
+
+func (x *Log) WithMaxSize(size int64) *Log {
+	x.MaxSize = size
+	return x
+}
+
+func (x *Log) WithMaxFiles(files int) *Log {
+	x.MaxFiles = files
+	return x
+}
+
+// Operation returns the operation audited for messages of type t, empty when t is not audited
+func Operation(t model.MessageType) string {
+	switch t {
+	case model.MessageTypeInsert:
+		return OperationInsert
+	case model.MessageTypeUpdate:
+		return OperationUpdate
+	case model.MessageTypeDelete:
+		return OperationDelete
+	}
+	return ""
+}
+
+func (x *Log) Open() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(x.Dir, 0700); err != nil {
+		return err
+	}
+	return x.open()
+}
+
+// Write appends r to the log, rotating the current file first if r does not fit in it.
+// A zero Time is set while holding the lock so that records are ordered by time across files.
+func (x *Log) Write(r Record) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.file == nil {
+		return model.ErrAuditClosed
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if x.MaxSize > 0 && x.size > 0 && x.size+int64(len(data)) > x.MaxSize {
+		if err = x.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := x.file.Write(data)
+	x.size += int64(n)
+	return err
+}
+
+func (x *Log) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.file == nil {
+		return nil
+	}
+	err := x.file.Sync()
+	if cerr := x.file.Close(); err == nil {
+		err = cerr
+	}
+	x.file = nil
+	return err
+}
+
+// open must be called with mu held
+func (x *Log) open() error {
+	f, err := os.OpenFile(filepath.Join(x.Dir, currentFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	x.file = f
+	x.size = info.Size()
+	return nil
+}
+
+// rotate must be called with mu held
+func (x *Log) rotate() error {
+	if err := x.file.Sync(); err != nil {
+		return err
+	}
+	if err := x.file.Close(); err != nil {
+		return err
+	}
+	x.file = nil
+
+	name := rotatedPrefix + time.Now().UTC().Format(rotatedLayout) + rotatedSuffix
+	if err := os.Rename(filepath.Join(x.Dir, currentFile), filepath.Join(x.Dir, name)); err != nil {
+		// Keep appending to the current file rather than losing records
+		return errors.Join(err, x.open())
+	}
+	return errors.Join(x.prune(), x.open())
+}
+
+// prune removes the oldest rotated files beyond MaxFiles
+func (x *Log) prune() error {
+	if x.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := rotatedFiles(x.Dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > x.MaxFiles {
+		if err = os.Remove(filepath.Join(x.Dir, files[0].name)); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+type rotated struct {
+	name string
+	at   time.Time
+}
+
+// rotatedFiles returns the rotated files of dir from the oldest to the newest
+func rotatedFiles(dir string) ([]rotated, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []rotated
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, rotatedPrefix) || !strings.HasSuffix(name, rotatedSuffix) {
+			continue
+		}
+		at, err := time.Parse(rotatedLayout, strings.TrimSuffix(strings.TrimPrefix(name, rotatedPrefix), rotatedSuffix))
+		if err != nil {
+			continue
+		}
+		out = append(out, rotated{name: name, at: at})
+	}
+	slices.SortFunc(out, func(a, b rotated) int {
+		return a.at.Compare(b.at)
+	})
+	return out, nil
+}
@@ -0,0 +1,188 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+func writeRecords(t *testing.T, l *Log, entity string, n int) []Record {
+	t.Helper()
+	var out []Record
+	for range n {
+		r := Record{
+			Time:      time.Now().UTC(),
+			User:      "user",
+			Remote:    "127.0.0.1:1234",
+			Operation: OperationInsert,
+			Entity:    entity,
+			Version:   "v1",
+			Uuid:      uuid.New(),
+			Status:    model.StatusSuccess,
+		}
+		if err := l.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, r)
+		// Distinct times make the filters of the tests deterministic
+		time.Sleep(time.Millisecond)
+	}
+	return out
+}
+
+func readAll(t *testing.T, dir string, f Filter) []Record {
+	t.Helper()
+	var out []Record
+	for r, err := range Read(dir, f) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// TestLogRotation checks that full files are rotated, the oldest are pruned and reading spans every file in order
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLog(dir).WithMaxSize(1000).WithMaxFiles(3)
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	written := writeRecords(t, l, "Sample", 30)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := rotatedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 rotated files, got %d", len(files))
+	}
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(dir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1000 {
+			t.Errorf("Rotated file %s exceeds the max size: %d", f.name, info.Size())
+		}
+	}
+
+	// Pruned records are gone, the remaining ones are the newest in the order they were written
+	read := readAll(t, dir, Filter{})
+	if len(read) == 0 || len(read) >= len(written) {
+		t.Fatalf("Expected the oldest records to be pruned, read %d of %d", len(read), len(written))
+	}
+	tail := written[len(written)-len(read):]
+	for i := range read {
+		if read[i].Uuid != tail[i].Uuid {
+			t.Fatalf("Record %d out of order: expected %s, got %s", i, tail[i].Uuid, read[i].Uuid)
+		}
+	}
+}
+
+// TestLogReopen checks that reopening a log appends to the current file
+func TestLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	for range 2 {
+		l := NewLog(dir)
+		if err := l.Open(); err != nil {
+			t.Fatal(err)
+		}
+		writeRecords(t, l, "Sample", 2)
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if read := readAll(t, dir, Filter{}); len(read) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(read))
+	}
+	if err := NewLog(dir).Write(Record{}); err != model.ErrAuditClosed {
+		t.Errorf("Expected ErrAuditClosed before Open, got %v", err)
+	}
+}
+
+// TestReadFilter checks the time range and entity filters, including across rotated files
+func TestReadFilter(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLog(dir).WithMaxSize(600)
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	samples := writeRecords(t, l, "Sample", 10)
+	others := writeRecords(t, l, "Other", 10)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []Record
+	}{
+		{"Entity", Filter{Entity: "Other"}, others},
+		{"From", Filter{From: others[5].Time}, others[5:]},
+		{"To", Filter{To: samples[3].Time}, samples[:3]},
+		{"Range and entity", Filter{From: samples[2].Time, To: others[4].Time, Entity: "Sample"}, samples[2:]},
+		{"Nothing", Filter{From: others[9].Time.Add(time.Hour)}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read := readAll(t, dir, tt.filter)
+			if len(read) != len(tt.expected) {
+				t.Fatalf("Expected %d records, got %d", len(tt.expected), len(read))
+			}
+			for i := range read {
+				if read[i].Uuid != tt.expected[i].Uuid {
+					t.Errorf("Record %d: expected %s, got %s", i, tt.expected[i].Uuid, read[i].Uuid)
+				}
+			}
+		})
+	}
+}
+
+// TestReadTornLine checks that a line torn by a crash is reported without hiding the records around it
+func TestReadTornLine(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLog(dir)
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, l, "Sample", 1)
+	if _, err := l.file.WriteString("{\"Time\":\n"); err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, l, "Sample", 1)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records, errs int
+	for _, err := range Read(dir, Filter{}) {
+		if err != nil {
+			errs++
+			continue
+		}
+		records++
+	}
+	if records != 2 || errs != 1 {
+		t.Errorf("Expected 2 records and 1 error, got %d and %d", records, errs)
+	}
+}
+
+// TestReadMissingDir checks that a node that never audited anything has an empty log
+func TestReadMissingDir(t *testing.T) {
+	if read := readAll(t, filepath.Join(t.TempDir(), "none"), Filter{}); len(read) != 0 {
+		t.Errorf("Expected no records, got %d", len(read))
+	}
+}
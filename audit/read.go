@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rah-0/hyperion/util"
+)
+
+// Filter selects records by time range and entity, zero values match everything
+type Filter struct {
+	From   time.Time // Inclusive
+	To     time.Time // Exclusive
+	Entity string
+}
+
+func (x Filter) Match(r Record) bool {
+	if !x.From.IsZero() && r.Time.Before(x.From) {
+		return false
+	}
+	if !x.To.IsZero() && !r.Time.Before(x.To) {
+		return false
+	}
+	return x.Entity == "" || x.Entity == r.Entity
+}
+
+/*
+Read yields the records of the log stored in dir that match f, from the oldest to the newest.
+Rotated files older than f.From are not opened and reading stops at the first file written after f.To.
+A line that cannot be decoded, such as one torn by a crash, yields an error and reading goes on if the caller continues.
+*/
+func Read(dir string, f Filter) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		files, err := rotatedFiles(dir)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				yield(Record{}, err)
+			}
+			return
+		}
+
+		var previous time.Time
+		paths := make([]string, 0, len(files)+1)
+		for _, r := range files {
+			// Every record of a rotated file was written before its rotation
+			if !f.From.IsZero() && r.at.Before(f.From) {
+				previous = r.at
+				continue
+			}
+			if !f.To.IsZero() && !previous.IsZero() && !previous.Before(f.To) {
+				break
+			}
+			paths = append(paths, filepath.Join(dir, r.name))
+			previous = r.at
+		}
+		if f.To.IsZero() || previous.IsZero() || previous.Before(f.To) {
+			paths = append(paths, filepath.Join(dir, currentFile))
+		}
+
+		for _, path := range paths {
+			if !readFile(path, f, yield) {
+				return
+			}
+		}
+	}
+}
+
+// readFile reports whether reading should go on with the next file
+func readFile(path string, f Filter, yield func(Record, error) bool) bool {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Rotated or pruned while reading
+		return true
+	}
+	if err != nil {
+		return yield(Record{}, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, util.Size4KB), util.Size1MB)
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			if !yield(Record{}, fmt.Errorf("%s:%d: %w", path, line, err)) {
+				return false
+			}
+			continue
+		}
+		if f.Match(r) && !yield(r, nil) {
+			return false
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return yield(Record{}, err)
+	}
+	return true
+}
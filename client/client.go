@@ -0,0 +1,466 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/config"
+	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/template"
+	"github.com/rah-0/hyperion/trace"
+)
+
+var DialTimeout = 5 * time.Second
+
+// maxBackoffShift caps the back off of throttled requests to 64 times the retry delay
+const maxBackoffShift = 6
+
+/*
+Client is a cluster aware hconn.Requester, it can be passed to every generated Db* function.
+Each request is routed to the owner of its entity, which is the node with the lowest host name
+holding that entity, the other nodes holding the entity are used as fallback.
+A request is retried on the next holder when a node is unreachable or shutting down, and the
+topology is refreshed from the cluster whenever a node answers with a redirect.
+*/
+type Client struct {
+	Config       config.Config
+	Seeds        []string
+	PoolSize     int
+	MaxRetries   int
+	MaxRedirects int
+	RetryDelay   time.Duration
+	// TLS enables TLS when set, the ServerName is the host name of the node being dialed when it is known
+	TLS *tls.Config
+	// Credentials authenticate the client to nodes requiring it, nil connects without authenticating
+	Credentials *model.Credentials
+	// Tracer records a span per request and per node tried, nodes continue the trace of requests
+	// whose context carries a span (see trace.WithSpan) or whose trace is sampled by the Tracer
+	Tracer *trace.Tracer
+
+	mu      sync.Mutex
+	pools   map[string]*hconn.Pool
+	dialing map[string]*dialing // Pools being started, see pool
+	closed  bool
+}
+
+// dialing is a pool being started, done is closed once p or err is set
+type dialing struct {
+	done chan struct{}
+	p    *hconn.Pool
+	err  error
+}
+
+var (
+	_ hconn.Requester = (*Client)(nil)
+	_ hconn.Pinner    = (*Client)(nil)
+)
+
+func NewClient() *Client {
+	return &Client{
+		PoolSize:     2,
+		MaxRetries:   3,
+		MaxRedirects: 3,
+		RetryDelay:   100 * time.Millisecond,
+		pools:        make(map[string]*hconn.Pool),
+		dialing:      make(map[string]*dialing),
+	}
+}
+
+// WithConfig sets the cluster config, usually the same one loaded by the nodes
+func (x *Client) WithConfig(c config.Config) *Client {
+	x.Config = c
+	return x
+}
+
+// WithSeeds sets the addresses (ip:port) of nodes used to fetch the cluster config
+func (x *Client) WithSeeds(addresses ...string) *Client {
+	x.Seeds = append(x.Seeds, addresses...)
+	return x
+}
+
+func (x *Client) WithPoolSize(size int) *Client {
+	x.PoolSize = size
+	return x
+}
+
+func (x *Client) WithMaxRetries(retries int) *Client {
+	x.MaxRetries = retries
+	return x
+}
+
+func (x *Client) WithMaxRedirects(redirects int) *Client {
+	x.MaxRedirects = redirects
+	return x
+}
+
+func (x *Client) WithTLS(c *tls.Config) *Client {
+	x.TLS = c
+	return x
+}
+
+func (x *Client) WithToken(token string) *Client {
+	x.Credentials = &model.Credentials{Token: token}
+	return x
+}
+
+func (x *Client) WithPassword(user string, password string) *Client {
+	x.Credentials = &model.Credentials{User: user, Password: password}
+	return x
+}
+
+func (x *Client) WithTracer(t *trace.Tracer) *Client {
+	x.Tracer = t
+	return x
+}
+
+func (x *Client) WithRetryDelay(d time.Duration) *Client {
+	x.RetryDelay = d
+	return x
+}
+
+// Connect registers the entities and fetches the cluster config from the seeds if none was given
+func (x *Client) Connect() error {
+	if err := template.RegisterEntities(); err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	hasConfig := len(x.Config.Nodes) > 0
+	x.mu.Unlock()
+	if hasConfig {
+		return nil
+	}
+	return x.Refresh()
+}
+
+// Refresh fetches the topology from the known nodes and seeds, the first one answering wins
+func (x *Client) Refresh() error {
+	return x.refresh(context.Background())
+}
+
+func (x *Client) refresh(ctx context.Context) error {
+	var lastErr error = model.ErrClientNoNodes
+	for _, address := range x.knownAddresses() {
+		c, err := x.fetchTopology(ctx, address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		x.mu.Lock()
+		x.Config = c
+		x.mu.Unlock()
+		return nil
+	}
+	return lastErr
+}
+
+// Route returns the addresses of the nodes holding the entity, the owner comes first
+func (x *Client) Route(entityName string) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var out []string
+	for _, n := range x.Config.Holders(entityName) {
+		out = append(out, n.Address())
+	}
+	return out
+}
+
+// SendReceive routes msg to the node owning msg.Entity and retries on node failure, throttling or redirection
+// until ctx is done
+func (x *Client) SendReceive(ctx context.Context, msg model.Message) (model.Message, error) {
+	return x.sendReceive(ctx, msg, nil)
+}
+
+// Pin returns a Requester routing its first request as SendReceive does, the following ones are sent over
+// the connection that answered it, see hconn.Pinner
+func (x *Client) Pin() (hconn.Requester, func(error), error) {
+	p := &pinned{client: x}
+	return p, p.release, nil
+}
+
+// pinned is a Requester of Client sending every request after the first one over the connection that answered it
+type pinned struct {
+	client *Client
+	conn   hconn.Requester
+	unpin  func(error)
+}
+
+func (x *pinned) SendReceive(ctx context.Context, msg model.Message) (model.Message, error) {
+	if x.conn != nil {
+		return x.conn.SendReceive(ctx, msg)
+	}
+	return x.client.sendReceive(ctx, msg, x)
+}
+
+func (x *pinned) release(err error) {
+	if x.unpin != nil {
+		x.unpin(err)
+	}
+}
+
+// sendReceive is SendReceive, pinning the connection answering msg to pin when it is not nil
+func (x *Client) sendReceive(ctx context.Context, msg model.Message, pin *pinned) (resp model.Message, err error) {
+	span := trace.FromContext(ctx).Child("request")
+	if span == nil {
+		span = x.Tracer.Span("request", msg.Trace)
+	}
+	span.Set("type", msg.Type.String()).Set("entity", msg.Entity.Name)
+	defer func() {
+		span.Fail(err).Finish()
+	}()
+
+	candidates := x.candidates(msg.Entity.Name)
+	if len(candidates) == 0 {
+		return model.Message{}, model.ErrClientNoNodes
+	}
+
+	var lastErr error
+	redirects := 0
+	throttles := 0
+	for attempt := 0; attempt <= x.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, x.RetryDelay); err != nil {
+				return model.Message{}, err
+			}
+		}
+
+		// Rotate so a failing node is tried again only after the others
+		address := candidates[0]
+		candidates = append(candidates[1:], address)
+
+		p, err := x.pool(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// Requests after a redirect are the ones forwarded to the peer holding the entity
+		name := "send"
+		if redirects > 0 {
+			name = "forward"
+		}
+		sent := span.Child(name).SetKind(trace.KindClient).Set("node", address)
+		if sent != nil {
+			msg.Trace = sent.Context()
+		}
+		resp, err = send(ctx, p, msg, pin)
+		if err != nil {
+			sent.Fail(err).Finish()
+			if ctx.Err() != nil {
+				return model.Message{}, err
+			}
+			lastErr = err
+			continue
+		}
+		sent.Set("status", resp.Status.String()).Finish()
+
+		switch resp.Status {
+		case model.StatusShutdown:
+			lastErr = errors.New(resp.String)
+		case model.StatusThrottled:
+			// Back off exponentially on top of the retry delay, the next holder may not be as busy
+			lastErr = errors.New(resp.String)
+			throttles++
+			if err = sleep(ctx, x.RetryDelay<<min(throttles, maxBackoffShift)); err != nil {
+				return model.Message{}, err
+			}
+		case model.StatusRedirect:
+			if redirects >= x.MaxRedirects {
+				return model.Message{}, model.ErrClientRedirectLoop
+			}
+			redirects++
+
+			if err = x.refresh(ctx); err != nil {
+				nabu.FromError(err).WithMessage("client: failed to refresh topology").Log()
+			}
+			candidates = []string{resp.String}
+			for _, c := range x.candidates(msg.Entity.Name) {
+				if c != resp.String {
+					candidates = append(candidates, c)
+				}
+			}
+			// Following a redirect does not count as a retry
+			attempt--
+		default:
+			return resp, nil
+		}
+	}
+
+	return model.Message{}, lastErr
+}
+
+// send sends msg over p, the connection answering it with success is pinned to pin when it is not nil
+func send(ctx context.Context, p *hconn.Pool, msg model.Message, pin *pinned) (model.Message, error) {
+	if pin == nil {
+		return p.SendReceive(ctx, msg)
+	}
+	conn, unpin, err := p.Pin()
+	if err != nil {
+		return model.Message{}, err
+	}
+	resp, err := conn.SendReceive(ctx, msg)
+	if err != nil || resp.Status != model.StatusSuccess {
+		// The connection is fine when the caller gave up
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			unpin(nil)
+		} else {
+			unpin(err)
+		}
+		return resp, err
+	}
+	pin.conn, pin.unpin = conn, unpin
+	return resp, nil
+}
+
+// Close closes every connection pool
+func (x *Client) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.closed = true
+	var err error
+	for address, p := range x.pools {
+		if e := p.Close(); e != nil {
+			err = e
+		}
+		delete(x.pools, address)
+	}
+	return err
+}
+
+func (x *Client) candidates(entityName string) []string {
+	if entityName != "" {
+		if r := x.Route(entityName); len(r) > 0 {
+			return r
+		}
+	}
+
+	// Messages without entity can be answered by any node
+	return x.knownAddresses()
+}
+
+func (x *Client) knownAddresses() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	seen := make(map[string]struct{})
+	var out []string
+	for _, n := range x.Config.Nodes {
+		a := n.Address()
+		if _, ok := seen[a]; !ok {
+			seen[a] = struct{}{}
+			out = append(out, a)
+		}
+	}
+	for _, a := range x.Seeds {
+		if _, ok := seen[a]; !ok {
+			seen[a] = struct{}{}
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (x *Client) fetchTopology(ctx context.Context, address string) (config.Config, error) {
+	var c config.Config
+
+	p, err := x.pool(address)
+	if err != nil {
+		return c, err
+	}
+
+	resp, err := p.SendReceive(ctx, model.Message{Type: model.MessageTypeTopology})
+	if err != nil {
+		return c, err
+	}
+	if resp.Status != model.StatusSuccess {
+		return c, errors.New(resp.String)
+	}
+
+	err = json.Unmarshal(resp.Bytes, &c)
+	return c, err
+}
+
+// pool returns the pool of address, starting it outside mu so that a slow node does not hold up
+// the requests to the others, concurrent callers wait for the same start
+func (x *Client) pool(address string) (*hconn.Pool, error) {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil, model.ErrPoolClosed
+	}
+	if p, ok := x.pools[address]; ok {
+		x.mu.Unlock()
+		return p, nil
+	}
+	if d, ok := x.dialing[address]; ok {
+		x.mu.Unlock()
+		<-d.done
+		return d.p, d.err
+	}
+
+	d := &dialing{done: make(chan struct{})}
+	x.dialing[address] = d
+	hello := hconn.NewHello("", x.Config.ClusterName)
+	hello.Credentials = x.Credentials
+	tlsConfig := x.tlsConfig(address)
+	x.mu.Unlock()
+
+	p := hconn.NewPool(func() (*hconn.HConn, error) {
+		return hconn.Dial(address, DialTimeout, tlsConfig, hello)
+	}).WithSize(x.PoolSize)
+	err := p.Start()
+
+	x.mu.Lock()
+	delete(x.dialing, address)
+	if err == nil && x.closed {
+		// Closed while starting, the pool would otherwise be left open
+		if e := p.Close(); e != nil {
+			nabu.FromError(e).Log()
+		}
+		err = model.ErrPoolClosed
+	}
+	if err == nil {
+		x.pools[address] = p
+		d.p = p
+	}
+	d.err = err
+	x.mu.Unlock()
+	close(d.done)
+	return d.p, d.err
+}
+
+// tlsConfig verifies the node at address by its host name, it must be called with mu held
+func (x *Client) tlsConfig(address string) *tls.Config {
+	if x.TLS == nil || x.TLS.ServerName != "" {
+		return x.TLS
+	}
+	for _, n := range x.Config.Nodes {
+		if n.Address() == address {
+			c := x.TLS.Clone()
+			c.ServerName = n.Host.Name
+			return c
+		}
+	}
+	return x.TLS
+}
+
+// sleep waits for d unless ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
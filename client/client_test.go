@@ -0,0 +1,497 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rah-0/hyperion/config"
+	SampleV1 "github.com/rah-0/hyperion/entities/Sample/v1"
+	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/node"
+	"github.com/rah-0/hyperion/query"
+	"github.com/rah-0/hyperion/template"
+	"github.com/rah-0/hyperion/trace"
+	"github.com/rah-0/hyperion/util"
+)
+
+// startNode starts an in-process node, all of them share the memory of the generated entities
+func startNode(t *testing.T, name string, entities []string, peers ...*node.Node) *node.Node {
+	t.Helper()
+	if err := template.RegisterEntities(); err != nil {
+		t.Fatal(err)
+	}
+
+	n := node.NewNode().
+		WithClusterName("test").
+		WithHost(name, "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir())
+	for _, e := range entities {
+		n.AddEntity(e)
+	}
+	for _, p := range peers {
+		n.AddPeer(node.NewNode().
+			WithHost(p.Host.Name, p.Host.IP, p.Host.Port).
+			WithPath(p.Path.Data))
+		for _, e := range p.Entities {
+			n.Peers[len(n.Peers)-1].AddEntity(e.Name)
+		}
+	}
+
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node %s: %v", name, err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+
+	return n
+}
+
+func address(n *node.Node) string {
+	return net.JoinHostPort(n.Host.IP, strconv.Itoa(n.Host.Port))
+}
+
+func configNode(n *node.Node, entities ...string) config.Node {
+	c := config.Node{Host: config.NodeHost{Name: n.Host.Name, IP: n.Host.IP, Port: n.Host.Port}}
+	for _, e := range entities {
+		c.Entities = append(c.Entities, config.NodeEntity{Name: e})
+	}
+	return c
+}
+
+func insertAndFind(t *testing.T, c *Client) {
+	t.Helper()
+
+	entity := SampleV1.Sample{Name: "Client", Surname: uuid.NewString()}
+	if err := entity.DbInsert(c); err != nil {
+		t.Fatal(err)
+	}
+
+	q := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: entity.Surname},
+	})
+	r, err := SampleV1.DbQuery(c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0].Uuid != entity.Uuid {
+		t.Fatalf("Expected inserted entity, got %+v", r)
+	}
+}
+
+func TestClientFetchesTopologyFromSeed(t *testing.T) {
+	x := startNode(t, "X", []string{SampleV1.Name})
+	y := startNode(t, "Y", nil, x)
+
+	c := NewClient().WithSeeds(address(y))
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	route := c.Route(SampleV1.Name)
+	if len(route) != 1 || route[0] != address(x) {
+		t.Fatalf("Expected route to [%s], got %v", address(x), route)
+	}
+
+	insertAndFind(t, c)
+}
+
+// TestClientIter checks that a stream stays on the connection holding its cursor, the client spreads requests over several
+func TestClientIter(t *testing.T) {
+	x := startNode(t, "ITER", []string{SampleV1.Name})
+	c := NewClient().WithConfig(config.Config{
+		ClusterName: "test",
+		Nodes:       []config.Node{configNode(x, SampleV1.Name)},
+	})
+	c.PoolSize = 3
+	defer c.Close()
+
+	surname := uuid.NewString()
+	for i := 0; i < 10; i++ {
+		if err := (&SampleV1.Sample{Name: "Iter", Surname: surname}).DbInsert(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+	})
+	count := 0
+	for _, err := range SampleV1.DbQueryIter(c, q, 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 10 {
+		t.Fatalf("Expected 10 entities, got %d", count)
+	}
+
+	// Breaking out closes the cursor over the same connection, the next stream starts over
+	for _, err := range SampleV1.DbQueryIter(c, q, 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	count = 0
+	for _, err := range SampleV1.DbQueryIter(c, q, 4) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 10 {
+		t.Fatalf("Expected 10 entities after a cancelled stream, got %d", count)
+	}
+}
+
+func TestClientFollowsRedirect(t *testing.T) {
+	x := startNode(t, "X", []string{SampleV1.Name})
+	y := startNode(t, "Y", nil, x)
+
+	// Stale config claiming that Y holds the entity
+	c := NewClient().WithConfig(config.Config{
+		ClusterName: "test",
+		Nodes:       []config.Node{configNode(y, SampleV1.Name)},
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	insertAndFind(t, c)
+
+	route := c.Route(SampleV1.Name)
+	if len(route) != 1 || route[0] != address(x) {
+		t.Fatalf("Expected topology to be refreshed with route to [%s], got %v", address(x), route)
+	}
+}
+
+func TestClientFailsOverUnreachableOwner(t *testing.T) {
+	x := startNode(t, "X", []string{SampleV1.Name})
+
+	dead := node.NewNode().WithHost("A", "127.0.0.1", util.GetAvailablePort())
+	c := NewClient().WithRetryDelay(0).WithConfig(config.Config{
+		ClusterName: "test",
+		Nodes: []config.Node{
+			configNode(x, SampleV1.Name),
+			configNode(dead, SampleV1.Name),
+		},
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	route := c.Route(SampleV1.Name)
+	if len(route) != 2 || route[0] != address(dead) {
+		t.Fatalf("Expected unreachable node to be the owner, got %v", route)
+	}
+
+	insertAndFind(t, c)
+}
+
+func TestClientRetriesOnShutdown(t *testing.T) {
+	w := startNode(t, "W", []string{SampleV1.Name})
+	x := startNode(t, "X", []string{SampleV1.Name})
+
+	c := NewClient().WithRetryDelay(0).WithConfig(config.Config{
+		ClusterName: "test",
+		Nodes: []config.Node{
+			configNode(w, SampleV1.Name),
+			configNode(x, SampleV1.Name),
+		},
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Warm up the connections to the owner before it goes away
+	insertAndFind(t, c)
+
+	if err := w.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	insertAndFind(t, c)
+}
+
+func TestClientNoNodes(t *testing.T) {
+	c := NewClient()
+	if err := c.Connect(); err == nil {
+		t.Fatal("Expected error without config nor seeds, got none")
+	}
+
+	entity := SampleV1.Sample{}
+	if err := entity.DbInsert(c); err == nil {
+		t.Fatal("Expected error without known nodes, got none")
+	}
+}
+
+// TestClientPoolDialsOutsideLock checks that a node slow to answer the handshake does not hold up the others
+func TestClientPoolDialsOutsideLock(t *testing.T) {
+	n := startNode(t, "POOL_LOCK", []string{SampleV1.Name})
+
+	// Accepts connections but never answers their handshake
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted = append(accepted, conn)
+			mu.Unlock()
+		}
+	}()
+
+	c := NewClient().WithConfig(config.Config{ClusterName: "test"})
+	defer c.Close()
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := c.pool(stuck.Addr().String())
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.pool(address(n))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the pool of a reachable node not to wait for the stuck one")
+	}
+
+	_ = stuck.Close()
+	mu.Lock()
+	if len(accepted) != 1 {
+		t.Errorf("Expected the callers of the stuck node to share a single dial, got %d", len(accepted))
+	}
+	for _, conn := range accepted {
+		_ = conn.Close()
+	}
+	mu.Unlock()
+	for range 2 {
+		if err = <-errs; err == nil {
+			t.Error("Expected the pool of the stuck node to fail")
+		}
+	}
+}
+
+// TestClientTLS checks that the client verifies every node by the host name found in the config
+func TestClientTLS(t *testing.T) {
+	certs, err := util.GenerateTestCertificates(t.TempDir(), "X", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = template.RegisterEntities(); err != nil {
+		t.Fatal(err)
+	}
+
+	x := node.NewNode().
+		WithClusterName("test").
+		WithHost("X", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithTLS(config.NodeTLS{Cert: certs.Cert["X"], Key: certs.Key["X"], CA: certs.CA})
+	x.AddEntity(SampleV1.Name)
+	go func() {
+		if err := x.Start(); err != nil {
+			t.Errorf("Failed to start node X: %v", err)
+		}
+	}()
+	x.WaitStatusActive()
+	t.Cleanup(func() { _ = x.Shutdown() })
+
+	tlsConfig, err := config.NodeTLS{Cert: certs.Cert["client"], Key: certs.Key["client"], CA: certs.CA}.ClientConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient().WithTLS(tlsConfig).WithConfig(config.Config{
+		ClusterName: "test",
+		Nodes:       []config.Node{configNode(x, SampleV1.Name)},
+	})
+	if err = c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	insertAndFind(t, c)
+}
+
+// TestClientToken checks that the client authenticates to every node with its token
+func TestClientToken(t *testing.T) {
+	if err := template.RegisterEntities(); err != nil {
+		t.Fatal(err)
+	}
+
+	x := node.NewNode().
+		WithClusterName("test").
+		WithHost("X", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithAuth(config.Auth{
+			Users: []config.User{{Name: "app", Tokens: []string{config.HashToken("app-token")}, Roles: []string{"app"}}},
+			Roles: []config.Role{{Name: "app", Permissions: []config.Permission{{Entity: "*", Actions: []model.Action{model.ActionRead, model.ActionWrite}}}}},
+		})
+	x.AddEntity(SampleV1.Name)
+	go func() {
+		if err := x.Start(); err != nil {
+			t.Errorf("Failed to start node X: %v", err)
+		}
+	}()
+	x.WaitStatusActive()
+	t.Cleanup(func() { _ = x.Shutdown() })
+
+	cfg := config.Config{ClusterName: "test", Nodes: []config.Node{configNode(x, SampleV1.Name)}}
+
+	anonymous := NewClient().WithConfig(cfg).WithMaxRetries(0)
+	defer anonymous.Close()
+	entity := SampleV1.Sample{Name: "Anonymous"}
+	if err := entity.DbInsert(anonymous); !errors.Is(err, model.ErrHandshakeRefused) {
+		t.Fatalf("Expected anonymous client to be refused, got %v", err)
+	}
+
+	c := NewClient().WithConfig(cfg).WithToken("app-token")
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	insertAndFind(t, c)
+}
+
+// TestClientThrottled checks that throttled requests are retried after backing off
+func TestClientThrottled(t *testing.T) {
+	if err := template.RegisterEntities(); err != nil {
+		t.Fatal(err)
+	}
+
+	x := node.NewNode().
+		WithClusterName("test").
+		WithHost("X", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithLimits(config.NodeLimits{ClientRate: 50, ClientBurst: 1})
+	x.AddEntity(SampleV1.Name)
+	go func() {
+		if err := x.Start(); err != nil {
+			t.Errorf("Failed to start node X: %v", err)
+		}
+	}()
+	x.WaitStatusActive()
+	t.Cleanup(func() { _ = x.Shutdown() })
+
+	c := NewClient().
+		WithConfig(config.Config{ClusterName: "test", Nodes: []config.Node{configNode(x, SampleV1.Name)}}).
+		WithRetryDelay(5 * time.Millisecond).
+		WithMaxRetries(10)
+	defer c.Close()
+
+	for i := range 10 {
+		entity := SampleV1.Sample{Name: "Throttled", Surname: strconv.Itoa(i)}
+		if err := entity.DbInsert(c); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+}
+
+// spanRecorder is a trace.Exporter shared by the client and the nodes of a test
+type spanRecorder struct {
+	mu      sync.Mutex
+	records []trace.Record
+}
+
+func (x *spanRecorder) Export(records []trace.Record) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.records = append(x.records, records...)
+	return nil
+}
+
+func (x *spanRecorder) Close() error {
+	return nil
+}
+
+// TestClientTracing checks that a request redirected to a peer is a single trace spanning the client and both nodes
+func TestClientTracing(t *testing.T) {
+	recorder := &spanRecorder{}
+	x := startNode(t, "X", []string{SampleV1.Name})
+	y := node.NewNode().
+		WithClusterName("test").
+		WithHost("Y", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithTracer(trace.NewTracer("Y", recorder)).
+		AddPeer(node.NewNode().WithHost(x.Host.Name, x.Host.IP, x.Host.Port).AddEntity(SampleV1.Name))
+	go func() {
+		if err := y.Start(); err != nil {
+			t.Errorf("Failed to start node Y: %v", err)
+		}
+	}()
+	y.WaitStatusActive()
+	t.Cleanup(func() { _ = y.Shutdown() })
+
+	// Stale config claiming that Y holds the entity
+	tracer := trace.NewTracer("client", recorder)
+	c := NewClient().WithTracer(tracer).WithConfig(config.Config{
+		ClusterName: "test",
+		Nodes:       []config.Node{configNode(y, SampleV1.Name)},
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	root := tracer.Span("test", nil)
+	entity := SampleV1.Sample{Name: "Traced"}
+	if err := entity.DbInsert(hconn.Bind(trace.WithSpan(context.Background(), root), c)); err != nil {
+		t.Fatal(err)
+	}
+	root.Finish()
+	if err := y.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]trace.Record)
+	for _, r := range recorder.records {
+		if r.TraceId == root.TraceId() {
+			spans[r.Service+" "+r.Name] = r
+		}
+	}
+	request, send, forward := spans["client request"], spans["client send"], spans["client forward"]
+	redirect, received := spans["Y redirect"], spans["Y receive"]
+	if request.ParentId != root.SpanId() || send.ParentId != request.SpanId || forward.ParentId != request.SpanId {
+		t.Fatalf("Expected the attempts of the request to be children of the root span, got %v", spans)
+	}
+	if send.Attributes["node"] != address(y) || send.Attributes["status"] != "redirect" || forward.Attributes["node"] != address(x) {
+		t.Errorf("Unexpected attempts: %+v and %+v", send, forward)
+	}
+	if received.ParentId != send.SpanId || redirect.ParentId != received.SpanId || redirect.Attributes["peer"] != "X" {
+		t.Errorf("Expected Y to record the redirect within the first attempt, got %+v and %+v", received, redirect)
+	}
+}
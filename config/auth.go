@@ -0,0 +1,170 @@
+package config
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+const (
+	passwordScheme = "pbkdf2-sha256"
+	passwordSalt   = 16
+	passwordKey    = 32
+)
+
+// PasswordIterations is used for new password hashes, existing hashes keep the iterations they were created with
+var PasswordIterations = 600_000
+
+// unknownUser holds the hash verified against the logins of unknown users, so that they cost as much as the ones
+// of known users, it is made again when PasswordIterations changes
+var unknownUser struct {
+	mu         sync.Mutex
+	iterations int
+	hash       string
+}
+
+func unknownUserHash() (string, error) {
+	unknownUser.mu.Lock()
+	defer unknownUser.mu.Unlock()
+	if unknownUser.iterations != PasswordIterations {
+		hash, err := HashPassword("")
+		if err != nil {
+			return "", err
+		}
+		unknownUser.iterations, unknownUser.hash = PasswordIterations, hash
+	}
+	return unknownUser.hash, nil
+}
+
+/*
+Auth is shared by every node of the cluster, authentication is required as soon as there is a user.
+Secrets are never stored in clear: passwords are salted PBKDF2 hashes made with HashPassword
+and tokens are SHA-256 hashes made with HashToken, both can be printed with the -hash flag.
+Nodes verified by mTLS are trusted as peers, otherwise they dial their peers with the Peer credentials.
+*/
+type Auth struct {
+	Users []User
+	Roles []Role
+	Peer  model.Credentials
+}
+
+type User struct {
+	Name     string
+	Password string   // Hash made with HashPassword, empty disables password login
+	Tokens   []string // Hashes made with HashToken
+	Roles    []string
+}
+
+type Role struct {
+	Name        string
+	Permissions []Permission
+}
+
+// Permission grants Actions over an entity, "*" matches every entity
+type Permission struct {
+	Entity  string
+	Actions []model.Action
+}
+
+func (x Auth) Enabled() bool {
+	return len(x.Users) > 0
+}
+
+// Authenticate returns the user matching c, a token takes precedence over the password
+func (x Auth) Authenticate(c model.Credentials) (User, error) {
+	if c.Token != "" {
+		hash := HashToken(c.Token)
+		for _, u := range x.Users {
+			for _, t := range u.Tokens {
+				if subtle.ConstantTimeCompare([]byte(t), []byte(hash)) == 1 {
+					return u, nil
+				}
+			}
+		}
+		return User{}, model.ErrAuthFailed
+	}
+
+	if c.User == "" {
+		return User{}, model.ErrAuthRequired
+	}
+	for _, u := range x.Users {
+		if u.Name == c.User && u.Password != "" {
+			return u, VerifyPassword(u.Password, c.Password)
+		}
+	}
+	// Answered in the time of a known user, so that the time does not tell which users exist
+	if hash, err := unknownUserHash(); err == nil {
+		_ = VerifyPassword(hash, c.Password)
+	}
+	return User{}, model.ErrAuthFailed
+}
+
+// Permissions returns the permissions of every role of u
+func (x Auth) Permissions(u User) []Permission {
+	var out []Permission
+	for _, r := range x.Roles {
+		if slices.Contains(u.Roles, r.Name) {
+			out = append(out, r.Permissions...)
+		}
+	}
+	return out
+}
+
+// HashPassword returns a salted hash of password in the format scheme$iterations$salt$key
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, PasswordIterations, passwordKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, PasswordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword returns model.ErrAuthFailed if password does not match hash
+func VerifyPassword(hash string, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return model.ErrConfigAuthInvalidHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return model.ErrConfigAuthInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return model.ErrConfigAuthInvalidHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return model.ErrConfigAuthInvalidHash
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return model.ErrAuthFailed
+	}
+	return nil
+}
+
+// HashToken returns the hex SHA-256 of token, tokens are random so they need no salt nor stretching
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
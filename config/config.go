@@ -1,5 +1,18 @@
 package config
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rah-0/hyperion/model"
+)
+
 var (
 	Loaded          Config
 	Path            string
@@ -11,17 +24,215 @@ var (
 
 type Config struct {
 	ClusterName string
-	Nodes       []struct {
-		Host struct {
-			Name string
-			IP   string
-			Port int
+	Nodes       []Node
+	Auth        Auth
+}
+
+type Node struct {
+	Host     NodeHost
+	Path     NodePath
+	Entities []NodeEntity
+	TLS      NodeTLS
+	Audit    NodeAudit
+	Limits   NodeLimits
+	Timeouts NodeTimeouts
+	Tracing  NodeTracing
+	SlowLog  NodeSlowLog
+	Status   NodeStatus
+}
+
+type NodeHost struct {
+	Name string
+	IP   string
+	Port int
+}
+
+type NodePath struct {
+	Data string // Where data will be stored
+}
+
+type NodeEntity struct {
+	Name string
+}
+
+/*
+NodeTLS enables TLS on the listener of the node and on the connections it dials, files are PEM encoded.
+- Cert, Key: certificate of the node, its DNS names must contain Host.Name since peers verify it by host name
+- CA: certificates trusted to verify peers, when set clients must present a certificate signed by it (mTLS),
+when empty the system roots are used to verify servers and client certificates are not required
+*/
+type NodeTLS struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// NodeAudit enables the audit log of inserts, updates and deletes when Path is set, see audit.Log
+type NodeAudit struct {
+	Path     string
+	MaxSize  int64 // Bytes before rotating, 0 uses audit.DefaultMaxSize
+	MaxFiles int   // Rotated files kept, 0 keeps all of them
+}
+
+/*
+NodeTracing exports the spans of the requests handled by the node, see trace.Tracer.
+Endpoint is the OTLP/HTTP traces URL of an OpenTelemetry collector, File a JSON lines file,
+Endpoint wins when both are set and tracing is disabled when neither is.
+*/
+type NodeTracing struct {
+	Endpoint    string
+	File        string
+	SampleRatio float64 // Share of requests without a trace of their own that start one, 0 traces them all
+}
+
+/*
+NodeStatus serves /healthz, /readyz, /status and /slow-queries over HTTP on Address (host:port), empty disables it.
+The probes are open to orchestrators, /status and /slow-queries require the bearer token whose hash made with
+HashToken is Token, they are open too when it is empty.
+*/
+type NodeStatus struct {
+	Address string
+	Token   string
+}
+
+// NodeSlowLog logs and keeps the queries taking at least Threshold along with their plan, 0 disables it
+type NodeSlowLog struct {
+	Threshold Duration
+	Size      int // Slow queries kept for Node.SlowQueries, 0 keeps 100
+}
+
+/*
+NodeLimits protects a node from runaway clients, a zero value disables its limit.
+Rates are requests per second, a burst of 0 allows one second worth of requests at once.
+Clients are identified by their user when authenticated, otherwise by their IP.
+*/
+type NodeLimits struct {
+	MaxConnections  int
+	ConnectionRate  float64
+	ConnectionBurst int
+	ClientRate      float64
+	ClientBurst     int
+	MaxInFlight     int // Requests processed at once by the node
+}
+
+// NodeTimeouts of the connections accepted by the node, zero keeps the hconn defaults and negative disables them,
+// see hconn.HConn for their meaning
+type NodeTimeouts struct {
+	Idle  Duration
+	Read  Duration
+	Write Duration
+}
+
+// Duration is written in JSON as a string parsed by time.ParseDuration, such as "30s" or "2m"
+type Duration time.Duration
+
+func (x Duration) Duration() time.Duration {
+	return time.Duration(x)
+}
+
+func (x Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(x).String())
+}
+
+func (x *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*x = Duration(d)
+	return nil
+}
+
+// Holders returns the nodes holding the entity ordered by host name,
+// the first one is the owner of the entity and the rest are used as fallback
+func (x Config) Holders(entityName string) []Node {
+	var out []Node
+	for _, n := range x.Nodes {
+		if n.HasEntity(entityName) {
+			out = append(out, n)
 		}
-		Path struct {
-			Data string // Where data will be stored
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Host.Name < out[j].Host.Name
+	})
+	return out
+}
+
+func (x Node) HasEntity(name string) bool {
+	for _, e := range x.Entities {
+		if e.Name == name {
+			return true
 		}
-		Entities []struct {
-			Name string
+	}
+	return false
+}
+
+func (x Node) Address() string {
+	return net.JoinHostPort(x.Host.IP, strconv.Itoa(x.Host.Port))
+}
+
+func (x NodeTLS) Enabled() bool {
+	return x.Cert != "" || x.CA != ""
+}
+
+// ServerConfig is used by the listener of the node
+func (x NodeTLS) ServerConfig() (*tls.Config, error) {
+	if x.Cert == "" || x.Key == "" {
+		return nil, model.ErrConfigTLSNoCertificate
+	}
+	cert, err := tls.LoadX509KeyPair(x.Cert, x.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if x.CA != "" {
+		if c.ClientCAs, err = x.caPool(); err != nil {
+			return nil, err
 		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// ClientConfig is used to dial the node whose Host.Name is serverName, the certificate is presented for mTLS if set
+func (x NodeTLS) ClientConfig(serverName string) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	var err error
+	if x.CA != "" {
+		if c.RootCAs, err = x.caPool(); err != nil {
+			return nil, err
+		}
+	}
+	if x.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(x.Cert, x.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+func (x NodeTLS) caPool() (*x509.CertPool, error) {
+	data, err := os.ReadFile(x.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, model.ErrConfigTLSInvalidCA
 	}
+	return pool, nil
 }
@@ -12,6 +12,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/rah-0/nabu"
 
+	"github.com/rah-0/hyperion/model"
 	"github.com/rah-0/hyperion/register"
 	"github.com/rah-0/hyperion/util"
 )
@@ -104,7 +105,7 @@ func (x *Disk) runBackgroundSync(ticker *time.Ticker, stopCh chan struct{}) {
 			if isClosed || file == nil {
 				return
 			}
-			err := file.Sync()
+			err := x.sync(file)
 			if err != nil {
 				nabu.FromError(err).WithMessage("failed to sync file").Log()
 			}
@@ -142,7 +143,7 @@ func (x *Disk) Close() error {
 
 	// Close the file if it was open
 	if file != nil {
-		if err := file.Sync(); err != nil {
+		if err := x.sync(file); err != nil {
 			return err
 		}
 		if err := file.Close(); err != nil {
@@ -156,6 +157,10 @@ func (x *Disk) DataWrite(data []byte) error {
 	x.Mu.Lock()
 	defer x.Mu.Unlock()
 
+	if x.IsClosed || x.File == nil {
+		return model.ErrDiskClosed
+	}
+
 	length := uint64(len(data))
 	if err := binary.Write(x.File, binary.LittleEndian, length); err != nil {
 		return err
@@ -210,8 +215,7 @@ func (x *Disk) DataReadAll() ([]register.Model, error) {
 
 		// Decode entity
 		instance := x.Entity.EntityExtension.New()
-		instance.SetBufferData(data)
-		if err = instance.Decode(); err != nil {
+		if err = instance.DecodeData(data); err != nil {
 			return nil, err
 		}
 
@@ -242,11 +246,20 @@ func (x *Disk) DataReadAll() ([]register.Model, error) {
 	return entities, nil
 }
 
-func (x *Disk) DataCleanup() error {
+// DataCleanup compacts the file by keeping only the latest version of every entity not deleted
+func (x *Disk) DataCleanup() (err error) {
 	x.Mu.Lock()
 	defer x.Mu.Unlock()
 
-	if _, err := x.File.Seek(0, io.SeekStart); err != nil {
+	result := CompactionCompacted
+	defer func() {
+		if err != nil {
+			result = CompactionFailed
+		}
+		compactions.With(append(x.labels(), result)...).Inc()
+	}()
+
+	if _, err = x.File.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
 
@@ -287,8 +300,7 @@ func (x *Disk) DataCleanup() error {
 		bytesRead += int64(len(data))
 
 		instance := x.Entity.EntityExtension.New()
-		instance.SetBufferData(data)
-		if err = instance.Decode(); err != nil {
+		if err = instance.DecodeData(data); err != nil {
 			return err
 		}
 
@@ -308,6 +320,7 @@ func (x *Disk) DataCleanup() error {
 
 	if !hasDuplicates {
 		nabu.FromMessage("No duplicates or deletions found. Skipping cleanup.").Log()
+		result = CompactionSkipped
 		return nil
 	}
 
@@ -342,8 +355,7 @@ func (x *Disk) DataCleanup() error {
 		bytesRead += int64(len(data))
 
 		instance := x.Entity.EntityExtension.New()
-		instance.SetBufferData(data)
-		if err = instance.Decode(); err != nil {
+		if err = instance.DecodeData(data); err != nil {
 			return err
 		}
 
@@ -404,7 +416,7 @@ func (x *Disk) DataCleanup() error {
 		}
 	}
 
-	if err = tempFile.Sync(); err != nil {
+	if err = x.sync(tempFile); err != nil {
 		return err
 	}
 	if err = os.Rename(tempPath, x.Path); err != nil {
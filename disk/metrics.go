@@ -0,0 +1,41 @@
+package disk
+
+import (
+	"os"
+	"time"
+
+	"github.com/rah-0/hyperion/metrics"
+)
+
+const (
+	CompactionSkipped   = "skipped"
+	CompactionCompacted = "compacted"
+	CompactionFailed    = "failed"
+)
+
+var (
+	fsyncDuration = metrics.NewHistogramVec("hyperion_disk_fsync_duration_seconds",
+		"Time to fsync the data file of an entity", metrics.DefaultBuckets, "entity", "version")
+	compactions = metrics.NewCounterVec("hyperion_disk_compactions_total",
+		"Compaction runs of the data file of an entity when it is loaded, by result", "entity", "version", "result")
+)
+
+func init() {
+	metrics.Register(fsyncDuration, compactions)
+}
+
+// labels returns the entity and version of the disk, empty for disks not bound to an entity
+func (x *Disk) labels() []string {
+	if x.Entity == nil {
+		return []string{"", ""}
+	}
+	return []string{x.Entity.EntityBase.Name, x.Entity.EntityBase.Version}
+}
+
+// sync flushes f to disk, recording how long it took
+func (x *Disk) sync(f *os.File) error {
+	start := time.Now()
+	err := f.Sync()
+	fsyncDuration.With(x.labels()...).Observe(time.Since(start).Seconds())
+	return err
+}
@@ -0,0 +1,110 @@
+package SampleV1
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/model"
+)
+
+func sampleForCodec() *Sample {
+	return &Sample{
+		Uuid:    uuid.New(),
+		Deleted: true,
+		Name:    "John",
+		Surname: "Doe",
+		Birth:   time.Date(1990, 5, 17, 8, 30, 15, 123456789, time.FixedZone("X", 3600)),
+	}
+}
+
+// TestCodecsRoundTrip ensures every codec restores all the fields of the entity
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, c := range []hconn.Codec{Codec, hconn.Binary{}} {
+		t.Run(c.Name(), func(t *testing.T) {
+			original := sampleForCodec()
+			data, err := c.Append(nil, original)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded Sample
+			if err = c.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Uuid != original.Uuid || decoded.Deleted != original.Deleted ||
+				decoded.Name != original.Name || decoded.Surname != original.Surname ||
+				!decoded.Birth.Equal(original.Birth) {
+				t.Fatalf("Expected %+v, got %+v", original, decoded)
+			}
+		})
+	}
+}
+
+// TestBinaryCodecCorruptedData ensures truncated or oversized data returns errors instead of panicking
+func TestBinaryCodecCorruptedData(t *testing.T) {
+	data, err := hconn.Binary{}.Append(nil, sampleForCodec())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(data); i++ {
+		var s Sample
+		if err = (hconn.Binary{}).Unmarshal(data[:i], &s); !errors.Is(err, model.ErrCodecShortData) {
+			t.Fatalf("Expected ErrCodecShortData for %d bytes, got %v", i, err)
+		}
+	}
+
+	var s Sample
+	if err = (hconn.Binary{}).Unmarshal(append(data, 0), &s); !errors.Is(err, model.ErrCodecTrailingData) {
+		t.Fatalf("Expected ErrCodecTrailingData, got %v", err)
+	}
+}
+
+func BenchmarkCodecGobEncode(b *testing.B) {
+	benchmarkCodecEncode(b, Codec)
+}
+
+func BenchmarkCodecBinaryEncode(b *testing.B) {
+	benchmarkCodecEncode(b, hconn.Binary{})
+}
+
+func BenchmarkCodecGobDecode(b *testing.B) {
+	benchmarkCodecDecode(b, Codec)
+}
+
+func BenchmarkCodecBinaryDecode(b *testing.B) {
+	benchmarkCodecDecode(b, hconn.Binary{})
+}
+
+func benchmarkCodecEncode(b *testing.B, c hconn.Codec) {
+	s := sampleForCodec()
+	var buf []byte
+	var err error
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if buf, err = c.Append(buf[:0], s); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(buf)), "encoded-bytes")
+}
+
+func benchmarkCodecDecode(b *testing.B, c hconn.Codec) {
+	data, err := c.Append(nil, sampleForCodec())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		var s Sample
+		if err = c.Unmarshal(data, &s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
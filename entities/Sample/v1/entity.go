@@ -6,14 +6,19 @@ package SampleV1
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"iter"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/index"
 	"github.com/rah-0/hyperion/model"
 	"github.com/rah-0/hyperion/query"
 	"github.com/rah-0/hyperion/register"
@@ -41,22 +46,37 @@ var FieldTypes = map[int]string{
 	FieldBirth:   "time.Time",
 }
 
+// Indexes holds the rows by value of the fields indexed, see the hyperion tag
 var Indexes = map[int]any{
-	FieldUuid:    map[uuid.UUID][]*Sample{},
-	FieldDeleted: map[bool][]*Sample{},
 	FieldName:    map[string][]*Sample{},
 	FieldSurname: map[string][]*Sample{},
 	FieldBirth:   map[time.Time][]*Sample{},
 }
 
+// Ranges keeps the fields tagged index=range in order, for range filters and orders
+var Ranges = map[int]any{
+	FieldName:    index.NewOrdered[string, *Sample](cmp.Compare[string]),
+	FieldSurname: index.NewOrdered[string, *Sample](cmp.Compare[string]),
+	FieldBirth:   index.NewOrdered[time.Time, *Sample](time.Time.Compare),
+}
+
+// Composite indexes, the rows in order of the values of their fields
+var (
+	compositeFullname = index.NewOrdered[compositeFullnameKey, *Sample](compositeFullnameKey.compare)
+)
+
 var (
-	_              register.Model = (*Sample)(nil)
-	mu             sync.Mutex
-	Buffer         = new(bytes.Buffer)
-	Encoder        = gob.NewEncoder(Buffer)
-	Decoder        = gob.NewDecoder(Buffer)
+	_       register.Model = (*Sample)(nil)
+	mu      sync.Mutex
+	Buffer  = new(bytes.Buffer)
+	Encoder = gob.NewEncoder(Buffer)
+	Decoder = gob.NewDecoder(Buffer)
+	// Codec encodes the data sent to nodes and stored on disk, gob by default.
+	// It must be set before Register and kept, data files written with another codec cannot be read.
+	Codec          hconn.Codec = &hconn.Serializer{Buffer: Buffer, E: Encoder, D: Decoder}
 	Mem            []*Sample
 	IndexAccessors = map[int]register.IndexAccessor{}
+	Composites     []register.CompositeAccessor
 )
 
 func Register() error {
@@ -67,9 +87,9 @@ func Register() error {
 		}
 	}
 
-	// The following process initializes the encoder and decoder by preloading metadata.
-	// This prevents metadata from being stored with the first encoded struct.
-	// If the metadata were missing or inconsistent, decoding the struct later could fail.
+	//The following process initializes the encoder and decoder by preloading metadata.
+	//This prevents metadata from being stored with the first encoded struct.
+	//If the metadata were missing or inconsistent, decoding the struct later could fail.
 	gob.Register(&Sample{})
 	x := New()
 	if err := x.Encode(); err != nil {
@@ -80,49 +100,79 @@ func Register() error {
 	}
 	x.BufferReset()
 
-	// IndexAccessors definitions
-	IndexAccessors[FieldUuid] = register.IndexAccessor{
+	// IndexAccessors definitions, the fields without one are scanned
+	IndexAccessors[FieldName] = register.IndexAccessor{
 		GetByValue: func(val any) []register.Model {
-			idx := Indexes[FieldUuid].(map[uuid.UUID][]*Sample)
-			v, ok := val.(uuid.UUID)
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldName].(map[string][]*Sample)
+			v, ok := val.(string)
 			if !ok {
 				return nil
 			}
 			return CastToModel(idx[v])
 		},
-	}
-	IndexAccessors[FieldDeleted] = register.IndexAccessor{
-		GetByValue: func(val any) []register.Model {
-			idx := Indexes[FieldDeleted].(map[bool][]*Sample)
-			v, ok := val.(bool)
+		CountByValue: func(val any) int {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldName].(map[string][]*Sample)
+			v, ok := val.(string)
 			if !ok {
-				return nil
+				return 0
 			}
-			return CastToModel(idx[v])
+			return len(idx[v])
+		},
+		Scan: func(r register.Range, yield func([]register.Model) bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			Ranges[FieldName].(*index.Ordered[string, *Sample]).Scan(r, func(values []*Sample) bool {
+				return yield(CastToModel(values))
+			})
+		},
+		CountRange: func(r register.Range) int {
+			mu.Lock()
+			defer mu.Unlock()
+			return Ranges[FieldName].(*index.Ordered[string, *Sample]).Count(r)
 		},
 	}
-	IndexAccessors[FieldName] = register.IndexAccessor{
+	IndexAccessors[FieldSurname] = register.IndexAccessor{
 		GetByValue: func(val any) []register.Model {
-			idx := Indexes[FieldName].(map[string][]*Sample)
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldSurname].(map[string][]*Sample)
 			v, ok := val.(string)
 			if !ok {
 				return nil
 			}
 			return CastToModel(idx[v])
 		},
-	}
-	IndexAccessors[FieldSurname] = register.IndexAccessor{
-		GetByValue: func(val any) []register.Model {
+		CountByValue: func(val any) int {
+			mu.Lock()
+			defer mu.Unlock()
 			idx := Indexes[FieldSurname].(map[string][]*Sample)
 			v, ok := val.(string)
 			if !ok {
-				return nil
+				return 0
 			}
-			return CastToModel(idx[v])
+			return len(idx[v])
+		},
+		Scan: func(r register.Range, yield func([]register.Model) bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			Ranges[FieldSurname].(*index.Ordered[string, *Sample]).Scan(r, func(values []*Sample) bool {
+				return yield(CastToModel(values))
+			})
+		},
+		CountRange: func(r register.Range) int {
+			mu.Lock()
+			defer mu.Unlock()
+			return Ranges[FieldSurname].(*index.Ordered[string, *Sample]).Count(r)
 		},
 	}
 	IndexAccessors[FieldBirth] = register.IndexAccessor{
 		GetByValue: func(val any) []register.Model {
+			mu.Lock()
+			defer mu.Unlock()
 			idx := Indexes[FieldBirth].(map[time.Time][]*Sample)
 			v, ok := val.(time.Time)
 			if !ok {
@@ -130,6 +180,64 @@ func Register() error {
 			}
 			return CastToModel(idx[v])
 		},
+		CountByValue: func(val any) int {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldBirth].(map[time.Time][]*Sample)
+			v, ok := val.(time.Time)
+			if !ok {
+				return 0
+			}
+			return len(idx[v])
+		},
+		Scan: func(r register.Range, yield func([]register.Model) bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			Ranges[FieldBirth].(*index.Ordered[time.Time, *Sample]).Scan(r, func(values []*Sample) bool {
+				return yield(CastToModel(values))
+			})
+		},
+		CountRange: func(r register.Range) int {
+			mu.Lock()
+			defer mu.Unlock()
+			return Ranges[FieldBirth].(*index.Ordered[time.Time, *Sample]).Count(r)
+		},
+	}
+
+	// Composites definitions, looked up by the values of their first fields
+	Composites = []register.CompositeAccessor{
+		{
+			Name:   "fullname",
+			Fields: []int{FieldName, FieldSurname},
+			GetByValues: func(values []any) []register.Model {
+				match, ok := compositeFullnameMatch(values)
+				if !ok {
+					return nil
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				var out []register.Model
+				compositeFullname.Match(match, func(rows []*Sample) bool {
+					out = append(out, CastToModel(rows)...)
+					return true
+				})
+				return out
+			},
+			CountByValues: func(values []any) int {
+				match, ok := compositeFullnameMatch(values)
+				if !ok {
+					return 0
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				count := 0
+				compositeFullname.Match(match, func(rows []*Sample) bool {
+					count += len(rows)
+					return true
+				})
+				return count
+			},
+		},
 	}
 
 	// Initializations
@@ -144,6 +252,7 @@ func Register() error {
 			FieldTypes:     FieldTypes,
 			Indexes:        Indexes,
 			IndexAccessors: IndexAccessors,
+			Composites:     Composites,
 		},
 	)
 
@@ -151,11 +260,50 @@ func Register() error {
 }
 
 type Sample struct {
-	Uuid    uuid.UUID `json:",omitzero"`
-	Deleted bool      `json:",omitzero"`
-	Name    string    `json:"-"`
-	Surname string    `json:"-"`
-	Birth   time.Time `json:"-"`
+	Uuid    uuid.UUID `json:",omitzero" hyperion:"noindex"`
+	Deleted bool      `json:",omitzero" hyperion:"noindex"`
+	Name    string    `json:"-" hyperion:"index=range,composite=fullname"`
+	Surname string    `json:"-" hyperion:"index=range,composite=fullname"`
+	Birth   time.Time `json:"-" hyperion:"index=range"`
+}
+
+type compositeFullnameKey struct {
+	Name    string
+	Surname string
+}
+
+func (x compositeFullnameKey) compare(y compositeFullnameKey) int {
+	if c := cmp.Compare[string](x.Name, y.Name); c != 0 {
+		return c
+	}
+	return cmp.Compare[string](x.Surname, y.Surname)
+}
+
+// compositeFullnameMatch returns how the keys of compositeFullname compare to the values of its first fields,
+// false when there are none, too many or one of another type
+func compositeFullnameMatch(values []any) (func(k compositeFullnameKey) int, bool) {
+	if len(values) == 0 || len(values) > 2 {
+		return nil, false
+	}
+	var key compositeFullnameKey
+	for i, v := range values {
+		var ok bool
+		switch i {
+		case 0:
+			key.Name, ok = v.(string)
+		case 1:
+			key.Surname, ok = v.(string)
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return func(k compositeFullnameKey) int {
+		if c := cmp.Compare[string](k.Name, key.Name); c != 0 || len(values) == 1 {
+			return c
+		}
+		return cmp.Compare[string](k.Surname, key.Surname)
+	}, true
 }
 
 func New() register.Model {
@@ -231,6 +379,42 @@ func (s *Sample) Decode() error {
 	return Decoder.Decode(s)
 }
 
+func (s *Sample) EncodeData() ([]byte, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return Codec.Append(nil, s)
+}
+
+func (s *Sample) DecodeData(data []byte) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return Codec.Unmarshal(data, s)
+}
+
+// AppendFields implements hconn.BinaryValue, fields are written in FieldX order
+func (s *Sample) AppendFields(b []byte) ([]byte, error) {
+	var err error
+	b = hconn.AppendUuid(b, s.Uuid)
+	b = hconn.AppendBool(b, s.Deleted)
+	b = hconn.AppendString(b, s.Name)
+	b = hconn.AppendString(b, s.Surname)
+	if b, err = hconn.AppendTime(b, s.Birth); err != nil {
+		return b, err
+	}
+	return b, nil
+}
+
+// UnmarshalFields implements hconn.BinaryValue, fields are read in FieldX order
+func (s *Sample) UnmarshalFields(data []byte) error {
+	r := hconn.NewBinaryReader(data)
+	s.Uuid = r.Uuid()
+	s.Deleted = r.Bool()
+	s.Name = r.String()
+	s.Surname = r.String()
+	s.Birth = r.Time()
+	return r.Err()
+}
+
 func (s *Sample) BufferReset() {
 	mu.Lock()
 	defer mu.Unlock()
@@ -255,50 +439,79 @@ func (s *Sample) SetBufferData(data []byte) {
 	Buffer.Write(data)
 }
 
-func (s *Sample) MemoryAdd() {
+// checkUnique returns a model.ConstraintError when another row holds a unique key of s, mu must be held
+func (s *Sample) checkUnique() error {
+	return nil
+}
+
+// addUnique makes s the holder of its unique keys, mu must be held
+func (s *Sample) addUnique() {
+}
+
+// removeUnique releases the unique keys held by s, mu must be held
+func (s *Sample) removeUnique() {
+}
+
+// MemoryCheck returns the model.ConstraintError MemoryAdd or MemoryUpdate would return for s, without holding it
+func (s *Sample) MemoryCheck() error {
 	mu.Lock()
 	defer mu.Unlock()
+	return s.checkUnique()
+}
+
+// MemoryAdd holds s, unless it breaks a unique constraint
+func (s *Sample) MemoryAdd() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := s.checkUnique(); err != nil {
+		return err
+	}
 	Mem = append(Mem, s)
+	s.addUnique()
+	compositeFullname.Add(compositeFullnameKey{Name: s.Name, Surname: s.Surname}, s)
 
 	// Update indexes
-	indexUuid := Indexes[FieldUuid].(map[uuid.UUID][]*Sample)
-	indexUuid[s.Uuid] = append(indexUuid[s.Uuid], s)
-	indexDeleted := Indexes[FieldDeleted].(map[bool][]*Sample)
-	indexDeleted[s.Deleted] = append(indexDeleted[s.Deleted], s)
 	indexName := Indexes[FieldName].(map[string][]*Sample)
 	indexName[s.Name] = append(indexName[s.Name], s)
+	Ranges[FieldName].(*index.Ordered[string, *Sample]).Add(s.Name, s)
 	indexSurname := Indexes[FieldSurname].(map[string][]*Sample)
 	indexSurname[s.Surname] = append(indexSurname[s.Surname], s)
+	Ranges[FieldSurname].(*index.Ordered[string, *Sample]).Add(s.Surname, s)
 	indexBirth := Indexes[FieldBirth].(map[time.Time][]*Sample)
 	indexBirth[s.Birth] = append(indexBirth[s.Birth], s)
+	Ranges[FieldBirth].(*index.Ordered[time.Time, *Sample]).Add(s.Birth, s)
+	return nil
 }
 
 func (s *Sample) MemoryRemove() {
 	mu.Lock()
 	defer mu.Unlock()
 	for i, instance := range Mem {
-		if instance.Uuid == s.Uuid {
-			lastIndex := len(Mem) - 1
-			Mem[i] = Mem[lastIndex]
-			Mem = Mem[:lastIndex]
-			break
+		if instance.Uuid != s.Uuid {
+			continue
 		}
+		lastIndex := len(Mem) - 1
+		Mem[i] = Mem[lastIndex]
+		Mem = Mem[:lastIndex]
+		instance.removeUnique()
+		compositeFullname.Remove(compositeFullnameKey{Name: instance.Name, Surname: instance.Surname}, instance)
+
+		// Remove from indexes with the values held, s may carry others such as Deleted
+		indexName := Indexes[FieldName].(map[string][]*Sample)
+		indexName[instance.Name] = removeFromIndex(indexName[instance.Name], instance)
+		Ranges[FieldName].(*index.Ordered[string, *Sample]).Remove(instance.Name, instance)
+		indexSurname := Indexes[FieldSurname].(map[string][]*Sample)
+		indexSurname[instance.Surname] = removeFromIndex(indexSurname[instance.Surname], instance)
+		Ranges[FieldSurname].(*index.Ordered[string, *Sample]).Remove(instance.Surname, instance)
+		indexBirth := Indexes[FieldBirth].(map[time.Time][]*Sample)
+		indexBirth[instance.Birth] = removeFromIndex(indexBirth[instance.Birth], instance)
+		Ranges[FieldBirth].(*index.Ordered[time.Time, *Sample]).Remove(instance.Birth, instance)
+		break
 	}
-
-	// Remove from indexes
-	indexUuid := Indexes[FieldUuid].(map[uuid.UUID][]*Sample)
-	indexUuid[s.Uuid] = removeFromIndex(indexUuid[s.Uuid], s)
-	indexDeleted := Indexes[FieldDeleted].(map[bool][]*Sample)
-	indexDeleted[s.Deleted] = removeFromIndex(indexDeleted[s.Deleted], s)
-	indexName := Indexes[FieldName].(map[string][]*Sample)
-	indexName[s.Name] = removeFromIndex(indexName[s.Name], s)
-	indexSurname := Indexes[FieldSurname].(map[string][]*Sample)
-	indexSurname[s.Surname] = removeFromIndex(indexSurname[s.Surname], s)
-	indexBirth := Indexes[FieldBirth].(map[time.Time][]*Sample)
-	indexBirth[s.Birth] = removeFromIndex(indexBirth[s.Birth], s)
 }
 
-func (s *Sample) MemoryUpdate() {
+// MemoryUpdate replaces the row held with the Uuid of s, unless s breaks a unique constraint
+func (s *Sample) MemoryUpdate() error {
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -306,37 +519,35 @@ func (s *Sample) MemoryUpdate() {
 		if old.Uuid != s.Uuid {
 			continue
 		}
-
-		// Update indexes only if values changed
-		if old.Uuid != s.Uuid {
-			indexUuid := Indexes[FieldUuid].(map[uuid.UUID][]*Sample)
-			indexUuid[old.Uuid] = removeFromIndex(indexUuid[old.Uuid], old)
-			indexUuid[s.Uuid] = append(indexUuid[s.Uuid], s)
-		}
-		if old.Deleted != s.Deleted {
-			indexDeleted := Indexes[FieldDeleted].(map[bool][]*Sample)
-			indexDeleted[old.Deleted] = removeFromIndex(indexDeleted[old.Deleted], old)
-			indexDeleted[s.Deleted] = append(indexDeleted[s.Deleted], s)
-		}
-		if old.Name != s.Name {
-			indexName := Indexes[FieldName].(map[string][]*Sample)
-			indexName[old.Name] = removeFromIndex(indexName[old.Name], old)
-			indexName[s.Name] = append(indexName[s.Name], s)
-		}
-		if old.Surname != s.Surname {
-			indexSurname := Indexes[FieldSurname].(map[string][]*Sample)
-			indexSurname[old.Surname] = removeFromIndex(indexSurname[old.Surname], old)
-			indexSurname[s.Surname] = append(indexSurname[s.Surname], s)
-		}
-		if old.Birth != s.Birth {
-			indexBirth := Indexes[FieldBirth].(map[time.Time][]*Sample)
-			indexBirth[old.Birth] = removeFromIndex(indexBirth[old.Birth], old)
-			indexBirth[s.Birth] = append(indexBirth[s.Birth], s)
+		if err := s.checkUnique(); err != nil {
+			return err
 		}
+		old.removeUnique()
+		s.addUnique()
+		compositeFullname.Remove(compositeFullnameKey{Name: old.Name, Surname: old.Surname}, old)
+		compositeFullname.Add(compositeFullnameKey{Name: s.Name, Surname: s.Surname}, s)
+
+		// Update indexes, the values that did not change must also point to s rather than old
+		indexName := Indexes[FieldName].(map[string][]*Sample)
+		indexName[old.Name] = removeFromIndex(indexName[old.Name], old)
+		indexName[s.Name] = append(indexName[s.Name], s)
+		Ranges[FieldName].(*index.Ordered[string, *Sample]).Remove(old.Name, old)
+		Ranges[FieldName].(*index.Ordered[string, *Sample]).Add(s.Name, s)
+		indexSurname := Indexes[FieldSurname].(map[string][]*Sample)
+		indexSurname[old.Surname] = removeFromIndex(indexSurname[old.Surname], old)
+		indexSurname[s.Surname] = append(indexSurname[s.Surname], s)
+		Ranges[FieldSurname].(*index.Ordered[string, *Sample]).Remove(old.Surname, old)
+		Ranges[FieldSurname].(*index.Ordered[string, *Sample]).Add(s.Surname, s)
+		indexBirth := Indexes[FieldBirth].(map[time.Time][]*Sample)
+		indexBirth[old.Birth] = removeFromIndex(indexBirth[old.Birth], old)
+		indexBirth[s.Birth] = append(indexBirth[s.Birth], s)
+		Ranges[FieldBirth].(*index.Ordered[time.Time, *Sample]).Remove(old.Birth, old)
+		Ranges[FieldBirth].(*index.Ordered[time.Time, *Sample]).Add(s.Birth, s)
 
 		Mem[i] = s
 		break
 	}
+	return nil
 }
 
 func (s *Sample) MemoryClear() {
@@ -344,12 +555,14 @@ func (s *Sample) MemoryClear() {
 	defer mu.Unlock()
 
 	Mem = []*Sample{}
+	compositeFullname.Clear()
 
-	Indexes[FieldUuid] = map[uuid.UUID][]*Sample{}
-	Indexes[FieldDeleted] = map[bool][]*Sample{}
 	Indexes[FieldName] = map[string][]*Sample{}
+	Ranges[FieldName].(*index.Ordered[string, *Sample]).Clear()
 	Indexes[FieldSurname] = map[string][]*Sample{}
+	Ranges[FieldSurname].(*index.Ordered[string, *Sample]).Clear()
 	Indexes[FieldBirth] = map[time.Time][]*Sample{}
+	Ranges[FieldBirth].(*index.Ordered[time.Time, *Sample]).Clear()
 }
 
 func (s *Sample) MemoryGetAll() []register.Model {
@@ -362,6 +575,12 @@ func (s *Sample) MemoryGetAll() []register.Model {
 	return instances
 }
 
+func (s *Sample) MemoryCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(Mem)
+}
+
 func (s *Sample) MemoryContains(target register.Model) bool {
 	mu.Lock()
 	defer mu.Unlock()
@@ -385,11 +604,12 @@ func (s *Sample) MemoryContains(target register.Model) bool {
 	return false
 }
 
-func (s *Sample) DbInsert(c *hconn.HConn) error {
+func (s *Sample) DbInsert(c hconn.Requester) error {
 	if s.Uuid == uuid.Nil {
 		s.WithNewUuid()
 	}
-	if err := s.Encode(); err != nil {
+	data, err := s.EncodeData()
+	if err != nil {
 		return err
 	}
 
@@ -398,25 +618,22 @@ func (s *Sample) DbInsert(c *hconn.HConn) error {
 		Entity: register.EntityBase{
 			Version: Version,
 			Name:    Name,
-			Data:    s.GetBufferData(),
+			Data:    data,
 		},
 	}
-	s.BufferReset()
 
-	resp, err := c.SendReceive(msg)
+	resp, err := c.SendReceive(context.Background(), msg)
 	if err != nil {
 		return err
 	}
-	if resp.Status == model.StatusError {
-		return errors.New(resp.String)
-	}
-
-	return nil
+	// A broken unique constraint is returned as a *model.ConstraintError
+	return resp.Err()
 }
 
-func (s *Sample) DbDelete(c *hconn.HConn) error {
+func (s *Sample) DbDelete(c hconn.Requester) error {
 	s.Deleted = true
-	if err := s.Encode(); err != nil {
+	data, err := s.EncodeData()
+	if err != nil {
 		return err
 	}
 
@@ -425,23 +642,22 @@ func (s *Sample) DbDelete(c *hconn.HConn) error {
 		Entity: register.EntityBase{
 			Version: Version,
 			Name:    Name,
-			Data:    s.GetBufferData(),
+			Data:    data,
 		},
 	}
-	s.BufferReset()
 
-	resp, err := c.SendReceive(msg)
+	resp, err := c.SendReceive(context.Background(), msg)
 	if err != nil {
 		return err
 	}
-	if resp.Status == model.StatusError {
+	if resp.Status != model.StatusSuccess {
 		return errors.New(resp.String)
 	}
 
 	return nil
 }
 
-func DbDeleteAll(c *hconn.HConn) error {
+func DbDeleteAll(c hconn.Requester) error {
 	entities, err := DbGetAll(c)
 	if err != nil {
 		return err
@@ -456,11 +672,12 @@ func DbDeleteAll(c *hconn.HConn) error {
 	return nil
 }
 
-func (s *Sample) DbUpdate(c *hconn.HConn) error {
+func (s *Sample) DbUpdate(c hconn.Requester) error {
 	if s.Uuid == uuid.Nil {
 		return model.ErrQueryEntityNoUuid
 	}
-	if err := s.Encode(); err != nil {
+	data, err := s.EncodeData()
+	if err != nil {
 		return err
 	}
 
@@ -469,23 +686,19 @@ func (s *Sample) DbUpdate(c *hconn.HConn) error {
 		Entity: register.EntityBase{
 			Version: Version,
 			Name:    Name,
-			Data:    s.GetBufferData(),
+			Data:    data,
 		},
 	}
-	s.BufferReset()
 
-	resp, err := c.SendReceive(msg)
+	resp, err := c.SendReceive(context.Background(), msg)
 	if err != nil {
 		return err
 	}
-	if resp.Status == model.StatusError {
-		return errors.New(resp.String)
-	}
-
-	return nil
+	// A broken unique constraint is returned as a *model.ConstraintError
+	return resp.Err()
 }
 
-func DbGetAll(c *hconn.HConn) ([]*Sample, error) {
+func DbGetAll(c hconn.Requester) ([]*Sample, error) {
 	msg := model.Message{
 		Type: model.MessageTypeGetAll,
 		Entity: register.EntityBase{
@@ -494,19 +707,19 @@ func DbGetAll(c *hconn.HConn) ([]*Sample, error) {
 		},
 	}
 
-	resp, err := c.SendReceive(msg)
+	resp, err := c.SendReceive(context.Background(), msg)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.Status == model.StatusError {
+	if resp.Status != model.StatusSuccess {
 		return nil, errors.New(resp.String)
 	}
 
 	return CastToSample(resp.Models), nil
 }
 
-func DbQuery(c *hconn.HConn, q *query.Query) ([]*Sample, error) {
+func DbQuery(c hconn.Requester, q *query.Query) ([]*Sample, error) {
 	msg := model.Message{
 		Type: model.MessageTypeQuery,
 		Entity: register.EntityBase{
@@ -516,18 +729,86 @@ func DbQuery(c *hconn.HConn, q *query.Query) ([]*Sample, error) {
 		Query: q,
 	}
 
-	resp, err := c.SendReceive(msg)
+	resp, err := c.SendReceive(context.Background(), msg)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.Status == model.StatusError {
+	if resp.Status != model.StatusSuccess {
 		return nil, errors.New(resp.String)
 	}
 
 	return CastToSample(resp.Models), nil
 }
 
+// DbExplain returns how the node would answer q without running it
+func DbExplain(c hconn.Requester, q *query.Query) (query.Plan, error) {
+	msg := model.Message{
+		Type: model.MessageTypeExplain,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+		Query: q,
+	}
+
+	var plan query.Plan
+	resp, err := c.SendReceive(context.Background(), msg)
+	if err != nil {
+		return plan, err
+	}
+
+	if resp.Status != model.StatusSuccess {
+		return plan, errors.New(resp.String)
+	}
+
+	err = json.Unmarshal(resp.Bytes, &plan)
+	return plan, err
+}
+
+// DbGetAllIter streams every entity in chunks of chunkSize (0 uses the node default), breaking out of the loop cancels the stream
+func DbGetAllIter(c hconn.Requester, chunkSize int) iter.Seq2[*Sample, error] {
+	msg := model.Message{
+		Type: model.MessageTypeGetAll,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+		Cursor: &model.Cursor{Size: chunkSize},
+	}
+
+	return castIter(hconn.Stream(context.Background(), c, msg))
+}
+
+// DbQueryIter streams the results of q in chunks of chunkSize (0 uses the node default), breaking out of the loop cancels the stream
+func DbQueryIter(c hconn.Requester, q *query.Query, chunkSize int) iter.Seq2[*Sample, error] {
+	msg := model.Message{
+		Type: model.MessageTypeQuery,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+		Query:  q,
+		Cursor: &model.Cursor{Size: chunkSize},
+	}
+
+	return castIter(hconn.Stream(context.Background(), c, msg))
+}
+
+func castIter(seq iter.Seq2[register.Model, error]) iter.Seq2[*Sample, error] {
+	return func(yield func(*Sample, error) bool) {
+		for m, err := range seq {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(m.(*Sample), nil) {
+				return
+			}
+		}
+	}
+}
+
 func CastToSample(models []register.Model) []*Sample {
 	out := make([]*Sample, len(models))
 	for i, m := range models {
@@ -557,20 +838,6 @@ func removeFromIndex(list []*Sample, target *Sample) []*Sample {
 
 func GetFullIndex(field int) []register.Model {
 	idx := Indexes[field]
-	if typed, ok := idx.(map[uuid.UUID][]*Sample); ok {
-		var all []*Sample
-		for _, list := range typed {
-			all = append(all, list...)
-		}
-		return CastToModel(all)
-	}
-	if typed, ok := idx.(map[bool][]*Sample); ok {
-		var all []*Sample
-		for _, list := range typed {
-			all = append(all, list...)
-		}
-		return CastToModel(all)
-	}
 	if typed, ok := idx.(map[string][]*Sample); ok {
 		var all []*Sample
 		for _, list := range typed {
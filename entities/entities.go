@@ -6,11 +6,22 @@ import (
 
 /*
 	Define your entities (structs) in this file.
+
+	Every field is indexed by value unless tagged otherwise, changing the tag does not create a new version:
+	- hyperion:"index": Equal and In filters are looked up in memory, the default
+	- hyperion:"index=range": also kept in order for range filters, prefixes and orders, for strings, numbers and times
+	- hyperion:"noindex": filters on the field scan the rows, for fields seldom filtered on
+	Unique constraints are added to the options after a comma, such as hyperion:"index,unique":
+	- hyperion:"unique": no two rows hold the same value of the field
+	- hyperion:"unique=name": no two rows hold the same values of the fields tagged with that name
+	Composite indexes keep the rows in order of the values of the fields tagged with their name, in the order of the struct,
+	so that Equal filters on their first fields are looked up at once, a field may be in several of them:
+	- hyperion:"composite=name": for strings, numbers and times, at least 2 fields per index
 */
 
 type Sample struct {
-	Name    string    `json:"-"`
-	Surname string    `json:"-"`
-	Birth   time.Time `json:"-"`
+	Name    string    `json:"-" hyperion:"index=range,composite=fullname"`
+	Surname string    `json:"-" hyperion:"index=range,composite=fullname"`
+	Birth   time.Time `json:"-" hyperion:"index=range"`
 	//FullName string
 }
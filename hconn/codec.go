@@ -0,0 +1,244 @@
+package hconn
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+const CodecBinary = "binary"
+
+/*
+Codec turns values into bytes and back.
+HConn uses one instance per direction of a connection, so stateful codecs such as gob can work as streams,
+and every generated entity uses one for the data sent to nodes and stored on disk.
+Codecs available for connections are negotiated during the handshake, see RegisterCodec.
+*/
+type Codec interface {
+	Name() string
+	// Append appends the encoding of a to dst and returns the extended slice
+	Append(dst []byte, a any) ([]byte, error)
+	Unmarshal(data []byte, a any) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]func() Codec{
+		CodecGob: func() Codec { return NewSerializer() },
+	}
+)
+
+// RegisterCodec makes a codec available to connections and advertises it during the handshake
+func RegisterCodec(name string, newCodec func() Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = newCodec
+	if !slices.Contains(SupportedCodecs, name) {
+		SupportedCodecs = append(SupportedCodecs, name)
+	}
+}
+
+func newCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	f, ok := codecs[name]
+	if !ok {
+		return nil, false
+	}
+	return f(), true
+}
+
+// BinaryValue is implemented by generated entities, fields are encoded in FieldX order without reflection
+type BinaryValue interface {
+	AppendFields(dst []byte) ([]byte, error)
+	UnmarshalFields(data []byte) error
+}
+
+// Binary is a stateless Codec for BinaryValue implementations, it is faster and smaller than gob
+// but only works with generated entities
+type Binary struct{}
+
+var _ Codec = Binary{}
+
+func (Binary) Name() string {
+	return CodecBinary
+}
+
+func (Binary) Append(dst []byte, a any) ([]byte, error) {
+	v, ok := a.(BinaryValue)
+	if !ok {
+		return dst, model.ErrCodecUnsupported
+	}
+	return v.AppendFields(dst)
+}
+
+func (Binary) Unmarshal(data []byte, a any) error {
+	v, ok := a.(BinaryValue)
+	if !ok {
+		return model.ErrCodecUnsupported
+	}
+	return v.UnmarshalFields(data)
+}
+
+// The following functions are used by the generated AppendFields, every supported field type has one
+
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func AppendInt(b []byte, v int64) []byte {
+	return binary.AppendVarint(b, v)
+}
+
+func AppendUint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func AppendFloat32(b []byte, v float32) []byte {
+	return binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+}
+
+func AppendFloat64(b []byte, v float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func AppendString(b []byte, v string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func AppendUuid(b []byte, v uuid.UUID) []byte {
+	return append(b, v[:]...)
+}
+
+// AppendTime keeps the same precision and zone offset as gob, the monotonic clock reading is dropped
+func AppendTime(b []byte, v time.Time) ([]byte, error) {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return b, err
+	}
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...), nil
+}
+
+// BinaryReader reads the fields written by the Append* functions, it is used by the generated UnmarshalFields.
+// The first failure is kept and returned by Err, every read after it returns zero values.
+type BinaryReader struct {
+	data []byte
+	err  error
+}
+
+func NewBinaryReader(data []byte) *BinaryReader {
+	return &BinaryReader{data: data}
+}
+
+func (x *BinaryReader) Err() error {
+	if x.err == nil && len(x.data) > 0 {
+		return model.ErrCodecTrailingData
+	}
+	return x.err
+}
+
+func (x *BinaryReader) Bool() bool {
+	b := x.next(1)
+	return b != nil && b[0] == 1
+}
+
+func (x *BinaryReader) Int() int64 {
+	if x.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(x.data)
+	if n <= 0 {
+		x.err = model.ErrCodecShortData
+		return 0
+	}
+	x.data = x.data[n:]
+	return v
+}
+
+func (x *BinaryReader) Uint() uint64 {
+	if x.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(x.data)
+	if n <= 0 {
+		x.err = model.ErrCodecShortData
+		return 0
+	}
+	x.data = x.data[n:]
+	return v
+}
+
+func (x *BinaryReader) Float32() float32 {
+	b := x.next(4)
+	if b == nil {
+		return 0
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(b))
+}
+
+func (x *BinaryReader) Float64() float64 {
+	b := x.next(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+func (x *BinaryReader) String() string {
+	return string(x.bytes())
+}
+
+func (x *BinaryReader) Uuid() uuid.UUID {
+	var v uuid.UUID
+	copy(v[:], x.next(len(v)))
+	return v
+}
+
+func (x *BinaryReader) Time() time.Time {
+	var v time.Time
+	b := x.bytes()
+	if b == nil {
+		return v
+	}
+	if err := v.UnmarshalBinary(b); err != nil {
+		x.err = err
+	}
+	return v
+}
+
+// bytes reads a length-prefixed byte slice, the length is checked against the remaining data before slicing
+func (x *BinaryReader) bytes() []byte {
+	l := x.Uint()
+	if x.err != nil {
+		return nil
+	}
+	if l > uint64(len(x.data)) {
+		x.err = model.ErrCodecShortData
+		return nil
+	}
+	return x.next(int(l))
+}
+
+func (x *BinaryReader) next(n int) []byte {
+	if x.err != nil {
+		return nil
+	}
+	if len(x.data) < n {
+		x.err = model.ErrCodecShortData
+		return nil
+	}
+	b := x.data[:n]
+	x.data = x.data[n:]
+	return b
+}
@@ -0,0 +1,150 @@
+package hconn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+// TestBinaryReaderRoundTrip ensures every Append function is read back by its BinaryReader counterpart
+func TestBinaryReaderRoundTrip(t *testing.T) {
+	u := uuid.New()
+	now := time.Now()
+
+	b := AppendBool(nil, true)
+	b = AppendInt(b, math.MinInt64)
+	b = AppendUint(b, math.MaxUint64)
+	b = AppendFloat32(b, 1.5)
+	b = AppendFloat64(b, -2.25)
+	b = AppendString(b, "héllo")
+	b = AppendUuid(b, u)
+	b, err := AppendTime(b, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewBinaryReader(b)
+	if v := r.Bool(); !v {
+		t.Errorf("Bool: got %v", v)
+	}
+	if v := r.Int(); v != math.MinInt64 {
+		t.Errorf("Int: got %v", v)
+	}
+	if v := r.Uint(); v != math.MaxUint64 {
+		t.Errorf("Uint: got %v", v)
+	}
+	if v := r.Float32(); v != 1.5 {
+		t.Errorf("Float32: got %v", v)
+	}
+	if v := r.Float64(); v != -2.25 {
+		t.Errorf("Float64: got %v", v)
+	}
+	if v := r.String(); v != "héllo" {
+		t.Errorf("String: got %v", v)
+	}
+	if v := r.Uuid(); v != u {
+		t.Errorf("Uuid: got %v", v)
+	}
+	if v := r.Time(); !v.Equal(now) {
+		t.Errorf("Time: got %v, want %v", v, now)
+	}
+	if err = r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBinaryReaderHugeLength ensures a corrupted length fails instead of allocating
+func TestBinaryReaderHugeLength(t *testing.T) {
+	r := NewBinaryReader(binary.AppendUvarint(nil, math.MaxUint64))
+	if v := r.String(); v != "" {
+		t.Errorf("Expected empty string, got %q", v)
+	}
+	if !errors.Is(r.Err(), model.ErrCodecShortData) {
+		t.Errorf("Expected ErrCodecShortData, got %v", r.Err())
+	}
+}
+
+// TestBinaryCodecUnsupported ensures values not generated by the template are refused
+func TestBinaryCodecUnsupported(t *testing.T) {
+	if _, err := (Binary{}).Append(nil, model.Message{}); !errors.Is(err, model.ErrCodecUnsupported) {
+		t.Errorf("Expected ErrCodecUnsupported on Append, got %v", err)
+	}
+	if err := (Binary{}).Unmarshal(nil, &model.Message{}); !errors.Is(err, model.ErrCodecUnsupported) {
+		t.Errorf("Expected ErrCodecUnsupported on Unmarshal, got %v", err)
+	}
+}
+
+// namedGob is gob under another name, used to check that connections switch to the negotiated codec
+type namedGob struct {
+	*Serializer
+}
+
+func (namedGob) Name() string {
+	return "gob-test"
+}
+
+// TestHandshakeSwitchesCodec ensures both sides use the codec agreed in the handshake
+func TestHandshakeSwitchesCodec(t *testing.T) {
+	RegisterCodec("gob-test", func() Codec { return namedGob{NewSerializer()} })
+
+	client := NewHello("", "")
+	client.Codecs = []string{"gob-test", CodecGob}
+	serverConn, clientConn, serverErr, clientErr := handshake(t, NewHello("A", ""), client, nil)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("Handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	for _, hc := range []*HConn{serverConn, clientConn} {
+		if hc.S.Name() != "gob-test" || hc.W.Name() != "gob-test" {
+			t.Fatalf("Expected connection to use gob-test, got %s/%s", hc.S.Name(), hc.W.Name())
+		}
+	}
+
+	go func() {
+		msg, err := serverConn.Receive()
+		if err != nil {
+			return
+		}
+		msg.Status = model.StatusSuccess
+		_ = serverConn.Send(msg)
+	}()
+
+	resp, err := clientConn.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: "Test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.String != "Test" {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+}
+
+// TestWithCodec ensures a connection built with a codec sends and receives with it
+func TestWithCodec(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	newCodec := func() Codec { return namedGob{NewSerializer()} }
+	serverConn := NewHConn(server).WithCodec(newCodec)
+	clientConn := NewHConn(client).WithCodec(newCodec)
+
+	go func() {
+		_ = clientConn.Send(model.Message{Type: model.MessageTypeTest, String: "Test"})
+	}()
+
+	msg, err := serverConn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.String != "Test" || serverConn.S.Name() != "gob-test" {
+		t.Errorf("Unexpected message %+v with codec %s", msg, serverConn.S.Name())
+	}
+}
@@ -0,0 +1,284 @@
+package hconn
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/util"
+)
+
+const (
+	// ProtocolVersion is the newest version of the wire protocol spoken by this build
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version of the wire protocol this build can still speak
+	MinProtocolVersion = 1
+
+	CodecGob = "gob"
+
+	FeatureMultiplex = "multiplex"
+	FeatureRedirect  = "redirect"
+	FeatureTopology  = "topology"
+
+	// maxHandshakeSize caps the handshake frames since they are read before the peer is trusted
+	maxHandshakeSize = util.Size64KB
+)
+
+var (
+	HandshakeTimeout  = 5 * time.Second
+	SupportedCodecs   = []string{CodecGob}
+	SupportedFeatures = []string{FeatureMultiplex, FeatureRedirect, FeatureTopology}
+)
+
+/*
+Hello is the first frame sent on every connection, before any model.Message.
+It is encoded as JSON so that it stays readable by every version no matter how model.Message evolves.
+The client sends its Hello, the server answers with a Welcome that either accepts the connection
+with the agreed protocol or refuses it with a reason, in which case the connection is closed.
+*/
+type Hello struct {
+	MinVersion  int
+	MaxVersion  int
+	NodeName    string // Empty for clients that are not nodes
+	ClusterName string // Empty skips the cluster check
+	Codecs      []string
+	Features    []string
+	// Credentials authenticate the client when the server requires it, they are never sent back by the server
+	Credentials *model.Credentials `json:",omitempty"`
+}
+
+// Agreement is the protocol both sides speak once the handshake is done
+type Agreement struct {
+	Version  int
+	Codec    string
+	Features []string
+}
+
+// Authenticator is run by the server once the protocol is agreed, an error refuses the connection with its reason
+type Authenticator func(hc *HConn, remote Hello) error
+
+type Welcome struct {
+	Accepted  bool
+	Reason    string
+	Hello     Hello
+	Agreement Agreement
+}
+
+func NewHello(nodeName string, clusterName string) Hello {
+	return Hello{
+		MinVersion:  MinProtocolVersion,
+		MaxVersion:  ProtocolVersion,
+		NodeName:    nodeName,
+		ClusterName: clusterName,
+		Codecs:      slices.Clone(SupportedCodecs),
+		Features:    slices.Clone(SupportedFeatures),
+	}
+}
+
+func (x Agreement) HasFeature(feature string) bool {
+	return slices.Contains(x.Features, feature)
+}
+
+// Negotiate decides the protocol spoken between server and client: the highest common version,
+// the first codec of the client that the server supports and the features supported by both
+func Negotiate(server Hello, client Hello) (Agreement, error) {
+	var a Agreement
+
+	if server.ClusterName != "" && client.ClusterName != "" && server.ClusterName != client.ClusterName {
+		return a, fmt.Errorf("%w: [%s] != [%s]", model.ErrHandshakeCluster, client.ClusterName, server.ClusterName)
+	}
+
+	a.Version = min(server.MaxVersion, client.MaxVersion)
+	if a.Version < max(server.MinVersion, client.MinVersion) {
+		return a, fmt.Errorf("%w: client [%d-%d], server [%d-%d]", model.ErrHandshakeVersion,
+			client.MinVersion, client.MaxVersion, server.MinVersion, server.MaxVersion)
+	}
+
+	for _, c := range client.Codecs {
+		if slices.Contains(server.Codecs, c) {
+			a.Codec = c
+			break
+		}
+	}
+	if a.Codec == "" {
+		return a, fmt.Errorf("%w: client %v, server %v", model.ErrHandshakeCodec, client.Codecs, server.Codecs)
+	}
+
+	for _, f := range client.Features {
+		if slices.Contains(server.Features, f) {
+			a.Features = append(a.Features, f)
+		}
+	}
+
+	return a, nil
+}
+
+// HandshakeClient sends local and waits for the server to accept it, it must be called before any other message
+func (hc *HConn) HandshakeClient(local Hello) error {
+	if err := hc.C.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return err
+	}
+	defer hc.C.SetDeadline(time.Time{})
+
+	if err := hc.writeJson(local); err != nil {
+		return err
+	}
+
+	var w Welcome
+	if err := hc.readJson(&w); err != nil {
+		return err
+	}
+	if !w.Accepted {
+		return fmt.Errorf("%w: %s", model.ErrHandshakeRefused, w.Reason)
+	}
+
+	hc.Peer = w.Hello
+	hc.Agreement = w.Agreement
+	return hc.useCodec(w.Agreement.Codec)
+}
+
+// HandshakeServer waits for the client Hello and accepts or refuses it, the connection must be closed on error.
+// auth may be nil when clients do not need to authenticate.
+func (hc *HConn) HandshakeServer(local Hello, auth Authenticator) error {
+	if err := hc.C.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return err
+	}
+	defer hc.C.SetDeadline(time.Time{})
+
+	var remote Hello
+	if err := hc.readJson(&remote); err != nil {
+		return err
+	}
+
+	a, err := Negotiate(local, remote)
+	if err == nil {
+		err = verifyIdentity(hc.C, remote)
+	}
+	if err == nil && auth != nil {
+		err = auth(hc, remote)
+	}
+	if err != nil {
+		// Let the client know why it was refused, the negotiation error is the one that matters
+		_ = hc.writeJson(Welcome{Reason: err.Error(), Hello: local})
+		return err
+	}
+
+	if err = hc.writeJson(Welcome{Accepted: true, Hello: local, Agreement: a}); err != nil {
+		return err
+	}
+
+	remote.Credentials = nil
+	hc.Peer = remote
+	hc.Agreement = a
+	return hc.useCodec(a.Codec)
+}
+
+// Refuse answers the client Hello with reason without negotiating anything, the connection must be closed afterward
+func (hc *HConn) Refuse(local Hello, reason error) error {
+	if err := hc.C.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return err
+	}
+
+	var remote Hello
+	if err := hc.readJson(&remote); err != nil {
+		return err
+	}
+	return hc.writeJson(Welcome{Reason: reason.Error(), Hello: local})
+}
+
+// verifyIdentity requires peers claiming a node name over mTLS to present a certificate issued for that name,
+// servers are verified by name during the TLS handshake already
+func verifyIdentity(conn net.Conn, remote Hello) error {
+	c, ok := conn.(*tls.Conn)
+	if !ok || remote.NodeName == "" {
+		return nil
+	}
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	if err := certs[0].VerifyHostname(remote.NodeName); err != nil {
+		return fmt.Errorf("%w: %v", model.ErrHandshakeIdentity, err)
+	}
+	return nil
+}
+
+// useCodec switches both directions to the negotiated codec, it runs before any message is exchanged
+func (hc *HConn) useCodec(name string) error {
+	if hc.S.Name() == name && hc.W.Name() == name {
+		return nil
+	}
+	c, ok := newCodec(name)
+	if !ok {
+		return fmt.Errorf("%w: [%s] is not registered", model.ErrHandshakeCodec, name)
+	}
+	hc.S = c
+	hc.W, _ = newCodec(name)
+	return nil
+}
+
+func (hc *HConn) writeJson(a any) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	lengthPrefix := make([]byte, 8)
+	binary.BigEndian.PutUint64(lengthPrefix, uint64(len(data)))
+
+	hc.wmu.Lock()
+	defer hc.wmu.Unlock()
+	if err = hc.write(lengthPrefix); err != nil {
+		return err
+	}
+	return hc.write(data)
+}
+
+func (hc *HConn) readJson(a any) error {
+	lengthPrefix, err := hc.read(8)
+	if err != nil {
+		return err
+	}
+
+	length := binary.BigEndian.Uint64(lengthPrefix)
+	if length == 0 || length > maxHandshakeSize {
+		return fmt.Errorf("%w: invalid frame length [%d]", model.ErrHandshakeInvalid, length)
+	}
+
+	data, err := hc.read(int(length))
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, a); err != nil {
+		return fmt.Errorf("%w: %v", model.ErrHandshakeInvalid, err)
+	}
+	return nil
+}
+
+// Dial connects to address, over TLS if tlsConfig is not nil, and performs the client side of the handshake with hello
+func Dial(address string, timeout time.Duration, tlsConfig *tls.Config, hello Hello) (*HConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers close idle connections, clients wait for them to do so
+	hc := NewHConn(conn).WithIdleTimeout(0).WithDropOverflow()
+	if err = hc.HandshakeClient(hello); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return hc, nil
+}
@@ -0,0 +1,226 @@
+package hconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+// handshake runs both sides of the handshake over a pipe and returns the connections and their errors
+func handshake(t *testing.T, server Hello, client Hello, auth Authenticator) (*HConn, *HConn, error, error) {
+	t.Helper()
+	s, c := net.Pipe()
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+
+	serverConn := NewHConn(s)
+	clientConn := NewHConn(c)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		err := serverConn.HandshakeServer(server, auth)
+		if err != nil {
+			// Refused connections are closed by the server
+			s.Close()
+		}
+		serverErr <- err
+	}()
+
+	clientErr := clientConn.HandshakeClient(client)
+	return serverConn, clientConn, <-serverErr, clientErr
+}
+
+func versions(minVersion int, maxVersion int) Hello {
+	h := NewHello("", "")
+	h.MinVersion = minVersion
+	h.MaxVersion = maxVersion
+	return h
+}
+
+// TestNegotiateCompatibilityMatrix checks which protocol version, if any, every pair of version ranges agrees on
+func TestNegotiateCompatibilityMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  Hello
+		client  Hello
+		version int
+		err     error
+	}{
+		{"Same version", versions(1, 1), versions(1, 1), 1, nil},
+		{"Newer client", versions(1, 1), versions(1, 2), 1, nil},
+		{"Newer server", versions(1, 2), versions(1, 1), 1, nil},
+		{"Both upgraded", versions(1, 2), versions(1, 2), 2, nil},
+		{"Overlapping ranges", versions(2, 4), versions(1, 3), 3, nil},
+		{"Client dropped old version", versions(1, 1), versions(2, 2), 0, model.ErrHandshakeVersion},
+		{"Server dropped old version", versions(2, 3), versions(1, 1), 0, model.ErrHandshakeVersion},
+		{"Disjoint ranges", versions(4, 5), versions(1, 3), 0, model.ErrHandshakeVersion},
+		{"Current build", NewHello("A", "c"), NewHello("B", "c"), ProtocolVersion, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := Negotiate(tt.server, tt.client)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if err == nil && a.Version != tt.version {
+				t.Errorf("Expected version %d, got %d", tt.version, a.Version)
+			}
+
+			// The outcome must not depend on which side dialed
+			b, err := Negotiate(tt.client, tt.server)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v with roles swapped, got %v", tt.err, err)
+			}
+			if err == nil && b.Version != tt.version {
+				t.Errorf("Expected version %d with roles swapped, got %d", tt.version, b.Version)
+			}
+		})
+	}
+}
+
+// TestNegotiateClusterName checks that nodes of different clusters refuse each other while unnamed sides are accepted
+func TestNegotiateClusterName(t *testing.T) {
+	tests := []struct {
+		server string
+		client string
+		err    error
+	}{
+		{"prod", "prod", nil},
+		{"prod", "", nil},
+		{"", "prod", nil},
+		{"", "", nil},
+		{"prod", "test", model.ErrHandshakeCluster},
+	}
+
+	for _, tt := range tests {
+		_, err := Negotiate(NewHello("A", tt.server), NewHello("B", tt.client))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Server [%s], client [%s]: expected error %v, got %v", tt.server, tt.client, tt.err, err)
+		}
+	}
+}
+
+// TestNegotiateCodecsAndFeatures checks that the client codec preference wins and only shared features are enabled
+func TestNegotiateCodecsAndFeatures(t *testing.T) {
+	server := NewHello("A", "")
+	server.Codecs = []string{"json", CodecGob}
+	server.Features = []string{FeatureMultiplex, "compression"}
+
+	client := NewHello("", "")
+	client.Codecs = []string{"msgpack", CodecGob, "json"}
+	client.Features = []string{FeatureMultiplex, FeatureRedirect}
+
+	a, err := Negotiate(server, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Codec != CodecGob {
+		t.Errorf("Expected codec %s, got %s", CodecGob, a.Codec)
+	}
+	if !slices.Equal(a.Features, []string{FeatureMultiplex}) {
+		t.Errorf("Expected only shared features, got %v", a.Features)
+	}
+	if !a.HasFeature(FeatureMultiplex) || a.HasFeature(FeatureRedirect) {
+		t.Errorf("Unexpected HasFeature results for %v", a.Features)
+	}
+
+	client.Codecs = []string{"msgpack"}
+	if _, err = Negotiate(server, client); !errors.Is(err, model.ErrHandshakeCodec) {
+		t.Errorf("Expected ErrHandshakeCodec, got %v", err)
+	}
+}
+
+// TestHandshakeAccepted checks that both sides learn about each other and can exchange messages afterward
+func TestHandshakeAccepted(t *testing.T) {
+	serverConn, clientConn, serverErr, clientErr := handshake(t, NewHello("A", "prod"), NewHello("", "prod"), nil)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("Handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	if clientConn.Peer.NodeName != "A" || clientConn.Agreement.Version != ProtocolVersion {
+		t.Errorf("Unexpected client view: peer %+v, agreement %+v", clientConn.Peer, clientConn.Agreement)
+	}
+	if serverConn.Peer.ClusterName != "prod" || serverConn.Agreement.Codec != CodecGob {
+		t.Errorf("Unexpected server view: peer %+v, agreement %+v", serverConn.Peer, serverConn.Agreement)
+	}
+
+	go func() {
+		msg, err := serverConn.Receive()
+		if err != nil {
+			return
+		}
+		msg.Status = model.StatusSuccess
+		_ = serverConn.Send(msg)
+	}()
+
+	resp, err := clientConn.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: "Test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.String != "Test" {
+		t.Errorf("Unexpected response after handshake: %+v", resp)
+	}
+}
+
+// TestHandshakeRefused checks that the client gets the reason of the refusal
+func TestHandshakeRefused(t *testing.T) {
+	_, _, serverErr, clientErr := handshake(t, versions(2, 2), versions(1, 1), nil)
+	if !errors.Is(serverErr, model.ErrHandshakeVersion) {
+		t.Errorf("Expected server ErrHandshakeVersion, got %v", serverErr)
+	}
+	if !errors.Is(clientErr, model.ErrHandshakeRefused) {
+		t.Errorf("Expected client ErrHandshakeRefused, got %v", clientErr)
+	}
+}
+
+// TestHandshakeInvalidFrame checks that a peer not speaking the handshake is refused without allocating its frame
+func TestHandshakeInvalidFrame(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	go func() {
+		// A gob message sent straight away, as a client predating the handshake would
+		_ = NewHConn(c).Send(model.Message{Type: model.MessageTypePing})
+	}()
+
+	if err := NewHConn(s).HandshakeServer(NewHello("A", ""), nil); !errors.Is(err, model.ErrHandshakeInvalid) {
+		t.Errorf("Expected ErrHandshakeInvalid, got %v", err)
+	}
+}
+
+// TestHandshakeAuthenticator checks that the authenticator decides the outcome and credentials are not kept
+func TestHandshakeAuthenticator(t *testing.T) {
+	auth := func(hc *HConn, remote Hello) error {
+		if remote.Credentials == nil || remote.Credentials.Token != "secret" {
+			return model.ErrAuthFailed
+		}
+		return nil
+	}
+
+	client := NewHello("", "")
+	_, _, serverErr, clientErr := handshake(t, NewHello("A", ""), client, auth)
+	if !errors.Is(serverErr, model.ErrAuthFailed) {
+		t.Errorf("Expected server ErrAuthFailed, got %v", serverErr)
+	}
+	if !errors.Is(clientErr, model.ErrHandshakeRefused) || !strings.Contains(clientErr.Error(), model.ErrAuthFailed.Error()) {
+		t.Errorf("Expected client refusal with the reason, got %v", clientErr)
+	}
+
+	client.Credentials = &model.Credentials{Token: "secret"}
+	serverConn, _, serverErr, clientErr := handshake(t, NewHello("A", ""), client, auth)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("Handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+	if serverConn.Peer.Credentials != nil {
+		t.Errorf("Credentials must not be kept after the handshake")
+	}
+}
@@ -1,94 +1,432 @@
 package hconn
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rah-0/nabu"
 
 	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/util"
 )
 
-var Timeout = 120 * time.Second
+var (
+	// IdleTimeout is how long new connections may go without any frame read or written and nothing in flight
+	// before they are closed, connections made by Dial do not time out since the server closes them
+	IdleTimeout = 120 * time.Second
+	// ReadTimeout bounds the time to read a whole frame once its first byte arrived
+	ReadTimeout = 30 * time.Second
+	// WriteTimeout bounds the time to write a whole frame
+	WriteTimeout = 30 * time.Second
+	// InboxSize is how many uncorrelated messages can be buffered before the reader blocks, or drops them (see WithDropOverflow)
+	InboxSize = 64
+	// MaxMessageSize is the largest frame new connections accept or send, larger length prefixes
+	// are rejected before allocating anything
+	MaxMessageSize = util.Size100MB
+	// maxPooledBuffer is the largest read buffer kept for reuse, bigger ones are left to the GC
+	maxPooledBuffer = util.Size1MB
 
+	readBuffers = sync.Pool{
+		New: func() any {
+			b := make([]byte, 0, util.Size4KB)
+			return &b
+		},
+	}
+)
+
+/*
+HConn starts every connection with a handshake (see Hello), after which it frames every message
+in a length-prefixed format:
+- Length: 8 Bytes, frames above the max message size are a protocol error that closes the connection
+- Data: model.Message encoded by the Codec negotiated in the handshake, gob by default
+
+Requests sent with SendReceive carry a unique Message.Id which the peer echoes back in its response.
+A single reader goroutine reads all frames from the connection and dispatches the ones that match
+a pending request to its caller, everything else is delivered through Receive (see WithDropOverflow).
+This allows many concurrent in-flight requests on the same connection without head-of-line blocking.
+
+Timeouts are set per connection, 0 disables them:
+- idle: the connection is closed once no frame was read or written for that long, unless a SendReceive is
+pending or a request received is being served (see Begin), so busy and healthy connections are never closed
+- read: once the first byte of a frame arrived, the rest of it must arrive within that time
+- write: every frame must be written within that time, a failed write closes the connection
+*/
 type HConn struct {
-	C  net.Conn
-	S  *Serializer
-	mu sync.Mutex
+	C net.Conn
+	S Codec // Used to decode received messages
+	W Codec // Used to encode sent messages
+
+	// Set by the handshake
+	Peer      Hello
+	Agreement Agreement
+
+	wmu            sync.Mutex // Serializes writes so frames are never interleaved
+	wbuf           []byte     // Reused for every frame sent, guarded by wmu
+	idleTimeout    time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	maxMessageSize int
+	lastActivity   atomic.Int64 // Unix nanoseconds of the last frame read or written
+	serving        atomic.Int64 // Requests received that are being served, see Begin
+	dropOverflow   bool
+	dropped        atomic.Int64
+
+	mu         sync.Mutex
+	nextId     uint64
+	pending    map[uint64]chan model.Message
+	abandoned  map[uint64]struct{} // Requests whose caller gave up, their late responses are dropped
+	inbox      chan model.Message
+	readerOn   bool
+	readerDone bool
+	readerErr  error
 }
 
 func NewHConn(conn net.Conn) *HConn {
-	return &HConn{
-		C: conn,
-		S: NewSerializer(),
+	hc := &HConn{
+		C:              conn,
+		S:              NewSerializer(),
+		W:              NewSerializer(),
+		pending:        make(map[uint64]chan model.Message),
+		abandoned:      make(map[uint64]struct{}),
+		inbox:          make(chan model.Message, InboxSize),
+		idleTimeout:    IdleTimeout,
+		readTimeout:    ReadTimeout,
+		writeTimeout:   WriteTimeout,
+		maxMessageSize: MaxMessageSize,
 	}
+	hc.touch()
+	return hc
+}
+
+// WithCodec replaces the gob codec of both directions, the handshake does the same with the negotiated codec
+func (hc *HConn) WithCodec(newCodec func() Codec) *HConn {
+	hc.S = newCodec()
+	hc.W = newCodec()
+	return hc
+}
+
+// WithMaxMessageSize overrides MaxMessageSize for this connection, it must be called before any message is exchanged
+func (hc *HConn) WithMaxMessageSize(size int) *HConn {
+	hc.maxMessageSize = size
+	return hc
+}
+
+func (hc *HConn) WithIdleTimeout(d time.Duration) *HConn {
+	hc.idleTimeout = d
+	return hc
+}
+
+func (hc *HConn) WithReadTimeout(d time.Duration) *HConn {
+	hc.readTimeout = d
+	return hc
+}
+
+func (hc *HConn) WithWriteTimeout(d time.Duration) *HConn {
+	hc.writeTimeout = d
+	return hc
+}
+
+/*
+WithDropOverflow makes the reader drop the messages that are not responses once InboxSize of them wait for Receive,
+instead of blocking and with it every pending SendReceive. Dial sets it since clients only wait for responses,
+servers keep blocking so that the requests they are slow to serve are not lost.
+*/
+func (hc *HConn) WithDropOverflow() *HConn {
+	hc.dropOverflow = true
+	return hc
+}
+
+// Dropped returns how many messages were dropped because the inbox was full, see WithDropOverflow
+func (hc *HConn) Dropped() int64 {
+	return hc.dropped.Load()
 }
 
 func (hc *HConn) Close() error {
 	return hc.C.Close()
 }
 
-// Send sends a message with a length-prefixed format
+// Begin marks a request received through Receive as being served, the connection is not considered idle
+// until the matching End, which is usually called once its response is sent
+func (hc *HConn) Begin() {
+	hc.serving.Add(1)
+}
+
+func (hc *HConn) End() {
+	hc.serving.Add(-1)
+	hc.touch()
+}
+
+// Send sends a message with a length-prefixed format, it is safe to call concurrently.
+// Messages above the max message size are not sent and the connection is closed.
+// The frame is written before the write timeout of the connection, which every request in flight shares,
+// a frame that cannot be written entirely closes the connection since the peer would read it truncated.
 func (hc *HConn) Send(a any) error {
-	if err := hc.S.Encode(a); err != nil {
+	hc.wmu.Lock()
+	defer hc.wmu.Unlock()
+
+	// The length prefix is reserved first so the whole frame is written at once
+	var lengthPrefix [8]byte
+	frame, err := hc.W.Append(append(hc.wbuf[:0], lengthPrefix[:]...), a)
+	if err != nil {
 		return nabu.FromError(err).Log()
 	}
+	if cap(frame) <= maxPooledBuffer {
+		hc.wbuf = frame
+	}
 
-	data := hc.S.GetData()
-	hc.S.Reset()
-
-	dataLen := uint64(len(data))
-	lengthPrefix := make([]byte, 8)
-	binary.BigEndian.PutUint64(lengthPrefix, dataLen)
+	dataLen := len(frame) - 8
+	if dataLen > hc.maxMessageSize {
+		// Stateful codecs already consider the type definitions in the frame as sent, skipping it would
+		// desynchronize the stream, so the connection cannot be used anymore
+		_ = hc.C.Close()
+		return fmt.Errorf("%w: [%d] bytes, max [%d]", model.ErrMessageTooLarge, dataLen, hc.maxMessageSize)
+	}
+	binary.BigEndian.PutUint64(frame, uint64(dataLen))
 
-	if err := hc.write(lengthPrefix); err != nil {
+	var deadline time.Time
+	if hc.writeTimeout > 0 {
+		deadline = time.Now().Add(hc.writeTimeout)
+	}
+	if err = hc.C.SetWriteDeadline(deadline); err != nil {
 		return err
 	}
-	if err := hc.write(data); err != nil {
+	if err = hc.write(frame); err != nil {
+		_ = hc.C.Close()
 		return err
 	}
-
+	hc.touch()
 	return nil
 }
 
-// Receive reads a message using the length-prefixed format
-func (hc *HConn) Receive() (msg model.Message, err error) {
-	if err = hc.C.SetReadDeadline(time.Now().Add(Timeout)); err != nil {
+// Receive returns the next message that is not a response to a pending SendReceive call
+func (hc *HConn) Receive() (model.Message, error) {
+	hc.startReader()
+
+	msg, ok := <-hc.inbox
+	if !ok {
+		return model.Message{}, hc.Err()
+	}
+	return msg, nil
+}
+
+// SendReceive sends msg tagged with a new request id and waits for the response carrying the same id
+// until ctx is done, in which case only this call gives up and its late response is dropped.
+// Any number of goroutines can call it concurrently on the same connection.
+func (hc *HConn) SendReceive(ctx context.Context, msg model.Message) (model.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Message{}, err
+	}
+	ch := make(chan model.Message, 1)
+
+	hc.mu.Lock()
+	if hc.readerDone {
+		hc.mu.Unlock()
+		return model.Message{}, hc.Err()
+	}
+	hc.nextId++
+	id := hc.nextId
+	hc.pending[id] = ch
+	hc.mu.Unlock()
+
+	hc.startReader()
+
+	msg.Id = id
+	if err := hc.Send(msg); err != nil {
+		hc.mu.Lock()
+		delete(hc.pending, id)
+		hc.mu.Unlock()
+		return model.Message{}, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return model.Message{}, hc.Err()
+		}
+		return resp, nil
+	case <-ctx.Done():
+		hc.mu.Lock()
+		if _, ok := hc.pending[id]; ok {
+			delete(hc.pending, id)
+			hc.abandoned[id] = struct{}{}
+		}
+		hc.mu.Unlock()
+		return model.Message{}, ctx.Err()
+	}
+}
+
+func (hc *HConn) startReader() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.readerOn {
 		return
 	}
+	hc.readerOn = true
+	go hc.readLoop()
+}
+
+// readLoop is the only reader of the connection, it runs until the connection fails
+func (hc *HConn) readLoop() {
+	for {
+		msg, err := hc.receive()
+		if err != nil {
+			hc.fail(err)
+			return
+		}
+
+		if msg.Id != 0 {
+			hc.mu.Lock()
+			ch, ok := hc.pending[msg.Id]
+			delete(hc.pending, msg.Id)
+			_, late := hc.abandoned[msg.Id]
+			delete(hc.abandoned, msg.Id)
+			hc.mu.Unlock()
+
+			if ok {
+				ch <- msg
+				continue
+			}
+			if late {
+				continue
+			}
+		}
+
+		if !hc.dropOverflow {
+			hc.inbox <- msg
+			continue
+		}
+		select {
+		case hc.inbox <- msg:
+		default:
+			hc.dropped.Add(1)
+		}
+	}
+}
 
-	lengthPrefix, err := hc.read(8)
+// fail releases every caller waiting on the connection, they will get err
+func (hc *HConn) fail(err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	hc.readerDone = true
+	hc.readerErr = err
+	for id, ch := range hc.pending {
+		close(ch)
+		delete(hc.pending, id)
+	}
+	clear(hc.abandoned)
+	close(hc.inbox)
+}
+
+// Err returns the error that stopped reading the connection, nil while it is usable
+func (hc *HConn) Err() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.readerErr
+}
+
+// receive reads a message using the length-prefixed format, the length is validated before allocating
+func (hc *HConn) receive() (msg model.Message, err error) {
+	var lengthPrefix [8]byte
+	n, err := hc.waitFrame(lengthPrefix[:])
+	if err != nil {
+		return
+	}
+	if hc.readTimeout > 0 {
+		err = hc.C.SetReadDeadline(time.Now().Add(hc.readTimeout))
+	} else {
+		err = hc.C.SetReadDeadline(time.Time{})
+	}
 	if err != nil {
 		return
 	}
+	if err = hc.readInto(lengthPrefix[n:]); err != nil {
+		return
+	}
 
-	messageLength := binary.BigEndian.Uint64(lengthPrefix)
+	messageLength := binary.BigEndian.Uint64(lengthPrefix[:])
 	if messageLength == 0 {
 		err = model.ErrMessageEmpty
 		return
 	}
+	if messageLength > uint64(hc.maxMessageSize) {
+		err = fmt.Errorf("%w: [%d] bytes, max [%d]", model.ErrMessageTooLarge, messageLength, hc.maxMessageSize)
+		return
+	}
 
-	message, err := hc.read(int(messageLength))
-	if err != nil {
+	buffer := getReadBuffer(int(messageLength))
+	defer putReadBuffer(buffer)
+	if err = hc.readInto(*buffer); err != nil {
 		return
 	}
 
-	hc.S.SetData(message)
-	err = hc.S.Decode(&msg)
-	hc.S.Reset()
+	hc.touch()
+
+	// Codecs copy what they keep, so the buffer can be reused right after
+	err = hc.S.Unmarshal(*buffer, &msg)
 	return msg, err
 }
 
-func (hc *HConn) SendReceive(msg model.Message) (model.Message, error) {
+// waitFrame reads the first bytes of the next frame into prefix, the connection can stay idle meanwhile for idleTimeout
+func (hc *HConn) waitFrame(prefix []byte) (int, error) {
+	for {
+		var deadline time.Time
+		if hc.idleTimeout > 0 {
+			deadline = time.Unix(0, hc.lastActivity.Load()).Add(hc.idleTimeout)
+			if now := time.Now(); deadline.Before(now) {
+				// Busy connections are checked again later
+				deadline = now.Add(hc.idleTimeout)
+			}
+		}
+		if err := hc.C.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+
+		n, err := hc.C.Read(prefix)
+		if n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, err
+		}
+		if hc.idle() {
+			return 0, fmt.Errorf("%w: %w", model.ErrConnectionIdle, err)
+		}
+	}
+}
+
+// idle reports whether nothing happened on the connection for idleTimeout and nothing is in flight
+func (hc *HConn) idle() bool {
+	if time.Since(time.Unix(0, hc.lastActivity.Load())) < hc.idleTimeout || hc.serving.Load() > 0 {
+		return false
+	}
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
+	return len(hc.pending) == 0
+}
 
-	if err := hc.Send(msg); err != nil {
-		return model.Message{}, err
+func (hc *HConn) touch() {
+	hc.lastActivity.Store(time.Now().UnixNano())
+}
+
+func getReadBuffer(size int) *[]byte {
+	b := readBuffers.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size)
 	}
-	return hc.Receive()
+	*b = (*b)[:size]
+	return b
+}
+
+func putReadBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	readBuffers.Put(b)
 }
 
 // Ensures all bytes are sent
@@ -107,15 +445,21 @@ func (hc *HConn) write(data []byte) error {
 // Reads exactly `size` bytes from the connection
 func (hc *HConn) read(size int) ([]byte, error) {
 	buffer := make([]byte, size)
-	totalRead := 0
+	if err := hc.readInto(buffer); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
 
-	for totalRead < size {
+// Fills buffer with bytes from the connection
+func (hc *HConn) readInto(buffer []byte) error {
+	totalRead := 0
+	for totalRead < len(buffer) {
 		n, err := hc.C.Read(buffer[totalRead:])
 		if err != nil {
-			return nil, err
+			return err
 		}
 		totalRead += n
 	}
-
-	return buffer, nil
+	return nil
 }
@@ -1,17 +1,20 @@
 package hconn
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/util"
 )
 
 // TestSendAndReceive tests sending and receiving a Message using HConn
@@ -180,9 +183,8 @@ func TestPartialRead(t *testing.T) {
 	}
 
 	hc := NewHConn(server)
-	hc.S.SetData(receivedBuf)
 	var decoded model.Message
-	err = hc.S.Decode(&decoded)
+	err = hc.S.Unmarshal(receivedBuf, &decoded)
 	if err != nil {
 		t.Fatalf("Decoding failed: %v", err)
 	}
@@ -230,10 +232,114 @@ func TestCorruptedData(t *testing.T) {
 	}
 }
 
+// TestReceiveRejectsOversizedFrame ensures a huge length prefix fails before anything is allocated for it
+func TestReceiveRejectsOversizedFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	serverConn := NewHConn(server)
+
+	go func() {
+		// Asking for an exabyte would crash the process if it was allocated
+		lengthPrefix := make([]byte, 8)
+		binary.BigEndian.PutUint64(lengthPrefix, 1<<60)
+		client.Write(lengthPrefix)
+	}()
+
+	_, err := serverConn.Receive()
+	if !errors.Is(err, model.ErrMessageTooLarge) {
+		t.Fatalf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+// TestMaxMessageSize ensures both sides honor the per connection limit
+func TestMaxMessageSize(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	serverConn := NewHConn(server).WithMaxMessageSize(1024)
+	clientConn := NewHConn(client).WithMaxMessageSize(1024)
+
+	small := model.Message{Type: model.MessageTypeTest, String: "Test"}
+	large := model.Message{Type: model.MessageTypeTest, String: string(make([]byte, 2048))}
+
+	go func() {
+		if err := clientConn.Send(small); err != nil {
+			t.Errorf("Send failed: %v", err)
+		}
+		if err := clientConn.Send(large); !errors.Is(err, model.ErrMessageTooLarge) {
+			t.Errorf("Expected Send to refuse the message, got %v", err)
+		}
+	}()
+
+	msg, err := serverConn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.String != "Test" {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+	// The sender closes the connection instead of sending the oversized frame
+	if _, err = serverConn.Receive(); err == nil {
+		t.Fatal("Expected error after oversized Send, got none")
+	}
+
+	// Bypass the sender limit to check the receiver one
+	server, client = net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	serverConn = NewHConn(server).WithMaxMessageSize(1024)
+	go func() { _ = NewHConn(client).Send(large) }()
+	if _, err = serverConn.Receive(); !errors.Is(err, model.ErrMessageTooLarge) {
+		t.Fatalf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+// FuzzReceive feeds arbitrary byte streams to Receive, which must return messages or errors but never panic
+func FuzzReceive(f *testing.F) {
+	s := NewSerializer()
+	if err := s.Encode(model.Message{Type: model.MessageTypeTest, String: "Test"}); err != nil {
+		f.Fatal(err)
+	}
+	valid := make([]byte, 8)
+	binary.BigEndian.PutUint64(valid, uint64(len(s.GetData())))
+	valid = append(valid, s.GetData()...)
+
+	huge := make([]byte, 8)
+	binary.BigEndian.PutUint64(huge, 1<<63)
+
+	f.Add(valid)
+	f.Add(append(valid, valid...))
+	f.Add(valid[:len(valid)/2])
+	f.Add(huge)
+	f.Add(make([]byte, 8))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server, client := net.Pipe()
+		defer server.Close()
+
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		hc := NewHConn(server).WithMaxMessageSize(util.Size64KB)
+		for {
+			if _, err := hc.Receive(); err != nil {
+				return
+			}
+		}
+	})
+}
+
 func TestReceiveTimeout(t *testing.T) {
-	originalTimeout := Timeout
-	defer func() { Timeout = originalTimeout }()
-	Timeout = 500 * time.Millisecond
+	originalTimeout := IdleTimeout
+	defer func() { IdleTimeout = originalTimeout }()
+	IdleTimeout = 500 * time.Millisecond
 
 	server, client := net.Pipe()
 	defer server.Close()
@@ -258,18 +364,18 @@ func TestReceiveTimeout(t *testing.T) {
 	select {
 	case <-done:
 		// OK, finished in time
-	case <-time.After(2 * Timeout):
+	case <-time.After(2 * IdleTimeout):
 		t.Error("Receive did not time out as expected")
 	}
 }
 
 func TestKeepAliveSuccessful(t *testing.T) {
 	// Save original timeout and restore at the end
-	originalTimeout := Timeout
-	defer func() { Timeout = originalTimeout }()
+	originalTimeout := IdleTimeout
+	defer func() { IdleTimeout = originalTimeout }()
 
 	// Use a shorter timeout for testing
-	Timeout = 200 * time.Millisecond
+	IdleTimeout = 200 * time.Millisecond
 
 	// Setup test
 	server, client := net.Pipe()
@@ -312,7 +418,7 @@ func TestKeepAliveSuccessful(t *testing.T) {
 	}()
 
 	go func() {
-		ticker := time.NewTicker(Timeout / 2)
+		ticker := time.NewTicker(IdleTimeout / 2)
 		defer ticker.Stop()
 		for range ticker.C {
 			pingMsg := model.Message{Type: model.MessageTypePing}
@@ -361,12 +467,12 @@ func TestPingMessageHandling(t *testing.T) {
 	}
 
 	// Verify timeout manipulation works correctly with the HConn
-	originalTimeout := Timeout
-	defer func() { Timeout = originalTimeout }()
+	originalTimeout := IdleTimeout
+	defer func() { IdleTimeout = originalTimeout }()
 
 	// Set to a very short timeout for testing
 	customTimeout := 50 * time.Millisecond
-	Timeout = customTimeout
+	IdleTimeout = customTimeout
 
 	// Verify the timeout is used in new connections
 	server, client := net.Pipe()
@@ -530,7 +636,7 @@ func TestSendReceiveRace_SharedConnection(t *testing.T) {
 			expected := fmt.Sprintf("hello from %d", id)
 			msg := model.Message{Type: model.MessageTypeTest, String: expected}
 
-			resp, err := client.SendReceive(msg)
+			resp, err := client.SendReceive(context.Background(), msg)
 			if err != nil {
 				errCh <- fmt.Errorf("send/recv error %d: %v", id, err)
 				return
@@ -558,3 +664,396 @@ func TestSendReceiveRace_SharedConnection(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestSendReceiveOutOfOrderResponses ensures responses are routed by request id and not by arrival order
+func TestSendReceiveOutOfOrderResponses(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client := NewHConn(clientConn)
+	server := NewHConn(serverConn)
+
+	const numRequests = 10
+
+	// Server collects every request first and answers them in reverse order
+	go func() {
+		var received []model.Message
+		for i := 0; i < numRequests; i++ {
+			msg, err := server.Receive()
+			if err != nil {
+				return
+			}
+			received = append(received, msg)
+		}
+		for i := len(received) - 1; i >= 0; i-- {
+			resp := received[i]
+			resp.String += "Received"
+			if err := server.Send(resp); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, numRequests)
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			expected := fmt.Sprintf("request %d", id)
+			resp, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: expected})
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if resp.String != expected+"Received" {
+				errCh <- fmt.Errorf("expected '%s', got '%s'", expected+"Received", resp.String)
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("test timeout")
+	}
+
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+// TestSendReceivePingNotBlockedBySlowRequest ensures a ping completes while another request is still pending
+func TestSendReceivePingNotBlockedBySlowRequest(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client := NewHConn(clientConn)
+	server := NewHConn(serverConn)
+
+	release := make(chan struct{})
+	go func() {
+		for {
+			msg, err := server.Receive()
+			if err != nil {
+				return
+			}
+			go func(msg model.Message) {
+				if msg.Type == model.MessageTypeTest {
+					<-release
+				}
+				msg.Status = model.StatusSuccess
+				_ = server.Send(msg)
+			}(msg)
+		}
+	}()
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: "slow"})
+		slowDone <- err
+	}()
+
+	pingDone := make(chan error, 1)
+	go func() {
+		resp, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypePing})
+		if err == nil && resp.Type != model.MessageTypePing {
+			err = fmt.Errorf("expected ping response, got %+v", resp)
+		}
+		pingDone <- err
+	}()
+
+	select {
+	case err := <-pingDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping was blocked by the slow request")
+	}
+
+	close(release)
+	select {
+	case err := <-slowDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow request never completed")
+	}
+}
+
+// TestSendReceivePendingFailOnClose ensures every pending caller is released when the connection dies
+func TestSendReceivePendingFailOnClose(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	client := NewHConn(clientConn)
+	server := NewHConn(serverConn)
+
+	const numRequests = 5
+	go func() {
+		for i := 0; i < numRequests; i++ {
+			if _, err := server.Receive(); err != nil {
+				return
+			}
+		}
+		serverConn.Close()
+	}()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, numRequests)
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest})
+			errCh <- err
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending requests were not released")
+	}
+
+	close(errCh)
+	for err := range errCh {
+		if err == nil {
+			t.Error("Expected error for request on closed connection, got none")
+		}
+	}
+
+	if _, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err == nil {
+		t.Error("Expected error when sending on a failed connection, got none")
+	}
+}
+
+// TestIdleTimeoutSparesBusyConnections checks that a connection serving a slow request is not closed as idle,
+// while one with nothing going on is
+func TestIdleTimeoutSparesBusyConnections(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	server := NewHConn(s).WithIdleTimeout(100 * time.Millisecond)
+	client := NewHConn(c).WithIdleTimeout(0)
+
+	idle := make(chan error, 1)
+	go func() {
+		msg, err := server.Receive()
+		if err != nil {
+			idle <- err
+			return
+		}
+		server.Begin()
+		time.Sleep(300 * time.Millisecond)
+		msg.Status = model.StatusSuccess
+		_ = server.Send(msg)
+		server.End()
+
+		_, err = server.Receive()
+		idle <- err
+	}()
+
+	resp, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypePing})
+	if err != nil || resp.Status != model.StatusSuccess {
+		t.Fatalf("Expected the slow request to be answered, got %+v: %v", resp, err)
+	}
+
+	start := time.Now()
+	select {
+	case err = <-idle:
+		if !errors.Is(err, model.ErrConnectionIdle) {
+			t.Fatalf("Expected ErrConnectionIdle, got %v", err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("Idle connection closed too late")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Idle connection was not closed")
+	}
+}
+
+// TestReadTimeoutPartialFrame checks that a frame that stops arriving midway fails after the read timeout
+func TestReadTimeoutPartialFrame(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	server := NewHConn(s).WithIdleTimeout(0).WithReadTimeout(100 * time.Millisecond)
+	go func() {
+		_, _ = c.Write([]byte{0, 0, 0, 0})
+	}()
+
+	_, err := server.Receive()
+	if !errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, model.ErrConnectionIdle) {
+		t.Fatalf("Expected a read deadline error, got %v", err)
+	}
+}
+
+// TestWriteTimeout checks that Send gives up on a peer not reading and closes the connection
+func TestWriteTimeout(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	hc := NewHConn(c).WithWriteTimeout(100 * time.Millisecond)
+	start := time.Now()
+	if err := hc.Send(model.Message{Type: model.MessageTypePing}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected a write deadline error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Send blocked past its write timeout")
+	}
+	if err := hc.Send(model.Message{Type: model.MessageTypePing}); !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+// TestSendReceiveContext checks that callers stop waiting once their context is done
+// and that the late response does not reach anyone else
+func TestSendReceiveContext(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	server := NewHConn(s)
+	client := NewHConn(c)
+
+	requests := make(chan model.Message, 2)
+	go func() {
+		for {
+			msg, err := server.Receive()
+			if err != nil {
+				return
+			}
+			requests <- msg
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := Bind(ctx, client).SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: "slow"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The late response is dropped, the next request gets its own
+	slow := <-requests
+	slow.Status = model.StatusSuccess
+	if err = server.Send(slow); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		fast := <-requests
+		fast.Status = model.StatusSuccess
+		_ = server.Send(fast)
+	}()
+
+	resp, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: "fast"})
+	if err != nil || resp.String != "fast" {
+		t.Fatalf("Expected the response of the second request, got %+v: %v", resp, err)
+	}
+	select {
+	case msg := <-client.inbox:
+		t.Fatalf("Late response leaked to Receive: %+v", msg)
+	default:
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = client.SendReceive(cancelled, model.Message{Type: model.MessageTypePing}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled before sending, got %v", err)
+	}
+}
+
+// TestDropOverflow checks that messages nobody receives do not block the responses behind them
+func TestDropOverflow(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	server := NewHConn(s)
+	client := NewHConn(c).WithDropOverflow()
+
+	go func() {
+		msg, err := server.Receive()
+		if err != nil {
+			return
+		}
+		for range InboxSize + 10 {
+			_ = server.Send(model.Message{Type: model.MessageTypeTest})
+		}
+		msg.Status = model.StatusSuccess
+		_ = server.Send(msg)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.SendReceive(ctx, model.Message{Type: model.MessageTypePing}); err != nil {
+		t.Fatalf("Expected the response past the full inbox, got %v", err)
+	}
+	if n := client.Dropped(); n != 10 {
+		t.Errorf("Expected 10 messages dropped, got %d", n)
+	}
+}
+
+// TestSendReceiveDeadlineShared checks that the deadline of a caller does not bound the write of its request,
+// which would close the connection under every other request in flight
+func TestSendReceiveDeadlineShared(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	server := NewHConn(s)
+	client := NewHConn(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.SendReceive(ctx, model.Message{Type: model.MessageTypeTest, String: "slow"})
+		done <- err
+	}()
+
+	// The pipe blocks the write until the server reads it, long after the deadline of the caller
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		for {
+			msg, err := server.Receive()
+			if err != nil {
+				return
+			}
+			if msg.String == "slow" {
+				continue
+			}
+			msg.Status = model.StatusSuccess
+			_ = server.Send(msg)
+		}
+	}()
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	resp, err := client.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: "next"})
+	if err != nil || resp.String != "next" {
+		t.Fatalf("Expected the connection to still be usable, got %+v: %v", resp, err)
+	}
+}
@@ -0,0 +1,362 @@
+package hconn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+// Requester is implemented by anything able to perform a request/response round trip,
+// generated entity helpers accept it so they work with a single HConn or a Pool
+type Requester interface {
+	SendReceive(ctx context.Context, msg model.Message) (model.Message, error)
+}
+
+type boundRequester struct {
+	ctx context.Context
+	r   Requester
+}
+
+// Bind returns a Requester sending every request of r with ctx, which lets the generated entity helpers
+// be cancelled or given a deadline: SampleV1.DbGetAll(hconn.Bind(ctx, c))
+func Bind(ctx context.Context, r Requester) Requester {
+	return boundRequester{ctx: ctx, r: r}
+}
+
+func (x boundRequester) SendReceive(_ context.Context, msg model.Message) (model.Message, error) {
+	return x.r.SendReceive(x.ctx, msg)
+}
+
+// Pin pins the Requester bound when it is a Pinner, the pinned one is bound to the same ctx
+func (x boundRequester) Pin() (Requester, func(error), error) {
+	p, ok := x.r.(Pinner)
+	if !ok {
+		return x, func(error) {}, nil
+	}
+	r, release, err := p.Pin()
+	if err != nil {
+		return nil, nil, err
+	}
+	return boundRequester{ctx: x.ctx, r: r}, release, nil
+}
+
+/*
+Pinner is implemented by the Requesters spreading requests over several connections, such as Pool.
+Pin returns a Requester sending every request over the same connection, which the requests reading a cursor need
+since cursors are kept per connection. release must be called once it is no longer used, with the transport error
+that broke the connection if any.
+*/
+type Pinner interface {
+	Pin() (r Requester, release func(err error), err error)
+}
+
+var (
+	_ Requester = (*HConn)(nil)
+	_ Requester = (*Pool)(nil)
+	_ Pinner    = (*Pool)(nil)
+	_ Pinner    = boundRequester{}
+)
+
+/*
+Pool keeps up to Size connections to the same node and spreads requests across them in round-robin.
+Connections are dialed lazily, a connection that fails a request or a health check ping is closed
+and its slot is dialed again the next time it is needed.
+- MaxIdle: connections without requests for longer than this are closed by the health check, 0 disables it
+- MaxLifetime: connections older than this are replaced once they have no requests in flight, 0 disables it
+- HealthCheckInterval: how often every open connection is pinged, 0 disables health checks
+*/
+type Pool struct {
+	Dial                func() (*HConn, error)
+	Size                int
+	MaxIdle             time.Duration
+	MaxLifetime         time.Duration
+	HealthCheckInterval time.Duration
+
+	mu     sync.Mutex
+	conns  []*pooledConn
+	next   int
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type pooledConn struct {
+	hc       *HConn
+	created  time.Time
+	lastUsed time.Time
+	inFlight int
+	retired  bool
+
+	// ready is closed once hc is dialed or err is set, the slot is reserved meanwhile, see connect
+	ready chan struct{}
+	err   error
+}
+
+func NewPool(dial func() (*HConn, error)) *Pool {
+	return &Pool{
+		Dial:                dial,
+		Size:                4,
+		HealthCheckInterval: IdleTimeout / 2,
+	}
+}
+
+func (x *Pool) WithSize(size int) *Pool {
+	x.Size = size
+	return x
+}
+
+func (x *Pool) WithMaxIdle(d time.Duration) *Pool {
+	x.MaxIdle = d
+	return x
+}
+
+func (x *Pool) WithMaxLifetime(d time.Duration) *Pool {
+	x.MaxLifetime = d
+	return x
+}
+
+func (x *Pool) WithHealthCheckInterval(d time.Duration) *Pool {
+	x.HealthCheckInterval = d
+	return x
+}
+
+// Start dials the first connection to fail fast on unreachable nodes and starts the health checks
+func (x *Pool) Start() error {
+	if x.Size < 1 {
+		x.Size = 1
+	}
+
+	pc := &pooledConn{ready: make(chan struct{})}
+	x.mu.Lock()
+	x.conns = make([]*pooledConn, x.Size)
+	x.conns[0] = pc
+	x.stop = make(chan struct{})
+	x.mu.Unlock()
+	x.connect(0, pc)
+	if pc.err != nil {
+		return pc.err
+	}
+
+	if x.HealthCheckInterval > 0 {
+		x.wg.Add(1)
+		go func() {
+			defer x.wg.Done()
+			x.runHealthChecks()
+		}()
+	}
+
+	return nil
+}
+
+// SendReceive performs the round trip on the next connection of the pool
+func (x *Pool) SendReceive(ctx context.Context, msg model.Message) (model.Message, error) {
+	pc, err := x.acquire()
+	if err != nil {
+		return model.Message{}, err
+	}
+
+	resp, err := pc.hc.SendReceive(ctx, msg)
+	// The connection is fine when the caller gave up
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		x.release(pc, nil)
+	} else {
+		x.release(pc, err)
+	}
+	return resp, err
+}
+
+// Pin returns the next connection of the pool, kept open until released, see Pinner
+func (x *Pool) Pin() (Requester, func(error), error) {
+	pc, err := x.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc.hc, func(err error) { x.release(pc, err) }, nil
+}
+
+// Len returns the amount of open connections
+func (x *Pool) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	n := 0
+	for _, pc := range x.conns {
+		if pc != nil && pc.hc != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close stops the health checks and closes every connection, requests in flight will fail
+func (x *Pool) Close() error {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil
+	}
+	x.closed = true
+	if x.stop != nil {
+		close(x.stop)
+	}
+
+	var err error
+	for i, pc := range x.conns {
+		if pc == nil {
+			continue
+		}
+		// Connections being dialed are closed by connect
+		if pc.hc != nil {
+			if e := pc.hc.Close(); e != nil {
+				err = e
+			}
+		}
+		x.conns[i] = nil
+	}
+	x.mu.Unlock()
+
+	x.wg.Wait()
+	return err
+}
+
+// acquire reserves the next slot under mu and dials it after unlocking when it is empty,
+// the requests reaching a slot being dialed wait for it instead of dialing again
+func (x *Pool) acquire() (*pooledConn, error) {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil, model.ErrPoolClosed
+	}
+	if x.conns == nil {
+		x.mu.Unlock()
+		return nil, model.ErrPoolNotStarted
+	}
+
+	i := x.next
+	x.next = (x.next + 1) % len(x.conns)
+
+	pc := x.conns[i]
+	if pc != nil && pc.hc != nil && x.MaxLifetime > 0 && time.Since(pc.created) > x.MaxLifetime {
+		x.retire(i)
+		pc = nil
+	}
+	empty := pc == nil
+	if empty {
+		pc = &pooledConn{ready: make(chan struct{})}
+		x.conns[i] = pc
+	}
+	pc.inFlight++
+	pc.lastUsed = time.Now()
+	x.mu.Unlock()
+
+	if empty {
+		x.connect(i, pc)
+	}
+	<-pc.ready
+	if pc.err != nil {
+		x.mu.Lock()
+		pc.inFlight--
+		x.mu.Unlock()
+		return nil, pc.err
+	}
+	return pc, nil
+}
+
+// connect dials pc reserved at slot i without holding mu, a failed dial frees the slot
+func (x *Pool) connect(i int, pc *pooledConn) {
+	hc, err := x.Dial()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	defer close(pc.ready)
+
+	if err == nil && x.closed {
+		_ = hc.Close()
+		err = model.ErrPoolClosed
+	}
+	if err != nil {
+		pc.err = err
+		if x.conns[i] == pc {
+			x.conns[i] = nil
+		}
+		return
+	}
+	now := time.Now()
+	pc.hc, pc.created, pc.lastUsed = hc, now, now
+}
+
+// release returns pc to the pool, a transport error means the connection is broken and it gets replaced
+func (x *Pool) release(pc *pooledConn, err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	pc.inFlight--
+	if err != nil && !pc.retired {
+		nabu.FromError(err).WithMessage("pool: replacing broken connection").Log()
+		for i, c := range x.conns {
+			if c == pc {
+				x.retire(i)
+			}
+		}
+	}
+	if pc.retired && pc.inFlight == 0 {
+		_ = pc.hc.Close()
+	}
+}
+
+// retire removes the connection at slot i, it is closed as soon as it has no requests in flight
+func (x *Pool) retire(i int) {
+	pc := x.conns[i]
+	x.conns[i] = nil
+	pc.retired = true
+	if pc.inFlight == 0 {
+		_ = pc.hc.Close()
+	}
+}
+
+func (x *Pool) runHealthChecks() {
+	ticker := time.NewTicker(x.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-x.stop:
+			return
+		case <-ticker.C:
+			x.healthCheck()
+		}
+	}
+}
+
+func (x *Pool) healthCheck() {
+	x.mu.Lock()
+	conns := make([]*pooledConn, 0, len(x.conns))
+	for i, pc := range x.conns {
+		if pc == nil || pc.hc == nil {
+			continue
+		}
+		if x.MaxIdle > 0 && pc.inFlight == 0 && time.Since(pc.lastUsed) > x.MaxIdle {
+			x.retire(i)
+			continue
+		}
+		pc.inFlight++
+		conns = append(conns, pc)
+	}
+	x.mu.Unlock()
+
+	for _, pc := range conns {
+		// A ping unanswered until the next check means the node is hung
+		ctx, cancel := context.WithTimeout(context.Background(), x.HealthCheckInterval)
+		resp, err := pc.hc.SendReceive(ctx, model.Message{Type: model.MessageTypePing})
+		cancel()
+		if err == nil && resp.Status != model.StatusSuccess {
+			err = model.ErrPoolPingFailed
+		}
+		x.release(pc, err)
+	}
+}
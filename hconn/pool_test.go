@@ -0,0 +1,286 @@
+package hconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+// pipeServer hands out net.Pipe connections whose server side echoes every message with StatusSuccess
+type pipeServer struct {
+	mu      sync.Mutex
+	servers []net.Conn
+	dials   int
+	refuse  bool
+}
+
+func (x *pipeServer) dial() (*HConn, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.refuse {
+		return nil, errors.New("connection refused")
+	}
+
+	client, server := net.Pipe()
+	x.dials++
+	x.servers = append(x.servers, server)
+
+	go func() {
+		hc := NewHConn(server)
+		for {
+			msg, err := hc.Receive()
+			if err != nil {
+				return
+			}
+			msg.Status = model.StatusSuccess
+			if err = hc.Send(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	return NewHConn(client), nil
+}
+
+func (x *pipeServer) dialCount() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.dials
+}
+
+func (x *pipeServer) closeAll() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, c := range x.servers {
+		c.Close()
+	}
+	x.servers = nil
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	ps := &pipeServer{}
+	p := NewPool(ps.dial).WithSize(3).WithHealthCheckInterval(0)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 9; i++ {
+		resp, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest, String: "Test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.String != "Test" {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+	}
+
+	if p.Len() != 3 {
+		t.Errorf("Expected 3 open connections, got %d", p.Len())
+	}
+	if ps.dialCount() != 3 {
+		t.Errorf("Expected 3 dials, got %d", ps.dialCount())
+	}
+}
+
+// TestPoolDialsOutsideLock checks that a slow dial holds up neither the other slots nor the requests waiting for it
+func TestPoolDialsOutsideLock(t *testing.T) {
+	ps := &pipeServer{}
+	dialing, gate := make(chan struct{}, 1), make(chan struct{})
+	var gated bool
+	p := NewPool(func() (*HConn, error) {
+		if gated {
+			dialing <- struct{}{}
+			<-gate
+		}
+		return ps.dial()
+	}).WithSize(2).WithHealthCheckInterval(0)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	send := func() error {
+		_, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest})
+		return err
+	}
+
+	// Slot 0 is open, the next request reaches the empty slot 1
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	gated = true
+	errs := make(chan error, 3)
+	go func() { errs <- send() }()
+	<-dialing
+
+	// Slot 0 answers while slot 1 is dialed, the request after it waits for the same dial
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { errs <- send() }()
+	select {
+	case err := <-errs:
+		t.Fatalf("Expected the requests of slot 1 to wait for its dial, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gate)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ps.dialCount() != 2 {
+		t.Errorf("Expected 2 dials, got %d", ps.dialCount())
+	}
+}
+
+func TestPoolNotStarted(t *testing.T) {
+	p := NewPool((&pipeServer{}).dial)
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); !errors.Is(err, model.ErrPoolNotStarted) {
+		t.Fatalf("Expected ErrPoolNotStarted, got %v", err)
+	}
+}
+
+func TestPoolReplacesBrokenConnection(t *testing.T) {
+	ps := &pipeServer{}
+	p := NewPool(ps.dial).WithSize(1).WithHealthCheckInterval(0)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ps.closeAll()
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err == nil {
+		t.Fatal("Expected error on broken connection, got none")
+	}
+
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err != nil {
+		t.Fatalf("Expected broken connection to be replaced, got: %v", err)
+	}
+	if ps.dialCount() != 2 {
+		t.Errorf("Expected 2 dials, got %d", ps.dialCount())
+	}
+}
+
+func TestPoolHealthCheckRemovesBrokenConnections(t *testing.T) {
+	ps := &pipeServer{}
+	p := NewPool(ps.dial).WithSize(2).WithHealthCheckInterval(20 * time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err != nil {
+		t.Fatal(err)
+	}
+
+	ps.closeAll()
+	time.Sleep(100 * time.Millisecond)
+
+	if p.Len() != 0 {
+		t.Errorf("Expected broken connections to be removed, %d still open", p.Len())
+	}
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err != nil {
+		t.Fatalf("Expected pool to recover, got: %v", err)
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	ps := &pipeServer{}
+	p := NewPool(ps.dial).
+		WithSize(2).
+		WithMaxIdle(30 * time.Millisecond).
+		WithHealthCheckInterval(10 * time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if p.Len() != 0 {
+		t.Errorf("Expected idle connections to be closed, %d still open", p.Len())
+	}
+}
+
+func TestPoolMaxLifetime(t *testing.T) {
+	ps := &pipeServer{}
+	p := NewPool(ps.dial).
+		WithSize(1).
+		WithMaxLifetime(20 * time.Millisecond).
+		WithHealthCheckInterval(0)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ps.dialCount() != 2 {
+		t.Errorf("Expected expired connection to be redialed, got %d dials", ps.dialCount())
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	ps := &pipeServer{}
+	p := NewPool(ps.dial).WithSize(2)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); !errors.Is(err, model.ErrPoolClosed) {
+		t.Errorf("Expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestPoolStartUnreachable(t *testing.T) {
+	ps := &pipeServer{refuse: true}
+	p := NewPool(ps.dial)
+	if err := p.Start(); err == nil {
+		t.Error("Expected error when node is unreachable, got none")
+	}
+}
+
+func TestPoolConcurrentSendReceive(t *testing.T) {
+	ps := &pipeServer{}
+	p := NewPool(ps.dial).WithSize(4).WithHealthCheckInterval(5 * time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTest}); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
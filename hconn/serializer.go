@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 )
 
+// Serializer is the gob Codec, it keeps the state of a gob stream so type information is only sent once
 type Serializer struct {
 	Buffer *bytes.Buffer
 	E      *gob.Encoder
@@ -20,6 +21,26 @@ func NewSerializer() *Serializer {
 	}
 }
 
+var _ Codec = (*Serializer)(nil)
+
+func (x *Serializer) Name() string {
+	return CodecGob
+}
+
+func (x *Serializer) Append(dst []byte, a any) ([]byte, error) {
+	defer x.Reset()
+	if err := x.Encode(a); err != nil {
+		return dst, err
+	}
+	return append(dst, x.GetData()...), nil
+}
+
+func (x *Serializer) Unmarshal(data []byte, a any) error {
+	defer x.Reset()
+	x.SetData(data)
+	return x.Decode(a)
+}
+
 func (x *Serializer) Encode(a any) error {
 	if err := x.E.Encode(a); err != nil {
 		return err
@@ -0,0 +1,86 @@
+package hconn
+
+import (
+	"context"
+	"errors"
+	"iter"
+
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/register"
+)
+
+/*
+Stream sends msg, a GetAll or Query carrying a model.Cursor, and yields the models of every chunk,
+fetching the next chunk only once the previous one was consumed.
+Breaking out of the loop cancels the stream and the cursor is closed on the node.
+Cursors are kept per connection, a Pinner such as Pool or a client is pinned to a single connection for the
+whole stream. The Entity of msg is repeated on every cursor request, the node checks it against the cursor.
+Every request is sent with ctx, except closing the cursor which must happen even if ctx is done.
+*/
+func Stream(ctx context.Context, c Requester, msg model.Message) iter.Seq2[register.Model, error] {
+	return func(yield func(register.Model, error) bool) {
+		entity := msg.Entity
+		entity.Data = nil
+
+		if p, ok := c.(Pinner); ok {
+			pinned, release, err := p.Pin()
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			var broken error
+			defer func() { release(broken) }()
+			c = recordBroken{r: pinned, broken: &broken}
+		}
+
+		resp, err := c.SendReceive(ctx, msg)
+		for {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if resp.Status != model.StatusSuccess {
+				yield(nil, errors.New(resp.String))
+				return
+			}
+
+			done := resp.Cursor == nil || resp.Cursor.Done
+			for _, m := range resp.Models {
+				if yield(m, nil) {
+					continue
+				}
+				if !done {
+					_, _ = c.SendReceive(context.WithoutCancel(ctx), model.Message{
+						Type:   model.MessageTypeCursorClose,
+						Entity: entity,
+						Cursor: &model.Cursor{Id: resp.Cursor.Id},
+					})
+				}
+				return
+			}
+			if done {
+				return
+			}
+
+			resp, err = c.SendReceive(ctx, model.Message{
+				Type:   model.MessageTypeCursorNext,
+				Entity: entity,
+				Cursor: &model.Cursor{Id: resp.Cursor.Id},
+			})
+		}
+	}
+}
+
+// recordBroken keeps the last transport error of r in broken, unless the caller gave up
+type recordBroken struct {
+	r      Requester
+	broken *error
+}
+
+func (x recordBroken) SendReceive(ctx context.Context, msg model.Message) (model.Message, error) {
+	resp, err := x.r.SendReceive(ctx, msg)
+	if err != nil && (ctx.Err() == nil || !errors.Is(err, ctx.Err())) {
+		*x.broken = err
+	}
+	return resp, err
+}
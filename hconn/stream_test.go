@@ -0,0 +1,122 @@
+package hconn_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	SampleV1 "github.com/rah-0/hyperion/entities/Sample/v1"
+	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/register"
+)
+
+// cursorNode answers like a node streaming total models in chunks of 3, and records the requests it got
+type cursorNode struct {
+	total    int
+	sent     int
+	requests []model.Message
+	closed   bool
+	fail     bool
+}
+
+func (x *cursorNode) SendReceive(_ context.Context, msg model.Message) (model.Message, error) {
+	x.requests = append(x.requests, msg)
+
+	resp := model.Message{Id: msg.Id, Status: model.StatusSuccess}
+	switch msg.Type {
+	case model.MessageTypeCursorClose:
+		x.closed = true
+		return resp, nil
+	case model.MessageTypeCursorNext:
+		if x.fail {
+			return model.Message{}, errors.New("connection lost")
+		}
+	}
+
+	n := min(3, x.total-x.sent)
+	for i := 0; i < n; i++ {
+		resp.Models = append(resp.Models, &SampleV1.Sample{})
+	}
+	x.sent += n
+	resp.Cursor = &model.Cursor{Id: 7, Size: 3, Done: x.sent == x.total}
+	return resp, nil
+}
+
+func getAll() model.Message {
+	return model.Message{
+		Type:   model.MessageTypeGetAll,
+		Entity: register.EntityBase{Name: SampleV1.Name, Version: SampleV1.Version},
+		Cursor: &model.Cursor{Size: 3},
+	}
+}
+
+// TestStreamAllChunks checks that every chunk is fetched and that the entity is repeated for routing
+func TestStreamAllChunks(t *testing.T) {
+	n := &cursorNode{total: 8}
+
+	count := 0
+	for _, err := range hconn.Stream(context.Background(), n, getAll()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+
+	if count != 8 {
+		t.Errorf("Expected 8 models, got %d", count)
+	}
+	if len(n.requests) != 3 {
+		t.Errorf("Expected 3 requests, got %d", len(n.requests))
+	}
+	for _, r := range n.requests[1:] {
+		if r.Type != model.MessageTypeCursorNext || r.Cursor.Id != 7 || r.Entity.Name != SampleV1.Name {
+			t.Errorf("Unexpected cursor request: %+v", r)
+		}
+	}
+	if n.closed {
+		t.Error("Exhausted cursor must not be closed explicitly")
+	}
+}
+
+// TestStreamCancel checks that breaking out of the loop stops fetching and closes the cursor
+func TestStreamCancel(t *testing.T) {
+	n := &cursorNode{total: 100}
+
+	count := 0
+	for _, err := range hconn.Stream(context.Background(), n, getAll()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+		if count == 4 {
+			break
+		}
+	}
+
+	if len(n.requests) != 3 {
+		t.Errorf("Expected 2 chunks and a close, got %d requests", len(n.requests))
+	}
+	if !n.closed {
+		t.Error("Expected cursor to be closed")
+	}
+}
+
+// TestStreamError checks that a failing chunk ends the stream with its error
+func TestStreamError(t *testing.T) {
+	n := &cursorNode{total: 100, fail: true}
+
+	count := 0
+	var last error
+	for _, err := range hconn.Stream(context.Background(), n, getAll()) {
+		if err != nil {
+			last = err
+			continue
+		}
+		count++
+	}
+
+	if count != 3 || last == nil {
+		t.Errorf("Expected first chunk then an error, got %d models and %v", count, last)
+	}
+}
@@ -0,0 +1,285 @@
+package index
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/rah-0/hyperion/register"
+)
+
+// maxLevel bounds the levels of the skip list, enough for 4^32 keys
+const maxLevel = 32
+
+/*
+Ordered keeps values by key in ascending order of compare, in a skip list, so that ranges of keys
+are read in order from either end without sorting. Values sharing a key are kept in the order they were added.
+It is not safe for concurrent use, generated entities guard it with their mutex.
+*/
+type Ordered[K any, V comparable] struct {
+	compare func(a, b K) int
+	head    *node[K, V] // Sentinel before the first key, with every level
+	tail    *node[K, V] // Last key, nil when empty
+	level   int
+	keys    int
+	values  int
+}
+
+type node[K any, V comparable] struct {
+	key    K
+	values []V
+	prev   *node[K, V] // Previous key, nil for the first one
+	next   []*node[K, V]
+}
+
+func NewOrdered[K any, V comparable](compare func(a, b K) int) *Ordered[K, V] {
+	return &Ordered[K, V]{
+		compare: compare,
+		head:    &node[K, V]{next: make([]*node[K, V], maxLevel)},
+		level:   1,
+	}
+}
+
+// Len returns how many values are kept
+func (x *Ordered[K, V]) Len() int {
+	return x.values
+}
+
+// Keys returns how many distinct keys are kept
+func (x *Ordered[K, V]) Keys() int {
+	return x.keys
+}
+
+func (x *Ordered[K, V]) Clear() {
+	clear(x.head.next)
+	x.tail = nil
+	x.level = 1
+	x.keys = 0
+	x.values = 0
+}
+
+func (x *Ordered[K, V]) Add(key K, value V) {
+	var update [maxLevel]*node[K, V]
+	if n := x.find(key, update[:]); n != nil {
+		n.values = append(n.values, value)
+		x.values++
+		return
+	}
+
+	level := randomLevel()
+	for l := x.level; l < level; l++ {
+		update[l] = x.head
+	}
+	x.level = max(x.level, level)
+
+	n := &node[K, V]{key: key, values: []V{value}, next: make([]*node[K, V], level)}
+	for l := range level {
+		n.next[l] = update[l].next[l]
+		update[l].next[l] = n
+	}
+	if update[0] != x.head {
+		n.prev = update[0]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	} else {
+		x.tail = n
+	}
+	x.keys++
+	x.values++
+}
+
+// Remove drops value from key, it returns false when it was not there
+func (x *Ordered[K, V]) Remove(key K, value V) bool {
+	var update [maxLevel]*node[K, V]
+	n := x.find(key, update[:])
+	if n == nil {
+		return false
+	}
+	i := slices.Index(n.values, value)
+	if i < 0 {
+		return false
+	}
+	n.values = slices.Delete(n.values, i, i+1)
+	x.values--
+	if len(n.values) > 0 {
+		return true
+	}
+
+	for l := range n.next {
+		update[l].next[l] = n.next[l]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n.prev
+	} else {
+		x.tail = n.prev
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+	x.keys--
+	return true
+}
+
+// Get returns the values of key
+func (x *Ordered[K, V]) Get(key K) []V {
+	if n := x.find(key, nil); n != nil {
+		return n.values
+	}
+	return nil
+}
+
+/*
+Scan calls yield with the values of every key within r, from the lowest key or from the highest with r.Desc,
+as long as yield returns true. The bounds of r must hold a K, and r.Prefix only applies when K is a string
+compared byte-wise. The values must not be modified nor kept beyond the call to yield.
+*/
+func (x *Ordered[K, V]) Scan(r register.Range, yield func(values []V) bool) {
+	lo, hi, ok := x.bounds(r)
+	if !ok {
+		return
+	}
+	prefix, hasPrefix := any(r.Prefix).(K)
+	hasPrefix = hasPrefix && r.Prefix != ""
+	if hasPrefix && (lo == nil || x.compare(prefix, lo.key) > 0) {
+		lo = &bound[K]{key: prefix}
+	}
+	inPrefix := func(key K) bool {
+		return !hasPrefix || strings.HasPrefix(any(key).(string), r.Prefix)
+	}
+
+	if r.Desc {
+		// Keys starting with the prefix follow the ones before it, so the last of them is the last key up to them
+		last := x.last(func(key K) bool {
+			return x.below(key, hi) && (inPrefix(key) || x.compare(key, prefix) < 0)
+		})
+		for n := last; n != nil && x.above(n.key, lo) && inPrefix(n.key); n = n.prev {
+			if !yield(n.values) {
+				return
+			}
+		}
+		return
+	}
+	first := x.last(func(key K) bool {
+		return !x.above(key, lo)
+	})
+	for n := x.after(first); n != nil && x.below(n.key, hi) && inPrefix(n.key); n = n.next[0] {
+		if !yield(n.values) {
+			return
+		}
+	}
+}
+
+/*
+Match calls yield with the values of every key for which match returns 0, in ascending order, as long as yield
+returns true. match must return a negative number for the keys before the ones matching and a positive one after,
+such as when comparing a prefix of the fields of composite keys.
+*/
+func (x *Ordered[K, V]) Match(match func(key K) int, yield func(values []V) bool) {
+	first := x.last(func(key K) bool {
+		return match(key) < 0
+	})
+	for n := x.after(first); n != nil && match(n.key) == 0; n = n.next[0] {
+		if !yield(n.values) {
+			return
+		}
+	}
+}
+
+// Count returns how many values are within r
+func (x *Ordered[K, V]) Count(r register.Range) int {
+	count := 0
+	x.Scan(r, func(values []V) bool {
+		count += len(values)
+		return true
+	})
+	return count
+}
+
+type bound[K any] struct {
+	key       K
+	exclusive bool
+}
+
+func (x *Ordered[K, V]) bounds(r register.Range) (lo *bound[K], hi *bound[K], ok bool) {
+	if r.From != nil {
+		k, ok := r.From.(K)
+		if !ok {
+			return nil, nil, false
+		}
+		lo = &bound[K]{key: k, exclusive: r.FromExclusive}
+	}
+	if r.To != nil {
+		k, ok := r.To.(K)
+		if !ok {
+			return nil, nil, false
+		}
+		hi = &bound[K]{key: k, exclusive: r.ToExclusive}
+	}
+	return lo, hi, true
+}
+
+func (x *Ordered[K, V]) above(key K, lo *bound[K]) bool {
+	if lo == nil {
+		return true
+	}
+	c := x.compare(key, lo.key)
+	return c > 0 || c == 0 && !lo.exclusive
+}
+
+func (x *Ordered[K, V]) below(key K, hi *bound[K]) bool {
+	if hi == nil {
+		return true
+	}
+	c := x.compare(key, hi.key)
+	return c < 0 || c == 0 && !hi.exclusive
+}
+
+// find fills update with the last node before key at every level, it returns the node of key if there is one
+func (x *Ordered[K, V]) find(key K, update []*node[K, V]) *node[K, V] {
+	n := x.head
+	for l := x.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && x.compare(n.next[l].key, key) < 0 {
+			n = n.next[l]
+		}
+		if update != nil {
+			update[l] = n
+		}
+	}
+	if next := n.next[0]; next != nil && x.compare(next.key, key) == 0 {
+		return next
+	}
+	return nil
+}
+
+// last returns the last node whose key satisfies before, nil if there is none.
+// before must hold for every key up to some key and for none after it.
+func (x *Ordered[K, V]) last(before func(key K) bool) *node[K, V] {
+	n := x.head
+	for l := x.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && before(n.next[l].key) {
+			n = n.next[l]
+		}
+	}
+	if n == x.head {
+		return nil
+	}
+	return n
+}
+
+// after returns the node following n, the first one when n is nil
+func (x *Ordered[K, V]) after(n *node[K, V]) *node[K, V] {
+	if n == nil {
+		return x.head.next[0]
+	}
+	return n.next[0]
+}
+
+// randomLevel returns 1 with a probability of 3/4, 2 with 3/16 and so on
+func randomLevel() int {
+	level := 1
+	for level < maxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	return level
+}
@@ -0,0 +1,211 @@
+package index
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rah-0/hyperion/register"
+)
+
+type entry struct {
+	key   int
+	value int
+}
+
+// reference returns the values of entries within r, ordered by key then by insertion
+func reference(entries []entry, r register.Range) []int {
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b entry) int { return cmp.Compare(a.key, b.key) })
+	var out []int
+	for _, e := range sorted {
+		if r.From != nil && (e.key < r.From.(int) || r.FromExclusive && e.key == r.From.(int)) {
+			continue
+		}
+		if r.To != nil && (e.key > r.To.(int) || r.ToExclusive && e.key == r.To.(int)) {
+			continue
+		}
+		out = append(out, e.value)
+	}
+	if r.Desc {
+		// Keys are reversed but the values sharing a key keep their order
+		var desc []int
+		for i := len(sorted) - 1; i >= 0; {
+			j := i
+			for j > 0 && sorted[j-1].key == sorted[i].key {
+				j--
+			}
+			for _, e := range sorted[j : i+1] {
+				if slices.Contains(out, e.value) {
+					desc = append(desc, e.value)
+				}
+			}
+			i = j - 1
+		}
+		out = desc
+	}
+	return out
+}
+
+func scan(o *Ordered[int, int], r register.Range) []int {
+	var out []int
+	o.Scan(r, func(values []int) bool {
+		out = append(out, values...)
+		return true
+	})
+	return out
+}
+
+func TestOrderedRandom(t *testing.T) {
+	o := NewOrdered[int, int](cmp.Compare[int])
+	var entries []entry
+	for i := range 2000 {
+		e := entry{key: rand.IntN(300), value: i}
+		o.Add(e.key, e.value)
+		entries = append(entries, e)
+	}
+	for range 500 {
+		i := rand.IntN(len(entries))
+		if !o.Remove(entries[i].key, entries[i].value) {
+			t.Fatalf("expected %v to be removed", entries[i])
+		}
+		entries = slices.Delete(entries, i, i+1)
+	}
+	if o.Len() != len(entries) {
+		t.Fatalf("expected %d values, got %d", len(entries), o.Len())
+	}
+
+	ranges := []register.Range{{}, {Desc: true}}
+	for range 200 {
+		lo, hi := rand.IntN(320)-10, rand.IntN(320)-10
+		ranges = append(ranges, register.Range{
+			From: lo, FromExclusive: rand.IntN(2) == 0,
+			To: hi, ToExclusive: rand.IntN(2) == 0,
+			Desc: rand.IntN(2) == 0,
+		})
+	}
+	ranges = append(ranges, register.Range{From: 150}, register.Range{To: 150, Desc: true})
+	for _, r := range ranges {
+		expected := reference(entries, r)
+		if got := scan(o, r); !slices.Equal(got, expected) {
+			t.Fatalf("range %+v: expected %v, got %v", r, expected, got)
+		}
+		if n := o.Count(r); n != len(expected) {
+			t.Fatalf("range %+v: expected a count of %d, got %d", r, len(expected), n)
+		}
+	}
+}
+
+func TestOrderedRemove(t *testing.T) {
+	o := NewOrdered[int, int](cmp.Compare[int])
+	o.Add(1, 10)
+	o.Add(1, 11)
+	o.Add(2, 20)
+
+	if o.Remove(1, 20) || o.Remove(3, 30) {
+		t.Fatal("expected missing values not to be removed")
+	}
+	if !o.Remove(1, 10) || !slices.Equal(o.Get(1), []int{11}) {
+		t.Fatalf("expected [11] left for 1, got %v", o.Get(1))
+	}
+	if !o.Remove(2, 20) || o.Keys() != 1 || o.Len() != 1 {
+		t.Fatalf("expected 1 key and 1 value left, got %d and %d", o.Keys(), o.Len())
+	}
+	if got := scan(o, register.Range{Desc: true}); !slices.Equal(got, []int{11}) {
+		t.Fatalf("expected the tail to be updated, got %v", got)
+	}
+
+	o.Clear()
+	if o.Len() != 0 || scan(o, register.Range{}) != nil {
+		t.Fatal("expected nothing after Clear")
+	}
+}
+
+func TestOrderedPrefix(t *testing.T) {
+	o := NewOrdered[string, int](strings.Compare)
+	keys := []string{"a", "ab", "abc", "abd", "ac", "b", "ba", ""}
+	for i, k := range keys {
+		o.Add(k, i)
+	}
+	collect := func(r register.Range) []int {
+		var out []int
+		o.Scan(r, func(values []int) bool {
+			out = append(out, values...)
+			return true
+		})
+		return out
+	}
+
+	cases := []struct {
+		name     string
+		r        register.Range
+		expected []int
+	}{
+		{"prefix", register.Range{Prefix: "ab"}, []int{1, 2, 3}},
+		{"prefix desc", register.Range{Prefix: "ab", Desc: true}, []int{3, 2, 1}},
+		{"prefix last keys desc", register.Range{Prefix: "b", Desc: true}, []int{6, 5}},
+		{"prefix missing", register.Range{Prefix: "z"}, nil},
+		{"prefix and bound", register.Range{Prefix: "ab", From: "abc", FromExclusive: true}, []int{3}},
+		{"prefix and upper bound desc", register.Range{Prefix: "a", To: "abc", Desc: true}, []int{2, 1, 0}},
+		{"empty prefix", register.Range{To: "a"}, []int{7, 0}},
+		{"mismatched bound", register.Range{From: 1}, nil},
+	}
+	for _, c := range cases {
+		if got := collect(c.r); !slices.Equal(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+
+	stopped := 0
+	o.Scan(register.Range{}, func(values []int) bool {
+		stopped++
+		return stopped < 3
+	})
+	if stopped != 3 {
+		t.Fatalf("expected the scan to stop after 3 keys, got %d", stopped)
+	}
+}
+
+func TestOrderedMatch(t *testing.T) {
+	type pair struct{ a, b int }
+	o := NewOrdered[pair, int](func(x, y pair) int {
+		if c := cmp.Compare(x.a, y.a); c != 0 {
+			return c
+		}
+		return cmp.Compare(x.b, y.b)
+	})
+	for i := range 50 {
+		o.Add(pair{i % 5, i % 7}, i)
+	}
+	prefix := func(a int) func(pair) int {
+		return func(k pair) int { return cmp.Compare(k.a, a) }
+	}
+
+	var got []int
+	o.Match(prefix(3), func(values []int) bool {
+		got = append(got, values...)
+		return true
+	})
+	var expected []int
+	for b := range 7 {
+		for i := range 50 {
+			if i%5 == 3 && i%7 == b {
+				expected = append(expected, i)
+			}
+		}
+	}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	got = nil
+	o.Match(prefix(9), func(values []int) bool {
+		got = append(got, values...)
+		return true
+	})
+	if got != nil {
+		t.Fatalf("expected nothing for a missing prefix, got %v", got)
+	}
+}
@@ -0,0 +1,744 @@
+package AccountV1
+
+// ---------------------------------------------------------------
+// The code in this file is autogenerated, do not modify manually!
+// ---------------------------------------------------------------
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"iter"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/query"
+	"github.com/rah-0/hyperion/register"
+)
+
+const (
+	Version    = "v1"
+	Name       = "Account"
+	DbFileName = "AccountV1.bin"
+)
+
+const (
+	FieldUuid    = 1
+	FieldDeleted = 2
+	FieldTenant  = 3
+	FieldLogin   = 4
+	FieldEmail   = 5
+)
+
+var FieldTypes = map[int]string{
+	FieldUuid:    "uuid.UUID",
+	FieldDeleted: "bool",
+	FieldTenant:  "string",
+	FieldLogin:   "string",
+	FieldEmail:   "string",
+}
+
+// Indexes holds the rows by value of the fields indexed, see the hyperion tag
+var Indexes = map[int]any{
+	FieldTenant: map[string][]*Account{},
+	FieldLogin:  map[string][]*Account{},
+	FieldEmail:  map[string][]*Account{},
+}
+
+// Ranges keeps the fields tagged index=range in order, for range filters and orders
+var Ranges = map[int]any{}
+
+// Unique constraints, the row holding every key
+var (
+	uniqueLogin = map[uniqueLoginKey]*Account{}
+	uniqueEmail = map[string]*Account{}
+)
+
+var (
+	_       register.Model = (*Account)(nil)
+	mu      sync.Mutex
+	Buffer  = new(bytes.Buffer)
+	Encoder = gob.NewEncoder(Buffer)
+	Decoder = gob.NewDecoder(Buffer)
+	// Codec encodes the data sent to nodes and stored on disk, gob by default.
+	// It must be set before Register and kept, data files written with another codec cannot be read.
+	Codec          hconn.Codec = &hconn.Serializer{Buffer: Buffer, E: Encoder, D: Decoder}
+	Mem            []*Account
+	IndexAccessors = map[int]register.IndexAccessor{}
+	Composites     []register.CompositeAccessor
+)
+
+func Register() error {
+	// Validate all FieldTypes have an operator set
+	for _, typ := range FieldTypes {
+		if _, ok := query.OperatorsRegistry[typ]; !ok {
+			return errors.New("missing operator set for field type: " + typ)
+		}
+	}
+
+	//The following process initializes the encoder and decoder by preloading metadata.
+	//This prevents metadata from being stored with the first encoded struct.
+	//If the metadata were missing or inconsistent, decoding the struct later could fail.
+	gob.Register(&Account{})
+	x := New()
+	if err := x.Encode(); err != nil {
+		return errors.New("failed to encode type metadata: " + err.Error())
+	}
+	if err := x.Decode(); err != nil {
+		return errors.New("failed to decode type metadata: " + err.Error())
+	}
+	x.BufferReset()
+
+	// IndexAccessors definitions, the fields without one are scanned
+	IndexAccessors[FieldTenant] = register.IndexAccessor{
+		GetByValue: func(val any) []register.Model {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldTenant].(map[string][]*Account)
+			v, ok := val.(string)
+			if !ok {
+				return nil
+			}
+			return CastToModel(idx[v])
+		},
+		CountByValue: func(val any) int {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldTenant].(map[string][]*Account)
+			v, ok := val.(string)
+			if !ok {
+				return 0
+			}
+			return len(idx[v])
+		},
+	}
+	IndexAccessors[FieldLogin] = register.IndexAccessor{
+		GetByValue: func(val any) []register.Model {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldLogin].(map[string][]*Account)
+			v, ok := val.(string)
+			if !ok {
+				return nil
+			}
+			return CastToModel(idx[v])
+		},
+		CountByValue: func(val any) int {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldLogin].(map[string][]*Account)
+			v, ok := val.(string)
+			if !ok {
+				return 0
+			}
+			return len(idx[v])
+		},
+	}
+	IndexAccessors[FieldEmail] = register.IndexAccessor{
+		GetByValue: func(val any) []register.Model {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldEmail].(map[string][]*Account)
+			v, ok := val.(string)
+			if !ok {
+				return nil
+			}
+			return CastToModel(idx[v])
+		},
+		CountByValue: func(val any) int {
+			mu.Lock()
+			defer mu.Unlock()
+			idx := Indexes[FieldEmail].(map[string][]*Account)
+			v, ok := val.(string)
+			if !ok {
+				return 0
+			}
+			return len(idx[v])
+		},
+	}
+
+	// Initializations
+	Mem = []*Account{}
+	register.RegisterEntity(
+		&register.EntityBase{
+			Version:    Version,
+			Name:       Name,
+			DbFileName: DbFileName,
+		}, &register.EntityExtension{
+			New:            New,
+			FieldTypes:     FieldTypes,
+			Indexes:        Indexes,
+			IndexAccessors: IndexAccessors,
+			Composites:     Composites,
+		},
+	)
+
+	return nil
+}
+
+type Account struct {
+	Uuid    uuid.UUID `json:",omitzero" hyperion:"noindex"`
+	Deleted bool      `json:",omitzero" hyperion:"noindex"`
+	Tenant  string    `hyperion:"unique=login"`
+	Login   string    `hyperion:"unique=login"`
+	Email   string    `hyperion:"unique"`
+}
+
+type uniqueLoginKey struct {
+	Tenant string
+	Login  string
+}
+
+func New() register.Model {
+	return &Account{}
+}
+
+func (s *Account) WithNewUuid() {
+	s.Uuid = uuid.New()
+}
+
+func (s *Account) SetUuid(uuid uuid.UUID) {
+	s.Uuid = uuid
+}
+
+func (s *Account) GetUuid() uuid.UUID {
+	return s.Uuid
+}
+
+func (s *Account) IsDeleted() bool {
+	return s.Deleted
+}
+
+func (s *Account) SetFieldValue(field int, value any) {
+	switch field {
+	case FieldUuid:
+		if v, ok := value.(uuid.UUID); ok {
+			s.Uuid = v
+		}
+	case FieldDeleted:
+		if v, ok := value.(bool); ok {
+			s.Deleted = v
+		}
+	case FieldTenant:
+		if v, ok := value.(string); ok {
+			s.Tenant = v
+		}
+	case FieldLogin:
+		if v, ok := value.(string); ok {
+			s.Login = v
+		}
+	case FieldEmail:
+		if v, ok := value.(string); ok {
+			s.Email = v
+		}
+	}
+}
+
+func (s *Account) GetFieldValue(field int) any {
+	switch field {
+	case FieldUuid:
+		return s.Uuid
+	case FieldDeleted:
+		return s.Deleted
+	case FieldTenant:
+		return s.Tenant
+	case FieldLogin:
+		return s.Login
+	case FieldEmail:
+		return s.Email
+	}
+	return nil
+}
+
+func (s *Account) Encode() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return Encoder.Encode(s)
+}
+
+func (s *Account) Decode() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return Decoder.Decode(s)
+}
+
+func (s *Account) EncodeData() ([]byte, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return Codec.Append(nil, s)
+}
+
+func (s *Account) DecodeData(data []byte) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return Codec.Unmarshal(data, s)
+}
+
+// AppendFields implements hconn.BinaryValue, fields are written in FieldX order
+func (s *Account) AppendFields(b []byte) ([]byte, error) {
+	b = hconn.AppendUuid(b, s.Uuid)
+	b = hconn.AppendBool(b, s.Deleted)
+	b = hconn.AppendString(b, s.Tenant)
+	b = hconn.AppendString(b, s.Login)
+	b = hconn.AppendString(b, s.Email)
+	return b, nil
+}
+
+// UnmarshalFields implements hconn.BinaryValue, fields are read in FieldX order
+func (s *Account) UnmarshalFields(data []byte) error {
+	r := hconn.NewBinaryReader(data)
+	s.Uuid = r.Uuid()
+	s.Deleted = r.Bool()
+	s.Tenant = r.String()
+	s.Login = r.String()
+	s.Email = r.String()
+	return r.Err()
+}
+
+func (s *Account) BufferReset() {
+	mu.Lock()
+	defer mu.Unlock()
+	Buffer.Reset()
+}
+
+func (s *Account) GetBuffer() *bytes.Buffer {
+	mu.Lock()
+	defer mu.Unlock()
+	return Buffer
+}
+
+func (s *Account) GetBufferData() []byte {
+	mu.Lock()
+	defer mu.Unlock()
+	return Buffer.Bytes()
+}
+
+func (s *Account) SetBufferData(data []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	Buffer.Write(data)
+}
+
+// checkUnique returns a model.ConstraintError when another row holds a unique key of s, mu must be held
+func (s *Account) checkUnique() error {
+	if other, ok := uniqueLogin[uniqueLoginKey{Tenant: s.Tenant, Login: s.Login}]; ok && other.Uuid != s.Uuid {
+		return &model.ConstraintError{Entity: Name, Constraint: "login", Fields: []string{"Tenant", "Login"}, Uuid: other.Uuid}
+	}
+	if other, ok := uniqueEmail[s.Email]; ok && other.Uuid != s.Uuid {
+		return &model.ConstraintError{Entity: Name, Constraint: "Email", Fields: []string{"Email"}, Uuid: other.Uuid}
+	}
+	return nil
+}
+
+// addUnique makes s the holder of its unique keys, mu must be held
+func (s *Account) addUnique() {
+	uniqueLogin[uniqueLoginKey{Tenant: s.Tenant, Login: s.Login}] = s
+	uniqueEmail[s.Email] = s
+}
+
+// removeUnique releases the unique keys held by s, mu must be held
+func (s *Account) removeUnique() {
+	if uniqueLogin[uniqueLoginKey{Tenant: s.Tenant, Login: s.Login}] == s {
+		delete(uniqueLogin, uniqueLoginKey{Tenant: s.Tenant, Login: s.Login})
+	}
+	if uniqueEmail[s.Email] == s {
+		delete(uniqueEmail, s.Email)
+	}
+}
+
+// MemoryCheck returns the model.ConstraintError MemoryAdd or MemoryUpdate would return for s, without holding it
+func (s *Account) MemoryCheck() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return s.checkUnique()
+}
+
+// MemoryAdd holds s, unless it breaks a unique constraint
+func (s *Account) MemoryAdd() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := s.checkUnique(); err != nil {
+		return err
+	}
+	Mem = append(Mem, s)
+	s.addUnique()
+
+	// Update indexes
+	indexTenant := Indexes[FieldTenant].(map[string][]*Account)
+	indexTenant[s.Tenant] = append(indexTenant[s.Tenant], s)
+	indexLogin := Indexes[FieldLogin].(map[string][]*Account)
+	indexLogin[s.Login] = append(indexLogin[s.Login], s)
+	indexEmail := Indexes[FieldEmail].(map[string][]*Account)
+	indexEmail[s.Email] = append(indexEmail[s.Email], s)
+	return nil
+}
+
+func (s *Account) MemoryRemove() {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, instance := range Mem {
+		if instance.Uuid != s.Uuid {
+			continue
+		}
+		lastIndex := len(Mem) - 1
+		Mem[i] = Mem[lastIndex]
+		Mem = Mem[:lastIndex]
+		instance.removeUnique()
+
+		// Remove from indexes with the values held, s may carry others such as Deleted
+		indexTenant := Indexes[FieldTenant].(map[string][]*Account)
+		indexTenant[instance.Tenant] = removeFromIndex(indexTenant[instance.Tenant], instance)
+		indexLogin := Indexes[FieldLogin].(map[string][]*Account)
+		indexLogin[instance.Login] = removeFromIndex(indexLogin[instance.Login], instance)
+		indexEmail := Indexes[FieldEmail].(map[string][]*Account)
+		indexEmail[instance.Email] = removeFromIndex(indexEmail[instance.Email], instance)
+		break
+	}
+}
+
+// MemoryUpdate replaces the row held with the Uuid of s, unless s breaks a unique constraint
+func (s *Account) MemoryUpdate() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i, old := range Mem {
+		if old.Uuid != s.Uuid {
+			continue
+		}
+		if err := s.checkUnique(); err != nil {
+			return err
+		}
+		old.removeUnique()
+		s.addUnique()
+
+		// Update indexes, the values that did not change must also point to s rather than old
+		indexTenant := Indexes[FieldTenant].(map[string][]*Account)
+		indexTenant[old.Tenant] = removeFromIndex(indexTenant[old.Tenant], old)
+		indexTenant[s.Tenant] = append(indexTenant[s.Tenant], s)
+		indexLogin := Indexes[FieldLogin].(map[string][]*Account)
+		indexLogin[old.Login] = removeFromIndex(indexLogin[old.Login], old)
+		indexLogin[s.Login] = append(indexLogin[s.Login], s)
+		indexEmail := Indexes[FieldEmail].(map[string][]*Account)
+		indexEmail[old.Email] = removeFromIndex(indexEmail[old.Email], old)
+		indexEmail[s.Email] = append(indexEmail[s.Email], s)
+
+		Mem[i] = s
+		break
+	}
+	return nil
+}
+
+func (s *Account) MemoryClear() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	Mem = []*Account{}
+	uniqueLogin = map[uniqueLoginKey]*Account{}
+	uniqueEmail = map[string]*Account{}
+
+	Indexes[FieldTenant] = map[string][]*Account{}
+	Indexes[FieldLogin] = map[string][]*Account{}
+	Indexes[FieldEmail] = map[string][]*Account{}
+}
+
+func (s *Account) MemoryGetAll() []register.Model {
+	mu.Lock()
+	defer mu.Unlock()
+	instances := make([]register.Model, len(Mem))
+	for i, instance := range Mem {
+		instances[i] = instance
+	}
+	return instances
+}
+
+func (s *Account) MemoryCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(Mem)
+}
+
+func (s *Account) MemoryContains(target register.Model) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	targetEntity, ok := target.(*Account)
+	if !ok {
+		return false
+	}
+
+	for _, instance := range Mem {
+		// If both UUIDs are nil/zero, fall back to pointer comparison
+		if instance.Uuid == uuid.Nil && targetEntity.Uuid == uuid.Nil {
+			if instance == targetEntity {
+				return true
+			}
+		} else if instance.Uuid == targetEntity.Uuid && instance.Uuid != uuid.Nil {
+			// For entities with actual UUIDs, compare by UUID
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Account) DbInsert(c hconn.Requester) error {
+	if s.Uuid == uuid.Nil {
+		s.WithNewUuid()
+	}
+	data, err := s.EncodeData()
+	if err != nil {
+		return err
+	}
+
+	msg := model.Message{
+		Type: model.MessageTypeInsert,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+			Data:    data,
+		},
+	}
+
+	resp, err := c.SendReceive(context.Background(), msg)
+	if err != nil {
+		return err
+	}
+	// A broken unique constraint is returned as a *model.ConstraintError
+	return resp.Err()
+}
+
+func (s *Account) DbDelete(c hconn.Requester) error {
+	s.Deleted = true
+	data, err := s.EncodeData()
+	if err != nil {
+		return err
+	}
+
+	msg := model.Message{
+		Type: model.MessageTypeDelete,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+			Data:    data,
+		},
+	}
+
+	resp, err := c.SendReceive(context.Background(), msg)
+	if err != nil {
+		return err
+	}
+	if resp.Status != model.StatusSuccess {
+		return errors.New(resp.String)
+	}
+
+	return nil
+}
+
+func DbDeleteAll(c hconn.Requester) error {
+	entities, err := DbGetAll(c)
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		if err := entity.DbDelete(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Account) DbUpdate(c hconn.Requester) error {
+	if s.Uuid == uuid.Nil {
+		return model.ErrQueryEntityNoUuid
+	}
+	data, err := s.EncodeData()
+	if err != nil {
+		return err
+	}
+
+	msg := model.Message{
+		Type: model.MessageTypeUpdate,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+			Data:    data,
+		},
+	}
+
+	resp, err := c.SendReceive(context.Background(), msg)
+	if err != nil {
+		return err
+	}
+	// A broken unique constraint is returned as a *model.ConstraintError
+	return resp.Err()
+}
+
+func DbGetAll(c hconn.Requester) ([]*Account, error) {
+	msg := model.Message{
+		Type: model.MessageTypeGetAll,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+	}
+
+	resp, err := c.SendReceive(context.Background(), msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != model.StatusSuccess {
+		return nil, errors.New(resp.String)
+	}
+
+	return CastToAccount(resp.Models), nil
+}
+
+func DbQuery(c hconn.Requester, q *query.Query) ([]*Account, error) {
+	msg := model.Message{
+		Type: model.MessageTypeQuery,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+		Query: q,
+	}
+
+	resp, err := c.SendReceive(context.Background(), msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != model.StatusSuccess {
+		return nil, errors.New(resp.String)
+	}
+
+	return CastToAccount(resp.Models), nil
+}
+
+// DbExplain returns how the node would answer q without running it
+func DbExplain(c hconn.Requester, q *query.Query) (query.Plan, error) {
+	msg := model.Message{
+		Type: model.MessageTypeExplain,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+		Query: q,
+	}
+
+	var plan query.Plan
+	resp, err := c.SendReceive(context.Background(), msg)
+	if err != nil {
+		return plan, err
+	}
+
+	if resp.Status != model.StatusSuccess {
+		return plan, errors.New(resp.String)
+	}
+
+	err = json.Unmarshal(resp.Bytes, &plan)
+	return plan, err
+}
+
+// DbGetAllIter streams every entity in chunks of chunkSize (0 uses the node default), breaking out of the loop cancels the stream
+func DbGetAllIter(c hconn.Requester, chunkSize int) iter.Seq2[*Account, error] {
+	msg := model.Message{
+		Type: model.MessageTypeGetAll,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+		Cursor: &model.Cursor{Size: chunkSize},
+	}
+
+	return castIter(hconn.Stream(context.Background(), c, msg))
+}
+
+// DbQueryIter streams the results of q in chunks of chunkSize (0 uses the node default), breaking out of the loop cancels the stream
+func DbQueryIter(c hconn.Requester, q *query.Query, chunkSize int) iter.Seq2[*Account, error] {
+	msg := model.Message{
+		Type: model.MessageTypeQuery,
+		Entity: register.EntityBase{
+			Version: Version,
+			Name:    Name,
+		},
+		Query:  q,
+		Cursor: &model.Cursor{Size: chunkSize},
+	}
+
+	return castIter(hconn.Stream(context.Background(), c, msg))
+}
+
+func castIter(seq iter.Seq2[register.Model, error]) iter.Seq2[*Account, error] {
+	return func(yield func(*Account, error) bool) {
+		for m, err := range seq {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(m.(*Account), nil) {
+				return
+			}
+		}
+	}
+}
+
+func CastToAccount(models []register.Model) []*Account {
+	out := make([]*Account, len(models))
+	for i, m := range models {
+		out[i] = m.(*Account)
+	}
+	return out
+}
+
+func CastToModel(items []*Account) []register.Model {
+	out := make([]register.Model, len(items))
+	for i, s := range items {
+		out[i] = s
+	}
+	return out
+}
+
+func removeFromIndex(list []*Account, target *Account) []*Account {
+	for i, item := range list {
+		if item.Uuid == target.Uuid {
+			last := len(list) - 1
+			list[i] = list[last]
+			return list[:last]
+		}
+	}
+	return list
+}
+
+func GetFullIndex(field int) []register.Model {
+	idx := Indexes[field]
+	if typed, ok := idx.(map[string][]*Account); ok {
+		var all []*Account
+		for _, list := range typed {
+			all = append(all, list...)
+		}
+		return CastToModel(all)
+	}
+	if typed, ok := idx.(map[string][]*Account); ok {
+		var all []*Account
+		for _, list := range typed {
+			all = append(all, list...)
+		}
+		return CastToModel(all)
+	}
+	if typed, ok := idx.(map[string][]*Account); ok {
+		var all []*Account
+		for _, list := range typed {
+			all = append(all, list...)
+		}
+		return CastToModel(all)
+	}
+	return nil
+}
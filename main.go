@@ -1,20 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/rah-0/nabu"
 	"github.com/rah-0/parsort"
 
+	"github.com/rah-0/hyperion/audit"
 	"github.com/rah-0/hyperion/config"
 	"github.com/rah-0/hyperion/node"
 	"github.com/rah-0/hyperion/profiler"
 	"github.com/rah-0/hyperion/template"
+	"github.com/rah-0/hyperion/trace"
 
 	"github.com/rah-0/hyperion/model"
 	"github.com/rah-0/hyperion/util"
@@ -28,8 +34,18 @@ func main() {
 	flag.BoolVar(&config.ProfilerEnabled, "profiler", false, "Enable profiler")
 	flag.StringVar(&config.ProfilerIP, "profiler-ip", "0.0.0.0", "IP to bind profiler (default: 0.0.0.0 if profiler enabled)")
 	flag.IntVar(&config.ProfilerPort, "profiler-port", 6060, "Port for profiler (default: 6060 if profiler enabled)")
+	// Auth flags
+	hash := flag.String("hash", "", "Print the hash of a secret read from stdin to store in the Auth config: password or token")
 	flag.Parse()
 
+	if *hash != "" {
+		if err := printHash(*hash); err != nil {
+			nabu.FromError(err).WithLevelFatal().Log()
+			os.Exit(1)
+		}
+		return
+	}
+
 	nabu.SetLogLevel(nabu.LevelDebug)
 	if 1 == 2 {
 		parsort.TuneSpecific(1000, 1000, 2000, -25, false)
@@ -170,12 +186,31 @@ func checkCurrentNode() (*node.Node, error) {
 	for _, nodeConfig := range config.Loaded.Nodes {
 		if nodeConfig.Host.Name == hostName {
 			n := node.NewNode().
+				WithClusterName(config.Loaded.ClusterName).
 				WithHost(nodeConfig.Host.Name, nodeConfig.Host.IP, nodeConfig.Host.Port).
-				WithPath(nodeConfig.Path.Data)
+				WithPath(nodeConfig.Path.Data).
+				WithTLS(nodeConfig.TLS).
+				WithAuth(config.Loaded.Auth).
+				WithLimits(nodeConfig.Limits).
+				WithTimeouts(nodeConfig.Timeouts).
+				WithSlowLog(nodeConfig.SlowLog).
+				WithStatusHTTP(nodeConfig.Status)
 
 			for _, e := range nodeConfig.Entities {
 				n.AddEntity(e.Name)
 			}
+			if nodeConfig.Audit.Path != "" {
+				l := audit.NewLog(nodeConfig.Audit.Path).WithMaxFiles(nodeConfig.Audit.MaxFiles)
+				if nodeConfig.Audit.MaxSize > 0 {
+					l.WithMaxSize(nodeConfig.Audit.MaxSize)
+				}
+				n.WithAudit(l)
+			}
+			t, err := newTracer(nodeConfig)
+			if err != nil {
+				return nil, err
+			}
+			n.WithTracer(t)
 
 			addNodePeers(n, config.Loaded)
 			return n, nil
@@ -185,6 +220,29 @@ func checkCurrentNode() (*node.Node, error) {
 	return nil, model.ErrConfigNodeNotFoundForHost
 }
 
+// newTracer returns the tracer of the node, nil when tracing is disabled
+func newTracer(nc config.Node) (*trace.Tracer, error) {
+	var e trace.Exporter
+	switch {
+	case nc.Tracing.Endpoint != "":
+		e = trace.NewOTLPExporter(nc.Tracing.Endpoint)
+	case nc.Tracing.File != "":
+		f, err := trace.NewFileExporter(nc.Tracing.File)
+		if err != nil {
+			return nil, err
+		}
+		e = f
+	default:
+		return nil, nil
+	}
+
+	t := trace.NewTracer(nc.Host.Name, e)
+	if nc.Tracing.SampleRatio > 0 {
+		t.WithSampleRatio(nc.Tracing.SampleRatio)
+	}
+	return t, nil
+}
+
 func addNodePeers(n *node.Node, c config.Config) {
 	for _, nc := range c.Nodes {
 		// Skip self
@@ -195,6 +253,7 @@ func addNodePeers(n *node.Node, c config.Config) {
 		}
 
 		peer := node.NewNode().
+			WithClusterName(c.ClusterName).
 			WithHost(nc.Host.Name, nc.Host.IP, nc.Host.Port).
 			WithPath(nc.Path.Data)
 
@@ -206,6 +265,29 @@ func addNodePeers(n *node.Node, c config.Config) {
 	}
 }
 
+// printHash reads a secret from the first line of stdin so that it does not end up in the shell history
+func printHash(kind string) error {
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+
+	switch kind {
+	case "password":
+		h, err := config.HashPassword(secret)
+		if err != nil {
+			return err
+		}
+		fmt.Println(h)
+	case "token":
+		fmt.Println(config.HashToken(secret))
+	default:
+		return errors.New("hash: unknown kind [" + kind + "], expected password or token")
+	}
+	return nil
+}
+
 func startProfilerIfEnabled() {
 	if config.ProfilerEnabled {
 		profiler.Start(config.ProfilerIP, config.ProfilerPort)
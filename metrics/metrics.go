@@ -0,0 +1,414 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds in seconds of latency histograms, from half a millisecond to 10 seconds
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Default is the registry exposed by Handler, packages register their metrics in it on init
+var Default = NewRegistry()
+
+/*
+Collector is a metric family written in the Prometheus text exposition format (version 0.0.4).
+Collectors sharing a name are written as a single family, which lets every node of a process expose
+its own series of the same metric, they must then have the same type and labels.
+*/
+type Collector interface {
+	desc() *desc
+	write(b *bytes.Buffer)
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+// Registry holds collectors in the order they were registered
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (x *Registry) Register(cs ...Collector) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.collectors = append(x.collectors, cs...)
+}
+
+func (x *Registry) Unregister(cs ...Collector) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.collectors = slices.DeleteFunc(x.collectors, func(c Collector) bool {
+		return slices.Contains(cs, c)
+	})
+}
+
+// Write returns every family in the text format, in the order their first collector was registered
+func (x *Registry) Write() []byte {
+	x.mu.Lock()
+	collectors := slices.Clone(x.collectors)
+	x.mu.Unlock()
+
+	var names []string
+	families := make(map[string][]Collector)
+	for _, c := range collectors {
+		name := c.desc().name
+		if _, ok := families[name]; !ok {
+			names = append(names, name)
+		}
+		families[name] = append(families[name], c)
+	}
+
+	var b bytes.Buffer
+	for _, name := range names {
+		d := families[name][0].desc()
+		b.WriteString("# HELP " + d.name + " " + escapeHelp(d.help) + "\n")
+		b.WriteString("# TYPE " + d.name + " " + d.kind + "\n")
+		for _, c := range families[name] {
+			c.write(&b)
+		}
+	}
+	return b.Bytes()
+}
+
+// Handler serves the metrics of x to Prometheus scrapes
+func (x *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(x.Write())
+	})
+}
+
+func Register(cs ...Collector) {
+	Default.Register(cs...)
+}
+
+func Unregister(cs ...Collector) {
+	Default.Unregister(cs...)
+}
+
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// vec keeps the series of a metric by their label values
+type vec[T any] struct {
+	d      desc
+	newT   func() *T
+	mu     sync.RWMutex
+	series map[string]*T
+	values map[string][]string
+}
+
+func newVec[T any](d desc, newT func() *T) *vec[T] {
+	v := &vec[T]{
+		d:      d,
+		newT:   newT,
+		series: make(map[string]*T),
+		values: make(map[string][]string),
+	}
+	// A metric without labels has a single series, it is exposed before its first use
+	if len(d.labels) == 0 {
+		v.with()
+	}
+	return v
+}
+
+func (x *vec[T]) desc() *desc {
+	return &x.d
+}
+
+// with returns the series of the label values, which must be as many as the labels of the metric
+func (x *vec[T]) with(values ...string) *T {
+	if len(values) != len(x.d.labels) {
+		panic("metrics: " + x.d.name + " expects " + strconv.Itoa(len(x.d.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+
+	x.mu.RLock()
+	s, ok := x.series[key]
+	x.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if s, ok = x.series[key]; !ok {
+		s = x.newT()
+		x.series[key] = s
+		x.values[key] = slices.Clone(values)
+	}
+	return s
+}
+
+// each calls f with every series sorted by label values so that scrapes are stable
+func (x *vec[T]) each(f func(values []string, s *T)) {
+	x.mu.RLock()
+	keys := make([]string, 0, len(x.series))
+	for k := range x.series {
+		keys = append(keys, k)
+	}
+	x.mu.RUnlock()
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		x.mu.RLock()
+		s, values := x.series[k], x.values[k]
+		x.mu.RUnlock()
+		f(values, s)
+	}
+}
+
+// value is a float64 updated atomically
+type value struct {
+	bits atomic.Uint64
+}
+
+func (x *value) add(v float64) {
+	for {
+		old := x.bits.Load()
+		if x.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (x *value) get() float64 {
+	return math.Float64frombits(x.bits.Load())
+}
+
+type Counter struct {
+	v value
+}
+
+// Add increases the counter, negative values are ignored since counters only go up
+func (x *Counter) Add(v float64) {
+	if v > 0 {
+		x.v.add(v)
+	}
+}
+
+func (x *Counter) Inc() {
+	x.v.add(1)
+}
+
+func (x *Counter) Value() float64 {
+	return x.v.get()
+}
+
+type CounterVec struct {
+	*vec[Counter]
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(desc{name: name, help: help, kind: "counter", labels: labels}, func() *Counter {
+		return &Counter{}
+	})}
+}
+
+func (x *CounterVec) With(values ...string) *Counter {
+	return x.with(values...)
+}
+
+func (x *CounterVec) write(b *bytes.Buffer) {
+	x.each(func(values []string, c *Counter) {
+		writeSample(b, x.d.name, x.d.labels, values, "", "", c.Value())
+	})
+}
+
+type Gauge struct {
+	v value
+}
+
+func (x *Gauge) Set(v float64) {
+	x.v.bits.Store(math.Float64bits(v))
+}
+
+func (x *Gauge) Add(v float64) {
+	x.v.add(v)
+}
+
+func (x *Gauge) Inc() {
+	x.v.add(1)
+}
+
+func (x *Gauge) Dec() {
+	x.v.add(-1)
+}
+
+func (x *Gauge) Value() float64 {
+	return x.v.get()
+}
+
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(desc{name: name, help: help, kind: "gauge", labels: labels}, func() *Gauge {
+		return &Gauge{}
+	})}
+}
+
+func (x *GaugeVec) With(values ...string) *Gauge {
+	return x.with(values...)
+}
+
+func (x *GaugeVec) write(b *bytes.Buffer) {
+	x.each(func(values []string, g *Gauge) {
+		writeSample(b, x.d.name, x.d.labels, values, "", "", g.Value())
+	})
+}
+
+// Histogram counts observations in cumulative buckets, as Prometheus expects them
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // Per bucket, not cumulative, the last one is +Inf
+	sum     float64
+	count   uint64
+}
+
+func (x *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(x.buckets, v)
+	x.mu.Lock()
+	x.counts[i]++
+	x.sum += v
+	x.count++
+	x.mu.Unlock()
+}
+
+// Count returns how many values were observed
+func (x *Histogram) Count() uint64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.count
+}
+
+type HistogramVec struct {
+	*vec[Histogram]
+	buckets []float64
+}
+
+// NewHistogramVec creates a histogram with buckets sorted by their upper bound, +Inf is implied
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &HistogramVec{
+		vec: newVec(desc{name: name, help: help, kind: "histogram", labels: labels}, func() *Histogram {
+			return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+		}),
+		buckets: buckets,
+	}
+}
+
+func (x *HistogramVec) With(values ...string) *Histogram {
+	return x.with(values...)
+}
+
+func (x *HistogramVec) write(b *bytes.Buffer) {
+	x.each(func(values []string, h *Histogram) {
+		h.mu.Lock()
+		counts, sum, count := slices.Clone(h.counts), h.sum, h.count
+		h.mu.Unlock()
+
+		var cumulative uint64
+		for i, le := range x.buckets {
+			cumulative += counts[i]
+			writeSample(b, x.d.name+"_bucket", x.d.labels, values, "le", formatFloat(le), float64(cumulative))
+		}
+		writeSample(b, x.d.name+"_bucket", x.d.labels, values, "le", "+Inf", float64(count))
+		writeSample(b, x.d.name+"_sum", x.d.labels, values, "", "", sum)
+		writeSample(b, x.d.name+"_count", x.d.labels, values, "", "", float64(count))
+	})
+}
+
+// GaugeFunc computes its series on every scrape, for values already kept elsewhere
+type GaugeFunc struct {
+	d       desc
+	collect func(emit func(v float64, values ...string))
+}
+
+// NewGaugeFunc creates a gauge whose collect calls emit once per series with the values of labels
+func NewGaugeFunc(name string, help string, labels []string, collect func(emit func(v float64, values ...string))) *GaugeFunc {
+	return &GaugeFunc{d: desc{name: name, help: help, kind: "gauge", labels: labels}, collect: collect}
+}
+
+func (x *GaugeFunc) desc() *desc {
+	return &x.d
+}
+
+func (x *GaugeFunc) write(b *bytes.Buffer) {
+	x.collect(func(v float64, values ...string) {
+		writeSample(b, x.d.name, x.d.labels, values, "", "", v)
+	})
+}
+
+// writeSample writes a line of the text format, extra is an additional label such as the le of buckets
+func writeSample(b *bytes.Buffer, name string, labels []string, values []string, extra string, extraValue string, v float64) {
+	b.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			b.WriteString(l + `="` + escapeLabel(value) + `"`)
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(extra + `="` + extraValue + `"`)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	t.Helper()
+	for _, l := range lines {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("Expected line [%s] in:\n%s", l, out)
+		}
+	}
+}
+
+// TestRegistryWrite checks the text format of every kind of metric
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := NewCounterVec("requests_total", "Requests by type", "type")
+	open := NewGaugeVec("open", "Open things")
+	latency := NewHistogramVec("latency_seconds", "Latency", []float64{1, 0.1}, "type")
+	rows := NewGaugeFunc("rows", "Rows", []string{"entity"}, func(emit func(float64, ...string)) {
+		emit(3, `Sa"m\ple`)
+	})
+	r.Register(requests, open, latency, rows)
+
+	requests.With("insert").Inc()
+	requests.With("insert").Add(2)
+	requests.With("insert").Add(-1)
+	requests.With("query").Inc()
+	open.With().Set(4)
+	open.With().Dec()
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		latency.With("query").Observe(v)
+	}
+
+	expectLines(t, string(r.Write()),
+		"# HELP requests_total Requests by type",
+		"# TYPE requests_total counter",
+		`requests_total{type="insert"} 3`,
+		`requests_total{type="query"} 1`,
+		"# TYPE open gauge",
+		"open 3",
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{type="query",le="0.1"} 2`,
+		`latency_seconds_bucket{type="query",le="1"} 3`,
+		`latency_seconds_bucket{type="query",le="+Inf"} 4`,
+		`latency_seconds_sum{type="query"} 2.65`,
+		`latency_seconds_count{type="query"} 4`,
+		`rows{entity="Sa\"m\\ple"} 3`,
+	)
+}
+
+// TestRegistryFamilies checks that collectors sharing a name are written as one family and can be unregistered
+func TestRegistryFamilies(t *testing.T) {
+	r := NewRegistry()
+	node := func(name string) *GaugeFunc {
+		return NewGaugeFunc("rows", "Rows", []string{"node"}, func(emit func(float64, ...string)) {
+			emit(1, name)
+		})
+	}
+	a, b := node("a"), node("b")
+	r.Register(a, b)
+
+	out := string(r.Write())
+	if strings.Count(out, "# TYPE rows") != 1 {
+		t.Errorf("Expected a single family, got:\n%s", out)
+	}
+	expectLines(t, out, `rows{node="a"} 1`, `rows{node="b"} 1`)
+
+	r.Unregister(a)
+	out = string(r.Write())
+	if strings.Contains(out, `node="a"`) || !strings.Contains(out, `node="b"`) {
+		t.Errorf("Expected only b after unregistering a, got:\n%s", out)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounterVec("hits_total", "Hits")
+	r.Register(c)
+	c.With().Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Result().Body)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type: %s", w.Header().Get("Content-Type"))
+	}
+	expectLines(t, string(body), "hits_total 1")
+}
@@ -0,0 +1,36 @@
+package model
+
+// Action is a permission granted by a role over an entity
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionDelete Action = "delete"
+	// ActionAdmin grants every other action
+	ActionAdmin Action = "admin"
+)
+
+// Credentials are sent by clients in the handshake, either a Token or a User with its Password
+type Credentials struct {
+	User     string
+	Password string
+	Token    string
+}
+
+// Action returns the permission required to send a message of type x, empty when any authenticated client may send it
+func (x MessageType) Action() Action {
+	switch x {
+	case MessageTypePing, MessageTypeTest, MessageTypeTopology:
+		return ""
+	case MessageTypeInsert, MessageTypeUpdate:
+		return ActionWrite
+	case MessageTypeDelete:
+		return ActionDelete
+	case MessageTypeGetAll, MessageTypeQuery, MessageTypeCursorNext, MessageTypeCursorClose, MessageTypeExplain:
+		return ActionRead
+	default:
+		// Types added later stay restricted until they are given an action
+		return ActionAdmin
+	}
+}
@@ -6,16 +6,17 @@ import (
 
 var (
 	// GlobalStructFields are the fields that are added to all Entities
-	// Uuid and Deleted cannot be removed, only [Tag] can be modified
+	// Uuid and Deleted cannot be removed, only [Tag] can be modified.
+	// They are not indexed, filters on them scan the rows.
 	GlobalStructFields = []util.StructField{
 		{
 			Name: "Uuid",
 			Type: "uuid.UUID",
-			Tag:  "`json:\",omitzero\"`",
+			Tag:  "`json:\",omitzero\" hyperion:\"noindex\"`",
 		}, {
 			Name: "Deleted",
 			Type: "bool",
-			Tag:  "`json:\",omitzero\"`",
+			Tag:  "`json:\",omitzero\" hyperion:\"noindex\"`",
 		},
 	}
 )
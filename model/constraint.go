@@ -0,0 +1,24 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ConstraintError is returned by writes giving a row the key of a unique constraint held by another row,
+// it matches ErrConstraintUnique with errors.Is
+type ConstraintError struct {
+	Entity     string
+	Constraint string
+	Fields     []string
+	Uuid       uuid.UUID // Row holding the key
+}
+
+func (x *ConstraintError) Error() string {
+	return ErrConstraintUnique.Error() + ": " + x.Entity + "." + x.Constraint + " (" + strings.Join(x.Fields, ", ") + ") by " + x.Uuid.String()
+}
+
+func (x *ConstraintError) Unwrap() error {
+	return ErrConstraintUnique
+}
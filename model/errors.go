@@ -6,11 +6,52 @@ import (
 
 var (
 	ErrGeneratorStructNotFound = errors.New("generator: struct not found")
+	ErrGeneratorTagInvalid     = errors.New("generator: invalid hyperion tag")
 
-	ErrMessageEmpty = errors.New("message: is empty")
+	ErrMessageEmpty    = errors.New("message: is empty")
+	ErrMessageTooLarge = errors.New("message: exceeds max message size")
+
+	ErrConnectionIdle = errors.New("connection: idle for too long")
+
+	ErrHandshakeRefused  = errors.New("handshake: refused by peer")
+	ErrHandshakeInvalid  = errors.New("handshake: invalid frame")
+	ErrHandshakeVersion  = errors.New("handshake: no common protocol version")
+	ErrHandshakeCluster  = errors.New("handshake: cluster name mismatch")
+	ErrHandshakeCodec    = errors.New("handshake: no common codec")
+	ErrHandshakeIdentity = errors.New("handshake: TLS certificate does not match the node name")
+
+	ErrAuthRequired  = errors.New("auth: credentials required")
+	ErrAuthFailed    = errors.New("auth: invalid credentials")
+	ErrAuthForbidden = errors.New("auth: permission denied")
+
+	ErrAuditClosed = errors.New("audit: log is closed")
+
+	ErrTraceExport = errors.New("trace: collector rejected the spans")
+
+	ErrLimitConnections = errors.New("limit: too many connections")
+	ErrLimitRate        = errors.New("limit: request rate exceeded")
+	ErrLimitInFlight    = errors.New("limit: too many requests in flight")
+
+	ErrCodecUnsupported  = errors.New("codec: value not supported")
+	ErrCodecShortData    = errors.New("codec: unexpected end of data")
+	ErrCodecTrailingData = errors.New("codec: unexpected data after last field")
+
+	ErrDiskClosed = errors.New("disk: file is closed")
+
+	ErrClientNoNodes      = errors.New("client: no known node for the request")
+	ErrClientRedirectLoop = errors.New("client: too many redirects")
+
+	ErrCursorNotFound = errors.New("cursor: not found or expired")
+
+	ErrPoolClosed     = errors.New("pool: is closed")
+	ErrPoolNotStarted = errors.New("pool: is not started")
+	ErrPoolPingFailed = errors.New("pool: health check ping failed")
 
 	ErrConfigNodesNotFound       = errors.New("GlobalConfig: node list is empty")
 	ErrConfigNodeNotFoundForHost = errors.New("GlobalConfig: node not found for current hostname")
+	ErrConfigTLSNoCertificate    = errors.New("GlobalConfig: TLS requires a certificate and key")
+	ErrConfigTLSInvalidCA        = errors.New("GlobalConfig: TLS CA file has no PEM certificates")
+	ErrConfigAuthInvalidHash     = errors.New("GlobalConfig: invalid password hash")
 
 	ErrPathConfigNoContent    = errors.New("pathConfig: GlobalConfig file is empty")
 	ErrPathConfigNotSpecified = errors.New("pathConfig: not specified in either command line argument or environment variable")
@@ -21,6 +62,9 @@ var (
 	ErrQueryEntityNoUuid                = errors.New("query: entity has no uuid")
 	ErrQueryEntityFieldNotFound         = errors.New("query: entity field not found")
 	ErrQueryEntityFieldOperatorNotFound = errors.New("query: operator not found for given field")
+	ErrQueryFilterInvalid               = errors.New("query: invalid filter")
+
+	ErrConstraintUnique = errors.New("constraint: unique key already held")
 
 	// Node-related errors
 	ErrNodeShutdown = errors.New("node: is shutting down, cannot process new messages")
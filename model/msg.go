@@ -1,6 +1,9 @@
 package model
 
 import (
+	"encoding/json"
+	"errors"
+
 	"github.com/rah-0/hyperion/query"
 	"github.com/rah-0/hyperion/register"
 )
@@ -16,6 +19,14 @@ const (
 	MessageTypeUpdate
 	MessageTypeGetAll
 	MessageTypeQuery
+	// MessageTypeTopology asks a node for the cluster config as it knows it, returned as JSON in Bytes
+	MessageTypeTopology
+	// MessageTypeCursorNext asks for the next chunk of a streamed GetAll or Query, see Cursor
+	MessageTypeCursorNext
+	// MessageTypeCursorClose drops a cursor before it is exhausted
+	MessageTypeCursorClose
+	// MessageTypeExplain asks how a Query would be answered without running it, the query.Plan is returned as JSON in Bytes
+	MessageTypeExplain
 )
 
 type Status int
@@ -23,9 +34,57 @@ type Status int
 const (
 	StatusSuccess Status = iota
 	StatusError
+	// StatusShutdown means the node refused the request because it is shutting down, retry on another node
+	StatusShutdown
+	// StatusRedirect means the node does not hold the entity, String contains the address of a node that does
+	StatusRedirect
+	// StatusThrottled means the node refused the request because a limit was reached, back off before retrying
+	StatusThrottled
+	// StatusConflict means the write was refused because it breaks a unique constraint, Bytes holds the ConstraintError as JSON
+	StatusConflict
 )
 
+var messageTypeNames = map[MessageType]string{
+	MessageTypeUndefined:   "undefined",
+	MessageTypePing:        "ping",
+	MessageTypeTest:        "test",
+	MessageTypeInsert:      "insert",
+	MessageTypeDelete:      "delete",
+	MessageTypeUpdate:      "update",
+	MessageTypeGetAll:      "getAll",
+	MessageTypeQuery:       "query",
+	MessageTypeTopology:    "topology",
+	MessageTypeCursorNext:  "cursorNext",
+	MessageTypeCursorClose: "cursorClose",
+	MessageTypeExplain:     "explain",
+}
+
+func (x MessageType) String() string {
+	if name, ok := messageTypeNames[x]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+var statusNames = map[Status]string{
+	StatusSuccess:   "success",
+	StatusError:     "error",
+	StatusShutdown:  "shutdown",
+	StatusRedirect:  "redirect",
+	StatusThrottled: "throttled",
+	StatusConflict:  "conflict",
+}
+
+func (x Status) String() string {
+	if name, ok := statusNames[x]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 type Message struct {
+	// Id correlates a response with its request, 0 means the message is not correlated
+	Id     uint64
 	Type   MessageType
 	Status Status
 	String string
@@ -33,6 +92,25 @@ type Message struct {
 	Entity register.EntityBase
 	Models []register.Model
 	Query  *query.Query
+	Cursor *Cursor
+	Trace  *Trace
+}
+
+// Trace propagates the span of the sender, the receiver records its spans as children of it
+type Trace struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+}
+
+/*
+Cursor streams the results of GetAll and Query in chunks instead of a single message.
+A request carrying a Cursor with a Size gets the first chunk and the Id of the cursor kept by the node,
+the next chunks are fetched with MessageTypeCursorNext until the node answers with Done.
+*/
+type Cursor struct {
+	Id   uint64
+	Size int  // Max amount of models per chunk
+	Done bool // Set by the node on the last chunk, the cursor no longer exists
 }
 
 func (x *Message) Error(errMsg string) *Message {
@@ -40,3 +118,42 @@ func (x *Message) Error(errMsg string) *Message {
 	x.String = errMsg
 	return x
 }
+
+func (x *Message) Shutdown(errMsg string) *Message {
+	x.Status = StatusShutdown
+	x.String = errMsg
+	return x
+}
+
+func (x *Message) Throttled(errMsg string) *Message {
+	x.Status = StatusThrottled
+	x.String = errMsg
+	return x
+}
+
+func (x *Message) Redirect(address string) *Message {
+	x.Status = StatusRedirect
+	x.String = address
+	return x
+}
+
+func (x *Message) Conflict(err *ConstraintError) *Message {
+	x.Status = StatusConflict
+	x.String = err.Error()
+	x.Bytes, _ = json.Marshal(err)
+	return x
+}
+
+// Err returns the error of a response, nil on success and a *ConstraintError on StatusConflict
+func (x *Message) Err() error {
+	switch x.Status {
+	case StatusSuccess:
+		return nil
+	case StatusConflict:
+		var err ConstraintError
+		if json.Unmarshal(x.Bytes, &err) == nil {
+			return &err
+		}
+	}
+	return errors.New(x.String)
+}
@@ -0,0 +1,47 @@
+package node
+
+import (
+	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/audit"
+	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/register"
+)
+
+// auditRequest records mutating requests once answered, including the refused ones, when the audit log is enabled.
+// entity is the one decoded from msgIn by handleMessage, nil for the requests refused before being handled.
+func (x *Node) auditRequest(hc *hconn.HConn, a *access, msgIn model.Message, msgOut model.Message, entity register.Model) {
+	op := audit.Operation(msgIn.Type)
+	if x.Audit == nil || op == "" {
+		return
+	}
+
+	r := audit.Record{
+		User:      a.name(),
+		Remote:    hc.C.RemoteAddr().String(),
+		Operation: op,
+		Entity:    msgIn.Entity.Name,
+		Version:   msgIn.Entity.Version,
+		Status:    msgOut.Status,
+	}
+	if msgOut.Status != model.StatusSuccess {
+		r.Error = msgOut.String
+	}
+	// The uuid is only known by decoding the entity, which fails for requests refused because of their data
+	if entity == nil {
+		if e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name); e != nil {
+			m := e.Memory.EntityExtension.New()
+			if err := m.DecodeData(msgIn.Entity.Data); err == nil {
+				entity = m
+			}
+		}
+	}
+	if entity != nil {
+		r.Uuid = entity.GetUuid()
+	}
+
+	if err := x.Audit.Write(r); err != nil {
+		x.reportError(nabu.FromError(err).WithArgs(r).Log())
+	}
+}
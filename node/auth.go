@@ -0,0 +1,80 @@
+package node
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/config"
+	"github.com/rah-0/hyperion/hconn"
+	"github.com/rah-0/hyperion/model"
+)
+
+// access is what the client of a connection may do, nil when authentication is disabled
+type access struct {
+	user        string
+	permissions []config.Permission
+}
+
+// authenticate runs during the handshake of every accepted connection, peers verified by mTLS are trusted as admins
+func (x *Node) authenticate(hc *hconn.HConn, remote hconn.Hello) (*access, error) {
+	if !x.Auth.Enabled() {
+		return nil, nil
+	}
+
+	if c, ok := hc.C.(*tls.Conn); ok && remote.NodeName != "" && len(c.ConnectionState().PeerCertificates) > 0 {
+		// The handshake already checked that the certificate was issued for NodeName
+		return &access{
+			user:        "node " + remote.NodeName,
+			permissions: []config.Permission{{Entity: "*", Actions: []model.Action{model.ActionAdmin}}},
+		}, nil
+	}
+
+	if remote.Credentials == nil {
+		return nil, model.ErrAuthRequired
+	}
+	u, err := x.Auth.Authenticate(*remote.Credentials)
+	if err != nil {
+		if errors.Is(err, model.ErrConfigAuthInvalidHash) {
+			nabu.FromError(err).WithArgs(u.Name).Log()
+		}
+		// Clients are not told whether the user exists
+		if !errors.Is(err, model.ErrAuthRequired) {
+			err = model.ErrAuthFailed
+		}
+		return nil, err
+	}
+
+	return &access{user: u.Name, permissions: x.Auth.Permissions(u)}, nil
+}
+
+// authorize checks that the client may send msg, the action required depends on its type
+func (x *access) authorize(msg model.Message) error {
+	if x == nil {
+		return nil
+	}
+	action := msg.Type.Action()
+	if action == "" {
+		return nil
+	}
+
+	for _, p := range x.permissions {
+		if p.Entity != "*" && p.Entity != msg.Entity.Name {
+			continue
+		}
+		if slices.Contains(p.Actions, action) || slices.Contains(p.Actions, model.ActionAdmin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: user [%s] cannot [%s] entity [%s]", model.ErrAuthForbidden, x.user, action, msg.Entity.Name)
+}
+
+func (x *access) name() string {
+	if x == nil {
+		return ""
+	}
+	return x.user
+}
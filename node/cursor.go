@@ -0,0 +1,137 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/register"
+)
+
+var (
+	// CursorTimeout is how long a cursor is kept without being read before it is dropped
+	CursorTimeout = 60 * time.Second
+	// DefaultChunkSize is used when a streamed request does not set the size of its chunks
+	DefaultChunkSize = 1000
+	// MaxChunkSize bounds the chunks no matter what the client asks for
+	MaxChunkSize = 10000
+)
+
+/*
+cursors holds the results of streamed GetAll and Query requests of a connection until they are read or expire:
+- ids are only valid on the connection that opened them, which closes its cursors when it ends
+- the cursors abandoned by their clients are swept on a timer armed while any is open
+*/
+type cursors struct {
+	mu     sync.Mutex
+	nextId uint64
+	open   map[uint64]*cursor
+	sweep  *time.Timer
+}
+
+type cursor struct {
+	// entity is the one the cursor was opened on, permissions are checked against it on every chunk
+	entity   string
+	models   []register.Model
+	size     int
+	lastUsed time.Time
+}
+
+// start keeps models of entity behind a new cursor unless they fit in a single chunk, and writes the first chunk to msgOut
+func (x *cursors) start(entity string, models []register.Model, size int, msgOut *model.Message) {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	size = min(size, MaxChunkSize)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	c := &cursor{entity: entity, models: models, size: size}
+	x.nextId++
+	msgOut.Cursor = &model.Cursor{Id: x.nextId, Size: size}
+	if !c.chunk(msgOut) {
+		if x.open == nil {
+			x.open = make(map[uint64]*cursor)
+		}
+		x.open[x.nextId] = c
+		x.schedule()
+	}
+}
+
+// next writes the next chunk of the cursor to msgOut, the cursor is dropped after its last chunk.
+// A cursor of another entity is not found, so that reading it requires the same permission as opening it.
+func (x *cursors) next(id uint64, entity string, msgOut *model.Message) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.expire()
+
+	c, ok := x.open[id]
+	if !ok || c.entity != entity {
+		return model.ErrCursorNotFound
+	}
+
+	msgOut.Cursor = &model.Cursor{Id: id, Size: c.size}
+	if c.chunk(msgOut) {
+		delete(x.open, id)
+	}
+	return nil
+}
+
+func (x *cursors) close(id uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.open, id)
+}
+
+func (x *cursors) closeAll() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.open = nil
+	if x.sweep != nil {
+		x.sweep.Stop()
+		x.sweep = nil
+	}
+}
+
+func (x *cursors) len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.open)
+}
+
+// expire drops the cursors abandoned by their clients, it must be called with mu held
+func (x *cursors) expire() {
+	for id, c := range x.open {
+		if time.Since(c.lastUsed) > CursorTimeout {
+			delete(x.open, id)
+		}
+	}
+}
+
+// schedule arms the sweep unless it already is, it must be called with mu held
+func (x *cursors) schedule() {
+	if x.sweep != nil {
+		return
+	}
+	x.sweep = time.AfterFunc(CursorTimeout, func() {
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		x.sweep = nil
+		x.expire()
+		if len(x.open) > 0 {
+			x.schedule()
+		}
+	})
+}
+
+// chunk moves the next chunk of models to msgOut and reports whether it was the last one
+func (x *cursor) chunk(msgOut *model.Message) bool {
+	n := min(x.size, len(x.models))
+	msgOut.Models = x.models[:n:n]
+	x.models = x.models[n:]
+	x.lastUsed = time.Now()
+
+	msgOut.Cursor.Done = len(x.models) == 0
+	return msgOut.Cursor.Done
+}
@@ -1,106 +1,183 @@
 package node
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/rah-0/parsort"
 
 	"github.com/rah-0/hyperion/model"
 	"github.com/rah-0/hyperion/query"
 	"github.com/rah-0/hyperion/register"
+	"github.com/rah-0/hyperion/trace"
 	"github.com/rah-0/hyperion/util"
 )
 
-type ResultType int
-
-const (
-	ResultTypeAll ResultType = iota
-	ResultTypeIntersect
-	ResultTypeUnion
-)
+// parallelFilterRows is the amount of rows from which filters are evaluated concurrently
+const parallelFilterRows = 10000
 
 func (x *EntityStorage) HandleQuery(q *query.Query) ([]register.Model, error) {
-	if q == nil {
-		return nil, model.ErrQueryNil
+	results, _, err := x.handleQuery(q, nil)
+	return results, err
+}
+
+// ExplainQuery returns how q would be answered without running it
+func (x *EntityStorage) ExplainQuery(q *query.Query) (query.Plan, error) {
+	plan, _, err := x.planQuery(q, true)
+	return plan, err
+}
+
+/*
+write stores entity inserted, updated or deleted, data being its encoding, on disk then in memory:
+- a row breaking a unique constraint is refused with a *model.ConstraintError before anything is written
+- a failed disk write leaves memory as it was, so the rows held always are the ones on disk
+Writes are serialized so that the constraints checked still hold once the row is held in memory.
+*/
+func (x *EntityStorage) write(t model.MessageType, entity register.Model, data []byte, span *trace.Span) error {
+	x.writeMu.Lock()
+	defer x.writeMu.Unlock()
+
+	if t != model.MessageTypeDelete {
+		if err := entity.MemoryCheck(); err != nil {
+			return err
+		}
 	}
 
-	var results []register.Model
-	fieldTypes := x.Memory.EntityExtension.FieldTypes
-	indexAccessors := x.Memory.EntityExtension.IndexAccessors
+	write := span.Child("disk write").Set("bytes", strconv.Itoa(len(data)))
+	if err := x.Disk.DataWrite(data); err != nil {
+		write.Fail(err).Finish()
+		return err
+	}
+	write.Finish()
+
+	switch t {
+	case model.MessageTypeInsert:
+		return entity.MemoryAdd()
+	case model.MessageTypeUpdate:
+		return entity.MemoryUpdate()
+	default:
+		entity.MemoryRemove()
+		return nil
+	}
+}
 
-	hasFilters := q.Filters.Type != query.FilterTypeUndefined
-	filters := q.Filters.Filters
-	filterType := q.Filters.Type
+// handleQuery returns how the query was answered along with the results,
+// the index lookup, filter and sort steps are recorded as children of span
+func (x *EntityStorage) handleQuery(q *query.Query, span *trace.Span) ([]register.Model, query.Plan, error) {
+	plan, ex, err := x.planQuery(q, false)
+	if err != nil {
+		return nil, plan, err
+	}
 
-	hasLimit := q.Limit > 0
-	limit := q.Limit
+	fieldTypes := x.Memory.EntityExtension.FieldTypes
 
-	hasOrders := len(q.Orders) > 0
-	if hasOrders {
-		if err := checkOrders(q, fieldTypes); err != nil {
-			return nil, err
+	var results []register.Model
+	start := time.Now()
+	lookup := span.Child("index lookup")
+	switch {
+	case ex.walk != nil:
+		// The filters are evaluated while reading the range, so that the limit stops it
+		var read int
+		results, read = x.walkRange(q, ex.walk, ex.filters, plan.Ordered)
+		plan.Indexes[0].Rows = read
+		if ex.filters != nil {
+			plan.Scanned = read
 		}
+	case ex.lookup != nil:
+		var rows []int
+		results = ex.lookup.find(x.Memory.EntityExtension, &rows)
+		for i, n := range rows {
+			plan.Indexes[i].Rows = n
+		}
+	default:
+		results = x.Memory.EntityExtension.New().MemoryGetAll()
 	}
+	plan.Lookup = time.Since(start)
+	lookup.Set("indexes", strconv.Itoa(len(plan.Indexes))).Set("rows", strconv.Itoa(len(results))).Finish()
 
-	var sets [][]register.Model
-	rt := ResultTypeAll
-	if hasFilters {
-		if filterType == query.FilterTypeAnd {
-			for _, f := range filters {
-				if f.Op == query.OperatorTypeEqual {
-					sets = append(sets, indexAccessors[f.Field].GetByValue(f.Value))
-					rt = ResultTypeIntersect
-				}
-			}
-		} else if filterType == query.FilterTypeOr {
-			for _, f := range filters {
-				if f.Op == query.OperatorTypeEqual {
-					sets = append(sets, indexAccessors[f.Field].GetByValue(f.Value))
-					rt = ResultTypeUnion
-				}
-			}
-		}
+	if ex.filters != nil && ex.walk == nil {
+		start = time.Now()
+		filter := span.Child("filter")
+		plan.Scanned = len(results)
+		plan.Parallel = len(results) >= parallelFilterRows
+		results = filterModels(results, *ex.filters, fieldTypes)
+		plan.Filter = time.Since(start)
+		filter.Set("rows", strconv.Itoa(len(results))).Finish()
 	}
-	if rt == ResultTypeIntersect {
-		results = intersectSets(sets)
-	} else if rt == ResultTypeUnion {
-		results = unionSets(sets)
-	} else if rt == ResultTypeAll {
-		results = x.Memory.EntityExtension.New().MemoryGetAll()
-		if hasFilters {
-			results = filterModels(results, filters, fieldTypes, filterType)
-		}
+
+	if len(q.Orders) > 0 && !plan.Ordered {
+		start = time.Now()
+		plan.Sorted = len(results)
+		sort := span.Child("sort").Set("rows", strconv.Itoa(len(results)))
+		parsort.StructAsc(results, orderLess(q.Orders, fieldTypes))
+		plan.Sort = time.Since(start)
+		sort.Finish()
 	}
 
-	if hasOrders {
-		parsort.StructAsc(results, func(a, b register.Model) bool {
-			for _, o := range q.Orders {
-				ft := fieldTypes[o.Field]
-				va := a.GetFieldValue(o.Field)
-				vb := b.GetFieldValue(o.Field)
-
-				switch o.Type {
-				case query.OrderTypeAsc:
-					ok, _ := query.EvaluateOperation(query.OperatorTypeLessThan, ft, va, vb)
-					eq, _ := query.EvaluateOperation(query.OperatorTypeEqual, ft, va, vb)
-					if !eq {
-						return ok
-					}
-				case query.OrderTypeDesc:
-					ok, _ := query.EvaluateOperation(query.OperatorTypeGreaterThan, ft, va, vb)
-					eq, _ := query.EvaluateOperation(query.OperatorTypeEqual, ft, va, vb)
-					if !eq {
-						return ok
-					}
-				}
-			}
-			return false
-		})
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
 	}
 
-	if hasLimit && len(results) > limit {
-		results = results[:limit]
+	plan.Results = len(results)
+	return results, plan, nil
+}
+
+/*
+walkRange returns the rows of w matching filters along with how many rows were read. The rows come in the order
+of the index when ordered, the rows sharing a value sorted by the next orders, and the read stops once the limit
+is reached, which it also does without orders.
+*/
+func (x *EntityStorage) walkRange(q *query.Query, w *rangeLookup, filters *query.Filters, ordered bool) ([]register.Model, int) {
+	fieldTypes := x.Memory.EntityExtension.FieldTypes
+	early := q.Limit > 0 && (ordered || len(q.Orders) == 0)
+	var less func(a, b register.Model) bool
+	if ordered && len(q.Orders) > 1 {
+		less = orderLess(q.Orders[1:], fieldTypes)
 	}
 
-	return results, nil
+	var results []register.Model
+	read := 0
+	x.Memory.EntityExtension.IndexAccessors[w.field].Scan(w.r, func(models []register.Model) bool {
+		read += len(models)
+		n := len(results)
+		for _, m := range models {
+			if filters == nil || matchModel(m, *filters, fieldTypes) {
+				results = append(results, m)
+			}
+		}
+		if less != nil && len(results)-n > 1 {
+			parsort.StructAsc(results[n:], less)
+		}
+		return !early || len(results) < q.Limit
+	})
+	return results, read
+}
+
+// orderLess returns whether a comes before b by orders
+func orderLess(orders []query.Order, fieldTypes map[int]string) func(a, b register.Model) bool {
+	return func(a, b register.Model) bool {
+		for _, o := range orders {
+			ft := fieldTypes[o.Field]
+			va := a.GetFieldValue(o.Field)
+			vb := b.GetFieldValue(o.Field)
+
+			switch o.Type {
+			case query.OrderTypeAsc:
+				ok, _ := query.EvaluateOperation(query.OperatorTypeLessThan, ft, va, vb)
+				eq, _ := query.EvaluateOperation(query.OperatorTypeEqual, ft, va, vb)
+				if !eq {
+					return ok
+				}
+			case query.OrderTypeDesc:
+				ok, _ := query.EvaluateOperation(query.OperatorTypeGreaterThan, ft, va, vb)
+				eq, _ := query.EvaluateOperation(query.OperatorTypeEqual, ft, va, vb)
+				if !eq {
+					return ok
+				}
+			}
+		}
+		return false
+	}
 }
 
 func checkOrders(q *query.Query, fieldTypes map[int]string) error {
@@ -160,49 +237,24 @@ func unionSets(sets [][]register.Model) []register.Model {
 	return out
 }
 
-func filterModels(models []register.Model, filters []query.Filter, fieldTypes map[int]string, ft query.FilterType) []register.Model {
+func filterModels(models []register.Model, filters query.Filters, fieldTypes map[int]string) []register.Model {
 	var out []register.Model
 
-	if len(models) < 10000 {
+	if len(models) < parallelFilterRows {
 		for _, m := range models {
-			if matchModel(m, filters, fieldTypes, ft) {
+			if matchModel(m, filters, fieldTypes) {
 				out = append(out, m)
 			}
 		}
 	} else {
 		out = util.ParallelFilter(models, func(m register.Model) bool {
-			return matchModel(m, filters, fieldTypes, ft)
+			return matchModel(m, filters, fieldTypes)
 		})
 	}
 
 	return out
 }
 
-func matchModel(m register.Model, filters []query.Filter, fieldTypes map[int]string, qft query.FilterType) bool {
-	switch qft {
-	case query.FilterTypeOr:
-		for _, f := range filters {
-			a := m.GetFieldValue(f.Field)
-			b := f.Value
-			ok, _ := query.EvaluateOperation(f.Op, fieldTypes[f.Field], a, b)
-			if ok {
-				return true
-			}
-		}
-		return false
-
-	case query.FilterTypeAnd:
-		for _, f := range filters {
-			a := m.GetFieldValue(f.Field)
-			b := f.Value
-			ok, _ := query.EvaluateOperation(f.Op, fieldTypes[f.Field], a, b)
-			if !ok {
-				return false
-			}
-		}
-		return true
-
-	default:
-		return false
-	}
+func matchModel(m register.Model, filters query.Filters, fieldTypes map[int]string) bool {
+	return filters.Match(fieldTypes, m.GetFieldValue)
 }
@@ -0,0 +1,205 @@
+package node
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rah-0/hyperion/config"
+	"github.com/rah-0/hyperion/model"
+)
+
+// clientPruneInterval is how often the buckets of clients gone quiet are dropped
+var clientPruneInterval = time.Minute
+
+/*
+limiter enforces config.NodeLimits, a nil limiter allows everything.
+Connections beyond MaxConnections are refused in the handshake, requests beyond the rate of their connection
+or client, or arriving while MaxInFlight requests are processed, are answered with model.StatusThrottled.
+Pings are never limited so that a busy node is not mistaken for a dead one.
+*/
+type limiter struct {
+	config config.NodeLimits
+	slots  chan struct{} // Requests in flight, nil without MaxInFlight
+
+	mu          sync.Mutex
+	connections int
+	clients     map[string]*bucket
+	nextPrune   time.Time
+}
+
+func newLimiter(c config.NodeLimits) *limiter {
+	x := &limiter{
+		config:  c,
+		clients: make(map[string]*bucket),
+	}
+	if c.MaxInFlight > 0 {
+		x.slots = make(chan struct{}, c.MaxInFlight)
+	}
+	return x
+}
+
+// admit reserves a connection, every admitted connection must be released
+func (x *limiter) admit() bool {
+	if x == nil || x.config.MaxConnections <= 0 {
+		return true
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.connections >= x.config.MaxConnections {
+		return false
+	}
+	x.connections++
+	return true
+}
+
+func (x *limiter) release() {
+	if x == nil || x.config.MaxConnections <= 0 {
+		return
+	}
+	x.mu.Lock()
+	x.connections--
+	x.mu.Unlock()
+}
+
+// connection returns the bucket limiting the requests of a single connection, nil when unlimited
+func (x *limiter) connection() *bucket {
+	if x == nil || x.config.ConnectionRate <= 0 {
+		return nil
+	}
+	return newBucket(x.config.ConnectionRate, x.config.ConnectionBurst)
+}
+
+// client returns the bucket shared by every connection of the client, identified by its user or else its IP.
+// Every connection using it must leave it when closed.
+func (x *limiter) client(user string, remote net.Addr) *bucket {
+	if x == nil || x.config.ClientRate <= 0 {
+		return nil
+	}
+	key := user
+	if key == "" {
+		key = remote.String()
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	now := time.Now()
+	if now.After(x.nextPrune) {
+		x.prune(now)
+		x.nextPrune = now.Add(clientPruneInterval)
+	}
+	b, ok := x.clients[key]
+	if !ok {
+		b = newBucket(x.config.ClientRate, x.config.ClientBurst)
+		x.clients[key] = b
+	}
+	b.conns++
+	return b
+}
+
+func (x *limiter) leave(b *bucket) {
+	if b == nil {
+		return
+	}
+	x.mu.Lock()
+	b.conns--
+	x.mu.Unlock()
+}
+
+// prune drops the buckets of clients without connections refilled since their last use,
+// they behave as new ones, it must be called with mu held
+func (x *limiter) prune(now time.Time) {
+	for key, b := range x.clients {
+		if b.conns == 0 && b.idle(now) {
+			delete(x.clients, key)
+		}
+	}
+}
+
+// begin checks the rates of a request of type t and takes an in-flight slot, end must be called when it succeeds
+func (x *limiter) begin(t model.MessageType, conn *bucket, client *bucket) error {
+	if t == model.MessageTypePing {
+		return nil
+	}
+	if !allow(conn, client) {
+		return model.ErrLimitRate
+	}
+	if x == nil || x.slots == nil {
+		return nil
+	}
+	select {
+	case x.slots <- struct{}{}:
+		return nil
+	default:
+		return model.ErrLimitInFlight
+	}
+}
+
+func (x *limiter) end(t model.MessageType) {
+	if t == model.MessageTypePing || x == nil || x.slots == nil {
+		return
+	}
+	<-x.slots
+}
+
+// bucket is a token bucket refilled at rate tokens per second up to burst, a nil bucket allows everything
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	conns  int // Connections sharing the bucket, guarded by the mu of the limiter
+}
+
+// newBucket starts full, a burst lower than 1 defaults to one second worth of tokens
+func newBucket(rate float64, burst int) *bucket {
+	b := float64(burst)
+	if burst < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &bucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// allow takes a token from every bucket only when none of them is empty, so that a request refused by one
+// does not spend the tokens of the others. The buckets are locked in order, connection buckets before shared ones.
+func allow(buckets ...*bucket) bool {
+	now := time.Now()
+	var held []*bucket
+	defer func() {
+		for _, b := range held {
+			b.mu.Unlock()
+		}
+	}()
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+		held = append(held, b)
+		b.refill(now)
+		if b.tokens < 1 {
+			return false
+		}
+	}
+	for _, b := range held {
+		b.tokens--
+	}
+	return true
+}
+
+// refill adds the tokens earned since the last refill, it must be called with mu held
+func (x *bucket) refill(now time.Time) {
+	x.tokens = math.Min(x.burst, x.tokens+now.Sub(x.last).Seconds()*x.rate)
+	x.last = now
+}
+
+func (x *bucket) idle(now time.Time) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.tokens+now.Sub(x.last).Seconds()*x.rate >= x.burst
+}
@@ -0,0 +1,81 @@
+package node
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rah-0/hyperion/metrics"
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/trace"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("hyperion_requests_total",
+		"Requests answered by a node by message type, entity and status", "node", "type", "entity", "status")
+	requestDuration = metrics.NewHistogramVec("hyperion_request_duration_seconds",
+		"Time to handle the requests accepted by a node by message type and entity", metrics.DefaultBuckets, "node", "type", "entity")
+	connectionsActive = metrics.NewGaugeVec("hyperion_connections_active",
+		"Connections accepted by a node that are open", "node")
+)
+
+func init() {
+	metrics.Register(requestsTotal, requestDuration, connectionsActive)
+}
+
+// observeRequest records a request once answered in the metrics and finishes its span,
+// elapsed is 0 for requests refused before being handled
+func (x *Node) observeRequest(span *trace.Span, msgIn model.Message, msgOut model.Message, elapsed time.Duration) {
+	entity := x.entityLabel(msgIn.Entity.Name)
+	requestsTotal.With(x.Host.Name, msgIn.Type.String(), entity, msgOut.Status.String()).Inc()
+	if elapsed > 0 {
+		requestDuration.With(x.Host.Name, msgIn.Type.String(), entity).Observe(elapsed.Seconds())
+	}
+
+	span.Set("status", msgOut.Status.String())
+	if msgOut.Status == model.StatusError || msgOut.Status == model.StatusThrottled || msgOut.Status == model.StatusConflict {
+		span.Fail(errors.New(msgOut.String))
+	}
+	span.Finish()
+}
+
+// entityLabel keeps the names sent by clients out of the labels unless the node holds them,
+// otherwise every made up name would create new series
+func (x *Node) entityLabel(name string) string {
+	for _, e := range x.Entities {
+		if e.Name == name {
+			return name
+		}
+	}
+	return ""
+}
+
+// newCollectors returns the metrics read from the state of the node on every scrape,
+// they are registered by Start and unregistered by Shutdown
+func (x *Node) newCollectors() []metrics.Collector {
+	rows := metrics.NewGaugeFunc("hyperion_entity_rows", "Rows of an entity held in memory",
+		[]string{"node", "entity", "version"}, func(emit func(float64, ...string)) {
+			for _, e := range x.entityStatuses() {
+				emit(float64(e.Rows), x.Host.Name, e.Name, e.Version)
+			}
+		})
+
+	fileSize := metrics.NewGaugeFunc("hyperion_disk_file_bytes", "Size of the data file of an entity",
+		[]string{"node", "entity", "version"}, func(emit func(float64, ...string)) {
+			for _, e := range x.entityStatuses() {
+				emit(float64(e.Size), x.Host.Name, e.Name, e.Version)
+			}
+		})
+
+	peers := metrics.NewGaugeFunc("hyperion_peer_connected", "Whether the connection of a node to a peer is up, 1 or 0",
+		[]string{"node", "peer"}, func(emit func(float64, ...string)) {
+			for _, p := range x.peerStatuses() {
+				v := 0.0
+				if p.Connected {
+					v = 1
+				}
+				emit(v, x.Host.Name, p.Name)
+			}
+		})
+
+	return []metrics.Collector{rows, fileSize, peers}
+}
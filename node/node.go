@@ -1,8 +1,13 @@
 package node
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -12,10 +17,14 @@ import (
 
 	"github.com/rah-0/nabu"
 
+	"github.com/rah-0/hyperion/audit"
+	"github.com/rah-0/hyperion/config"
 	"github.com/rah-0/hyperion/disk"
+	"github.com/rah-0/hyperion/metrics"
 	"github.com/rah-0/hyperion/model"
 	"github.com/rah-0/hyperion/register"
 	"github.com/rah-0/hyperion/template"
+	"github.com/rah-0/hyperion/trace"
 	"github.com/rah-0/hyperion/util"
 )
 
@@ -28,11 +37,22 @@ const (
 	StatusShutdown
 )
 
-var DialTimeout = 5 * time.Second
+var (
+	// TLSConfig is used by ConnectToNodeWithHostAndPort, nil connects without TLS
+	TLSConfig *tls.Config
+	// Credentials are used by ConnectToNodeWithHostAndPort, nil connects without authenticating
+	Credentials *model.Credentials
+
+	DialTimeout = 5 * time.Second
+	// ShutdownTimeout is how long Shutdown waits for in-flight requests before closing storage
+	ShutdownTimeout = 10 * time.Second
+)
 
 type EntityStorage struct {
 	Disk   *disk.Disk
 	Memory *register.Entity
+
+	writeMu sync.Mutex // Serializes the writes, see write
 }
 
 type Entity struct {
@@ -51,9 +71,18 @@ type Host struct {
 
 type Node struct {
 	// Props coming from json config
-	Host     Host
-	Path     Path
-	Entities []Entity
+	ClusterName string
+	Host        Host
+	Path        Path
+	Entities    []Entity
+	TLS         config.NodeTLS
+	Auth        config.Auth
+	Audit       *audit.Log
+	Limits      config.NodeLimits
+	Timeouts    config.NodeTimeouts
+	Tracer      *trace.Tracer
+	SlowLog     config.NodeSlowLog
+	StatusHTTP  config.NodeStatus
 
 	ErrCh           chan error
 	Status          Status
@@ -62,7 +91,14 @@ type Node struct {
 	EntitiesStorage []*EntityStorage
 	PeerConnected   bool
 
-	Mu sync.Mutex
+	Mu         sync.Mutex
+	listener   net.Listener
+	inFlight   sync.WaitGroup
+	limiter    *limiter
+	slowLog    *slowLog
+	collectors []metrics.Collector
+	statusHTTP *http.Server
+	statusL    net.Listener // Closed along with statusHTTP, which only knows it once it serves
 }
 
 func NewNode() *Node {
@@ -71,6 +107,11 @@ func NewNode() *Node {
 	}
 }
 
+func (x *Node) WithClusterName(name string) *Node {
+	x.ClusterName = name
+	return x
+}
+
 func (x *Node) WithHost(name string, ip string, port int) *Node {
 	x.Host.Name = name
 	x.Host.IP = ip
@@ -78,6 +119,53 @@ func (x *Node) WithHost(name string, ip string, port int) *Node {
 	return x
 }
 
+// WithTLS enables TLS on the listener and on the connections to peers
+func (x *Node) WithTLS(t config.NodeTLS) *Node {
+	x.TLS = t
+	return x
+}
+
+// WithAuth requires clients to authenticate and enforces the permissions of their roles
+func (x *Node) WithAuth(a config.Auth) *Node {
+	x.Auth = a
+	return x
+}
+
+// WithAudit records every insert, update and delete in l, it is opened by Start and closed by Shutdown
+func (x *Node) WithAudit(l *audit.Log) *Node {
+	x.Audit = l
+	return x
+}
+
+// WithLimits bounds the connections and request rates accepted by the node
+func (x *Node) WithLimits(l config.NodeLimits) *Node {
+	x.Limits = l
+	return x
+}
+
+// WithTimeouts overrides the hconn defaults for the connections accepted by the node
+func (x *Node) WithTimeouts(t config.NodeTimeouts) *Node {
+	x.Timeouts = t
+	return x
+}
+
+func (x *Node) WithSlowLog(l config.NodeSlowLog) *Node {
+	x.SlowLog = l
+	return x
+}
+
+// WithStatusHTTP serves Handler on its own address, see config.NodeStatus
+func (x *Node) WithStatusHTTP(s config.NodeStatus) *Node {
+	x.StatusHTTP = s
+	return x
+}
+
+// WithTracer records the spans of the requests handled by the node, see trace.Tracer
+func (x *Node) WithTracer(t *trace.Tracer) *Node {
+	x.Tracer = t
+	return x
+}
+
 func (x *Node) WithPath(pathData string) *Node {
 	x.Path.Data = pathData
 	return x
@@ -93,20 +181,37 @@ func (x *Node) AddPeer(p *Node) *Node {
 	return x
 }
 
+// ConnectToNodeWithHostAndPort connects over TLS when TLSConfig is set
 func ConnectToNodeWithHostAndPort(ip string, port string) (*hconn.HConn, error) {
+	hello := hconn.NewHello("", "")
+	hello.Credentials = Credentials
+	return connectToNode(net.JoinHostPort(ip, port), TLSConfig, hello)
+}
+
+// ConnectToNode connects over TLS when x has TLS settings, they are used to verify x and as client certificate,
+// it authenticates with the Peer credentials of x if there are any
+func ConnectToNode(x *Node) (*hconn.HConn, error) {
+	tlsConfig, err := x.clientTLS(x.Host.Name)
+	if err != nil {
+		return nil, err
+	}
+	return connectToNode(x.getListenAddress(), tlsConfig, x.clientHello(""))
+}
+
+// connectToNode retries until the node at address is listening, a refused handshake is not retried
+func connectToNode(address string, tlsConfig *tls.Config, hello hconn.Hello) (*hconn.HConn, error) {
 	if err := template.RegisterEntities(); err != nil {
 		return nil, err
 	}
 
 	for {
-		conn, err := net.DialTimeout("tcp", ip+":"+port, DialTimeout)
+		hc, err := hconn.Dial(address, DialTimeout, tlsConfig, hello)
 		if err == nil {
-			hc := hconn.NewHConn(conn)
 			go keepalive(hc)
 			return hc, nil
 		}
 		if strings.Contains(err.Error(), "connection refused") || strings.Contains(err.Error(), "i/o timeout") {
-			nabu.FromMessage("trying to connect to: [" + ip + ":" + port + "]").Log()
+			nabu.FromMessage("trying to connect to: [" + address + "]").Log()
 		} else {
 			return nil, err
 		}
@@ -114,33 +219,52 @@ func ConnectToNodeWithHostAndPort(ip string, port string) (*hconn.HConn, error)
 	}
 }
 
-func ConnectToNode(x *Node) (*hconn.HConn, error) {
+// NewPoolToNode creates a connection pool to x, it can be tuned with the With* methods before calling Start
+func NewPoolToNode(x *Node) (*hconn.Pool, error) {
 	if err := template.RegisterEntities(); err != nil {
 		return nil, err
 	}
 
-	for {
-		conn, err := net.DialTimeout("tcp", x.getListenAddress(), DialTimeout)
-		if err == nil {
-			hc := hconn.NewHConn(conn)
-			go keepalive(hc)
-			return hc, nil
-		}
-		if strings.Contains(err.Error(), "connection refused") || strings.Contains(err.Error(), "i/o timeout") {
-			nabu.FromMessage("trying to connect to: [" + x.getListenAddress() + "]").Log()
-		} else {
-			return nil, err
-		}
-		time.Sleep(1 * time.Second)
+	tlsConfig, err := x.clientTLS(x.Host.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	address := x.getListenAddress()
+	hello := x.clientHello("")
+	return hconn.NewPool(func() (*hconn.HConn, error) {
+		return hconn.Dial(address, DialTimeout, tlsConfig, hello)
+	}), nil
+}
+
+// clientTLS returns the TLS config used to dial the node named serverName, nil without TLS settings
+func (x *Node) clientTLS(serverName string) (*tls.Config, error) {
+	if !x.TLS.Enabled() {
+		return nil, nil
 	}
+	return x.TLS.ClientConfig(serverName)
 }
 
 func (x *Node) Start() error {
 	if err := x.checkDataDir(); err != nil {
 		return err
 	}
+	// Served first so that orchestrators see the node starting while it loads its entities,
+	// the status server is closed by Shutdown once the node serves and here if it never does
+	if err := x.serveStatus(); err != nil {
+		return err
+	}
+	serving := false
+	defer func() {
+		if !serving {
+			x.Mu.Lock()
+			x.closeStatusHTTP()
+			x.Mu.Unlock()
+		}
+	}()
 
 	// Config per node targets an entity by name but here we find all versions for that entity
+	var storages []*EntityStorage
 	for _, e := range x.Entities {
 		for _, re := range register.Entities {
 			if e.Name == re.EntityBase.Name {
@@ -149,27 +273,60 @@ func (x *Node) Start() error {
 					return err
 				}
 
-				x.EntitiesStorage = append(x.EntitiesStorage, &EntityStorage{
+				storages = append(storages, &EntityStorage{
 					Disk:   d,
 					Memory: re,
 				})
 			}
 		}
 	}
+	// Read by the status server meanwhile
+	x.Mu.Lock()
+	x.EntitiesStorage = append(x.EntitiesStorage, storages...)
+	x.Mu.Unlock()
 
 	if err := x.loadEntitiesFromDisk(); err != nil {
 		return err
 	}
+	if x.Audit != nil {
+		if err := x.Audit.Open(); err != nil {
+			return err
+		}
+	}
+	x.limiter = newLimiter(x.Limits)
+	x.Mu.Lock()
+	x.slowLog = newSlowLog(x.SlowLog)
+	x.Mu.Unlock()
+	x.collectors = x.newCollectors()
+	metrics.Register(x.collectors...)
+	x.Tracer.Start()
 
 	listener, err := net.Listen("tcp", x.getListenAddress())
 	if err != nil {
 		return nabu.FromError(err).WithArgs(x.Host).Log()
 	}
+	if x.TLS.Enabled() {
+		c, err := x.TLS.ServerConfig()
+		if err != nil {
+			_ = listener.Close()
+			return nabu.FromError(err).WithArgs(x.Host).Log()
+		}
+		listener = tls.NewListener(listener, c)
+	}
+
+	x.Mu.Lock()
+	if x.Status == StatusShutdown {
+		x.Mu.Unlock()
+		return listener.Close()
+	}
+	x.listener = listener
+	x.Mu.Unlock()
 
+	serving = true
 	x.handleErrors()
 	defer func() {
-		if err = listener.Close(); err != nil {
-			x.ErrCh <- err
+		if err = x.closeListener(); err != nil {
+			x.reportError(err)
 		}
 	}()
 	go x.connectToPeers()
@@ -212,8 +369,21 @@ func (x *Node) loadEntitiesFromDisk() error {
 			return err
 		}
 
+		// The rows and their unique keys are rebuilt from the file alone. A unique tag added to an entity does not
+		// create a new version, so the rows written before it may break it: they are logged and left out of memory.
+		if len(entities) > 0 {
+			entities[0].MemoryClear()
+		}
 		for _, e := range entities {
-			e.MemoryAdd()
+			err = e.MemoryAdd()
+			var ce *model.ConstraintError
+			if errors.As(err, &ce) {
+				nabu.FromError(err).WithArgs(e.GetUuid()).WithMessage("node: row skipped on load").WithLevelWarn().Log()
+				continue
+			}
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -224,9 +394,15 @@ func (x *Node) connectToPeers() {
 	x.WaitStatusActive()
 
 	for _, node := range x.Peers {
-		c, err := ConnectToNode(node)
+		tlsConfig, err := x.clientTLS(node.Host.Name)
 		if err != nil {
-			x.ErrCh <- nabu.FromError(err).Log()
+			x.reportError(nabu.FromError(err).Log())
+			continue
+		}
+
+		c, err := connectToNode(node.getListenAddress(), tlsConfig, x.clientHello(x.Host.Name))
+		if err != nil {
+			x.reportError(nabu.FromError(err).Log())
 			continue
 		}
 
@@ -253,119 +429,414 @@ func (x *Node) acceptConnections(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			x.ErrCh <- err
+			// Accept fails once Shutdown closes the listener, that is not an error
+			if !x.isShuttingDown() {
+				x.reportError(err)
+			}
 			return
 		}
 
-		c := hconn.NewHConn(conn)
-		go x.handleConnection(c)
+		// Connections over the limit are still told why they are refused, which bounds how long they are kept
+		if !x.limiter.admit() {
+			go func() {
+				err := hconn.NewHConn(conn).Refuse(x.hello(), model.ErrLimitConnections)
+				nabu.FromError(model.ErrLimitConnections).WithArgs(conn.RemoteAddr().String(), err).Log()
+				_ = conn.Close()
+			}()
+			continue
+		}
+
+		go func() {
+			defer x.limiter.release()
+
+			var a *access
+			c := x.newHConn(conn)
+			err := c.HandshakeServer(x.hello(), func(hc *hconn.HConn, remote hconn.Hello) (err error) {
+				a, err = x.authenticate(hc, remote)
+				return err
+			})
+			if err != nil {
+				nabu.FromError(err).WithArgs(conn.RemoteAddr().String()).Log()
+				_ = conn.Close()
+				return
+			}
+			connections := connectionsActive.With(x.Host.Name)
+			connections.Inc()
+			defer connections.Dec()
+			x.handleConnection(c, a)
+		}()
 	}
 }
 
-func (x *Node) handleConnection(hc *hconn.HConn) {
+// newHConn applies the timeouts of the node to an accepted connection
+func (x *Node) newHConn(conn net.Conn) *hconn.HConn {
+	c := hconn.NewHConn(conn)
+	if x.Timeouts.Idle != 0 {
+		c.WithIdleTimeout(x.Timeouts.Idle.Duration())
+	}
+	if x.Timeouts.Read != 0 {
+		c.WithReadTimeout(x.Timeouts.Read.Duration())
+	}
+	if x.Timeouts.Write != 0 {
+		c.WithWriteTimeout(x.Timeouts.Write.Duration())
+	}
+	return c
+}
+
+// hello identifies this node during the handshake of every connection it accepts
+func (x *Node) hello() hconn.Hello {
+	return hconn.NewHello(x.Host.Name, x.ClusterName)
+}
+
+// clientHello is sent when dialing a node, nodeName is empty unless dialing a peer
+func (x *Node) clientHello(nodeName string) hconn.Hello {
+	h := hconn.NewHello(nodeName, x.ClusterName)
+	if x.Auth.Peer != (model.Credentials{}) {
+		peer := x.Auth.Peer
+		h.Credentials = &peer
+	}
+	return h
+}
+
+// handleConnection serves the messages of hc, a is the access of its client or nil when authentication is disabled
+func (x *Node) handleConnection(hc *hconn.HConn, a *access) {
+	// Requests are processed concurrently, the connection is closed only after all of them responded
+	var requests sync.WaitGroup
+	var cs cursors
 	defer func() {
+		requests.Wait()
+		cs.closeAll()
 		if err := hc.Close(); err != nil {
-			x.ErrCh <- nabu.FromError(err).Log()
+			x.reportError(nabu.FromError(err).Log())
 		}
 	}()
 
 	nabu.FromMessage("new connection from [" + hc.C.RemoteAddr().String() + "] to [" + hc.C.LocalAddr().String() + "]").Log()
 
+	connRate := x.limiter.connection()
+	clientRate := x.limiter.client(a.name(), hc.C.RemoteAddr())
+	defer x.limiter.leave(clientRate)
+
 	for {
 		msgIn, err := hc.Receive()
+		if errors.Is(err, model.ErrConnectionIdle) {
+			nabu.FromMessage("closing idle connection from [" + hc.C.RemoteAddr().String() + "]").Log()
+			break
+		}
 		if err != nil {
-			x.ErrCh <- nabu.FromError(err).Log()
+			x.reportError(nabu.FromError(err).Log())
 			break
 		}
 
-		msgOut := model.Message{}
-
-		// Check node status before processing messages
-		x.Mu.Lock()
-		nodeStatus := x.Status
-		x.Mu.Unlock()
+		span := x.Tracer.Span("receive", msgIn.Trace).SetKind(trace.KindServer).
+			Set("node", x.Host.Name).Set("type", msgIn.Type.String()).Set("entity", msgIn.Entity.Name)
 
-		if nodeStatus == StatusShutdown {
-			err := model.ErrNodeShutdown
-			nabu.FromError(err).Log()
+		if err = a.authorize(msgIn); err != nil {
+			nabu.FromError(err).WithArgs(hc.C.RemoteAddr().String()).Log()
+			msgOut := model.Message{Id: msgIn.Id}
 			msgOut.Error(err.Error())
-			if err := hc.Send(msgOut); err != nil {
-				x.ErrCh <- nabu.FromError(err).Log()
+			x.auditRequest(hc, a, msgIn, msgOut, nil)
+			x.observeRequest(span, msgIn, msgOut, 0)
+			if err = hc.Send(msgOut); err != nil {
+				x.reportError(nabu.FromError(err).Log())
+				break
 			}
-			break
+			continue
 		}
 
-		// Process message if node is not shutting down
-		switch msgIn.Type {
-		case model.MessageTypePing:
-			// Respond to ping with success status
-			msgOut.Status = model.StatusSuccess
-			msgOut.Type = model.MessageTypePing
-		case model.MessageTypeInsert, model.MessageTypeDelete, model.MessageTypeUpdate:
-			e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name)
-			if e == nil {
-				msgOut.Error("entity not found: [" + msgIn.Entity.Name + "]")
+		if err = x.limiter.begin(msgIn.Type, connRate, clientRate); err != nil {
+			msgOut := model.Message{Id: msgIn.Id}
+			msgOut.Throttled(err.Error())
+			x.auditRequest(hc, a, msgIn, msgOut, nil)
+			x.observeRequest(span, msgIn, msgOut, 0)
+			if err = hc.Send(msgOut); err != nil {
+				x.reportError(nabu.FromError(err).Log())
 				break
 			}
+			continue
+		}
 
-			entity := e.Memory.EntityExtension.New()
-			entity.SetBufferData(msgIn.Entity.Data)
-			if err := entity.Decode(); err != nil {
-				msgOut.Error(err.Error())
-				break
+		// Requests arriving while shutting down are refused so clients can retry on another node
+		if !x.beginRequest() {
+			x.limiter.end(msgIn.Type)
+			err = model.ErrNodeShutdown
+			nabu.FromError(err).Log()
+			msgOut := model.Message{Id: msgIn.Id}
+			msgOut.Shutdown(err.Error())
+			x.observeRequest(span, msgIn, msgOut, 0)
+			if err = hc.Send(msgOut); err != nil {
+				x.reportError(nabu.FromError(err).Log())
 			}
+			break
+		}
 
-			switch msgIn.Type {
-			case model.MessageTypeInsert:
-				entity.MemoryAdd()
-			case model.MessageTypeDelete:
-				entity.MemoryRemove()
-			case model.MessageTypeUpdate:
-				entity.MemoryUpdate()
+		requests.Add(1)
+		hc.Begin()
+		go func(msgIn model.Message) {
+			defer requests.Done()
+			defer x.inFlight.Done()
+			defer x.limiter.end(msgIn.Type)
+			defer hc.End()
+
+			start := time.Now()
+			msgOut, entity := x.handleMessage(msgIn, &cs, span)
+			msgOut.Id = msgIn.Id
+			x.auditRequest(hc, a, msgIn, msgOut, entity)
+			x.observeRequest(span, msgIn, msgOut, time.Since(start))
+			if err := hc.Send(msgOut); err != nil {
+				x.reportError(nabu.FromError(err).Log())
 			}
+		}(msgIn)
+	}
+}
 
-			if err = e.Disk.DataWrite(msgIn.Entity.Data); err != nil {
-				msgOut.Error(err.Error())
-				break
-			}
-			msgOut.Status = model.StatusSuccess
+// handleMessage answers msgIn with the cursors of its connection, its steps are recorded as children of span.
+// It returns the entity decoded from the inserts, updates and deletes, nil when it could not be.
+func (x *Node) handleMessage(msgIn model.Message, cs *cursors, span *trace.Span) (msgOut model.Message, entity register.Model) {
+	switch msgIn.Type {
+	case model.MessageTypePing:
+		// Respond to ping with success status
+		msgOut.Status = model.StatusSuccess
+		msgOut.Type = model.MessageTypePing
+	case model.MessageTypeInsert, model.MessageTypeDelete, model.MessageTypeUpdate:
+		e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name)
+		if e == nil {
+			x.entityNotFound(span, &msgOut, msgIn.Entity)
+			break
+		}
 
-		case model.MessageTypeGetAll:
-			e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name)
-			if e == nil {
-				msgOut.Error("entity not found: [" + msgIn.Entity.Name + "]")
-				break
-			}
-			msgOut.Status = model.StatusSuccess
-			msgOut.Models = e.Memory.EntityExtension.New().MemoryGetAll()
+		decoded := e.Memory.EntityExtension.New()
+		decode := span.Child("decode")
+		if err := decoded.DecodeData(msgIn.Entity.Data); err != nil {
+			decode.Fail(err).Finish()
+			msgOut.Error(err.Error())
+			break
+		}
+		decode.Finish()
+		entity = decoded
 
-		case model.MessageTypeTest:
-			msgOut.String = msgIn.String + "Received"
+		err := e.write(msgIn.Type, entity, msgIn.Entity.Data, span)
+		var ce *model.ConstraintError
+		if errors.As(err, &ce) {
+			msgOut.Conflict(ce)
+			break
+		}
+		if err != nil {
+			msgOut.Error(err.Error())
+			break
+		}
+		msgOut.Status = model.StatusSuccess
 
-		case model.MessageTypeQuery:
-			e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name)
-			if e == nil {
-				msgOut.Error("entity not found: [" + msgIn.Entity.Name + "]")
-				break
-			}
+	case model.MessageTypeGetAll:
+		e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name)
+		if e == nil {
+			x.entityNotFound(span, &msgOut, msgIn.Entity)
+			break
+		}
+		msgOut.Status = model.StatusSuccess
+		respondModels(msgIn, &msgOut, cs, e.Memory.EntityExtension.New().MemoryGetAll())
 
-			r, err := e.HandleQuery(msgIn.Query)
-			if err != nil {
-				msgOut.Error(err.Error())
-				break
-			}
+	case model.MessageTypeTest:
+		msgOut.String = msgIn.String + "Received"
+
+	case model.MessageTypeTopology:
+		data, err := json.Marshal(x.Topology())
+		if err != nil {
+			msgOut.Error(err.Error())
+			break
+		}
+		msgOut.Status = model.StatusSuccess
+		msgOut.Bytes = data
+
+	case model.MessageTypeQuery:
+		e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name)
+		if e == nil {
+			x.entityNotFound(span, &msgOut, msgIn.Entity)
+			break
+		}
 
-			msgOut.Status = model.StatusSuccess
-			msgOut.Models = r
+		start := time.Now()
+		r, plan, err := e.handleQuery(msgIn.Query, span)
+		x.slowLog.record(SlowQuery{
+			Time:     start,
+			Entity:   msgIn.Entity.Name,
+			Version:  msgIn.Entity.Version,
+			Duration: time.Since(start),
+			Query:    msgIn.Query,
+			Plan:     plan,
+		})
+		if err != nil {
+			msgOut.Error(err.Error())
+			break
 		}
 
-		if err = hc.Send(msgOut); err != nil {
-			x.ErrCh <- nabu.FromError(err).Log()
+		msgOut.Status = model.StatusSuccess
+		respondModels(msgIn, &msgOut, cs, r)
+
+	case model.MessageTypeExplain:
+		e := x.findEntityStorage(msgIn.Entity.Version, msgIn.Entity.Name)
+		if e == nil {
+			x.entityNotFound(span, &msgOut, msgIn.Entity)
+			break
 		}
+
+		plan, err := e.ExplainQuery(msgIn.Query)
+		if err != nil {
+			msgOut.Error(err.Error())
+			break
+		}
+		data, err := json.Marshal(plan)
+		if err != nil {
+			msgOut.Error(err.Error())
+			break
+		}
+		msgOut.Status = model.StatusSuccess
+		msgOut.Bytes = data
+
+	case model.MessageTypeCursorNext:
+		if msgIn.Cursor == nil {
+			msgOut.Error(model.ErrCursorNotFound.Error())
+			break
+		}
+		if err := cs.next(msgIn.Cursor.Id, msgIn.Entity.Name, &msgOut); err != nil {
+			msgOut.Error(err.Error())
+			break
+		}
+		msgOut.Status = model.StatusSuccess
+
+	case model.MessageTypeCursorClose:
+		if msgIn.Cursor != nil {
+			cs.close(msgIn.Cursor.Id)
+		}
+		msgOut.Status = model.StatusSuccess
+	}
+
+	return
+}
+
+// respondModels sends models in a single message, or streams them in chunks of cs if the request carries a Cursor
+func respondModels(msgIn model.Message, msgOut *model.Message, cs *cursors, models []register.Model) {
+	if msgIn.Cursor == nil {
+		msgOut.Models = models
+		return
+	}
+	cs.start(msgIn.Entity.Name, models, msgIn.Cursor.Size, msgOut)
+}
+
+// entityNotFound redirects the client to the first peer holding the entity if there is any,
+// which is how requests reach the peers of a node. Nodes hold every registered version of the entities
+// they are configured with, so a version that is not registered is held by none of them.
+func (x *Node) entityNotFound(span *trace.Span, msgOut *model.Message, e register.EntityBase) {
+	if registered(e.Name, e.Version) {
+		for _, n := range x.Topology().Holders(e.Name) {
+			if n.Host.Name != x.Host.Name {
+				span.Child("redirect").Set("peer", n.Host.Name).Finish()
+				msgOut.Redirect(n.Address())
+				return
+			}
+		}
+	}
+	msgOut.Error("entity not found: [" + e.Name + "] [" + e.Version + "]")
+}
+
+func registered(name, version string) bool {
+	for _, re := range register.Entities {
+		if re.EntityBase.Name == name && re.EntityBase.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Topology returns the cluster config as known by this node, which is itself and its peers
+func (x *Node) Topology() config.Config {
+	x.Mu.Lock()
+	peers := x.Peers
+	x.Mu.Unlock()
+
+	c := config.Config{ClusterName: x.ClusterName}
+	c.Nodes = append(c.Nodes, x.toConfig())
+	for _, p := range peers {
+		c.Nodes = append(c.Nodes, p.toConfig())
+	}
+	return c
+}
+
+func (x *Node) toConfig() config.Node {
+	n := config.Node{
+		Host: config.NodeHost{Name: x.Host.Name, IP: x.Host.IP, Port: x.Host.Port},
+		Path: config.NodePath{Data: x.Path.Data},
+	}
+	for _, e := range x.Entities {
+		n.Entities = append(n.Entities, config.NodeEntity{Name: e.Name})
+	}
+	return n
+}
+
+// beginRequest registers an in-flight request, it returns false if the node is shutting down.
+// Every successful call must be paired with inFlight.Done once the response has been sent.
+func (x *Node) beginRequest() bool {
+	x.Mu.Lock()
+	defer x.Mu.Unlock()
+	if x.Status == StatusShutdown {
+		return false
+	}
+	x.inFlight.Add(1)
+	return true
+}
+
+func (x *Node) isShuttingDown() bool {
+	x.Mu.Lock()
+	defer x.Mu.Unlock()
+	return x.Status == StatusShutdown
+}
+
+// waitInFlight blocks until all in-flight requests are done or the timeout expires.
+// It returns false if requests were still running when the timeout expired.
+func (x *Node) waitInFlight(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		x.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// closeListener closes the listener only once, no matter if Start or Shutdown gets to it first
+func (x *Node) closeListener() error {
+	x.Mu.Lock()
+	listener := x.listener
+	x.listener = nil
+	x.Mu.Unlock()
+
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+// reportError forwards err to ErrCh without blocking, errors are dropped once the node is shut down
+func (x *Node) reportError(err error) {
+	x.Mu.Lock()
+	defer x.Mu.Unlock()
+	if x.ErrCh == nil {
+		return
+	}
+	select {
+	case x.ErrCh <- err:
+	default:
 	}
 }
 
 func (x *Node) findEntityStorage(version, name string) *EntityStorage {
+	x.Mu.Lock()
+	defer x.Mu.Unlock()
 	for _, e := range x.EntitiesStorage {
 		if e.Memory.EntityBase.Version == version && e.Memory.EntityBase.Name == name {
 			return e
@@ -406,7 +877,7 @@ func (x *Node) WaitStatusActive() {
 		x.Mu.Lock()
 		s := x.Status
 		x.Mu.Unlock()
-		if s == StatusActive {
+		if s == StatusActive || s == StatusReady {
 			break
 		}
 	}
@@ -414,18 +885,31 @@ func (x *Node) WaitStatusActive() {
 
 // Shutdown performs a graceful shutdown of the node, ensuring that all data is
 // properly flushed to disk and resources are released.
-// It closes all entity storage disks and cleans up resources
+// New connections are no longer accepted and new requests are answered with StatusShutdown,
+// requests already in flight are given up to ShutdownTimeout to finish before the
+// entity storage disks are synced and closed.
 func (x *Node) Shutdown() error {
 	x.Mu.Lock()
-	defer x.Mu.Unlock()
-
 	if x.Status == StatusShutdown {
+		x.Mu.Unlock()
 		return nil
 	}
 
 	nabu.FromMessage("Shutting down node").WithArgs(x.Host).Log()
-
 	x.Status = StatusShutdown
+	x.Mu.Unlock()
+
+	if err := x.closeListener(); err != nil {
+		nabu.FromError(err).Log()
+	}
+
+	if !x.waitInFlight(ShutdownTimeout) {
+		nabu.FromMessage("Timed out waiting for in-flight requests").WithArgs(x.Host).Log()
+	}
+
+	x.Mu.Lock()
+	defer x.Mu.Unlock()
+
 	if len(x.Peers) > 0 {
 		x.Peers = nil
 	}
@@ -437,17 +921,31 @@ func (x *Node) Shutdown() error {
 	}
 	for _, es := range x.EntitiesStorage {
 		if es.Disk != nil {
+			// Close performs the final fsync before releasing the file
 			nabu.FromMessage("Closing entity storage disk").WithArgs(es.Disk.Path).Log()
 			if err := es.Disk.Close(); err != nil {
 				nabu.FromError(err).Log()
 			}
-			es.Disk = nil
 		}
 	}
 
+	if x.Audit != nil {
+		if err := x.Audit.Close(); err != nil {
+			nabu.FromError(err).Log()
+		}
+	}
+	metrics.Unregister(x.collectors...)
+	x.collectors = nil
+	if err := x.Tracer.Close(); err != nil {
+		nabu.FromError(err).Log()
+	}
+
 	// Force cleanup any other references
 	x.EntitiesStorage = nil
 
+	// Closed last, the probes report the shutdown until then
+	x.closeStatusHTTP()
+
 	// Close error channel - mutex is already locked in Shutdown
 	if x.ErrCh != nil {
 		errCh := x.ErrCh
@@ -465,16 +963,20 @@ func (x *Node) Shutdown() error {
 	return nil
 }
 
+// keepalive pings hc often enough for the node not to close it as idle, an unanswered ping ends it.
+// There is nothing to do when idle timeouts are disabled.
 func keepalive(hc *hconn.HConn) {
-	ticker := time.NewTicker(hconn.Timeout / 2)
+	interval := hconn.IdleTimeout / 2
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for range ticker.C {
-		pingMsg := model.Message{Type: model.MessageTypePing}
-		if err := hc.Send(pingMsg); err != nil {
-			nabu.FromError(err).Log()
-			return
-		}
-		if _, err := hc.Receive(); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_, err := hc.SendReceive(ctx, model.Message{Type: model.MessageTypePing})
+		cancel()
+		if err != nil {
 			nabu.FromError(err).Log()
 			return
 		}
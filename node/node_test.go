@@ -1,12 +1,19 @@
 package node
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -14,13 +21,17 @@ import (
 	"github.com/google/uuid"
 	"github.com/rah-0/testmark/testutil"
 
+	"github.com/rah-0/hyperion/audit"
 	"github.com/rah-0/hyperion/config"
 	"github.com/rah-0/hyperion/disk"
 	SampleV1 "github.com/rah-0/hyperion/entities/Sample/v1"
 	"github.com/rah-0/hyperion/hconn"
+	AccountV1 "github.com/rah-0/hyperion/internal/testentities/Account/v1"
+	"github.com/rah-0/hyperion/metrics"
 	"github.com/rah-0/hyperion/model"
 	"github.com/rah-0/hyperion/query"
 	"github.com/rah-0/hyperion/register"
+	"github.com/rah-0/hyperion/trace"
 	"github.com/rah-0/hyperion/util"
 )
 
@@ -260,12 +271,12 @@ func TestNodeMessageDuringShutdown(t *testing.T) {
 		t.Fatalf("Failed to receive message: %v", err)
 	}
 
-	// Check that we received the shutdown error
-	if response.Status != model.StatusError {
-		t.Errorf("Expected status error, got %d", response.Status)
+	// Check that we received the shutdown status so the client knows to retry elsewhere
+	if response.Status != model.StatusShutdown {
+		t.Errorf("Expected status shutdown, got %d", response.Status)
 	}
 
-	// The error message should be in the String field when Status is StatusError
+	// The error message should be in the String field when Status is StatusShutdown
 	expectedErrMsg := model.ErrNodeShutdown.Error()
 	if response.String != expectedErrMsg {
 		t.Errorf("Expected error message '%s', got '%s'", expectedErrMsg, response.String)
@@ -306,6 +317,127 @@ func TestNodeShutdownMultiple(t *testing.T) {
 	}
 }
 
+// TestNodeShutdownDrainsWrites hammers a node with inserts while it shuts down, every insert
+// acknowledged with StatusSuccess must be on disk once Shutdown returns
+func TestNodeShutdownDrainsWrites(t *testing.T) {
+	const (
+		clients          = 8
+		insertsPerClient = 200
+	)
+
+	port := util.GetAvailablePort()
+	dataPath := t.TempDir()
+	n := NewNode().
+		WithHost("shutdown-drain-node", "127.0.0.1", port).
+		WithPath(dataPath).
+		AddEntity(SampleV1.Name)
+	n.ErrCh = make(chan error, 10)
+
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+
+	// Pre-encode all payloads so the clients only measure the node
+	payloads := make([][][]byte, clients)
+	for i := range payloads {
+		for j := 0; j < insertsPerClient; j++ {
+			s := SampleV1.Sample{Name: fmt.Sprintf("drain%d", i), Surname: fmt.Sprintf("%d", j)}
+			s.WithNewUuid()
+			data, err := s.EncodeData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			payloads[i] = append(payloads[i], data)
+		}
+	}
+
+	conns := make([]*hconn.HConn, clients)
+	for i := range conns {
+		c, err := ConnectToNodeWithHostAndPort("127.0.0.1", fmt.Sprintf("%d", port))
+		if err != nil {
+			t.Fatalf("Failed to connect to node: %v", err)
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	acknowledged := 0
+	refused := 0
+	start := make(chan struct{})
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(c *hconn.HConn, data [][]byte) {
+			defer wg.Done()
+			<-start
+			for _, d := range data {
+				resp, err := c.SendReceive(context.Background(), model.Message{
+					Type: model.MessageTypeInsert,
+					Entity: register.EntityBase{
+						Version: SampleV1.Version,
+						Name:    SampleV1.Name,
+						Data:    d,
+					},
+				})
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				switch resp.Status {
+				case model.StatusSuccess:
+					acknowledged++
+				case model.StatusShutdown:
+					refused++
+				default:
+					t.Errorf("Unexpected response during shutdown: %+v", resp)
+				}
+				mu.Unlock()
+
+				if resp.Status != model.StatusSuccess {
+					return
+				}
+			}
+		}(conns[i], payloads[i])
+	}
+
+	close(start)
+	time.Sleep(20 * time.Millisecond)
+	if err := n.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	wg.Wait()
+
+	if acknowledged == 0 {
+		t.Fatal("Expected some inserts to be acknowledged before shutdown")
+	}
+	t.Logf("acknowledged: %d, refused: %d", acknowledged, refused)
+
+	// Every acknowledged insert must have been flushed before the disk was closed
+	var re *register.Entity
+	for _, e := range register.Entities {
+		if e.EntityBase.Name == SampleV1.Name && e.EntityBase.Version == SampleV1.Version {
+			re = e
+		}
+	}
+	d := disk.NewDisk().WithPath(filepath.Join(dataPath, SampleV1.DbFileName)).WithEntity(re)
+	if err := d.OpenFile(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	entities, err := d.DataReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) < acknowledged {
+		t.Fatalf("Expected at least %d entities on disk, got %d", acknowledged, len(entities))
+	}
+}
+
 func TestNodeDirectConnectionIpAndPort(t *testing.T) {
 	msg := model.Message{
 		Type:   model.MessageTypeTest,
@@ -376,6 +508,32 @@ func TestNodesDirectConnection(t *testing.T) {
 	}
 }
 
+// TestNodeHandshake checks that nodes identify themselves and refuse clients of another cluster
+func TestNodeHandshake(t *testing.T) {
+	nodeConfig := config.Loaded.Nodes[0]
+	n := NewNode().
+		WithClusterName(config.Loaded.ClusterName).
+		WithHost(nodeConfig.Host.Name, nodeConfig.Host.IP, nodeConfig.Host.Port)
+
+	c, err := ConnectToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.Peer.NodeName != nodeConfig.Host.Name || c.Peer.ClusterName != config.Loaded.ClusterName {
+		t.Errorf("Unexpected peer identity: %+v", c.Peer)
+	}
+	if c.Agreement.Version != hconn.ProtocolVersion {
+		t.Errorf("Expected protocol version %d, got %d", hconn.ProtocolVersion, c.Agreement.Version)
+	}
+
+	n.WithClusterName("other")
+	if _, err = ConnectToNode(n); !errors.Is(err, model.ErrHandshakeRefused) {
+		t.Errorf("Expected ErrHandshakeRefused, got %v", err)
+	}
+}
+
 func TestMessageInsert(t *testing.T) {
 	entity := SampleV1.Sample{
 		Name:    "Something",
@@ -490,6 +648,79 @@ func TestMessageInsert1000(t *testing.T) {
 	}
 }
 
+func TestMessageInsertConcurrentSameConnection(t *testing.T) {
+	const goroutines = 50
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, goroutines)
+	expected := make([]*SampleV1.Sample, goroutines)
+	for i := 0; i < goroutines; i++ {
+		expected[i] = &SampleV1.Sample{
+			Name:    fmt.Sprintf("Concurrent%d", i),
+			Surname: fmt.Sprintf("Else%d", i),
+		}
+
+		wg.Add(1)
+		go func(entity *SampleV1.Sample) {
+			defer wg.Done()
+			if err := entity.DbInsert(connection); err != nil {
+				errCh <- err
+			}
+		}(expected[i])
+	}
+	wg.Wait()
+
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	for _, e := range expected {
+		q := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+			{Field: SampleV1.FieldUuid, Op: query.OperatorTypeEqual, Value: e.Uuid},
+		})
+		r, err := SampleV1.DbQuery(connection, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r) != 1 || r[0].Name != e.Name || r[0].Surname != e.Surname {
+			t.Fatalf("Expected %+v, got %+v", e, r)
+		}
+	}
+}
+
+func TestPoolDbInsertAndQuery(t *testing.T) {
+	n := NewNode().WithHost("A", "127.0.0.1", 5000)
+	p, err := NewPoolToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.WithSize(3).Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	entity := SampleV1.Sample{Name: "Pooled", Surname: uuid.NewString()}
+	if err = entity.DbInsert(p); err != nil {
+		t.Fatal(err)
+	}
+
+	q := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: entity.Surname},
+	})
+	r, err := SampleV1.DbQuery(p, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 1 || r[0].Uuid != entity.Uuid {
+		t.Fatalf("Expected inserted entity, got %+v", r)
+	}
+
+	if err = r[0].DbDelete(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestMessageUpdate(t *testing.T) {
 	entity := &SampleV1.Sample{
 		Name:    "Initial",
@@ -569,6 +800,259 @@ func TestMessageGetAll(t *testing.T) {
 	}
 }
 
+// TestMessageIterChunks streams GetAll and Query results in chunks smaller than the result set
+func TestMessageIterChunks(t *testing.T) {
+	surname := uuid.NewString()
+	inserted := make(map[uuid.UUID]bool)
+	for i := 0; i < 25; i++ {
+		entity := &SampleV1.Sample{Name: fmt.Sprintf("Iter%d", i), Surname: surname}
+		if err := entity.DbInsert(connection); err != nil {
+			t.Fatal(err)
+		}
+		inserted[entity.Uuid] = true
+	}
+
+	q := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+	})
+	seen := make(map[uuid.UUID]bool)
+	for entity, err := range SampleV1.DbQueryIter(connection, q, 4) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inserted[entity.Uuid] || seen[entity.Uuid] {
+			t.Fatalf("Unexpected or duplicated entity: %+v", entity)
+		}
+		seen[entity.Uuid] = true
+	}
+	if len(seen) != len(inserted) {
+		t.Fatalf("Expected %d entities, got %d", len(inserted), len(seen))
+	}
+
+	all, err := SampleV1.DbGetAll(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, err := range SampleV1.DbGetAllIter(connection, 7) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != len(all) {
+		t.Fatalf("Expected %d entities, got %d", len(all), count)
+	}
+}
+
+// TestMessageIterPool streams through a Pool, whose requests would otherwise go to every connection in turn
+// while the cursor is only known to the one that opened it
+func TestMessageIterPool(t *testing.T) {
+	p := hconn.NewPool(func() (*hconn.HConn, error) {
+		return ConnectToNodeWithHostAndPort("127.0.0.1", "5000")
+	}).WithSize(3)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	surname := uuid.NewString()
+	for i := 0; i < 10; i++ {
+		if err := (&SampleV1.Sample{Name: fmt.Sprintf("Pool%d", i), Surname: surname}).DbInsert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+	})
+	for _, r := range []hconn.Requester{p, hconn.Bind(context.Background(), p)} {
+		count := 0
+		for _, err := range SampleV1.DbQueryIter(r, q, 3) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		if count != 10 {
+			t.Fatalf("Expected 10 entities, got %d", count)
+		}
+	}
+}
+
+// TestMessageIterCancel stops reading mid-stream and checks that the cursor is gone
+func TestMessageIterCancel(t *testing.T) {
+	surname := uuid.NewString()
+	for i := 0; i < 10; i++ {
+		entity := &SampleV1.Sample{Name: fmt.Sprintf("Cancel%d", i), Surname: surname}
+		if err := entity.DbInsert(connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+	})
+	msg := model.Message{
+		Type:   model.MessageTypeQuery,
+		Entity: register.EntityBase{Version: SampleV1.Version, Name: SampleV1.Name},
+		Query:  q,
+		Cursor: &model.Cursor{Size: 3},
+	}
+	resp, err := connection.SendReceive(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Models) != 3 || resp.Cursor == nil || resp.Cursor.Done {
+		t.Fatalf("Expected a first chunk of 3 with more to come, got %d models and %+v", len(resp.Models), resp.Cursor)
+	}
+
+	cursor := &model.Cursor{Id: resp.Cursor.Id}
+	if _, err = connection.SendReceive(context.Background(), model.Message{Type: model.MessageTypeCursorClose, Entity: msg.Entity, Cursor: cursor}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same entity as the open, so that the cursor can only be missing because it was closed
+	resp, err = connection.SendReceive(context.Background(), model.Message{Type: model.MessageTypeCursorNext, Entity: msg.Entity, Cursor: cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != model.StatusError || resp.String != model.ErrCursorNotFound.Error() {
+		t.Fatalf("Expected closed cursor to be gone, got %+v", resp)
+	}
+}
+
+// TestEntityNotFoundVersion checks that only the versions held by peers are redirected, others are not found
+// rather than bouncing between the nodes holding the entity
+func TestEntityNotFoundVersion(t *testing.T) {
+	peer := NewNode().WithHost("HOLDER", "127.0.0.1", util.GetAvailablePort()).AddEntity(SampleV1.Name)
+	n := NewNode().WithHost("NOT_HOLDER", "127.0.0.1", util.GetAvailablePort()).AddPeer(peer)
+
+	for version, status := range map[string]model.Status{SampleV1.Version: model.StatusRedirect, "v99": model.StatusError} {
+		msgOut, _ := n.handleMessage(model.Message{
+			Type:   model.MessageTypeQuery,
+			Entity: register.EntityBase{Name: SampleV1.Name, Version: version},
+			Query:  query.NewQuery(),
+		}, &cursors{}, nil)
+		if msgOut.Status != status {
+			t.Errorf("Expected %s for version %s, got %+v", status, version, msgOut)
+		}
+	}
+}
+
+// TestKeepaliveIdleTimeoutDisabled checks that connections are kept without pings when idle timeouts are disabled
+func TestKeepaliveIdleTimeoutDisabled(t *testing.T) {
+	original := hconn.IdleTimeout
+	defer func() { hconn.IdleTimeout = original }()
+	hconn.IdleTimeout = 0
+
+	c, err := ConnectToNodeWithHostAndPort("127.0.0.1", "5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		keepalive(c)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected keepalive to return at once without an idle timeout")
+	}
+	if resp, err := c.SendReceive(context.Background(), model.Message{Type: model.MessageTypePing}); err != nil || resp.Status != model.StatusSuccess {
+		t.Fatalf("Expected the connection to work, got %+v: %v", resp, err)
+	}
+}
+
+// TestCursorsExpire checks that cursors abandoned by their clients are dropped
+func TestCursorsExpire(t *testing.T) {
+	original := CursorTimeout
+	defer func() { CursorTimeout = original }()
+	CursorTimeout = 20 * time.Millisecond
+
+	models := make([]register.Model, 10)
+	var c cursors
+
+	var first model.Message
+	c.start("Sample", models, 3, &first)
+	if c.len() != 1 || len(first.Models) != 3 {
+		t.Fatalf("Expected an open cursor after a chunk of 3, got %d cursors and %d models", c.len(), len(first.Models))
+	}
+
+	// Results fitting in one chunk do not keep a cursor
+	var single model.Message
+	c.start("Sample", models[:2], 3, &single)
+	if c.len() != 1 || !single.Cursor.Done {
+		t.Fatalf("Expected single chunk to be done without cursor, got %d cursors", c.len())
+	}
+
+	// Swept without being read again
+	deadline := time.Now().Add(time.Second)
+	for c.len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the abandoned cursor to be swept, got %d cursors", c.len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var next model.Message
+	if err := c.next(first.Cursor.Id, "Sample", &next); !errors.Is(err, model.ErrCursorNotFound) {
+		t.Fatalf("Expected expired cursor, got %v", err)
+	}
+
+	c.start("Sample", models, 3, &first)
+	c.closeAll()
+	if c.len() != 0 || c.sweep != nil {
+		t.Fatalf("Expected no cursor nor sweep once closed, got %d cursors", c.len())
+	}
+}
+
+// TestCursorOfAnotherConnection checks that a cursor is only found on the connection that opened it
+func TestCursorOfAnotherConnection(t *testing.T) {
+	surname := uuid.NewString()
+	for i := 0; i < 5; i++ {
+		if err := (&SampleV1.Sample{Name: fmt.Sprintf("Other%d", i), Surname: surname}).DbInsert(connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := connection.SendReceive(context.Background(), model.Message{
+		Type:   model.MessageTypeQuery,
+		Entity: register.EntityBase{Version: SampleV1.Version, Name: SampleV1.Name},
+		Query: query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+			{Field: FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+		}),
+		Cursor: &model.Cursor{Size: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Cursor == nil || resp.Cursor.Done {
+		t.Fatalf("Expected a cursor with more to come, got %+v", resp.Cursor)
+	}
+
+	other, err := ConnectToNodeWithHostAndPort("127.0.0.1", "5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	next := model.Message{
+		Type:   model.MessageTypeCursorNext,
+		Entity: register.EntityBase{Version: SampleV1.Version, Name: SampleV1.Name},
+		Cursor: &model.Cursor{Id: resp.Cursor.Id},
+	}
+	if resp, err = other.SendReceive(context.Background(), next); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != model.StatusError || resp.String != model.ErrCursorNotFound.Error() {
+		t.Fatalf("Expected the cursor to be hidden from another connection, got %+v", resp)
+	}
+	if resp, err = connection.SendReceive(context.Background(), next); err != nil || resp.Status != model.StatusSuccess || len(resp.Models) != 2 {
+		t.Fatalf("Expected the next chunk on the connection of the cursor, got %+v: %v", resp, err)
+	}
+}
+
 func TestQueryStringFilter(t *testing.T) {
 	entities := []*SampleV1.Sample{
 		{Name: "Alice", Surname: "Smith"},
@@ -1210,7 +1694,7 @@ func TestPingHandling(t *testing.T) {
 	}()
 
 	// Start handling the connection in the test node
-	go testNode.handleConnection(serverHConn)
+	go testNode.handleConnection(serverHConn, nil)
 
 	// Wait for test to complete or timeout
 	select {
@@ -1236,52 +1720,159 @@ func TestDialTimeoutConfig(t *testing.T) {
 	}
 }
 
-func BenchmarkHyperionInsert100kAndSort(b *testing.B) {
-	defer testutil.RecoverBenchHandler(b)
-
-	const totalRows = 1000000
-	var inserted []*SampleV1.Sample
+// startTLSNode starts an in-process node named name serving mTLS with the given certificates
+func startTLSNode(t *testing.T, certs util.TestCertificates, name string, peers ...*Node) *Node {
+	t.Helper()
 
-	// Insert fresh unique records every run
-	for i := 0; i < totalRows; i++ {
-		entity := &SampleV1.Sample{
-			Name: fmt.Sprintf("SortBench_Unique_%03d", totalRows-i), // reverse order for obvious sorting
-		}
-		if err := entity.DbInsert(connection); err != nil {
-			b.Fatalf("Insert failed: %v", err)
-		}
-		inserted = append(inserted, entity)
+	n := NewNode().
+		WithHost(name, "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithTLS(config.NodeTLS{Cert: certs.Cert[name], Key: certs.Key[name], CA: certs.CA})
+	for _, p := range peers {
+		n.AddPeer(NewNode().WithHost(p.Host.Name, p.Host.IP, p.Host.Port))
 	}
 
-	b.ReportAllocs()
-	b.ResetTimer()
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node %s: %v", name, err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+	return n
+}
 
-	for i := 0; i < b.N; i++ {
-		q := query.NewQuery().
-			SetFilters(query.FilterTypeOr, func() []query.Filter {
-				var filters []query.Filter
-				for _, e := range inserted {
-					filters = append(filters, query.Filter{
-						Field: SampleV1.FieldUuid,
-						Op:    query.OperatorTypeEqual,
-						Value: e.Uuid,
-					})
-				}
-				return filters
-			}()).
-			SetOrders([]query.Order{
-				{Type: query.OrderTypeAsc, Field: SampleV1.FieldName},
-			})
+// TestNodeTLS checks mTLS between clients and nodes, including the verification of host names on both sides
+func TestNodeTLS(t *testing.T) {
+	certs, err := util.GenerateTestCertificates(t.TempDir(), "TA", "TB", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := startTLSNode(t, certs, "TA")
+	address := n.getListenAddress()
+	clientTLS := config.NodeTLS{Cert: certs.Cert["client"], Key: certs.Key["client"], CA: certs.CA}
 
-		results, err := SampleV1.DbQuery(connection, q)
+	t.Run("Trusted client", func(t *testing.T) {
+		target := NewNode().WithHost("TA", n.Host.IP, n.Host.Port).WithTLS(clientTLS)
+		c, err := ConnectToNode(target)
 		if err != nil {
-			b.Fatal(err)
+			t.Fatal(err)
 		}
+		defer c.Close()
 
-		if len(results) != totalRows {
-			b.Fatalf("Expected %d results, got %d", totalRows, len(results))
+		if _, ok := c.C.(*tls.Conn); !ok {
+			t.Fatalf("Expected a TLS connection, got %T", c.C)
 		}
-
+		resp, err := c.SendReceive(context.Background(), model.Message{Type: model.MessageTypePing})
+		if err != nil || resp.Status != model.StatusSuccess {
+			t.Fatalf("Ping over TLS failed: %v, %+v", err, resp)
+		}
+	})
+
+	t.Run("Plain client", func(t *testing.T) {
+		if _, err := hconn.Dial(address, DialTimeout, nil, hconn.NewHello("", "")); err == nil {
+			t.Fatal("Expected plain connection to be refused")
+		}
+	})
+
+	t.Run("Wrong server name", func(t *testing.T) {
+		c, err := clientTLS.ClientConfig("TB")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = hconn.Dial(address, DialTimeout, c, hconn.NewHello("", "")); err == nil {
+			t.Fatal("Expected certificate of TA to be refused for TB")
+		}
+	})
+
+	t.Run("Missing client certificate", func(t *testing.T) {
+		c, err := config.NodeTLS{CA: certs.CA}.ClientConfig("TA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = hconn.Dial(address, DialTimeout, c, hconn.NewHello("", "")); err == nil {
+			t.Fatal("Expected connection without client certificate to be refused")
+		}
+	})
+
+	t.Run("Impersonated node", func(t *testing.T) {
+		c, err := clientTLS.ClientConfig("TA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = hconn.Dial(address, DialTimeout, c, hconn.NewHello("TB", ""))
+		if !errors.Is(err, model.ErrHandshakeRefused) {
+			t.Fatalf("Expected ErrHandshakeRefused for a client claiming to be TB, got %v", err)
+		}
+	})
+
+	t.Run("Peers", func(t *testing.T) {
+		b := startTLSNode(t, certs, "TB", n)
+		for i := 0; i < 100; i++ {
+			b.Mu.Lock()
+			status := b.Status
+			b.Mu.Unlock()
+			if status == StatusReady {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		p := b.Peers[0]
+		p.Mu.Lock()
+		defer p.Mu.Unlock()
+		if !p.PeerConnected {
+			t.Fatal("Expected TB to connect to TA over mTLS")
+		}
+	})
+}
+
+func BenchmarkHyperionInsert100kAndSort(b *testing.B) {
+	defer testutil.RecoverBenchHandler(b)
+
+	const totalRows = 1000000
+	var inserted []*SampleV1.Sample
+
+	// Insert fresh unique records every run
+	for i := 0; i < totalRows; i++ {
+		entity := &SampleV1.Sample{
+			Name: fmt.Sprintf("SortBench_Unique_%03d", totalRows-i), // reverse order for obvious sorting
+		}
+		if err := entity.DbInsert(connection); err != nil {
+			b.Fatalf("Insert failed: %v", err)
+		}
+		inserted = append(inserted, entity)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		q := query.NewQuery().
+			SetFilters(query.FilterTypeOr, func() []query.Filter {
+				var filters []query.Filter
+				for _, e := range inserted {
+					filters = append(filters, query.Filter{
+						Field: SampleV1.FieldUuid,
+						Op:    query.OperatorTypeEqual,
+						Value: e.Uuid,
+					})
+				}
+				return filters
+			}()).
+			SetOrders([]query.Order{
+				{Type: query.OrderTypeAsc, Field: SampleV1.FieldName},
+			})
+
+		results, err := SampleV1.DbQuery(connection, q)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if len(results) != totalRows {
+			b.Fatalf("Expected %d results, got %d", totalRows, len(results))
+		}
+
 		for j := 1; j < len(results); j++ {
 			if results[j].Name < results[j-1].Name {
 				b.Fatalf("Sort order incorrect at index %d: %s < %s", j, results[j].Name, results[j-1].Name)
@@ -1289,3 +1880,1458 @@ func BenchmarkHyperionInsert100kAndSort(b *testing.B) {
 		}
 	}
 }
+
+// TestAuthenticateUnknownUser checks that the login of an unknown user costs as much as the one of a known user,
+// so that the time taken does not tell whether the user exists
+func TestAuthenticateUnknownUser(t *testing.T) {
+	original := config.PasswordIterations
+	defer func() { config.PasswordIterations = original }()
+	config.PasswordIterations = 100_000
+
+	password, err := config.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := config.Auth{Users: []config.User{{Name: "known", Password: password}}}
+	elapsed := func(user string) time.Duration {
+		start := time.Now()
+		if _, err := auth.Authenticate(model.Credentials{User: user, Password: "wrong"}); !errors.Is(err, model.ErrAuthFailed) {
+			t.Fatalf("Expected ErrAuthFailed for %s, got %v", user, err)
+		}
+		return time.Since(start)
+	}
+	elapsed("unknown")
+	if known, unknown := elapsed("known"), elapsed("unknown"); unknown < known/4 {
+		t.Errorf("Expected an unknown user to take about as long as a known one, got %s and %s", unknown, known)
+	}
+}
+
+// TestNodeAuth checks that clients authenticate in the handshake and are limited to the permissions of their roles
+func TestNodeAuth(t *testing.T) {
+	original := config.PasswordIterations
+	defer func() { config.PasswordIterations = original }()
+	config.PasswordIterations = 1000
+
+	password, err := config.HashPassword("reader-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := config.Auth{
+		Users: []config.User{
+			{Name: "reader", Password: password, Roles: []string{"readers"}},
+			{Name: "writer", Tokens: []string{config.HashToken("writer-token")}, Roles: []string{"writers"}},
+		},
+		Roles: []config.Role{
+			{Name: "readers", Permissions: []config.Permission{{Entity: "*", Actions: []model.Action{model.ActionRead}}}},
+			{Name: "writers", Permissions: []config.Permission{{Entity: SampleV1.Name, Actions: []model.Action{model.ActionRead, model.ActionWrite}}}},
+		},
+	}
+
+	n := NewNode().
+		WithHost("AUTH", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithAuth(auth).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+
+	dial := func(c *model.Credentials) (*hconn.HConn, error) {
+		hello := hconn.NewHello("", "")
+		hello.Credentials = c
+		return hconn.Dial(n.getListenAddress(), DialTimeout, nil, hello)
+	}
+
+	refused := []struct {
+		name        string
+		credentials *model.Credentials
+		err         error
+	}{
+		{"No credentials", nil, model.ErrAuthRequired},
+		{"Wrong password", &model.Credentials{User: "reader", Password: "nope"}, model.ErrAuthFailed},
+		{"Unknown user", &model.Credentials{User: "nobody", Password: "reader-password"}, model.ErrAuthFailed},
+		{"Wrong token", &model.Credentials{Token: "nope"}, model.ErrAuthFailed},
+	}
+	for _, tt := range refused {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := dial(tt.credentials)
+			if !errors.Is(err, model.ErrHandshakeRefused) || !strings.Contains(err.Error(), tt.err.Error()) {
+				t.Fatalf("Expected refusal with [%v], got %v", tt.err, err)
+			}
+		})
+	}
+
+	writer, err := dial(&model.Credentials{Token: "writer-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	reader, err := dial(&model.Credentials{User: "reader", Password: "reader-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	s := &SampleV1.Sample{Uuid: uuid.New(), Name: "auth"}
+	if err = s.DbInsert(writer); err != nil {
+		t.Fatalf("Writer failed to insert: %v", err)
+	}
+	if err = s.DbInsert(reader); err == nil || !strings.Contains(err.Error(), model.ErrAuthForbidden.Error()) {
+		t.Fatalf("Expected reader insert to be forbidden, got %v", err)
+	}
+	if err = s.DbDelete(writer); err == nil || !strings.Contains(err.Error(), "cannot [delete]") {
+		t.Fatalf("Expected writer delete to be forbidden, got %v", err)
+	}
+
+	// The memory of the generated entities is shared with other in-process nodes, look for the inserted one
+	all, err := SampleV1.DbGetAll(reader)
+	if err != nil {
+		t.Fatalf("Reader failed to get all: %v", err)
+	}
+	if !slices.ContainsFunc(all, func(e *SampleV1.Sample) bool { return e.Uuid == s.Uuid }) {
+		t.Fatalf("Expected reader to get the inserted entity")
+	}
+
+	// Messages whose type has no permission yet are reserved to admins
+	resp, err := reader.SendReceive(context.Background(), model.Message{Type: model.MessageTypeUndefined})
+	if err != nil || resp.Status != model.StatusError || !strings.Contains(resp.String, "cannot [admin]") {
+		t.Fatalf("Expected undefined message to be forbidden, got %+v: %v", resp, err)
+	}
+	resp, err = reader.SendReceive(context.Background(), model.Message{Type: model.MessageTypePing})
+	if err != nil || resp.Status != model.StatusSuccess {
+		t.Fatalf("Expected ping to be allowed, got %+v: %v", resp, err)
+	}
+}
+
+// TestCursorOfAnotherEntity checks that a cursor can only be read through the entity it was opened on
+func TestCursorOfAnotherEntity(t *testing.T) {
+	var c cursors
+	var first model.Message
+	c.start(SampleV1.Name, make([]register.Model, 10), 3, &first)
+
+	var next model.Message
+	if err := c.next(first.Cursor.Id, "Other", &next); !errors.Is(err, model.ErrCursorNotFound) {
+		t.Fatalf("Expected cursor to be hidden from another entity, got %v", err)
+	}
+	if err := c.next(first.Cursor.Id, SampleV1.Name, &next); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNodeAudit checks that inserts, updates and deletes are audited with their client and outcome, refused ones included
+func TestNodeAudit(t *testing.T) {
+	dir := t.TempDir()
+	n := NewNode().
+		WithHost("AUDIT", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithAudit(audit.NewLog(dir)).
+		WithAuth(config.Auth{
+			Users: []config.User{{Name: "writer", Tokens: []string{config.HashToken("writer-token")}, Roles: []string{"writers"}}},
+			Roles: []config.Role{{Name: "writers", Permissions: []config.Permission{{Entity: "*", Actions: []model.Action{model.ActionRead, model.ActionWrite}}}}},
+		}).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+
+	hello := hconn.NewHello("", "")
+	hello.Credentials = &model.Credentials{Token: "writer-token"}
+	c, err := hconn.Dial(n.getListenAddress(), DialTimeout, nil, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	s := &SampleV1.Sample{Uuid: uuid.New(), Name: "audit"}
+	if err = s.DbInsert(c); err != nil {
+		t.Fatal(err)
+	}
+	s.Name = "audited"
+	if err = s.DbUpdate(c); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DbDelete(c); err == nil {
+		t.Fatal("Expected delete to be forbidden")
+	}
+	if _, err = SampleV1.DbGetAll(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutdown flushes the log
+	if err = n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []audit.Record
+	for r, err := range audit.Read(dir, audit.Filter{From: start, Entity: SampleV1.Name}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected insert, update and delete to be audited, got %d records", len(records))
+	}
+
+	expected := []struct {
+		operation string
+		status    model.Status
+	}{
+		{audit.OperationInsert, model.StatusSuccess},
+		{audit.OperationUpdate, model.StatusSuccess},
+		{audit.OperationDelete, model.StatusError},
+	}
+	for i, r := range records {
+		if r.Operation != expected[i].operation || r.Status != expected[i].status {
+			t.Errorf("Record %d: expected %s with status %d, got %+v", i, expected[i].operation, expected[i].status, r)
+		}
+		if r.User != "writer" || r.Uuid != s.Uuid || r.Version != SampleV1.Version || r.Remote != c.C.LocalAddr().String() {
+			t.Errorf("Record %d does not identify the request: %+v", i, r)
+		}
+	}
+	if !strings.Contains(records[2].Error, model.ErrAuthForbidden.Error()) {
+		t.Errorf("Expected the refused delete to record why, got [%s]", records[2].Error)
+	}
+}
+
+func startLimitedNode(t *testing.T, l config.NodeLimits) *Node {
+	t.Helper()
+	n := NewNode().
+		WithHost("LIMITS", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithLimits(l)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+	return n
+}
+
+// topology sends a request subject to the limits, unlike pings
+func topology(t *testing.T, c *hconn.HConn) model.Status {
+	t.Helper()
+	resp, err := c.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTopology})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Status
+}
+
+// TestNodeLimits checks the admission of connections and the throttling of requests by connection and by client
+func TestNodeLimits(t *testing.T) {
+	t.Run("Max connections", func(t *testing.T) {
+		n := startLimitedNode(t, config.NodeLimits{MaxConnections: 2})
+		dial := func() (*hconn.HConn, error) {
+			return hconn.Dial(n.getListenAddress(), DialTimeout, nil, hconn.NewHello("", ""))
+		}
+
+		first, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = dial(); !errors.Is(err, model.ErrHandshakeRefused) || !strings.Contains(err.Error(), model.ErrLimitConnections.Error()) {
+			t.Fatalf("Expected third connection to be refused, got %v", err)
+		}
+
+		// Closing a connection frees its slot once the node notices
+		_ = first.Close()
+		deadline := time.Now().Add(time.Second)
+		for {
+			c, err := dial()
+			if err == nil {
+				c.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Slot was not released: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		second.Close()
+	})
+
+	t.Run("Connection rate", func(t *testing.T) {
+		n := startLimitedNode(t, config.NodeLimits{ConnectionRate: 1, ConnectionBurst: 2})
+		c, err := hconn.Dial(n.getListenAddress(), DialTimeout, nil, hconn.NewHello("", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if topology(t, c) != model.StatusSuccess || topology(t, c) != model.StatusSuccess {
+			t.Fatal("Expected the burst to be allowed")
+		}
+		resp, err := c.SendReceive(context.Background(), model.Message{Type: model.MessageTypeTopology})
+		if err != nil || resp.Status != model.StatusThrottled || resp.String != model.ErrLimitRate.Error() {
+			t.Fatalf("Expected request over the burst to be throttled, got %+v: %v", resp, err)
+		}
+		resp, err = c.SendReceive(context.Background(), model.Message{Type: model.MessageTypePing})
+		if err != nil || resp.Status != model.StatusSuccess {
+			t.Fatalf("Expected pings not to be limited, got %+v: %v", resp, err)
+		}
+
+		// Another connection has its own bucket
+		other, err := hconn.Dial(n.getListenAddress(), DialTimeout, nil, hconn.NewHello("", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		if topology(t, other) != model.StatusSuccess {
+			t.Fatal("Expected another connection not to be throttled")
+		}
+	})
+
+	t.Run("Client rate", func(t *testing.T) {
+		n := startLimitedNode(t, config.NodeLimits{ClientRate: 1, ClientBurst: 2})
+		var conns []*hconn.HConn
+		for range 3 {
+			c, err := hconn.Dial(n.getListenAddress(), DialTimeout, nil, hconn.NewHello("", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			conns = append(conns, c)
+		}
+
+		// Every connection comes from the same IP, so they share the burst
+		statuses := []model.Status{topology(t, conns[0]), topology(t, conns[1]), topology(t, conns[2])}
+		if !slices.Equal(statuses, []model.Status{model.StatusSuccess, model.StatusSuccess, model.StatusThrottled}) {
+			t.Fatalf("Expected the third request of the client to be throttled, got %v", statuses)
+		}
+	})
+}
+
+// TestLimiterInFlight checks that requests beyond MaxInFlight are throttled until a slot is freed
+func TestLimiterInFlight(t *testing.T) {
+	l := newLimiter(config.NodeLimits{MaxInFlight: 1})
+	if err := l.begin(model.MessageTypeQuery, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.begin(model.MessageTypeQuery, nil, nil); !errors.Is(err, model.ErrLimitInFlight) {
+		t.Fatalf("Expected ErrLimitInFlight, got %v", err)
+	}
+	if err := l.begin(model.MessageTypePing, nil, nil); err != nil {
+		t.Fatalf("Expected pings not to need a slot, got %v", err)
+	}
+	l.end(model.MessageTypePing)
+	l.end(model.MessageTypeQuery)
+	if err := l.begin(model.MessageTypeQuery, nil, nil); err != nil {
+		t.Fatalf("Expected the slot to be free again, got %v", err)
+	}
+
+	var unlimited *limiter
+	if err := unlimited.begin(model.MessageTypeQuery, nil, nil); err != nil || !unlimited.admit() {
+		t.Fatalf("Expected a nil limiter to allow everything, got %v", err)
+	}
+}
+
+// TestBucketRefill checks that a token bucket refills at its rate and never above its burst
+func TestBucketRefill(t *testing.T) {
+	b := newBucket(100, 2)
+	if !allow(b) || !allow(b) || allow(b) {
+		t.Fatal("Expected a burst of exactly 2")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !allow(b) || !allow(b) || allow(b) {
+		t.Fatal("Expected the bucket to refill up to its burst only")
+	}
+	if newBucket(0.5, 0).burst != 1 || newBucket(10, 0).burst != 10 {
+		t.Fatal("Expected the default burst to be one second worth of tokens, at least 1")
+	}
+}
+
+// TestBucketsRefusedTogether checks that a request refused by one bucket spends no token of the others
+func TestBucketsRefusedTogether(t *testing.T) {
+	conn, client := newBucket(0.001, 2), newBucket(0.001, 1)
+	if !allow(conn, client) {
+		t.Fatal("Expected the first request to be allowed")
+	}
+	for range 3 {
+		if allow(conn, client) {
+			t.Fatal("Expected the client bucket to refuse the request")
+		}
+	}
+	if !allow(conn) || allow(conn) {
+		t.Fatal("Expected the connection bucket to have spent only the token of the allowed request")
+	}
+}
+
+// TestNodeMetrics checks the series a node exposes once it served requests, and that its collectors go away on shutdown
+func TestNodeMetrics(t *testing.T) {
+	n := NewNode().
+		WithHost("METRICS", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+
+	c, err := ConnectToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := &SampleV1.Sample{Uuid: uuid.New(), Name: "metrics"}
+	if err = s.DbInsert(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.SendReceive(context.Background(), model.Message{Type: model.MessageTypeInsert, Entity: register.EntityBase{Name: "Made up"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(metrics.Default.Write())
+	for _, l := range []string{
+		`hyperion_requests_total{node="METRICS",type="insert",entity="Sample",status="success"} 1`,
+		`hyperion_requests_total{node="METRICS",type="insert",entity="",status="error"} 1`,
+		`hyperion_request_duration_seconds_count{node="METRICS",type="insert",entity="Sample"} 1`,
+		`hyperion_connections_active{node="METRICS"} 1`,
+		`hyperion_entity_rows{node="METRICS",entity="Sample",version="v1"} `,
+		`hyperion_disk_file_bytes{node="METRICS",entity="Sample",version="v1"} `,
+	} {
+		if !strings.Contains(out, l) {
+			t.Errorf("Expected [%s] in the metrics", l)
+		}
+	}
+
+	if err = n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if out = string(metrics.Default.Write()); strings.Contains(out, `hyperion_entity_rows{node="METRICS"`) {
+		t.Errorf("Expected the collectors of the node to be unregistered on shutdown")
+	}
+}
+
+func probe(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Code, w.Body.String()
+}
+
+// TestNodeStatusEndpoints checks the probes through the life of a node and the report of /status
+func TestNodeStatusEndpoints(t *testing.T) {
+	n := NewNode().
+		WithClusterName("status").
+		WithHost("STATUS", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		AddEntity(SampleV1.Name)
+	h := n.Handler()
+
+	if code, _ := probe(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("Expected a starting node to be healthy, got %d", code)
+	}
+	if code, body := probe(t, h, "/readyz"); code != http.StatusServiceUnavailable || body != "starting\n" {
+		t.Errorf("Expected a starting node not to be ready, got %d %q", code, body)
+	}
+
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, _ := probe(t, h, "/readyz")
+		if code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Node never became ready, last answer %d", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, err := ConnectToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = (&SampleV1.Sample{Uuid: uuid.New(), Name: "status"}).DbInsert(c); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := probe(t, h, "/status")
+	if code != http.StatusOK {
+		t.Fatalf("Expected /status to answer 200, got %d", code)
+	}
+	var r StatusReport
+	if err = json.Unmarshal([]byte(body), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Node != "STATUS" || r.Cluster != "status" || r.Status != StatusReady.String() || r.Build.GoVersion == "" {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+	if len(r.Entities) != 1 {
+		t.Fatalf("Expected 1 entity, got %+v", r.Entities)
+	}
+	e := r.Entities[0]
+	if e.Name != SampleV1.Name || e.Version != SampleV1.Version || e.Rows < 1 || e.Size == 0 ||
+		e.Path != filepath.Join(n.Path.Data, SampleV1.DbFileName) {
+		t.Errorf("Unexpected entity status: %+v", e)
+	}
+
+	if err = n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body = probe(t, h, "/healthz"); code != http.StatusServiceUnavailable || body != "shutdown\n" {
+		t.Errorf("Expected a node shut down not to be healthy, got %d %q", code, body)
+	}
+}
+
+// spanRecorder is a trace.Exporter keeping the spans exported by a node
+type spanRecorder struct {
+	mu      sync.Mutex
+	records []trace.Record
+}
+
+func (x *spanRecorder) Export(records []trace.Record) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.records = append(x.records, records...)
+	return nil
+}
+
+func (x *spanRecorder) Close() error {
+	return nil
+}
+
+// tracedRequester sends every request as a child of span, as a traced client would
+type tracedRequester struct {
+	hc   *hconn.HConn
+	span *trace.Span
+}
+
+func (x tracedRequester) SendReceive(ctx context.Context, msg model.Message) (model.Message, error) {
+	msg.Trace = x.span.Context()
+	return x.hc.SendReceive(ctx, msg)
+}
+
+// TestNodeTracing checks that a node continues the trace of its clients and records the steps of their requests
+func TestNodeTracing(t *testing.T) {
+	recorder := &spanRecorder{}
+	n := NewNode().
+		WithHost("TRACING", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithTracer(trace.NewTracer("TRACING", recorder)).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+
+	c, err := ConnectToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	client := trace.NewTracer("client", &spanRecorder{})
+	insert := client.Span("insert", nil)
+	s := &SampleV1.Sample{Uuid: uuid.New(), Name: "Tracing", Surname: "Traced"}
+	if err = s.DbInsert(tracedRequester{hc: c, span: insert}); err != nil {
+		t.Fatal(err)
+	}
+	// Ordered by a field without a range index, so that the rows are filtered and then sorted
+	search := client.Span("query", nil)
+	q := query.NewQuery().
+		SetFilters(query.FilterTypeAnd, []query.Filter{{Field: SampleV1.FieldSurname, Op: query.OperatorTypeContains, Value: "Trace"}}).
+		AddOrder(query.OrderTypeAsc, SampleV1.FieldUuid)
+	if _, err = SampleV1.DbQuery(tracedRequester{hc: c, span: search}, q); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutdown exports the spans left
+	if err = n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	children := func(parent trace.SpanId) map[string]trace.Record {
+		out := make(map[string]trace.Record)
+		for _, r := range recorder.records {
+			if r.ParentId == parent {
+				out[r.Name] = r
+			}
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		span  *trace.Span
+		steps []string
+	}{
+		{insert, []string{"decode", "disk write"}},
+		{search, []string{"index lookup", "filter", "sort"}},
+	} {
+		received, ok := children(tc.span.SpanId())["receive"]
+		if !ok {
+			t.Fatalf("Expected a receive span child of the client span %s", tc.span.SpanId())
+		}
+		if received.TraceId != tc.span.TraceId() || received.Kind != trace.KindServer || received.Attributes["status"] != "success" {
+			t.Errorf("Unexpected receive span: %+v", received)
+		}
+		steps := children(received.SpanId)
+		for _, name := range tc.steps {
+			if _, ok = steps[name]; !ok {
+				t.Errorf("Expected a %s span in %s, got %v", name, received.Attributes["type"], steps)
+			}
+		}
+	}
+}
+
+// TestSlowQueryLog checks that slow queries are kept with their plan, the newest first, and served over HTTP
+func TestSlowQueryLog(t *testing.T) {
+	n := NewNode().
+		WithHost("SLOW", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithSlowLog(config.NodeSlowLog{Threshold: config.Duration(time.Nanosecond), Size: 2}).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+
+	c, err := ConnectToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	surname := uuid.NewString()
+	for _, name := range []string{"b", "a"} {
+		if err = (&SampleV1.Sample{Uuid: uuid.New(), Name: name, Surname: surname}).DbInsert(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queries := []*query.Query{
+		query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{{Field: SampleV1.FieldName, Op: query.OperatorTypeEqual, Value: "unused"}}),
+		query.NewQuery().SetFilters(query.FilterTypeOr, []query.Filter{
+			{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+			{Field: SampleV1.FieldName, Op: query.OperatorTypeEqual, Value: "none"},
+		}),
+		query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{{Field: SampleV1.FieldSurname, Op: query.OperatorTypeContains, Value: surname}}).
+			AddOrder(query.OrderTypeAsc, SampleV1.FieldUuid).SetLimit(1),
+	}
+	for _, q := range queries {
+		if _, err = SampleV1.DbQuery(c, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slow := n.SlowQueries()
+	if len(slow) != 2 {
+		t.Fatalf("Expected the 2 latest slow queries, got %d", len(slow))
+	}
+	scan, union := slow[0], slow[1]
+	if scan.Entity != SampleV1.Name || scan.Version != SampleV1.Version || scan.Duration <= 0 || scan.Query.Limit != 1 {
+		t.Errorf("Unexpected slow query: %+v", scan)
+	}
+	if p := scan.Plan; p.Strategy != query.PlanScan || len(p.Indexes) != 0 || p.Scanned < 2 || p.Sorted != 2 || p.Results != 1 || p.Parallel {
+		t.Errorf("Unexpected plan of the scan: %+v", p)
+	}
+	if p := union.Plan; p.Strategy != query.PlanUnion || len(p.Indexes) != 2 || p.Indexes[0].Rows != 2 || p.Indexes[1].Rows != 0 || p.Scanned != 0 || p.Results != 2 {
+		t.Errorf("Unexpected plan of the union: %+v", p)
+	}
+
+	code, body := probe(t, n.Handler(), "/slow-queries")
+	var served []SlowQuery
+	if err = json.Unmarshal([]byte(body), &served); err != nil || code != http.StatusOK || len(served) != 2 {
+		t.Fatalf("Expected /slow-queries to serve the 2 slow queries, got %d %s: %v", code, body, err)
+	}
+	if f := served[1].Query.Filters.Filters; len(f) != 2 || f[0].Field != SampleV1.FieldSurname || f[0].Value != nil || strings.Contains(body, surname) {
+		t.Errorf("Expected /slow-queries to serve the filters without their values, got %s", body)
+	}
+	if union.Query.Filters.Filters[0].Value != surname {
+		t.Errorf("Expected the slow queries kept to keep their values, got %+v", union.Query)
+	}
+}
+
+// TestNodeStatusServer checks that Start serves Handler on the status address and that its token guards the reports
+func TestNodeStatusServer(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", util.GetAvailablePort())
+	n := NewNode().
+		WithHost("STATUS_HTTP", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		WithStatusHTTP(config.NodeStatus{Address: addr, Token: config.HashToken("status-token")}).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	// Reports requested while the node starts, which the race detector checks
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for n.Report().Status != StatusReady.String() {
+			req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/status", nil)
+			req.Header.Set("Authorization", "Bearer status-token")
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				_ = resp.Body.Close()
+			}
+		}
+	}()
+	n.WaitStatusActive()
+	<-polled
+
+	get := func(path, token string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, tc := range []struct {
+		path  string
+		token string
+		code  int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/status", "", http.StatusUnauthorized},
+		{"/status", "wrong", http.StatusUnauthorized},
+		{"/status", "status-token", http.StatusOK},
+		{"/slow-queries", "", http.StatusUnauthorized},
+		{"/slow-queries", "status-token", http.StatusOK},
+	} {
+		if code := get(tc.path, tc.token); code != tc.code {
+			t.Errorf("Expected %s with token %q to answer %d, got %d", tc.path, tc.token, tc.code, code)
+		}
+	}
+
+	if err := n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		t.Errorf("Expected the status server to be closed on shutdown")
+	}
+}
+
+// TestNodeStatusServerStartFailure checks that the status server is closed when Start fails after starting it
+func TestNodeStatusServerStartFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+
+	addr := fmt.Sprintf("127.0.0.1:%d", util.GetAvailablePort())
+	n := NewNode().
+		WithHost("STATUS_FAIL", "127.0.0.1", port).
+		WithPath(t.TempDir()).
+		WithStatusHTTP(config.NodeStatus{Address: addr})
+	if err = n.Start(); err == nil {
+		t.Fatal("Expected Start to fail on a port already taken")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected the status address to be released, got %v", err)
+	}
+	_ = l.Close()
+}
+
+// TestSlowLogThreshold checks that fast queries are ignored and that a disabled log records nothing
+func TestSlowLogThreshold(t *testing.T) {
+	l := newSlowLog(config.NodeSlowLog{Threshold: config.Duration(time.Second)})
+	l.record(SlowQuery{Duration: time.Millisecond})
+	l.record(SlowQuery{Duration: 2 * time.Second})
+	if r := l.recent(); len(r) != 1 || r[0].Duration != 2*time.Second {
+		t.Errorf("Expected only the slow query, got %+v", r)
+	}
+
+	disabled := newSlowLog(config.NodeSlowLog{})
+	disabled.record(SlowQuery{Duration: time.Hour})
+	if r := disabled.recent(); len(r) != 0 {
+		t.Errorf("Expected a disabled log to record nothing, got %+v", r)
+	}
+}
+
+func TestQueryExplain(t *testing.T) {
+	n := NewNode().
+		WithHost("EXPLAIN", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+
+	c, err := ConnectToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	surname, alice, bob := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	for _, name := range []string{alice, alice, bob} {
+		if err = (&SampleV1.Sample{Uuid: uuid.New(), Name: name, Surname: surname}).DbInsert(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	intersect := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+		{Field: SampleV1.FieldName, Op: query.OperatorTypeEqual, Value: alice},
+		{Field: SampleV1.FieldName, Op: query.OperatorTypeContains, Value: alice[:8]},
+	})
+	p, err := SampleV1.DbExplain(c, intersect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Name and Surname are the fields of the composite index fullname, looked up at once
+	if !p.Explained || p.Strategy != query.PlanIntersect || len(p.Indexes) != 1 ||
+		p.Indexes[0] != (query.PlanIndex{Field: SampleV1.FieldName, Composite: "fullname", Rows: 2}) ||
+		len(p.Filtered) != 1 || p.Filtered[0] != SampleV1.FieldName || p.Scanned != 2 || p.Results != 2 || p.Parallel {
+		t.Errorf("Unexpected plan of the intersection: %+v", p)
+	}
+
+	rows := SampleV1.New().MemoryCount()
+	scan := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: SampleV1.FieldSurname, Op: query.OperatorTypeContains, Value: surname},
+	}).AddOrder(query.OrderTypeAsc, SampleV1.FieldName).SetLimit(1)
+	if p, err = SampleV1.DbExplain(c, scan); err != nil {
+		t.Fatal(err)
+	}
+	// Without a filter answered by the indexes, the rows are read in order from the range index of the order
+	if p.Strategy != query.PlanRange || len(p.Indexes) != 1 || p.Indexes[0] != (query.PlanIndex{Field: SampleV1.FieldName, Range: true, Rows: rows}) ||
+		p.Scanned != rows || !p.Ordered || p.Sorted != 0 || len(p.Orders) != 1 || p.Limit != 1 || p.Results != 1 || p.Lookup != 0 {
+		t.Errorf("Unexpected plan of the scan over %d rows: %+v", rows, p)
+	}
+
+	// An Or is only answered by the indexes when every filter can be looked up
+	mixed := query.NewQuery().SetFilters(query.FilterTypeOr, []query.Filter{
+		{Field: SampleV1.FieldName, Op: query.OperatorTypeEqual, Value: bob},
+		{Field: SampleV1.FieldSurname, Op: query.OperatorTypeContains, Value: surname},
+	})
+	if p, err = SampleV1.DbExplain(c, mixed); err != nil {
+		t.Fatal(err)
+	}
+	if p.Strategy != query.PlanScan || len(p.Indexes) != 0 || len(p.Filtered) != 2 {
+		t.Errorf("Unexpected plan of the mixed Or: %+v", p)
+	}
+
+	// Uuid is tagged noindex, so it is filtered on every row
+	first := SampleV1.New().MemoryGetAll()[0].(*SampleV1.Sample)
+	byUuid := query.NewQuery().Where(query.Filter{Field: SampleV1.FieldUuid, Op: query.OperatorTypeEqual, Value: first.Uuid})
+	if p, err = SampleV1.DbExplain(c, byUuid); err != nil {
+		t.Fatal(err)
+	}
+	if p.Strategy != query.PlanScan || len(p.Indexes) != 0 || len(p.Filtered) != 1 || p.Filtered[0] != SampleV1.FieldUuid {
+		t.Errorf("Unexpected plan of the filter on a field not indexed: %+v", p)
+	}
+	if found, err := SampleV1.DbQuery(c, byUuid); err != nil || len(found) != 1 || found[0].Uuid != first.Uuid {
+		t.Errorf("Expected %s, got %+v: %v", first.Uuid, found, err)
+	}
+
+	unknown := query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{{Field: 99, Op: query.OperatorTypeEqual, Value: bob}})
+	if _, err = SampleV1.DbExplain(c, unknown); err == nil || err.Error() != model.ErrQueryEntityFieldNotFound.Error() {
+		t.Errorf("Expected %v, got %v", model.ErrQueryEntityFieldNotFound, err)
+	}
+
+	// The filters that are not looked up still apply to the rows found in the indexes
+	results, err := SampleV1.DbQuery(c, query.NewQuery().SetFilters(query.FilterTypeAnd, []query.Filter{
+		{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+		{Field: SampleV1.FieldName, Op: query.OperatorTypeContains, Value: bob[:8]},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != bob {
+		t.Errorf("Expected only %s, got %+v", bob, results)
+	}
+}
+
+func TestQueryNestedFilters(t *testing.T) {
+	surname, alice, bob, carol := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+	for _, name := range []string{alice, alice, bob, carol} {
+		if err := (&SampleV1.Sample{Uuid: uuid.New(), Name: name, Surname: surname}).DbInsert(connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := func(op query.OperatorType, v string) query.Filter {
+		return query.Filter{Field: SampleV1.FieldName, Op: op, Value: v}
+	}
+	sameSurname := query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname}
+
+	cases := []struct {
+		name     string
+		filters  query.Filters
+		expected []string
+		strategy string
+		indexes  int
+		filtered int
+	}{
+		{
+			name:     "or group within and",
+			filters:  query.And(query.Or(name(query.OperatorTypeEqual, alice), name(query.OperatorTypeEqual, bob)), sameSurname),
+			expected: []string{alice, alice, bob},
+			strategy: query.PlanIntersect, indexes: 3,
+		},
+		{
+			name:     "not within and",
+			filters:  query.And(sameSurname, query.Not(name(query.OperatorTypeEqual, alice))),
+			expected: []string{bob, carol},
+			strategy: query.PlanIntersect, indexes: 1, filtered: 1,
+		},
+		{
+			name:     "and group within or",
+			filters:  query.Or(name(query.OperatorTypeEqual, alice), query.And(sameSurname, name(query.OperatorTypeContains, carol[:8]))),
+			expected: []string{alice, alice, carol},
+			strategy: query.PlanUnion, indexes: 2, filtered: 3,
+		},
+		{
+			name:     "not at the top",
+			filters:  query.And(query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeContains, Value: surname}, query.Not(query.Or(name(query.OperatorTypeEqual, alice), name(query.OperatorTypeEqual, carol)))),
+			expected: []string{bob},
+			strategy: query.PlanScan, filtered: 3,
+		},
+	}
+	for _, c := range cases {
+		q := query.NewQuery().Where(c.filters)
+		results, err := SampleV1.DbQuery(connection, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+		}
+		slices.Sort(names)
+		expected := slices.Sorted(slices.Values(c.expected))
+		if !slices.Equal(names, expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, expected, names)
+		}
+
+		p, err := SampleV1.DbExplain(connection, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Strategy != c.strategy || len(p.Indexes) != c.indexes || len(p.Filtered) != c.filtered {
+			t.Errorf("%s: unexpected plan %+v", c.name, p)
+		}
+	}
+}
+
+func TestQuerySetOperators(t *testing.T) {
+	surname, alice, bob, carol := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+	day := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	entities := []*SampleV1.Sample{
+		{Uuid: uuid.New(), Name: alice, Surname: surname, Birth: day},
+		{Uuid: uuid.New(), Name: bob, Surname: surname, Birth: day.AddDate(0, 0, 1)},
+		{Uuid: uuid.New(), Name: carol, Surname: surname},
+	}
+	for _, e := range entities {
+		if err := e.DbInsert(connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sameSurname := query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname}
+
+	cases := []struct {
+		name     string
+		filter   query.Filter
+		expected []string
+	}{
+		{"in", query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeIn, Value: []string{alice, carol, uuid.NewString()}}, []string{alice, carol}},
+		{"not in", query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeNotIn, Value: []string{alice, carol}}, []string{bob}},
+		{"between", query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeBetween, Value: []time.Time{day, day.AddDate(0, 0, 1)}}, []string{alice, bob}},
+		{"is zero", query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeIsZero}, []string{carol}},
+		{"not zero", query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeNotZero}, []string{alice, bob}},
+	}
+	for _, c := range cases {
+		results, err := SampleV1.DbQuery(connection, query.NewQuery().Where(query.And(sameSurname, c.filter)))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+		}
+		slices.Sort(names)
+		expected := slices.Sorted(slices.Values(c.expected))
+		if !slices.Equal(names, expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, expected, names)
+		}
+	}
+
+	// An In alone is answered by the index, as the union of the lookups of its values
+	in := query.NewQuery().Where(query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeIn, Value: []string{alice, bob}})
+	p, err := SampleV1.DbExplain(connection, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Strategy != query.PlanIntersect || len(p.Indexes) != 1 || p.Indexes[0].Rows != 2 || len(p.Filtered) != 0 {
+		t.Errorf("Unexpected plan of the in: %+v", p)
+	}
+	results, err := SampleV1.DbQuery(connection, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Expected %s and %s, got %+v", alice, bob, results)
+	}
+}
+
+func TestQueryStringPatterns(t *testing.T) {
+	surname := uuid.NewString()
+	for _, name := range []string{"Ångström", "ANGSTROM-7", "order_1", "order-2"} {
+		if err := (&SampleV1.Sample{Uuid: uuid.New(), Name: name, Surname: surname}).DbInsert(connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sameSurname := query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname}
+
+	cases := []struct {
+		name     string
+		filter   query.Filter
+		expected []string
+	}{
+		{"equal fold", query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeEqualFold, Value: "åNGSTRÖM"}, []string{"Ångström"}},
+		{"contains fold", query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeContainsFold, Value: "strom"}, []string{"ANGSTROM-7"}},
+		{"starts with fold", query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeStartsWithFold, Value: "ORDER"}, []string{"order-2", "order_1"}},
+		{"matches", query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeMatches, Value: `-\d$`}, []string{"ANGSTROM-7", "order-2"}},
+		{"like", query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeLike, Value: `order\__`}, []string{"order_1"}},
+	}
+	for _, c := range cases {
+		results, err := SampleV1.DbQuery(connection, query.NewQuery().Where(query.And(sameSurname, c.filter)))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, names)
+		}
+	}
+
+	bad := query.NewQuery().Where(query.And(sameSurname, query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeMatches, Value: `order-(`}))
+	if _, err := SampleV1.DbQuery(connection, bad); err == nil || !strings.HasPrefix(err.Error(), model.ErrQueryFilterInvalid.Error()) {
+		t.Errorf("Expected %v, got %v", model.ErrQueryFilterInvalid, err)
+	}
+	if _, err := SampleV1.DbExplain(connection, bad); err == nil || !strings.HasPrefix(err.Error(), model.ErrQueryFilterInvalid.Error()) {
+		t.Errorf("Expected %v from explain, got %v", model.ErrQueryFilterInvalid, err)
+	}
+}
+
+// TestPlanOrRangeNotAbsorbed checks that an Or with a range filter its range can't hold is scanned
+func TestPlanOrRangeNotAbsorbed(t *testing.T) {
+	var ext *register.EntityExtension
+	for _, e := range register.Entities {
+		if e.EntityBase.Name == SampleV1.Name && e.EntityBase.Version == SampleV1.Version {
+			ext = e.EntityExtension
+		}
+	}
+	now := time.Now()
+	g := query.Or(
+		query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeEqual, Value: "a"},
+		query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeBetween, Value: []time.Time{now, now, now}},
+	)
+	if a, rest := planGroup(g, ext); a != nil || rest == nil {
+		t.Fatalf("Expected the group to be scanned, got %+v", a)
+	}
+
+	g.Filters[1].Value = []time.Time{now, now.Add(time.Hour)}
+	if a, rest := planGroup(g, ext); a == nil || len(a.ranges) != 1 || rest != nil {
+		t.Fatalf("Expected the group to be answered from the indexes, got %+v", a)
+	}
+}
+
+func TestQueryRangeIndex(t *testing.T) {
+	n := NewNode().
+		WithHost("RANGE", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(t.TempDir()).
+		AddEntity(SampleV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+
+	c, err := ConnectToNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The entity is shared by the nodes of the tests, the rows are told apart by their prefix and the year of their birth
+	prefix := uuid.NewString()
+	day := time.Date(3000+int(uuid.New().ID()%5000), 1, 1, 0, 0, 0, 0, time.UTC)
+	var entities []*SampleV1.Sample
+	for i := range 10 {
+		e := &SampleV1.Sample{Uuid: uuid.New(), Name: fmt.Sprintf("%s-name-%d", prefix, i%5), Surname: fmt.Sprintf("%s-s%d", prefix, i), Birth: day.AddDate(0, 0, i)}
+		if err = e.DbInsert(c); err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, e)
+	}
+	surnames := func(results []*SampleV1.Sample) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, strings.TrimPrefix(r.Surname, prefix+"-"))
+		}
+		return out
+	}
+
+	// The range is read from the index in order, the limit stops it without sorting the rows
+	q := query.NewQuery().Where(query.And(
+		query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeGreaterThanEqual, Value: day.AddDate(0, 0, 3)},
+		query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeLessThan, Value: day.AddDate(1, 0, 0)},
+	)).AddOrder(query.OrderTypeDesc, SampleV1.FieldBirth).SetLimit(2)
+	p, err := SampleV1.DbExplain(c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Strategy != query.PlanRange || !p.Ordered || p.Sorted != 0 || len(p.Indexes) != 1 ||
+		p.Indexes[0] != (query.PlanIndex{Field: SampleV1.FieldBirth, Range: true, Rows: 7}) || p.Results != 2 {
+		t.Errorf("Unexpected plan of the range: %+v", p)
+	}
+	results, err := SampleV1.DbQuery(c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := surnames(results); !slices.Equal(got, []string{"s9", "s8"}) {
+		t.Errorf("Expected [s9 s8], got %v", got)
+	}
+
+	cases := []struct {
+		name     string
+		q        *query.Query
+		expected []string
+	}{
+		{"merged bounds", query.NewQuery().Where(query.And(
+			query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeGreaterThan, Value: day.AddDate(0, 0, 2)},
+			query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeGreaterThan, Value: day},
+			query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeLessThan, Value: day.AddDate(0, 0, 6)},
+		)).AddOrder(query.OrderTypeAsc, SampleV1.FieldBirth), []string{"s3", "s4", "s5"}},
+		{"between", query.NewQuery().Where(query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeBetween, Value: []time.Time{day.AddDate(0, 0, 8), day.AddDate(0, 0, 20)}}).
+			AddOrder(query.OrderTypeAsc, SampleV1.FieldBirth), []string{"s8", "s9"}},
+		{"prefix ordered by another field", query.NewQuery().Where(query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeStartsWith, Value: prefix}).
+			AddOrder(query.OrderTypeDesc, SampleV1.FieldBirth).SetLimit(3), []string{"s9", "s8", "s7"}},
+		{"prefix ordered by its field then another", query.NewQuery().Where(query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeStartsWith, Value: prefix}).
+			AddOrder(query.OrderTypeAsc, SampleV1.FieldName).AddOrder(query.OrderTypeDesc, SampleV1.FieldBirth).SetLimit(4), []string{"s5", "s0", "s6", "s1"}},
+		{"range and residual filter", query.NewQuery().Where(query.And(
+			query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeGreaterThanEqual, Value: prefix + "-name-3"},
+			query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeLessThan, Value: prefix + "-name-9"},
+			query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeNotEqual, Value: prefix + "-s3"},
+		)).AddOrder(query.OrderTypeAsc, SampleV1.FieldName).AddOrder(query.OrderTypeAsc, SampleV1.FieldSurname), []string{"s8", "s4", "s9"}},
+		{"or of ranges", query.NewQuery().Where(query.Or(
+			query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeBetween, Value: []time.Time{day, day}},
+			query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeStartsWith, Value: prefix + "-s9"},
+		)).AddOrder(query.OrderTypeAsc, SampleV1.FieldBirth), []string{"s0", "s9"}},
+	}
+	for _, tc := range cases {
+		results, err := SampleV1.DbQuery(c, tc.q)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := surnames(results); !slices.Equal(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+
+	// Deleted and updated rows leave the index
+	if err = entities[9].DbDelete(c); err != nil {
+		t.Fatal(err)
+	}
+	entities[8].Birth = day.AddDate(-1, 0, 0)
+	if err = entities[8].DbUpdate(c); err != nil {
+		t.Fatal(err)
+	}
+	if results, err = SampleV1.DbQuery(c, q); err != nil {
+		t.Fatal(err)
+	}
+	if got := surnames(results); !slices.Equal(got, []string{"s7", "s6"}) {
+		t.Errorf("Expected [s7 s6] after the delete and update, got %v", got)
+	}
+	oldest := query.NewQuery().Where(query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeBetween, Value: []time.Time{day.AddDate(-1, 0, 0), day}}).
+		AddOrder(query.OrderTypeAsc, SampleV1.FieldBirth).SetLimit(1)
+	if results, err = SampleV1.DbQuery(c, oldest); err != nil {
+		t.Fatal(err)
+	}
+	if got := surnames(results); !slices.Equal(got, []string{"s8"}) {
+		t.Errorf("Expected [s8] as the oldest, got %v", got)
+	}
+}
+
+func TestQueryCompositeIndex(t *testing.T) {
+	name, other, a, b := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+	day := time.Date(1000+int(uuid.New().ID()%1000), 1, 1, 0, 0, 0, 0, time.UTC)
+	entities := []*SampleV1.Sample{
+		{Uuid: uuid.New(), Name: name, Surname: a, Birth: day},
+		{Uuid: uuid.New(), Name: name, Surname: a},
+		{Uuid: uuid.New(), Name: name, Surname: b},
+		{Uuid: uuid.New(), Name: other, Surname: a},
+	}
+	for _, e := range entities {
+		if err := e.DbInsert(connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fullname := func(name, surname string, more ...query.Condition) *query.Query {
+		return query.NewQuery().Where(query.And(append([]query.Condition{
+			query.Filter{Field: SampleV1.FieldSurname, Op: query.OperatorTypeEqual, Value: surname},
+			query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeEqual, Value: name},
+		}, more...)...))
+	}
+	count := func(q *query.Query) int {
+		results, err := SampleV1.DbQuery(connection, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(results)
+	}
+
+	p, err := SampleV1.DbExplain(connection, fullname(name, a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Strategy != query.PlanIntersect || len(p.Indexes) != 1 ||
+		p.Indexes[0] != (query.PlanIndex{Field: SampleV1.FieldName, Composite: "fullname", Rows: 2}) || len(p.Filtered) != 0 || p.Results != 2 {
+		t.Errorf("Unexpected plan of the composite lookup: %+v", p)
+	}
+
+	// The other lookups still narrow down the rows of the composite index
+	born := fullname(name, a, query.Filter{Field: SampleV1.FieldBirth, Op: query.OperatorTypeEqual, Value: day})
+	if p, err = SampleV1.DbExplain(connection, born); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Indexes) != 2 || p.Indexes[0].Field != SampleV1.FieldBirth || p.Indexes[1].Composite != "fullname" {
+		t.Errorf("Unexpected plan of the composite and value lookups: %+v", p)
+	}
+	if n := count(born); n != 1 {
+		t.Errorf("Expected 1 row born on %s, got %d", day, n)
+	}
+
+	// A single field is looked up in its own index rather than in the composite one
+	byName := query.NewQuery().Where(query.Filter{Field: SampleV1.FieldName, Op: query.OperatorTypeEqual, Value: name})
+	if p, err = SampleV1.DbExplain(connection, byName); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Indexes) != 1 || p.Indexes[0] != (query.PlanIndex{Field: SampleV1.FieldName, Rows: 3}) {
+		t.Errorf("Unexpected plan of the single field: %+v", p)
+	}
+
+	// Updated and deleted rows leave the composite index
+	entities[1].Surname = b
+	if err = entities[1].DbUpdate(connection); err != nil {
+		t.Fatal(err)
+	}
+	if err = entities[2].DbDelete(connection); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(fullname(name, a)); n != 1 {
+		t.Errorf("Expected 1 row of %s %s after the update, got %d", name, a, n)
+	}
+	if n := count(fullname(name, b)); n != 1 {
+		t.Errorf("Expected 1 row of %s %s after the update and delete, got %d", name, b, n)
+	}
+	if n := count(fullname(other, a)); n != 1 {
+		t.Errorf("Expected 1 row of %s %s, got %d", other, a, n)
+	}
+}
+
+// registerAccount registers the Account test entity, which RegisterEntities leaves out
+var registerAccount = sync.OnceValue(AccountV1.Register)
+
+func TestUniqueConstraints(t *testing.T) {
+	if err := registerAccount(); err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir()
+	start := func() (*Node, *hconn.HConn) {
+		n := NewNode().
+			WithHost("UNIQUE", "127.0.0.1", util.GetAvailablePort()).
+			WithPath(path).
+			AddEntity(AccountV1.Name)
+		go func() {
+			if err := n.Start(); err != nil {
+				t.Errorf("Failed to start node: %v", err)
+			}
+		}()
+		n.WaitStatusActive()
+		c, err := ConnectToNode(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, c
+	}
+	n, c := start()
+	t.Cleanup(func() { _ = n.Shutdown() })
+	held := AccountV1.New().MemoryCount() // By the nodes of the other tests, until this one loads its own rows
+
+	tenant, other := uuid.NewString(), uuid.NewString()
+	alice := &AccountV1.Account{Tenant: tenant, Login: "alice", Email: tenant + "@alice"}
+	if err := alice.DbInsert(c); err != nil {
+		t.Fatal(err)
+	}
+	conflict := func(name string, err error, constraint string) {
+		t.Helper()
+		var ce *model.ConstraintError
+		if !errors.As(err, &ce) || !errors.Is(err, model.ErrConstraintUnique) || ce.Entity != AccountV1.Name ||
+			ce.Constraint != constraint || ce.Uuid != alice.Uuid {
+			t.Errorf("%s: expected %s to be held by %s, got %v", name, constraint, alice.Uuid, err)
+		}
+	}
+
+	// The composite key only conflicts when every field matches
+	conflict("same login", (&AccountV1.Account{Tenant: tenant, Login: "alice", Email: tenant + "@other"}).DbInsert(c), "login")
+	bob := &AccountV1.Account{Tenant: other, Login: "alice", Email: tenant + "@bob"}
+	if err := bob.DbInsert(c); err != nil {
+		t.Fatal(err)
+	}
+	bob.Email = alice.Email
+	conflict("update to a held email", bob.DbUpdate(c), "Email")
+
+	// A row keeps its own keys when updated, and releases them once changed or deleted
+	alice.Email = tenant + "@alice2"
+	if err := alice.DbUpdate(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.DbUpdate(c); err != nil {
+		t.Fatalf("Expected the email released by the update to be taken: %v", err)
+	}
+	if err := bob.DbDelete(c); err != nil {
+		t.Fatal(err)
+	}
+	carol := &AccountV1.Account{Tenant: other, Login: "alice", Email: tenant + "@alice"}
+	if err := carol.DbInsert(c); err != nil {
+		t.Fatalf("Expected the keys released by the delete to be taken: %v", err)
+	}
+	if rows := AccountV1.New().MemoryCount() - held; rows != 2 {
+		t.Errorf("Expected the 2 rows written, got %d", rows)
+	}
+
+	// The keys are rebuilt from disk, where the refused writes are not
+	c.Close()
+	if err := n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	n, c = start()
+	defer c.Close()
+	if rows := AccountV1.New().MemoryCount(); rows != 2 {
+		t.Errorf("Expected the 2 rows written after loading, got %d", rows)
+	}
+	conflict("same login after loading", (&AccountV1.Account{Tenant: tenant, Login: "alice"}).DbInsert(c), "login")
+}
+
+// TestUniqueConstraintsWriteFailure checks that a write failing on disk leaves memory and the unique keys as they were
+func TestUniqueConstraintsWriteFailure(t *testing.T) {
+	if err := registerAccount(); err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(register.Entities, func(e *register.Entity) bool { return e.EntityBase.Name == AccountV1.Name })
+	d := disk.NewDisk().WithPath(filepath.Join(t.TempDir(), AccountV1.DbFileName)).WithEntity(register.Entities[i])
+	if err := d.OpenFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es := &EntityStorage{Disk: d, Memory: register.Entities[i]}
+
+	tenant := uuid.NewString()
+	account := &AccountV1.Account{Uuid: uuid.New(), Tenant: tenant, Login: "alice", Email: tenant}
+	data, err := account.EncodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := AccountV1.New().MemoryCount()
+	if err = es.write(model.MessageTypeInsert, account, data, nil); !errors.Is(err, model.ErrDiskClosed) {
+		t.Fatalf("Expected %v, got %v", model.ErrDiskClosed, err)
+	}
+	if n := AccountV1.New().MemoryCount(); n != rows {
+		t.Errorf("Expected %d rows held, got %d", rows, n)
+	}
+	same := &AccountV1.Account{Uuid: uuid.New(), Tenant: tenant, Login: "alice", Email: tenant}
+	if err = same.MemoryCheck(); err != nil {
+		t.Errorf("Expected the keys of the failed write not to be held, got %v", err)
+	}
+}
+
+// TestUniqueConstraintsLoad checks that rows on disk breaking a constraint added later are skipped rather than stopping the node
+func TestUniqueConstraintsLoad(t *testing.T) {
+	if err := registerAccount(); err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(register.Entities, func(e *register.Entity) bool { return e.EntityBase.Name == AccountV1.Name })
+	path := t.TempDir()
+	d := disk.NewDisk().WithPath(filepath.Join(path, AccountV1.DbFileName)).WithEntity(register.Entities[i])
+	if err := d.OpenFile(); err != nil {
+		t.Fatal(err)
+	}
+	email := uuid.NewString()
+	accounts := []*AccountV1.Account{
+		{Uuid: uuid.New(), Tenant: uuid.NewString(), Login: "alice", Email: email},
+		{Uuid: uuid.New(), Tenant: uuid.NewString(), Login: "bob", Email: email},
+	}
+	for _, a := range accounts {
+		data, err := a.EncodeData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = d.DataWrite(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNode().
+		WithHost("UNIQUE_LOAD", "127.0.0.1", util.GetAvailablePort()).
+		WithPath(path).
+		AddEntity(AccountV1.Name)
+	go func() {
+		if err := n.Start(); err != nil {
+			t.Errorf("Failed to start node: %v", err)
+		}
+	}()
+	n.WaitStatusActive()
+	t.Cleanup(func() { _ = n.Shutdown() })
+
+	// Either row may hold the email, the rows are not read from disk in order
+	all := AccountV1.New().MemoryGetAll()
+	if len(all) != 1 || all[0].GetUuid() != accounts[0].Uuid && all[0].GetUuid() != accounts[1].Uuid {
+		t.Errorf("Expected a single row of %+v to be loaded, got %+v", accounts, all)
+	}
+}
@@ -0,0 +1,445 @@
+package node
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/query"
+	"github.com/rah-0/hyperion/register"
+)
+
+// execution is how planQuery decided to answer a query, beyond the query.Plan it reports
+type execution struct {
+	lookup  *lookupPlan    // Finds the rows in the indexes, nil to read them all
+	walk    *rangeLookup   // Reads the rows from an ordered index instead, in order
+	filters *query.Filters // Evaluated on the rows found, nil when the indexes answer alone
+}
+
+/*
+lookupPlan is how a group of filters is answered from the indexes: the rows found by its lookups, composite lookups,
+ranges and groups, intersected under And or united under Or.
+*/
+type lookupPlan struct {
+	op         query.FilterType
+	lookups    []query.Filter
+	composites []compositeLookup
+	ranges     []rangeLookup
+	groups     []*lookupPlan
+}
+
+// compositeLookup finds the rows holding values in the first fields of a composite index
+type compositeLookup struct {
+	index  int // Of the composite index in register.EntityExtension.Composites
+	values []any
+}
+
+// rangeLookup reads the values of a field within a range from its ordered index
+type rangeLookup struct {
+	field int
+	r     register.Range
+}
+
+/*
+planGroup returns how g can be answered from the indexes, nil when it can't, along with the filters left
+to evaluate on the rows found, nil when the indexes answer g alone:
+- And: its Equal and In filters and its groups answered from the indexes narrow the rows down, the rest filters them.
+The Equal filters on the first fields of a composite index are looked up together, see planComposite.
+Without any of them, the range filters of the field of the first one are read from its ordered index.
+- Or: only when every filter is Equal, In or a range filter and every group is answered from the indexes
+- Not never is, its rows are found by scanning
+*/
+func planGroup(g query.Filters, ext *register.EntityExtension) (*lookupPlan, *query.Filters) {
+	accessors := ext.IndexAccessors
+	switch g.Type {
+	case query.FilterTypeAnd:
+		a := &lookupPlan{op: query.FilterTypeAnd}
+		rest := query.Filters{Type: query.FilterTypeAnd}
+		filters := g.Filters
+		if c, left := planComposite(filters, ext); c != nil {
+			a.composites = append(a.composites, *c)
+			filters = left
+		}
+		for _, f := range filters {
+			if isLookup(f, accessors) {
+				a.lookups = append(a.lookups, f)
+			} else {
+				rest.Filters = append(rest.Filters, f)
+			}
+		}
+		for _, sub := range g.Groups {
+			sa, sr := planGroup(sub, ext)
+			if sa == nil {
+				rest.Groups = append(rest.Groups, sub)
+				continue
+			}
+			a.groups = append(a.groups, sa)
+			if sr != nil {
+				rest.Groups = append(rest.Groups, *sr)
+			}
+		}
+		// Ranges tend to hold far more rows than values, they only narrow down what nothing else does
+		if len(a.lookups) == 0 && len(a.composites) == 0 && len(a.groups) == 0 {
+			var rl *rangeLookup
+			if rl, rest.Filters = planRange(rest.Filters, ext); rl != nil {
+				a.ranges = append(a.ranges, *rl)
+			}
+		}
+		if len(a.lookups) == 0 && len(a.composites) == 0 && len(a.groups) == 0 && len(a.ranges) == 0 {
+			return nil, &g
+		}
+		if len(rest.Filters) == 0 && len(rest.Groups) == 0 {
+			return a, nil
+		}
+		return a, &rest
+
+	case query.FilterTypeOr:
+		a := &lookupPlan{op: query.FilterTypeOr}
+		exact := true
+		for _, f := range g.Filters {
+			switch {
+			case isLookup(f, accessors):
+				a.lookups = append(a.lookups, f)
+			case isRangeFilter(f, accessors):
+				// A filter the range can't hold would never be evaluated, so the group is scanned instead
+				rl, left := planRange([]query.Filter{f}, ext)
+				if len(left) > 0 {
+					return nil, &g
+				}
+				a.ranges = append(a.ranges, *rl)
+			default:
+				return nil, &g
+			}
+		}
+		for _, sub := range g.Groups {
+			sa, sr := planGroup(sub, ext)
+			if sa == nil {
+				return nil, &g
+			}
+			a.groups = append(a.groups, sa)
+			exact = exact && sr == nil
+		}
+		// A row found by one operand may match another one only, so the whole group is evaluated again
+		if !exact {
+			return a, &g
+		}
+		return a, nil
+
+	default:
+		return nil, &g
+	}
+}
+
+/*
+planComposite returns the lookup of the composite index whose first fields are covered by the most Equal filters
+of an And, along with the filters left. An index is only looked up for 2 fields or more, or for its first field
+when that field has no index of its own.
+*/
+func planComposite(filters []query.Filter, ext *register.EntityExtension) (*compositeLookup, []query.Filter) {
+	equal := func(field int) int {
+		return slices.IndexFunc(filters, func(f query.Filter) bool {
+			return f.Field == field && f.Op == query.OperatorTypeEqual
+		})
+	}
+	best, covered := -1, 0
+	for i, c := range ext.Composites {
+		n := 0
+		for n < len(c.Fields) && equal(c.Fields[n]) >= 0 {
+			n++
+		}
+		if _, indexed := ext.IndexAccessors[c.Fields[0]]; n > covered && (n > 1 || !indexed) {
+			best, covered = i, n
+		}
+	}
+	if best < 0 {
+		return nil, filters
+	}
+
+	c := &compositeLookup{index: best}
+	left := slices.Clone(filters)
+	for _, field := range ext.Composites[best].Fields[:covered] {
+		i := slices.IndexFunc(left, func(f query.Filter) bool {
+			return f.Field == field && f.Op == query.OperatorTypeEqual
+		})
+		c.values = append(c.values, left[i].Value)
+		left = slices.Delete(left, i, i+1)
+	}
+	return c, left
+}
+
+// isLookup tells whether the rows matching f are found in the index of its field, which holds Equal and In filters
+func isLookup(f query.Filter, accessors map[int]register.IndexAccessor) bool {
+	if _, ok := accessors[f.Field]; !ok {
+		return false
+	}
+	switch f.Op {
+	case query.OperatorTypeEqual:
+		return true
+	case query.OperatorTypeIn:
+		_, ok := query.Values(f.Value)
+		return ok
+	default:
+		return false
+	}
+}
+
+// lookupValues returns the values f looks up, the elements of the value of an In
+func lookupValues(f query.Filter) []any {
+	if f.Op == query.OperatorTypeIn {
+		values, _ := query.Values(f.Value)
+		return values
+	}
+	return []any{f.Value}
+}
+
+// isRangeFilter tells whether the rows matching f are a range of the ordered index of its field
+func isRangeFilter(f query.Filter, accessors map[int]register.IndexAccessor) bool {
+	if accessors[f.Field].Scan == nil {
+		return false
+	}
+	switch f.Op {
+	case query.OperatorTypeGreaterThan, query.OperatorTypeGreaterThanEqual,
+		query.OperatorTypeLessThan, query.OperatorTypeLessThanEqual,
+		query.OperatorTypeBetween, query.OperatorTypeStartsWith:
+		return true
+	default:
+		return false
+	}
+}
+
+// planRange merges the range filters on the field of the first one into a single range,
+// it returns nil when there is none along with the filters the range does not answer
+func planRange(filters []query.Filter, ext *register.EntityExtension) (*rangeLookup, []query.Filter) {
+	accessors, fieldTypes := ext.IndexAccessors, ext.FieldTypes
+	var rl *rangeLookup
+	var rest []query.Filter
+	for _, f := range filters {
+		if !isRangeFilter(f, accessors) || rl != nil && f.Field != rl.field {
+			rest = append(rest, f)
+			continue
+		}
+		if rl == nil {
+			rl = &rangeLookup{field: f.Field}
+		}
+		if !mergeRange(&rl.r, f, fieldTypes[f.Field]) {
+			rest = append(rest, f)
+		}
+	}
+	return rl, rest
+}
+
+// mergeRange narrows r down to the values matching f, it returns false when it can't, such as for disjoint prefixes
+func mergeRange(r *register.Range, f query.Filter, fieldType string) bool {
+	switch f.Op {
+	case query.OperatorTypeGreaterThan:
+		lowerBound(r, f.Value, true, fieldType)
+	case query.OperatorTypeGreaterThanEqual:
+		lowerBound(r, f.Value, false, fieldType)
+	case query.OperatorTypeLessThan:
+		upperBound(r, f.Value, true, fieldType)
+	case query.OperatorTypeLessThanEqual:
+		upperBound(r, f.Value, false, fieldType)
+	case query.OperatorTypeBetween:
+		values, ok := query.Values(f.Value)
+		if !ok || len(values) != 2 {
+			return false
+		}
+		lowerBound(r, values[0], false, fieldType)
+		upperBound(r, values[1], false, fieldType)
+	case query.OperatorTypeStartsWith:
+		prefix, _ := f.Value.(string)
+		switch {
+		case strings.HasPrefix(prefix, r.Prefix):
+			r.Prefix = prefix
+		case !strings.HasPrefix(r.Prefix, prefix):
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func lowerBound(r *register.Range, v any, exclusive bool, fieldType string) {
+	if r.From != nil {
+		above, _ := query.EvaluateOperation(query.OperatorTypeGreaterThan, fieldType, v, r.From)
+		equal, _ := query.EvaluateOperation(query.OperatorTypeEqual, fieldType, v, r.From)
+		if !above && !(equal && exclusive) {
+			return
+		}
+	}
+	r.From, r.FromExclusive = v, exclusive
+}
+
+func upperBound(r *register.Range, v any, exclusive bool, fieldType string) {
+	if r.To != nil {
+		below, _ := query.EvaluateOperation(query.OperatorTypeLessThan, fieldType, v, r.To)
+		equal, _ := query.EvaluateOperation(query.OperatorTypeEqual, fieldType, v, r.To)
+		if !below && !(equal && exclusive) {
+			return
+		}
+	}
+	r.To, r.ToExclusive = v, exclusive
+}
+
+// estimate adds the lookups of x to indexes in the order they run and returns how many rows x finds at most,
+// the rows are only counted when count is set
+func (x *lookupPlan) estimate(ext *register.EntityExtension, indexes *[]query.PlanIndex, count bool) int {
+	accessors := ext.IndexAccessors
+	rows := -1
+	add := func(n int) {
+		switch {
+		case x.op == query.FilterTypeOr:
+			rows = max(rows, 0) + n
+		case rows < 0 || n < rows:
+			rows = n
+		}
+	}
+	for _, f := range x.lookups {
+		n := 0
+		for _, v := range lookupValues(f) {
+			if count {
+				n += accessors[f.Field].CountByValue(v)
+			}
+		}
+		*indexes = append(*indexes, query.PlanIndex{Field: f.Field, Rows: n})
+		add(n)
+	}
+	for _, cl := range x.composites {
+		c := ext.Composites[cl.index]
+		n := 0
+		if count {
+			n = c.CountByValues(cl.values)
+		}
+		*indexes = append(*indexes, query.PlanIndex{Field: c.Fields[0], Composite: c.Name, Rows: n})
+		add(n)
+	}
+	for _, rl := range x.ranges {
+		n := 0
+		if count {
+			n = accessors[rl.field].CountRange(rl.r)
+		}
+		*indexes = append(*indexes, query.PlanIndex{Field: rl.field, Range: true, Rows: n})
+		add(n)
+	}
+	for _, g := range x.groups {
+		add(g.estimate(ext, indexes, count))
+	}
+	return max(rows, 0)
+}
+
+// find returns the rows found by x, the amount found by every lookup is added to rows in the order of estimate
+func (x *lookupPlan) find(ext *register.EntityExtension, rows *[]int) []register.Model {
+	accessors := ext.IndexAccessors
+	var sets [][]register.Model
+	for _, f := range x.lookups {
+		values := lookupValues(f)
+		found := make([][]register.Model, len(values))
+		for i, v := range values {
+			found[i] = accessors[f.Field].GetByValue(v)
+		}
+		set := unionSets(found)
+		*rows = append(*rows, len(set))
+		sets = append(sets, set)
+	}
+	for _, cl := range x.composites {
+		set := ext.Composites[cl.index].GetByValues(cl.values)
+		*rows = append(*rows, len(set))
+		sets = append(sets, set)
+	}
+	for _, rl := range x.ranges {
+		var set []register.Model
+		accessors[rl.field].Scan(rl.r, func(models []register.Model) bool {
+			set = append(set, models...)
+			return true
+		})
+		*rows = append(*rows, len(set))
+		sets = append(sets, set)
+	}
+	for _, g := range x.groups {
+		sets = append(sets, g.find(ext, rows))
+	}
+	if x.op == query.FilterTypeOr {
+		return unionSets(sets)
+	}
+	return intersectSets(sets)
+}
+
+/*
+planQuery decides how q is answered, see planGroup, and when explaining estimates the rows of every step.
+A query answered by a single range, or without filters answered by the indexes but ordered by a field with
+an ordered index, reads the rows from that index instead of collecting them. When the range is of the field
+of the first order the rows come in order, so they are not sorted and the limit stops the read.
+*/
+func (x *EntityStorage) planQuery(q *query.Query, explain bool) (query.Plan, execution, error) {
+	plan := query.Plan{Strategy: query.PlanScan, Explained: explain}
+	var ex execution
+	if q == nil {
+		return plan, ex, model.ErrQueryNil
+	}
+
+	ext := x.Memory.EntityExtension
+	fieldTypes := ext.FieldTypes
+	indexAccessors := ext.IndexAccessors
+	if err := checkOrders(q, fieldTypes); err != nil {
+		return plan, ex, err
+	}
+	for f := range q.Filters.All() {
+		if _, ok := fieldTypes[f.Field]; !ok {
+			return plan, ex, model.ErrQueryEntityFieldNotFound
+		}
+	}
+	if err := q.Filters.Compile(fieldTypes); err != nil {
+		return plan, ex, fmt.Errorf("%w: %v", model.ErrQueryFilterInvalid, err)
+	}
+
+	if q.Filters.Type != query.FilterTypeUndefined {
+		ex.lookup, ex.filters = planGroup(q.Filters, ext)
+	}
+	if l := ex.lookup; l != nil && len(l.lookups) == 0 && len(l.composites) == 0 && len(l.groups) == 0 && len(l.ranges) == 1 {
+		ex.walk, ex.lookup = &l.ranges[0], nil
+	} else if l == nil && len(q.Orders) > 0 && indexAccessors[q.Orders[0].Field].Scan != nil {
+		ex.walk = &rangeLookup{field: q.Orders[0].Field}
+	}
+	if ex.walk != nil && len(q.Orders) > 0 && q.Orders[0].Field == ex.walk.field {
+		plan.Ordered = true
+		ex.walk.r.Desc = q.Orders[0].Type == query.OrderTypeDesc
+	}
+
+	rows := 0
+	switch {
+	case ex.walk != nil:
+		plan.Strategy = query.PlanRange
+		if explain {
+			rows = indexAccessors[ex.walk.field].CountRange(ex.walk.r)
+		}
+		plan.Indexes = []query.PlanIndex{{Field: ex.walk.field, Range: true, Rows: rows}}
+	case ex.lookup == nil:
+		rows = ext.New().MemoryCount()
+	case ex.lookup.op == query.FilterTypeAnd:
+		plan.Strategy = query.PlanIntersect
+		rows = ex.lookup.estimate(ext, &plan.Indexes, explain)
+	default:
+		plan.Strategy = query.PlanUnion
+		rows = ex.lookup.estimate(ext, &plan.Indexes, explain)
+	}
+
+	if ex.filters != nil {
+		plan.Scanned = rows
+		plan.Parallel = ex.walk == nil && rows >= parallelFilterRows
+		for f := range ex.filters.All() {
+			plan.Filtered = append(plan.Filtered, f.Field)
+		}
+	}
+	plan.Orders = q.Orders
+	if len(q.Orders) > 0 && !plan.Ordered {
+		plan.Sorted = rows
+	}
+	if q.Limit > 0 {
+		plan.Limit = q.Limit
+		rows = min(rows, q.Limit)
+	}
+	plan.Results = rows
+	return plan, ex, nil
+}
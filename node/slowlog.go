@@ -0,0 +1,115 @@
+package node
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/config"
+	"github.com/rah-0/hyperion/query"
+)
+
+// DefaultSlowLogSize is how many slow queries a node keeps when config.NodeSlowLog has no Size
+var DefaultSlowLogSize = 100
+
+// SlowQuery is a query that took at least the slow query threshold of the node
+type SlowQuery struct {
+	Time     time.Time
+	Entity   string
+	Version  string
+	Duration time.Duration
+	Query    *query.Query
+	Plan     query.Plan
+}
+
+// slowLog keeps the latest slow queries in a ring, a nil slowLog records nothing
+type slowLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	entries []SlowQuery
+	next    int
+	full    bool
+}
+
+func newSlowLog(c config.NodeSlowLog) *slowLog {
+	if c.Threshold <= 0 {
+		return nil
+	}
+	size := c.Size
+	if size <= 0 {
+		size = DefaultSlowLogSize
+	}
+	return &slowLog{threshold: c.Threshold.Duration(), entries: make([]SlowQuery, size)}
+}
+
+// record keeps q and logs it without the values of its filters when it is slow
+func (x *slowLog) record(q SlowQuery) {
+	if x == nil || q.Duration < x.threshold {
+		return
+	}
+
+	x.mu.Lock()
+	x.entries[x.next] = q
+	x.next = (x.next + 1) % len(x.entries)
+	x.full = x.full || x.next == 0
+	x.mu.Unlock()
+
+	data, err := json.Marshal(redacted(q))
+	if err != nil {
+		nabu.FromError(err).Log()
+		return
+	}
+	nabu.FromMessage("slow query on [" + q.Entity + "] took " + q.Duration.String() + ": " + string(data)).Log()
+}
+
+// recent returns the slow queries kept, the newest first
+func (x *slowLog) recent() []SlowQuery {
+	if x == nil {
+		return []SlowQuery{}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	n := x.next
+	if x.full {
+		n = len(x.entries)
+	}
+	out := make([]SlowQuery, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, x.entries[(x.next-i+len(x.entries))%len(x.entries)])
+	}
+	return out
+}
+
+// SlowQueries returns the latest queries that took at least the slow query threshold, the newest first
+func (x *Node) SlowQueries() []SlowQuery {
+	x.Mu.Lock()
+	l := x.slowLog
+	x.Mu.Unlock()
+	return l.recent()
+}
+
+// redacted returns q without the values of its filters, which may hold personal data, for the slow queries
+// logged and served over HTTP
+func redacted(q SlowQuery) SlowQuery {
+	if q.Query != nil {
+		rq := *q.Query
+		rq.Filters = redactedFilters(rq.Filters)
+		q.Query = &rq
+	}
+	return q
+}
+
+func redactedFilters(fs query.Filters) query.Filters {
+	out := query.Filters{Type: fs.Type}
+	for _, f := range fs.Filters {
+		out.Filters = append(out.Filters, query.Filter{Field: f.Field, Op: f.Op})
+	}
+	for _, g := range fs.Groups {
+		out.Groups = append(out.Groups, redactedFilters(g))
+	}
+	return out
+}
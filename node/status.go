@@ -0,0 +1,240 @@
+package node
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/config"
+)
+
+var statusNames = map[Status]string{
+	StatusStarting: "starting",
+	StatusActive:   "active",
+	StatusReady:    "ready",
+	StatusShutdown: "shutdown",
+}
+
+func (x Status) String() string {
+	if name, ok := statusNames[x]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// StatusReport is the state of a node as served by the /status endpoint
+type StatusReport struct {
+	Node     string
+	Cluster  string
+	Address  string
+	Status   string
+	Build    Build
+	Entities []EntityStatus
+	Peers    []PeerStatus
+}
+
+type EntityStatus struct {
+	Name    string
+	Version string
+	Rows    int
+	Path    string
+	Size    int64 // Bytes of the data file, 0 until something was written
+}
+
+type PeerStatus struct {
+	Name      string
+	Address   string
+	Connected bool
+}
+
+// Build identifies the binary running the node, read from the build info embedded by the Go toolchain
+type Build struct {
+	Version   string
+	Revision  string `json:",omitempty"`
+	Time      string `json:",omitempty"`
+	Modified  bool   `json:",omitempty"`
+	GoVersion string
+}
+
+func readBuild() Build {
+	b := Build{GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	b.Version = info.Main.Version
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.time":
+			b.Time = s.Value
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+// Report returns the current state of the node
+func (x *Node) Report() StatusReport {
+	x.Mu.Lock()
+	status := x.Status
+	x.Mu.Unlock()
+
+	return StatusReport{
+		Node:     x.Host.Name,
+		Cluster:  x.ClusterName,
+		Address:  x.getListenAddress(),
+		Status:   status.String(),
+		Build:    readBuild(),
+		Entities: x.entityStatuses(),
+		Peers:    x.peerStatuses(),
+	}
+}
+
+func (x *Node) entityStatuses() []EntityStatus {
+	x.Mu.Lock()
+	storages := append([]*EntityStorage(nil), x.EntitiesStorage...)
+	x.Mu.Unlock()
+
+	out := make([]EntityStatus, 0, len(storages))
+	for _, s := range storages {
+		es := EntityStatus{
+			Name:    s.Memory.EntityBase.Name,
+			Version: s.Memory.EntityBase.Version,
+			Rows:    s.Memory.EntityExtension.New().MemoryCount(),
+			Path:    s.Disk.Path,
+		}
+		if info, err := os.Stat(s.Disk.Path); err == nil {
+			es.Size = info.Size()
+		}
+		out = append(out, es)
+	}
+	return out
+}
+
+func (x *Node) peerStatuses() []PeerStatus {
+	x.Mu.Lock()
+	peers := x.Peers
+	x.Mu.Unlock()
+
+	out := make([]PeerStatus, 0, len(peers))
+	for _, p := range peers {
+		p.Mu.Lock()
+		connected := p.PeerConnected && p.HConn != nil && p.HConn.Err() == nil
+		p.Mu.Unlock()
+		out = append(out, PeerStatus{Name: p.Host.Name, Address: p.getListenAddress(), Connected: connected})
+	}
+	return out
+}
+
+/*
+Handler serves the state of the node over HTTP, for orchestrators and operators:
+- /healthz: 200 while the node runs, including while it loads its entities, 503 once it shuts down
+- /readyz: 200 once the entities are loaded and the peers were dialed, 503 otherwise
+- /status: StatusReport as JSON
+- /slow-queries: SlowQueries as JSON, without the values of their filters
+/status and /slow-queries require the token of StatusHTTP when it has one.
+*/
+func (x *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		x.Mu.Lock()
+		status := x.Status
+		x.Mu.Unlock()
+		writeProbe(w, status != StatusShutdown, status)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		x.Mu.Lock()
+		status := x.Status
+		x.Mu.Unlock()
+		writeProbe(w, status == StatusReady, status)
+	})
+	mux.HandleFunc("GET /status", x.statusAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(x.Report()); err != nil {
+			nabu.FromError(err).Log()
+		}
+	}))
+	mux.HandleFunc("GET /slow-queries", x.statusAuth(func(w http.ResponseWriter, r *http.Request) {
+		qs := x.SlowQueries()
+		for i := range qs {
+			qs[i] = redacted(qs[i])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(qs); err != nil {
+			nabu.FromError(err).Log()
+		}
+	}))
+	return mux
+}
+
+// writeProbe answers a probe with the status of the node as the body
+func writeProbe(w http.ResponseWriter, ok bool, status Status) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write([]byte(status.String() + "\n"))
+}
+
+// statusAuth answers 401 unless the request carries the token of StatusHTTP as a bearer token
+func (x *Node) statusAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := x.StatusHTTP.Token
+		if want != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(config.HashToken(token)), []byte(want)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// serveStatus serves Handler on the address of StatusHTTP, if any, until Shutdown
+func (x *Node) serveStatus() error {
+	if x.StatusHTTP.Address == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", x.StatusHTTP.Address)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: x.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	x.Mu.Lock()
+	x.statusHTTP, x.statusL = srv, l
+	x.Mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			nabu.FromError(err).WithMessage("node: status server stopped").Log()
+		}
+	}()
+	nabu.FromMessage("Status server started on " + l.Addr().String()).Log()
+	return nil
+}
+
+// closeStatusHTTP stops the server started by serveStatus if any, it must be called with Mu held
+func (x *Node) closeStatusHTTP() {
+	if x.statusHTTP == nil {
+		return
+	}
+	if err := x.statusHTTP.Close(); err != nil {
+		nabu.FromError(err).Log()
+	}
+	_ = x.statusL.Close()
+	x.statusHTTP, x.statusL = nil, nil
+}
@@ -6,9 +6,11 @@ import (
 	"net/http/pprof"
 
 	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/metrics"
 )
 
-// Start initializes and starts the pprof HTTP server
+// Start initializes and starts the pprof HTTP server, which also serves the Prometheus metrics on /metrics
 func Start(ip string, port int) {
 	addr := fmt.Sprintf("%s:%d", ip, port)
 	mux := http.NewServeMux()
@@ -19,6 +21,7 @@ func Start(ip string, port int) {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/metrics", metrics.Handler())
 
 	// Start HTTP server in a goroutine
 	go func() {
@@ -2,8 +2,10 @@ package query
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/google/uuid"
 )
@@ -23,6 +25,25 @@ const (
 	OperatorTypeNotContains
 	OperatorTypeStartsWith
 	OperatorTypeEndsWith
+	// OperatorTypeIn matches when the field equals any element of the value, a slice of the type of the field
+	OperatorTypeIn
+	OperatorTypeNotIn
+	// OperatorTypeBetween matches when the field is within the 2 elements of the value, both included
+	OperatorTypeBetween
+	// OperatorTypeIsZero matches when the field holds the zero value of its type, the value of the filter is ignored
+	OperatorTypeIsZero
+	OperatorTypeNotZero
+	// The Fold operators ignore case, comparing strings under Unicode simple case folding
+	OperatorTypeEqualFold
+	OperatorTypeNotEqualFold
+	OperatorTypeContainsFold
+	OperatorTypeNotContainsFold
+	OperatorTypeStartsWithFold
+	OperatorTypeEndsWithFold
+	// OperatorTypeMatches matches when the field matches the regular expression of the value, see regexp
+	OperatorTypeMatches
+	// OperatorTypeLike matches the whole field to an SQL pattern: % is any text, _ any character, \ escapes them
+	OperatorTypeLike
 )
 
 var OperatorsRegistry = map[string]any{
@@ -50,7 +71,32 @@ var OperatorsRegistry = map[string]any{
 	"time.Time": TimeOperations,
 }
 
+// ZeroValues holds the zero value of every type of OperatorsRegistry, which IsZero and NotZero compare to
+var ZeroValues = map[string]any{
+	"string":    "",
+	"bool":      false,
+	"int":       0,
+	"int8":      int8(0),
+	"int16":     int16(0),
+	"int32":     int32(0),
+	"int64":     int64(0),
+	"uint":      uint(0),
+	"uint8":     uint8(0),
+	"uint16":    uint16(0),
+	"uint32":    uint32(0),
+	"uint64":    uint64(0),
+	"float32":   float32(0),
+	"float64":   float64(0),
+	"uuid.UUID": uuid.Nil,
+	"time.Time": time.Time{},
+}
+
 func EvaluateOperation(operator OperatorType, fieldType string, a, b any) (bool, error) {
+	switch operator {
+	case OperatorTypeIn, OperatorTypeNotIn, OperatorTypeBetween, OperatorTypeIsZero, OperatorTypeNotZero:
+		return evaluateSetOperation(operator, fieldType, a, b)
+	}
+
 	switch fieldType {
 	case "string":
 		av, aok := a.(string)
@@ -249,6 +295,147 @@ func EvaluateOperation(operator OperatorType, fieldType string, a, b any) (bool,
 	}
 }
 
+// evaluateSetOperation compares a to the elements of b, or to the zero value of its type, with the operations of the type
+func evaluateSetOperation(operator OperatorType, fieldType string, a, b any) (bool, error) {
+	switch operator {
+	case OperatorTypeIsZero, OperatorTypeNotZero:
+		zero, ok := ZeroValues[fieldType]
+		if !ok {
+			return false, fmt.Errorf("unsupported field type: %s", fieldType)
+		}
+		eq, err := EvaluateOperation(OperatorTypeEqual, fieldType, a, zero)
+		return eq == (operator == OperatorTypeIsZero), err
+
+	case OperatorTypeIn, OperatorTypeNotIn:
+		values, ok := Values(b)
+		if !ok {
+			return false, fmt.Errorf("value of %s must be a slice", fieldType)
+		}
+		for _, v := range values {
+			eq, err := EvaluateOperation(OperatorTypeEqual, fieldType, a, v)
+			if err != nil {
+				return false, err
+			}
+			if eq {
+				return operator == OperatorTypeIn, nil
+			}
+		}
+		return operator == OperatorTypeNotIn, nil
+
+	case OperatorTypeBetween:
+		values, ok := Values(b)
+		if !ok || len(values) != 2 {
+			return false, fmt.Errorf("value of between must be a slice of 2 %s", fieldType)
+		}
+		from, err := EvaluateOperation(OperatorTypeGreaterThanEqual, fieldType, a, values[0])
+		if err != nil || !from {
+			return false, err
+		}
+		return EvaluateOperation(OperatorTypeLessThanEqual, fieldType, a, values[1])
+
+	default:
+		return false, fmt.Errorf("unsupported operator")
+	}
+}
+
+// Values returns the elements of v when it is a slice of a type of OperatorsRegistry or of any
+func Values(v any) ([]any, bool) {
+	switch s := v.(type) {
+	case []any:
+		return s, true
+	case []string:
+		return toAny(s), true
+	case []bool:
+		return toAny(s), true
+	case []int:
+		return toAny(s), true
+	case []int8:
+		return toAny(s), true
+	case []int16:
+		return toAny(s), true
+	case []int32:
+		return toAny(s), true
+	case []int64:
+		return toAny(s), true
+	case []uint:
+		return toAny(s), true
+	case []uint8:
+		return toAny(s), true
+	case []uint16:
+		return toAny(s), true
+	case []uint32:
+		return toAny(s), true
+	case []uint64:
+		return toAny(s), true
+	case []float32:
+		return toAny(s), true
+	case []float64:
+		return toAny(s), true
+	case []uuid.UUID:
+		return toAny(s), true
+	case []time.Time:
+		return toAny(s), true
+	default:
+		return nil, false
+	}
+}
+
+func toAny[T any](s []T) []any {
+	out := make([]any, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+// Fold maps every rune of s to the smallest rune it is equal to under Unicode simple case folding,
+// strings equal under strings.EqualFold have the same Fold
+func Fold(s string) string {
+	return strings.Map(func(r rune) rune {
+		folded := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			folded = min(folded, f)
+		}
+		return folded
+	}, s)
+}
+
+// CompilePattern returns the regular expression of the pattern of a Matches or Like operator
+func CompilePattern(op OperatorType, pattern string) (*regexp.Regexp, error) {
+	if op == OperatorTypeMatches {
+		return regexp.Compile(pattern)
+	}
+
+	var b strings.Builder
+	b.WriteString(`(?s)\A`)
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("like pattern ends with an escape: %q", pattern)
+	}
+	b.WriteString(`\z`)
+	return regexp.Compile(b.String())
+}
+
+func matchPattern(op OperatorType, a, pattern string) bool {
+	re, err := CompilePattern(op, pattern)
+	return err == nil && re.MatchString(a)
+}
+
 var StringOperations = map[OperatorType]func(a, b string) bool{
 	OperatorTypeEqual:       func(a, b string) bool { return a == b },
 	OperatorTypeNotEqual:    func(a, b string) bool { return a != b },
@@ -256,6 +443,16 @@ var StringOperations = map[OperatorType]func(a, b string) bool{
 	OperatorTypeNotContains: func(a, b string) bool { return !strings.Contains(a, b) },
 	OperatorTypeStartsWith:  func(a, b string) bool { return strings.HasPrefix(a, b) },
 	OperatorTypeEndsWith:    func(a, b string) bool { return strings.HasSuffix(a, b) },
+	// Fold operators
+	OperatorTypeEqualFold:       func(a, b string) bool { return strings.EqualFold(a, b) },
+	OperatorTypeNotEqualFold:    func(a, b string) bool { return !strings.EqualFold(a, b) },
+	OperatorTypeContainsFold:    func(a, b string) bool { return strings.Contains(Fold(a), Fold(b)) },
+	OperatorTypeNotContainsFold: func(a, b string) bool { return !strings.Contains(Fold(a), Fold(b)) },
+	OperatorTypeStartsWithFold:  func(a, b string) bool { return strings.HasPrefix(Fold(a), Fold(b)) },
+	OperatorTypeEndsWithFold:    func(a, b string) bool { return strings.HasSuffix(Fold(a), Fold(b)) },
+	// Pattern operators compile the pattern on every call, filters compile it once with Filters.Compile
+	OperatorTypeMatches: func(a, b string) bool { return matchPattern(OperatorTypeMatches, a, b) },
+	OperatorTypeLike:    func(a, b string) bool { return matchPattern(OperatorTypeLike, a, b) },
 	// Operators below also used for sorting
 	OperatorTypeGreaterThan:      func(a, b string) bool { return a > b },
 	OperatorTypeLessThan:         func(a, b string) bool { return a < b },
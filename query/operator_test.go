@@ -377,3 +377,176 @@ func TestTimeOperations(t *testing.T) {
 		}
 	}
 }
+
+func TestZeroValues_CoversAllOperationsRegistryTypes(t *testing.T) {
+	for fieldType := range OperatorsRegistry {
+		zero, ok := ZeroValues[fieldType]
+		if !ok {
+			t.Errorf("missing zero value for type: %s", fieldType)
+			continue
+		}
+		if ok, err := EvaluateOperation(OperatorTypeIsZero, fieldType, zero, nil); err != nil || !ok {
+			t.Errorf("IsZero of the zero value of %q: got %v, %v", fieldType, ok, err)
+		}
+		if ok, err := EvaluateOperation(OperatorTypeNotZero, fieldType, zero, nil); err != nil || ok {
+			t.Errorf("NotZero of the zero value of %q: got %v, %v", fieldType, ok, err)
+		}
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Minute)
+	id := uuid.New()
+	cases := []struct {
+		name      string
+		op        OperatorType
+		fieldType string
+		a, b      any
+		expected  bool
+	}{
+		{"string in", OperatorTypeIn, "string", "b", []string{"a", "b"}, true},
+		{"string not in", OperatorTypeNotIn, "string", "c", []string{"a", "b"}, true},
+		{"string in empty", OperatorTypeIn, "string", "a", []string{}, false},
+		{"string not in empty", OperatorTypeNotIn, "string", "a", []string{}, true},
+		{"string between", OperatorTypeBetween, "string", "b", []string{"a", "c"}, true},
+		{"string is zero", OperatorTypeIsZero, "string", "", nil, true},
+		{"string not zero", OperatorTypeNotZero, "string", "a", nil, true},
+		{"bool in", OperatorTypeIn, "bool", true, []bool{true}, true},
+		{"bool is zero", OperatorTypeIsZero, "bool", true, nil, false},
+		{"int in", OperatorTypeIn, "int", 2, []int{1, 2, 3}, true},
+		{"int in false", OperatorTypeIn, "int", 4, []int{1, 2, 3}, false},
+		{"int not in false", OperatorTypeNotIn, "int", 2, []int{1, 2, 3}, false},
+		{"int between lower bound", OperatorTypeBetween, "int", 1, []int{1, 3}, true},
+		{"int between upper bound", OperatorTypeBetween, "int", 3, []int{1, 3}, true},
+		{"int between below", OperatorTypeBetween, "int", 0, []int{1, 3}, false},
+		{"int between above", OperatorTypeBetween, "int", 4, []int{1, 3}, false},
+		{"int between reversed", OperatorTypeBetween, "int", 2, []int{3, 1}, false},
+		{"int in any", OperatorTypeIn, "int", 2, []any{1, 2}, true},
+		{"int8 in", OperatorTypeIn, "int8", int8(1), []int8{1}, true},
+		{"int16 between", OperatorTypeBetween, "int16", int16(2), []int16{1, 2}, true},
+		{"int32 not in", OperatorTypeNotIn, "int32", int32(3), []int32{1, 2}, true},
+		{"int64 is zero", OperatorTypeIsZero, "int64", int64(0), nil, true},
+		{"uint in", OperatorTypeIn, "uint", uint(1), []uint{1}, true},
+		{"uint8 between", OperatorTypeBetween, "uint8", uint8(5), []uint8{1, 9}, true},
+		{"uint16 not zero", OperatorTypeNotZero, "uint16", uint16(1), nil, true},
+		{"uint32 in", OperatorTypeIn, "uint32", uint32(1), []uint32{2}, false},
+		{"uint64 between", OperatorTypeBetween, "uint64", uint64(10), []uint64{1, 9}, false},
+		{"float32 in", OperatorTypeIn, "float32", float32(1.5), []float32{1.5}, true},
+		{"float64 between", OperatorTypeBetween, "float64", 1.5, []float64{1, 2}, true},
+		{"uuid in", OperatorTypeIn, "uuid.UUID", id, []uuid.UUID{uuid.New(), id}, true},
+		{"uuid is zero", OperatorTypeIsZero, "uuid.UUID", uuid.Nil, nil, true},
+		{"uuid not zero", OperatorTypeNotZero, "uuid.UUID", id, nil, true},
+		{"time in", OperatorTypeIn, "time.Time", now, []time.Time{later, now}, true},
+		{"time between", OperatorTypeBetween, "time.Time", now, []time.Time{now, later}, true},
+		{"time between above", OperatorTypeBetween, "time.Time", later.Add(time.Second), []time.Time{now, later}, false},
+		{"time is zero", OperatorTypeIsZero, "time.Time", time.Time{}, nil, true},
+		{"time not zero", OperatorTypeNotZero, "time.Time", now, nil, true},
+	}
+	for _, c := range cases {
+		got, err := EvaluateOperation(c.op, c.fieldType, c.a, c.b)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestSetOperations_Errors(t *testing.T) {
+	cases := []struct {
+		name      string
+		op        OperatorType
+		fieldType string
+		a, b      any
+	}{
+		{"in without slice", OperatorTypeIn, "int", 1, 1},
+		{"in with mismatching elements", OperatorTypeIn, "int", 1, []string{"1"}},
+		{"between with 1 element", OperatorTypeBetween, "int", 1, []int{1}},
+		{"between with 3 elements", OperatorTypeBetween, "int", 1, []int{1, 2, 3}},
+		{"between with mismatching elements", OperatorTypeBetween, "int", 1, []int64{0, 2}},
+		{"is zero of unknown type", OperatorTypeIsZero, "complex64", complex64(0), nil},
+		{"is zero of mismatching value", OperatorTypeIsZero, "int", "0", nil},
+	}
+	for _, c := range cases {
+		if got, err := EvaluateOperation(c.op, c.fieldType, c.a, c.b); err == nil || got {
+			t.Errorf("%s: expected an error, got %v, %v", c.name, got, err)
+		}
+	}
+}
+
+func TestStringFoldOperations(t *testing.T) {
+	tests := []struct {
+		op       OperatorType
+		a, b     string
+		expected bool
+	}{
+		{OperatorTypeEqualFold, "Hello", "hELLO", true},
+		{OperatorTypeEqualFold, "Straße", "STRASSE", false}, // Simple folding does not expand ß
+		{OperatorTypeEqualFold, "Σίσυφος", "ΣΊΣΥΦΟΣ", true},
+		{OperatorTypeNotEqualFold, "Hello", "world", true},
+		{OperatorTypeNotEqualFold, "Hello", "HELLO", false},
+		{OperatorTypeContainsFold, "Hello World", "o w", true},
+		{OperatorTypeContainsFold, "Hello World", "mars", false},
+		{OperatorTypeContainsFold, "ÅNGSTRÖM", "ström", true},
+		{OperatorTypeContainsFold, "k", "\u212a", true}, // Kelvin sign folds to k
+		{OperatorTypeNotContainsFold, "Hello World", "MARS", true},
+		{OperatorTypeNotContainsFold, "Hello World", "WORLD", false},
+		{OperatorTypeStartsWithFold, "GoLang", "go", true},
+		{OperatorTypeStartsWithFold, "GoLang", "lang", false},
+		{OperatorTypeEndsWithFold, "GoLang", "LANG", true},
+		{OperatorTypeEndsWithFold, "GoLang", "GO", false},
+	}
+
+	for _, tt := range tests {
+		if got := StringOperations[tt.op](tt.a, tt.b); got != tt.expected {
+			t.Errorf("StringOperations[%v](%q, %q) = %v; want %v", tt.op, tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestStringPatternOperations(t *testing.T) {
+	tests := []struct {
+		op       OperatorType
+		a, b     string
+		expected bool
+	}{
+		{OperatorTypeMatches, "order-123", `^order-\d+$`, true},
+		{OperatorTypeMatches, "order-abc", `^order-\d+$`, false},
+		{OperatorTypeMatches, "an order-1 here", `order-\d`, true},
+		{OperatorTypeMatches, "ORDER", `(?i)order`, true},
+		{OperatorTypeMatches, "anything", `(`, false},
+		{OperatorTypeLike, "hello world", "hello%", true},
+		{OperatorTypeLike, "hello world", "%world", true},
+		{OperatorTypeLike, "hello world", "%lo w%", true},
+		{OperatorTypeLike, "hello world", "hello", false},
+		{OperatorTypeLike, "hello", "h_llo", true},
+		{OperatorTypeLike, "hllo", "h_llo", false},
+		{OperatorTypeLike, "line\nbreak", "line%", true},
+		{OperatorTypeLike, "a.c", "a.c", true},
+		{OperatorTypeLike, "abc", "a.c", false},
+		{OperatorTypeLike, "100%", `100\%`, true},
+		{OperatorTypeLike, "1000", `100\%`, false},
+		{OperatorTypeLike, "a_b", `a\_b`, true},
+		{OperatorTypeLike, "axb", `a\_b`, false},
+		{OperatorTypeLike, `a\b`, `a\\b`, true},
+		{OperatorTypeLike, "Hello", "hello", false},
+		{OperatorTypeLike, "ab", `ab\`, false},
+	}
+
+	for _, tt := range tests {
+		if got := StringOperations[tt.op](tt.a, tt.b); got != tt.expected {
+			t.Errorf("StringOperations[%v](%q, %q) = %v; want %v", tt.op, tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	for _, s := range [][2]string{{"Hello", "hello"}, {"ÀÉÎ", "àéî"}, {"\u212a", "k"}, {"ΣΊΣΥΦΟΣ", "σίσυφος"}} {
+		if Fold(s[0]) != Fold(s[1]) {
+			t.Errorf("Fold(%q) = %q, Fold(%q) = %q", s[0], Fold(s[0]), s[1], Fold(s[1]))
+		}
+	}
+}
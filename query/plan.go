@@ -0,0 +1,46 @@
+package query
+
+import "time"
+
+const (
+	// PlanScan evaluates the filters on every row
+	PlanScan = "scan"
+	// PlanIntersect keeps the rows found in the indexes by every Equal filter, composite index and nested group of an And
+	PlanIntersect = "intersect"
+	// PlanUnion keeps the rows found in the indexes by any Equal filter or nested group of an Or
+	PlanUnion = "union"
+	// PlanRange reads the rows from the ordered index of a field, within the bounds of its range filters
+	PlanRange = "range"
+)
+
+/*
+Plan describes how a node answers a query, it is what the slow query log records and what an explain returns.
+An explained query is not run, its row counts are then estimates taken from the sizes of the index entries
+and the amount of rows held, Results being an upper bound, and its durations are 0.
+*/
+type Plan struct {
+	Strategy  string
+	Explained bool
+	Indexes   []PlanIndex // Index lookups, in the order of the filters
+	Filtered  []int       // Fields of the filters evaluated on the rows, the others were answered by Indexes
+	Scanned   int         // Rows the filters were evaluated on, 0 when the indexes answered alone
+	Parallel  bool        // The filters were evaluated concurrently over chunks of the rows
+	Orders    []Order     `json:",omitempty"`
+	Ordered   bool        // The rows were read in the order of the first order from its range index, only ties were sorted
+	Sorted    int         // Rows sorted
+	Limit     int         `json:",omitempty"` // Applied after sorting
+	Results   int         // Rows returned, after the limit
+
+	Lookup time.Duration
+	Filter time.Duration
+	Sort   time.Duration
+}
+
+// PlanIndex is the lookup of a value in the index of a field, the read of a range of its ordered index,
+// or the lookup of the values of the first fields of a composite index starting with that field
+type PlanIndex struct {
+	Field     int
+	Range     bool   `json:",omitempty"`
+	Composite string `json:",omitempty"` // Name of the composite index
+	Rows      int    // Rows found, a range read in order stops once the limit is reached
+}
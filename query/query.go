@@ -1,5 +1,11 @@
 package query
 
+import (
+	"fmt"
+	"iter"
+	"regexp"
+)
+
 type FilterType int
 type OrderType int
 
@@ -7,6 +13,8 @@ const (
 	FilterTypeUndefined FilterType = iota
 	FilterTypeOr
 	FilterTypeAnd
+	// FilterTypeNot matches the rows its filters and groups, combined with And, do not match
+	FilterTypeNot
 )
 const (
 	OrderTypeUndefined OrderType = iota
@@ -20,15 +28,197 @@ type Query struct {
 	Limit   int
 }
 
+/*
+Filters is a group of conditions combined with Type, Groups nest other groups to any depth so that
+expressions such as (Name = "a" OR Name = "b") AND Birth > X can be written, see And, Or and Not.
+A group without Type matches every row.
+*/
 type Filters struct {
 	Type    FilterType
 	Filters []Filter
+	Groups  []Filters
 }
 
 type Filter struct {
 	Field int
 	Value any
 	Op    OperatorType
+
+	pattern *regexp.Regexp // Compiled from Value by Filters.Compile for Matches and Like
+}
+
+// Condition is a Filter or a group of them, the operands of And, Or and Not
+type Condition interface {
+	addTo(g *Filters)
+}
+
+func (x Filter) addTo(g *Filters) {
+	g.Filters = append(g.Filters, x)
+}
+
+func (x Filters) addTo(g *Filters) {
+	g.Groups = append(g.Groups, x)
+}
+
+func group(t FilterType, cs []Condition) Filters {
+	g := Filters{Type: t}
+	for _, c := range cs {
+		c.addTo(&g)
+	}
+	return g
+}
+
+// And matches the rows matching every condition, all rows when there is none
+func And(cs ...Condition) Filters {
+	return group(FilterTypeAnd, cs)
+}
+
+// Or matches the rows matching any condition, no row when there is none
+func Or(cs ...Condition) Filters {
+	return group(FilterTypeOr, cs)
+}
+
+// Not matches the rows not matching every condition
+func Not(cs ...Condition) Filters {
+	return group(FilterTypeNot, cs)
+}
+
+/*
+Match tells whether the row whose field values are returned by value matches the group,
+fieldTypes gives the type of the fields and filters with an unknown operator or a mismatching value never match.
+*/
+func (x Filters) Match(fieldTypes map[int]string, value func(field int) any) bool {
+	switch x.Type {
+	case FilterTypeAnd:
+		return x.all(fieldTypes, value)
+	case FilterTypeOr:
+		for _, f := range x.Filters {
+			if f.Match(fieldTypes, value) {
+				return true
+			}
+		}
+		for _, g := range x.Groups {
+			if g.Match(fieldTypes, value) {
+				return true
+			}
+		}
+		return false
+	case FilterTypeNot:
+		return !x.all(fieldTypes, value)
+	default:
+		return true
+	}
+}
+
+func (x Filters) all(fieldTypes map[int]string, value func(field int) any) bool {
+	for _, f := range x.Filters {
+		if !f.Match(fieldTypes, value) {
+			return false
+		}
+	}
+	for _, g := range x.Groups {
+		if !g.Match(fieldTypes, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// All returns the filters of the group and of its nested groups, depth first
+func (x Filters) All() iter.Seq[Filter] {
+	return func(yield func(Filter) bool) {
+		x.each(yield)
+	}
+}
+
+func (x Filters) each(yield func(Filter) bool) bool {
+	for _, f := range x.Filters {
+		if !yield(f) {
+			return false
+		}
+	}
+	for _, g := range x.Groups {
+		if !g.each(yield) {
+			return false
+		}
+	}
+	return true
+}
+
+func (x Filter) Match(fieldTypes map[int]string, value func(field int) any) bool {
+	if x.pattern != nil {
+		s, ok := value(x.Field).(string)
+		return ok && x.pattern.MatchString(s)
+	}
+	ok, _ := EvaluateOperation(x.Op, fieldTypes[x.Field], value(x.Field), x.Value)
+	return ok
+}
+
+/*
+Compile checks every filter of the group and of its nested groups against the types of the fields,
+so that a query with an unknown field or operator, a value of the wrong type or a bad pattern is refused
+rather than matching nothing, and compiles the patterns of Matches and Like once for every row.
+*/
+func (x *Filters) Compile(fieldTypes map[int]string) error {
+	for i := range x.Filters {
+		if err := x.Filters[i].compile(fieldTypes); err != nil {
+			return err
+		}
+	}
+	for i := range x.Groups {
+		if err := x.Groups[i].Compile(fieldTypes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *Filter) compile(fieldTypes map[int]string) error {
+	fieldType, ok := fieldTypes[x.Field]
+	if !ok {
+		return fmt.Errorf("field [%d] not found", x.Field)
+	}
+	if err := x.check(fieldType); err != nil {
+		return fmt.Errorf("field [%d]: %v", x.Field, err)
+	}
+	if x.Op == OperatorTypeMatches || x.Op == OperatorTypeLike {
+		re, err := CompilePattern(x.Op, x.Value.(string))
+		if err != nil {
+			return fmt.Errorf("field [%d]: %v", x.Field, err)
+		}
+		x.pattern = re
+	}
+	return nil
+}
+
+/*
+check evaluates the filter on the zero value of the field, which fails as it would on any row.
+The evaluation of In and NotIn stops at the first element equal to the zero value and the one of Between
+at the first bound failing, so every element and both bounds are checked on their own.
+*/
+func (x *Filter) check(fieldType string) error {
+	zero := ZeroValues[fieldType]
+	if _, err := EvaluateOperation(x.Op, fieldType, zero, x.Value); err != nil {
+		return err
+	}
+
+	values, _ := Values(x.Value)
+	switch x.Op {
+	case OperatorTypeIn, OperatorTypeNotIn:
+		for _, v := range values {
+			if _, err := EvaluateOperation(OperatorTypeEqual, fieldType, zero, v); err != nil {
+				return err
+			}
+		}
+	case OperatorTypeBetween:
+		if _, err := EvaluateOperation(OperatorTypeGreaterThanEqual, fieldType, zero, values[0]); err != nil {
+			return err
+		}
+		if _, err := EvaluateOperation(OperatorTypeLessThanEqual, fieldType, zero, values[1]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type Order struct {
@@ -46,6 +236,16 @@ func (x *Query) SetFilters(opType FilterType, filters []Filter) *Query {
 	return x
 }
 
+// Where replaces the filters of the query with c, a single Filter becomes a group of its own
+func (x *Query) Where(c Condition) *Query {
+	if g, ok := c.(Filters); ok {
+		x.Filters = g
+	} else {
+		x.Filters = And(c)
+	}
+	return x
+}
+
 func (x *Query) SetOrders(orders []Order) *Query {
 	x.Orders = orders
 	return x
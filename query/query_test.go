@@ -0,0 +1,174 @@
+package query
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+const (
+	fieldName = iota
+	fieldAge
+	fieldBirth
+)
+
+var testFieldTypes = map[int]string{
+	fieldName:  "string",
+	fieldAge:   "int",
+	fieldBirth: "time.Time",
+}
+
+func testRow(name string, age int, birth time.Time) func(field int) any {
+	return func(field int) any {
+		switch field {
+		case fieldName:
+			return name
+		case fieldAge:
+			return age
+		default:
+			return birth
+		}
+	}
+}
+
+func TestFiltersMatch(t *testing.T) {
+	now := time.Now()
+	a := Filter{Field: fieldName, Op: OperatorTypeEqual, Value: "a"}
+	b := Filter{Field: fieldName, Op: OperatorTypeEqual, Value: "b"}
+	adult := Filter{Field: fieldAge, Op: OperatorTypeGreaterThanEqual, Value: 18}
+	recent := Filter{Field: fieldBirth, Op: OperatorTypeGreaterThan, Value: now.Add(-time.Hour)}
+
+	cases := []struct {
+		name     string
+		filters  Filters
+		row      func(field int) any
+		expected bool
+	}{
+		{"undefined matches", Filters{Filters: []Filter{b}}, testRow("a", 1, now), true},
+		{"empty and matches", And(), testRow("a", 1, now), true},
+		{"empty or does not match", Or(), testRow("a", 1, now), false},
+		{"empty not does not match", Not(), testRow("a", 1, now), false},
+		{"and true", And(a, adult), testRow("a", 20, now), true},
+		{"and false", And(a, adult), testRow("a", 10, now), false},
+		{"or first", Or(a, b), testRow("a", 1, now), true},
+		{"or second", Or(a, b), testRow("b", 1, now), true},
+		{"or none", Or(a, b), testRow("c", 1, now), false},
+		{"not true", Not(a), testRow("b", 1, now), true},
+		{"not false", Not(a), testRow("a", 1, now), false},
+		{"not of and partially matched", Not(a, adult), testRow("a", 10, now), true},
+		{"not of and matched", Not(a, adult), testRow("a", 20, now), false},
+		{"or group and filter true", And(Or(a, b), recent), testRow("b", 1, now), true},
+		{"or group and filter false by group", And(Or(a, b), recent), testRow("c", 1, now), false},
+		{"or group and filter false by filter", And(Or(a, b), recent), testRow("a", 1, now.Add(-2*time.Hour)), false},
+		{"or of and groups first", Or(And(a, adult), And(b, Not(adult))), testRow("a", 20, now), true},
+		{"or of and groups second", Or(And(a, adult), And(b, Not(adult))), testRow("b", 10, now), true},
+		{"or of and groups none", Or(And(a, adult), And(b, Not(adult))), testRow("b", 20, now), false},
+		{"double not", Not(Not(a)), testRow("a", 1, now), true},
+		{"deep nesting", And(Or(Not(Or(a, b)), adult), recent), testRow("c", 1, now), true},
+		{"deep nesting false", And(Or(Not(Or(a, b)), adult), recent), testRow("a", 1, now), false},
+		{"type mismatch never matches", And(Filter{Field: fieldAge, Op: OperatorTypeEqual, Value: "1"}), testRow("a", 1, now), false},
+		{"unknown operator never matches", And(Filter{Field: fieldName, Op: OperatorTypeUndefined, Value: "a"}), testRow("a", 1, now), false},
+	}
+	for _, c := range cases {
+		if got := c.filters.Match(testFieldTypes, c.row); got != c.expected {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestFiltersBuilders(t *testing.T) {
+	a := Filter{Field: fieldName, Op: OperatorTypeEqual, Value: "a"}
+	adult := Filter{Field: fieldAge, Op: OperatorTypeGreaterThan, Value: 17}
+
+	g := And(a, Or(adult), Not(a))
+	if g.Type != FilterTypeAnd || len(g.Filters) != 1 || len(g.Groups) != 2 ||
+		g.Groups[0].Type != FilterTypeOr || g.Groups[1].Type != FilterTypeNot {
+		t.Errorf("Unexpected group: %+v", g)
+	}
+
+	if q := NewQuery().Where(a); q.Filters.Type != FilterTypeAnd || len(q.Filters.Filters) != 1 || q.Filters.Filters[0] != a {
+		t.Errorf("Expected a single filter to become an And group, got %+v", q.Filters)
+	}
+	if q := NewQuery().Where(Or(a, adult)); q.Filters.Type != FilterTypeOr || len(q.Filters.Filters) != 2 {
+		t.Errorf("Expected the group as is, got %+v", q.Filters)
+	}
+}
+
+func TestFiltersAll(t *testing.T) {
+	f := func(field int) Filter {
+		return Filter{Field: field, Op: OperatorTypeEqual}
+	}
+	g := And(f(0), Or(f(1), Not(f(2))), f(3), Or(f(4)))
+
+	var fields []int
+	for x := range g.All() {
+		fields = append(fields, x.Field)
+	}
+	if !slices.Equal(fields, []int{0, 3, 1, 2, 4}) {
+		t.Errorf("Unexpected order: %v", fields)
+	}
+
+	fields = nil
+	for x := range g.All() {
+		fields = append(fields, x.Field)
+		if len(fields) == 3 {
+			break
+		}
+	}
+	if !slices.Equal(fields, []int{0, 3, 1}) {
+		t.Errorf("Expected the iteration to stop, got %v", fields)
+	}
+}
+
+func TestFiltersCompile(t *testing.T) {
+	valid := []Filters{
+		And(Filter{Field: fieldName, Op: OperatorTypeMatches, Value: `^a\d+$`}),
+		And(Or(Filter{Field: fieldName, Op: OperatorTypeLike, Value: "a%"}), Filter{Field: fieldAge, Op: OperatorTypeIn, Value: []int{1}}),
+		And(Filter{Field: fieldName, Op: OperatorTypeContainsFold, Value: "A"}, Filter{Field: fieldBirth, Op: OperatorTypeIsZero}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeBetween, Value: []any{5, 9}}, Filter{Field: fieldAge, Op: OperatorTypeIn, Value: []any{0, 2}}),
+	}
+	for _, g := range valid {
+		if err := g.Compile(testFieldTypes); err != nil {
+			t.Errorf("Unexpected error for %+v: %v", g, err)
+		}
+	}
+
+	invalid := []Filters{
+		And(Filter{Field: 99, Op: OperatorTypeEqual, Value: "a"}),
+		And(Filter{Field: fieldName, Op: OperatorTypeMatches, Value: `(`}),
+		And(Or(Not(Filter{Field: fieldName, Op: OperatorTypeLike, Value: `a\`}))),
+		And(Filter{Field: fieldName, Op: OperatorTypeMatches, Value: 1}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeMatches, Value: "1"}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeContainsFold, Value: 1}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeEqual, Value: "1"}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeBetween, Value: []int{1}}),
+		And(Filter{Field: fieldName, Op: OperatorTypeUndefined, Value: "a"}),
+		// The zero value fails the first bound or equals the first element, the rest must still be checked
+		And(Filter{Field: fieldAge, Op: OperatorTypeBetween, Value: []any{5, "x"}}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeBetween, Value: []any{"x", 5}}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeIn, Value: []any{0, "x"}}),
+		And(Filter{Field: fieldAge, Op: OperatorTypeNotIn, Value: []any{0, "x"}}),
+	}
+	for _, g := range invalid {
+		if err := g.Compile(testFieldTypes); err == nil {
+			t.Errorf("Expected an error for %+v", g)
+		}
+	}
+}
+
+func TestFiltersCompiledPattern(t *testing.T) {
+	g := And(Or(Filter{Field: fieldName, Op: OperatorTypeLike, Value: "a_c%"}), Filter{Field: fieldName, Op: OperatorTypeMatches, Value: `\d$`})
+	if err := g.Compile(testFieldTypes); err != nil {
+		t.Fatal(err)
+	}
+	if g.Groups[0].Filters[0].pattern == nil || g.Filters[0].pattern == nil {
+		t.Fatal("Expected the patterns to be compiled")
+	}
+
+	now := time.Now()
+	for name, expected := range map[string]bool{"abc1": true, "axcdef9": true, "abc": false, "ac1": false} {
+		if got := g.Match(testFieldTypes, testRow(name, 0, now)); got != expected {
+			t.Errorf("%s: got %v, want %v", name, got, expected)
+		}
+	}
+}
@@ -8,6 +8,31 @@ import (
 
 type IndexAccessor struct {
 	GetByValue func(value any) []Model
+	// CountByValue returns how many models GetByValue would return without copying them
+	CountByValue func(value any) int
+	// Scan calls yield with the models of every value within the range, grouped by value and in the order of the values,
+	// as long as yield returns true. Scan and CountRange are nil for fields without an ordered index.
+	Scan       func(r Range, yield func(models []Model) bool)
+	CountRange func(r Range) int
+}
+
+// Range selects values of an ordered index, a nil bound leaves that side unbounded
+type Range struct {
+	From          any
+	FromExclusive bool
+	To            any
+	ToExclusive   bool
+	Prefix        string // Only the strings starting with it
+	Desc          bool   // From the highest value down
+}
+
+// CompositeAccessor reads a composite index, the models in order of the values of several fields.
+// values are the values of the first fields of the index, at least one of them.
+type CompositeAccessor struct {
+	Name          string
+	Fields        []int
+	GetByValues   func(values []any) []Model
+	CountByValues func(values []any) int
 }
 
 var Entities []*Entity
@@ -30,6 +55,7 @@ type EntityExtension struct {
 	FieldTypes     map[int]string
 	Indexes        map[int]any
 	IndexAccessors map[int]IndexAccessor
+	Composites     []CompositeAccessor
 }
 
 func RegisterEntity(entity *EntityBase, entityExtension *EntityExtension) {
@@ -49,16 +75,24 @@ type Model interface {
 
 	Encode() error
 	Decode() error
+	// EncodeData and DecodeData perform the whole buffer round trip atomically,
+	// they are safe to use from concurrent goroutines
+	EncodeData() ([]byte, error)
+	DecodeData([]byte) error
 
 	BufferReset()
 	GetBuffer() *bytes.Buffer
 	GetBufferData() []byte
 	SetBufferData([]byte)
 
-	MemoryAdd()
+	// MemoryAdd and MemoryUpdate refuse rows breaking a unique constraint of the entity,
+	// MemoryCheck returns the same error without holding the row
+	MemoryCheck() error
+	MemoryAdd() error
 	MemoryRemove()
-	MemoryUpdate()
+	MemoryUpdate() error
 	MemoryClear()
 	MemoryGetAll() []Model
+	MemoryCount() int
 	MemoryContains(Model) bool
 }
@@ -1,10 +1,16 @@
 package template
 
 import (
+	"errors"
+	"fmt"
+	"go/token"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/rah-0/hyperion/model"
 	"github.com/rah-0/hyperion/util"
 )
 
@@ -19,10 +25,43 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "// The code in this file is autogenerated, do not modify manually!" + "\n"
 	template += "// ---------------------------------------------------------------" + "\n\n"
 
+	options := make(map[string]fieldOptions, len(s.Fields))
+	indexes := make(map[string]indexKind, len(s.Fields))
+	ordered, compared := false, false
+	for _, f := range s.Fields {
+		o, err := fieldTag(f)
+		if err != nil {
+			return "", err
+		}
+		options[f.Name] = o
+		indexes[f.Name] = o.index
+		if o.index == indexRange {
+			ordered = true
+			compared = compared || f.Type != "time.Time"
+		}
+	}
+	uniques := uniqueConstraints(s, options)
+	composites, err := compositeIndexes(s, options)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range composites {
+		ordered = true
+		for _, f := range c.fields {
+			compared = compared || f.Type != "time.Time"
+		}
+	}
+
 	template += "import (\n"
 	template += `"bytes"` + "\n"
+	if compared {
+		template += `"cmp"` + "\n"
+	}
+	template += `"context"` + "\n"
 	template += `"encoding/gob"` + "\n"
+	template += `"encoding/json"` + "\n"
 	template += `"errors"` + "\n"
+	template += `"iter"` + "\n"
 	template += `"sync"` + "\n"
 	for _, f := range s.Fields {
 		if f.Type == "time.Time" {
@@ -32,6 +71,9 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "\n"
 	template += `"github.com/google/uuid"` + "\n\n"
 	template += `"` + filepath.Join(mn, "hconn") + `"` + "\n"
+	if ordered {
+		template += `"` + filepath.Join(mn, "index") + `"` + "\n"
+	}
 	template += `"` + filepath.Join(mn, "model") + `"` + "\n"
 	template += `"` + filepath.Join(mn, "query") + `"` + "\n"
 	template += `"` + filepath.Join(mn, "register") + `"` + "\n"
@@ -59,20 +101,55 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	}
 	template += "}" + "\n\n"
 
+	template += "// Indexes holds the rows by value of the fields indexed, see the hyperion tag\n"
 	template += "var Indexes = map[int]any{\n"
 	for _, f := range s.Fields {
+		if indexes[f.Name] == indexNone {
+			continue
+		}
 		template += "\tField" + f.Name + ": map[" + f.Type + "][]*" + s.Name + "{},\n"
 	}
 	template += "}\n\n"
 
+	template += "// Ranges keeps the fields tagged index=range in order, for range filters and orders\n"
+	template += "var Ranges = map[int]any{\n"
+	for _, f := range s.Fields {
+		if indexes[f.Name] == indexRange {
+			template += "\tField" + f.Name + ": index.NewOrdered[" + f.Type + ", *" + s.Name + "](" + rangeCompare(f) + "),\n"
+		}
+	}
+	template += "}\n\n"
+
+	if len(uniques) > 0 {
+		template += "// Unique constraints, the row holding every key\n"
+		template += "var (\n"
+		for _, c := range uniques {
+			template += c.variable() + " = map[" + c.keyType() + "]*" + s.Name + "{}\n"
+		}
+		template += ")\n\n"
+	}
+
+	if len(composites) > 0 {
+		template += "// Composite indexes, the rows in order of the values of their fields\n"
+		template += "var (\n"
+		for _, c := range composites {
+			template += c.variable() + " = index.NewOrdered[" + c.keyType() + ", *" + s.Name + "](" + c.keyType() + ".compare)\n"
+		}
+		template += ")\n\n"
+	}
+
 	template += "var (" + "\n"
 	template += "_ register.Model = (*" + s.Name + ")(nil)" + "\n"
 	template += "mu sync.Mutex" + "\n"
 	template += "Buffer = new(bytes.Buffer)" + "\n"
 	template += "Encoder = gob.NewEncoder(Buffer)" + "\n"
 	template += "Decoder = gob.NewDecoder(Buffer)" + "\n"
+	template += "// Codec encodes the data sent to nodes and stored on disk, gob by default.\n"
+	template += "// It must be set before Register and kept, data files written with another codec cannot be read.\n"
+	template += "Codec hconn.Codec = &hconn.Serializer{Buffer: Buffer, E: Encoder, D: Decoder}\n"
 	template += "Mem []*" + s.Name + "\n"
 	template += "IndexAccessors = map[int]register.IndexAccessor{}\n"
+	template += "Composites []register.CompositeAccessor\n"
 	template += ")" + "\n\n"
 
 	template += "func Register() error {\n"
@@ -94,11 +171,16 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += `return errors.New("failed to decode type metadata: " + err.Error())` + "\n"
 	template += "}\n"
 	template += "x.BufferReset()\n\n"
-	template += "// IndexAccessors definitions\n"
+	template += "// IndexAccessors definitions, the fields without one are scanned\n"
 	for _, f := range s.Fields {
+		if indexes[f.Name] == indexNone {
+			continue
+		}
 		template += "IndexAccessors[Field" + f.Name + "] = register.IndexAccessor{\n"
 		// GetByValue
 		template += "GetByValue: func(val any) []register.Model {\n"
+		template += "mu.Lock()\n"
+		template += "defer mu.Unlock()\n"
 		template += "idx := Indexes[Field" + f.Name + "].(map[" + f.Type + "][]*" + s.Name + ")\n"
 		template += "v, ok := val.(" + f.Type + ")\n"
 		template += "if !ok {\n"
@@ -106,9 +188,82 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 		template += "}\n"
 		template += "return CastToModel(idx[v])\n"
 		template += "},\n"
+		// CountByValue
+		template += "CountByValue: func(val any) int {\n"
+		template += "mu.Lock()\n"
+		template += "defer mu.Unlock()\n"
+		template += "idx := Indexes[Field" + f.Name + "].(map[" + f.Type + "][]*" + s.Name + ")\n"
+		template += "v, ok := val.(" + f.Type + ")\n"
+		template += "if !ok {\n"
+		template += "return 0\n"
+		template += "}\n"
+		template += "return len(idx[v])\n"
+		template += "},\n"
+		if indexes[f.Name] == indexRange {
+			rangeOf := "Ranges[Field" + f.Name + "].(" + rangeType(s, f) + ")"
+			// Scan
+			template += "Scan: func(r register.Range, yield func([]register.Model) bool) {\n"
+			template += "mu.Lock()\n"
+			template += "defer mu.Unlock()\n"
+			template += rangeOf + ".Scan(r, func(values []*" + s.Name + ") bool {\n"
+			template += "return yield(CastToModel(values))\n"
+			template += "})\n"
+			template += "},\n"
+			// CountRange
+			template += "CountRange: func(r register.Range) int {\n"
+			template += "mu.Lock()\n"
+			template += "defer mu.Unlock()\n"
+			template += "return " + rangeOf + ".Count(r)\n"
+			template += "},\n"
+		}
 		template += "}\n"
 	}
 	template += "\n"
+	if len(composites) > 0 {
+		template += "// Composites definitions, looked up by the values of their first fields\n"
+		template += "Composites = []register.CompositeAccessor{\n"
+		for _, c := range composites {
+			var fields []string
+			for _, f := range c.fields {
+				fields = append(fields, "Field"+f.Name)
+			}
+			template += "{\n"
+			template += "Name: " + strconv.Quote(c.name) + ",\n"
+			template += "Fields: []int{" + strings.Join(fields, ", ") + "},\n"
+			// GetByValues
+			template += "GetByValues: func(values []any) []register.Model {\n"
+			template += "match, ok := " + c.variable() + "Match(values)\n"
+			template += "if !ok {\n"
+			template += "return nil\n"
+			template += "}\n"
+			template += "mu.Lock()\n"
+			template += "defer mu.Unlock()\n"
+			template += "var out []register.Model\n"
+			template += c.variable() + ".Match(match, func(rows []*" + s.Name + ") bool {\n"
+			template += "out = append(out, CastToModel(rows)...)\n"
+			template += "return true\n"
+			template += "})\n"
+			template += "return out\n"
+			template += "},\n"
+			// CountByValues
+			template += "CountByValues: func(values []any) int {\n"
+			template += "match, ok := " + c.variable() + "Match(values)\n"
+			template += "if !ok {\n"
+			template += "return 0\n"
+			template += "}\n"
+			template += "mu.Lock()\n"
+			template += "defer mu.Unlock()\n"
+			template += "count := 0\n"
+			template += c.variable() + ".Match(match, func(rows []*" + s.Name + ") bool {\n"
+			template += "count += len(rows)\n"
+			template += "return true\n"
+			template += "})\n"
+			template += "return count\n"
+			template += "},\n"
+			template += "},\n"
+		}
+		template += "}\n\n"
+	}
 	template += "// Initializations" + "\n"
 	template += "Mem = []*" + s.Name + "{}\n"
 	template += "register.RegisterEntity(\n"
@@ -121,6 +276,7 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "FieldTypes: FieldTypes,\n"
 	template += "Indexes: Indexes,\n"
 	template += "IndexAccessors: IndexAccessors,\n"
+	template += "Composites: Composites,\n"
 	template += "},\n"
 	template += ")\n\n"
 	template += "return nil\n"
@@ -130,7 +286,70 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	for _, f := range s.Fields {
 		template += f.Name + " " + f.Type + " " + f.Tag + "\n"
 	}
-	template += "}\n"
+	template += "}\n\n"
+
+	// The keys of composite constraints follow the entity, the generator reads the first struct of the file as the entity
+	for _, c := range uniques {
+		if len(c.fields) == 1 {
+			continue
+		}
+		template += "type " + c.keyType() + " struct {\n"
+		for _, f := range c.fields {
+			template += f.Name + " " + f.Type + "\n"
+		}
+		template += "}\n\n"
+	}
+	for _, c := range composites {
+		template += "type " + c.keyType() + " struct {\n"
+		for _, f := range c.fields {
+			template += f.Name + " " + f.Type + "\n"
+		}
+		template += "}\n\n"
+
+		template += "func (x " + c.keyType() + ") compare(y " + c.keyType() + ") int {\n"
+		for i, f := range c.fields {
+			if i == len(c.fields)-1 {
+				template += "return " + rangeCompare(f) + "(x." + f.Name + ", y." + f.Name + ")\n"
+				break
+			}
+			template += "if c := " + rangeCompare(f) + "(x." + f.Name + ", y." + f.Name + "); c != 0 {\n"
+			template += "return c\n"
+			template += "}\n"
+		}
+		template += "}\n\n"
+
+		template += "// " + c.variable() + "Match returns how the keys of " + c.variable() + " compare to the values of its first fields,\n"
+		template += "// false when there are none, too many or one of another type\n"
+		template += "func " + c.variable() + "Match(values []any) (func(k " + c.keyType() + ") int, bool) {\n"
+		template += "if len(values) == 0 || len(values) > " + strconv.Itoa(len(c.fields)) + " {\n"
+		template += "return nil, false\n"
+		template += "}\n"
+		template += "var key " + c.keyType() + "\n"
+		template += "for i, v := range values {\n"
+		template += "var ok bool\n"
+		template += "switch i {\n"
+		for i, f := range c.fields {
+			template += "case " + strconv.Itoa(i) + ":\n"
+			template += "key." + f.Name + ", ok = v.(" + f.Type + ")\n"
+		}
+		template += "}\n"
+		template += "if !ok {\n"
+		template += "return nil, false\n"
+		template += "}\n"
+		template += "}\n"
+		template += "return func(k " + c.keyType() + ") int {\n"
+		for i, f := range c.fields {
+			if i == len(c.fields)-1 {
+				template += "return " + rangeCompare(f) + "(k." + f.Name + ", key." + f.Name + ")\n"
+				break
+			}
+			template += "if c := " + rangeCompare(f) + "(k." + f.Name + ", key." + f.Name + "); c != 0 || len(values) == " + strconv.Itoa(i+1) + " {\n"
+			template += "return c\n"
+			template += "}\n"
+		}
+		template += "}, true\n"
+		template += "}\n\n"
+	}
 
 	template += "func New() register.Model {\n"
 	template += "return &" + s.Name + "{}\n"
@@ -188,6 +407,48 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "return Decoder.Decode(s)\n"
 	template += "}\n\n"
 
+	template += "func (s *" + s.Name + ") EncodeData() ([]byte, error) {\n"
+	template += "mu.Lock()\n"
+	template += "defer mu.Unlock()\n"
+	template += "return Codec.Append(nil, s)\n"
+	template += "}\n\n"
+
+	template += "func (s *" + s.Name + ") DecodeData(data []byte) error {\n"
+	template += "mu.Lock()\n"
+	template += "defer mu.Unlock()\n"
+	template += "return Codec.Unmarshal(data, s)\n"
+	template += "}\n\n"
+
+	template += "// AppendFields implements hconn.BinaryValue, fields are written in FieldX order\n"
+	template += "func (s *" + s.Name + ") AppendFields(b []byte) ([]byte, error) {\n"
+	hasTime := false
+	for _, f := range s.Fields {
+		if f.Type == "time.Time" {
+			hasTime = true
+		}
+	}
+	if hasTime {
+		template += "var err error\n"
+	}
+	for _, f := range s.Fields {
+		a, err := binaryAppend(f)
+		if err != nil {
+			return "", err
+		}
+		template += a
+	}
+	template += "return b, nil\n"
+	template += "}\n\n"
+
+	template += "// UnmarshalFields implements hconn.BinaryValue, fields are read in FieldX order\n"
+	template += "func (s *" + s.Name + ") UnmarshalFields(data []byte) error {\n"
+	template += "r := hconn.NewBinaryReader(data)\n"
+	for _, f := range s.Fields {
+		template += "s." + f.Name + " = " + binaryRead(f) + "\n"
+	}
+	template += "return r.Err()\n"
+	template += "}\n\n"
+
 	template += "func (s *" + s.Name + ") BufferReset() {\n"
 	template += "mu.Lock()\n"
 	template += "defer mu.Unlock()\n"
@@ -212,64 +473,159 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "Buffer.Write(data)\n"
 	template += "}\n\n"
 
-	template += "func (s *" + s.Name + ") MemoryAdd() {\n"
+	template += "// checkUnique returns a model.ConstraintError when another row holds a unique key of s, mu must be held\n"
+	template += "func (s *" + s.Name + ") checkUnique() error {\n"
+	for _, c := range uniques {
+		var fields []string
+		for _, f := range c.fields {
+			fields = append(fields, strconv.Quote(f.Name))
+		}
+		template += "if other, ok := " + c.variable() + "[" + c.key("s") + "]; ok && other.Uuid != s.Uuid {\n"
+		template += "return &model.ConstraintError{Entity: Name, Constraint: " + strconv.Quote(c.name) + ", Fields: []string{" + strings.Join(fields, ", ") + "}, Uuid: other.Uuid}\n"
+		template += "}\n"
+	}
+	template += "return nil\n"
+	template += "}\n\n"
+
+	template += "// addUnique makes s the holder of its unique keys, mu must be held\n"
+	template += "func (s *" + s.Name + ") addUnique() {\n"
+	for _, c := range uniques {
+		template += c.variable() + "[" + c.key("s") + "] = s\n"
+	}
+	template += "}\n\n"
+
+	template += "// removeUnique releases the unique keys held by s, mu must be held\n"
+	template += "func (s *" + s.Name + ") removeUnique() {\n"
+	for _, c := range uniques {
+		template += "if " + c.variable() + "[" + c.key("s") + "] == s {\n"
+		template += "delete(" + c.variable() + ", " + c.key("s") + ")\n"
+		template += "}\n"
+	}
+	template += "}\n\n"
+
+	template += "// MemoryCheck returns the model.ConstraintError MemoryAdd or MemoryUpdate would return for s, without holding it\n"
+	template += "func (s *" + s.Name + ") MemoryCheck() error {\n"
 	template += "mu.Lock()\n"
 	template += "defer mu.Unlock()\n"
-	template += "Mem = append(Mem, s)\n\n"
+	template += "return s.checkUnique()\n"
+	template += "}\n\n"
+
+	template += "// MemoryAdd holds s, unless it breaks a unique constraint\n"
+	template += "func (s *" + s.Name + ") MemoryAdd() error {\n"
+	template += "mu.Lock()\n"
+	template += "defer mu.Unlock()\n"
+	template += "if err := s.checkUnique(); err != nil {\n"
+	template += "return err\n"
+	template += "}\n"
+	template += "Mem = append(Mem, s)\n"
+	template += "s.addUnique()\n"
+	for _, c := range composites {
+		template += c.variable() + ".Add(" + c.key("s") + ", s)\n"
+	}
+	template += "\n"
 	template += "// Update indexes\n"
 	for _, f := range s.Fields {
+		if indexes[f.Name] == indexNone {
+			continue
+		}
 		varName := "index" + f.Name
 		template += varName + " := Indexes[Field" + f.Name + "].(map[" + f.Type + "][]*" + s.Name + ")\n"
 		template += varName + "[s." + f.Name + "] = append(" + varName + "[s." + f.Name + "], s)\n"
+		if indexes[f.Name] == indexRange {
+			template += "Ranges[Field" + f.Name + "].(" + rangeType(s, f) + ").Add(s." + f.Name + ", s)\n"
+		}
 	}
+	template += "return nil\n"
 	template += "}\n\n"
 
 	template += "func (s *" + s.Name + ") MemoryRemove() {\n"
 	template += "mu.Lock()\n"
 	template += "defer mu.Unlock()\n"
 	template += "for i, instance := range Mem {\n"
-	template += "if instance.Uuid == s.Uuid {\n"
+	template += "if instance.Uuid != s.Uuid {\n"
+	template += "continue\n"
+	template += "}\n"
 	template += "lastIndex := len(Mem) - 1\n"
 	template += "Mem[i] = Mem[lastIndex]\n"
 	template += "Mem = Mem[:lastIndex]\n"
-	template += "break\n"
-	template += "}\n"
-	template += "}\n\n"
-	template += "// Remove from indexes\n"
+	template += "instance.removeUnique()\n"
+	for _, c := range composites {
+		template += c.variable() + ".Remove(" + c.key("instance") + ", instance)\n"
+	}
+	template += "\n"
+	template += "// Remove from indexes with the values held, s may carry others such as Deleted\n"
 	for _, f := range s.Fields {
+		if indexes[f.Name] == indexNone {
+			continue
+		}
 		varName := "index" + f.Name
 		template += varName + " := Indexes[Field" + f.Name + "].(map[" + f.Type + "][]*" + s.Name + ")\n"
-		template += varName + "[s." + f.Name + "] = removeFromIndex(" + varName + "[s." + f.Name + "], s)\n"
+		template += varName + "[instance." + f.Name + "] = removeFromIndex(" + varName + "[instance." + f.Name + "], instance)\n"
+		if indexes[f.Name] == indexRange {
+			template += "Ranges[Field" + f.Name + "].(" + rangeType(s, f) + ").Remove(instance." + f.Name + ", instance)\n"
+		}
 	}
+	template += "break\n"
+	template += "}\n"
 	template += "}\n\n"
 
-	template += "func (s *" + s.Name + ") MemoryUpdate() {\n"
+	template += "// MemoryUpdate replaces the row held with the Uuid of s, unless s breaks a unique constraint\n"
+	template += "func (s *" + s.Name + ") MemoryUpdate() error {\n"
 	template += "mu.Lock()\n"
 	template += "defer mu.Unlock()\n\n"
 	template += "for i, old := range Mem {\n"
 	template += "if old.Uuid != s.Uuid {\n"
 	template += "continue\n"
-	template += "}\n\n"
-	template += "// Update indexes only if values changed\n"
+	template += "}\n"
+	template += "if err := s.checkUnique(); err != nil {\n"
+	template += "return err\n"
+	template += "}\n"
+	template += "old.removeUnique()\n"
+	template += "s.addUnique()\n"
+	for _, c := range composites {
+		template += c.variable() + ".Remove(" + c.key("old") + ", old)\n"
+		template += c.variable() + ".Add(" + c.key("s") + ", s)\n"
+	}
+	template += "\n"
+	template += "// Update indexes, the values that did not change must also point to s rather than old\n"
 	for _, f := range s.Fields {
-		template += "if old." + f.Name + " != s." + f.Name + " {\n"
+		if indexes[f.Name] == indexNone {
+			continue
+		}
 		varName := "index" + f.Name
 		template += varName + " := Indexes[Field" + f.Name + "].(map[" + f.Type + "][]*" + s.Name + ")\n"
 		template += varName + "[old." + f.Name + "] = removeFromIndex(" + varName + "[old." + f.Name + "], old)\n"
 		template += varName + "[s." + f.Name + "] = append(" + varName + "[s." + f.Name + "], s)\n"
-		template += "}\n"
+		if indexes[f.Name] == indexRange {
+			template += "Ranges[Field" + f.Name + "].(" + rangeType(s, f) + ").Remove(old." + f.Name + ", old)\n"
+			template += "Ranges[Field" + f.Name + "].(" + rangeType(s, f) + ").Add(s." + f.Name + ", s)\n"
+		}
 	}
 	template += "\nMem[i] = s\n"
 	template += "break\n"
 	template += "}\n"
+	template += "return nil\n"
 	template += "}\n\n"
 
 	template += "func (s *" + s.Name + ") MemoryClear() {\n"
 	template += "mu.Lock()\n"
 	template += "defer mu.Unlock()\n\n"
-	template += "Mem = []*" + s.Name + "{}\n\n"
+	template += "Mem = []*" + s.Name + "{}\n"
+	for _, c := range uniques {
+		template += c.variable() + " = map[" + c.keyType() + "]*" + s.Name + "{}\n"
+	}
+	for _, c := range composites {
+		template += c.variable() + ".Clear()\n"
+	}
+	template += "\n"
 	for _, f := range s.Fields {
+		if indexes[f.Name] == indexNone {
+			continue
+		}
 		template += "Indexes[Field" + f.Name + "] = map[" + f.Type + "][]*" + s.Name + "{}\n"
+		if indexes[f.Name] == indexRange {
+			template += "Ranges[Field" + f.Name + "].(" + rangeType(s, f) + ").Clear()\n"
+		}
 	}
 	template += "}\n\n"
 
@@ -283,6 +639,12 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "return instances\n"
 	template += "}\n\n"
 
+	template += "func (s *" + s.Name + ") MemoryCount() int {\n"
+	template += "mu.Lock()\n"
+	template += "defer mu.Unlock()\n"
+	template += "return len(Mem)\n"
+	template += "}\n\n"
+
 	template += "func (s *" + s.Name + ") MemoryContains(target register.Model) bool {\n"
 	template += "mu.Lock()\n"
 	template += "defer mu.Unlock()\n\n"
@@ -304,11 +666,12 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "return false\n"
 	template += "}\n\n"
 
-	template += "func (s *" + s.Name + ") DbInsert(c *hconn.HConn) error {\n"
+	template += "func (s *" + s.Name + ") DbInsert(c hconn.Requester) error {\n"
 	template += "if s.Uuid == uuid.Nil {\n"
 	template += "s.WithNewUuid()\n"
 	template += "}\n"
-	template += "if err := s.Encode(); err != nil {\n"
+	template += "data, err := s.EncodeData()\n"
+	template += "if err != nil {\n"
 	template += "return err\n"
 	template += "}\n\n"
 	template += "msg := model.Message{\n"
@@ -316,23 +679,21 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "Entity: register.EntityBase{\n"
 	template += "Version: Version,\n"
 	template += "Name: Name,\n"
-	template += "Data: s.GetBufferData(),\n"
+	template += "Data: data,\n"
 	template += "},\n"
-	template += "}\n"
-	template += "s.BufferReset()\n\n"
-	template += "resp, err := c.SendReceive(msg)\n"
+	template += "}\n\n"
+	template += "resp, err := c.SendReceive(context.Background(), msg)\n"
 	template += "if err != nil {\n"
 	template += "return err\n"
 	template += "}\n"
-	template += "if resp.Status == model.StatusError {\n"
-	template += "return errors.New(resp.String)\n"
-	template += "}\n\n"
-	template += "return nil\n"
+	template += "// A broken unique constraint is returned as a *model.ConstraintError\n"
+	template += "return resp.Err()\n"
 	template += "}\n\n"
 
-	template += "func (s *" + s.Name + ") DbDelete(c *hconn.HConn) error {\n"
+	template += "func (s *" + s.Name + ") DbDelete(c hconn.Requester) error {\n"
 	template += "s.Deleted = true\n"
-	template += "if err := s.Encode(); err != nil {\n"
+	template += "data, err := s.EncodeData()\n"
+	template += "if err != nil {\n"
 	template += "return err\n"
 	template += "}\n\n"
 	template += "msg := model.Message{\n"
@@ -340,21 +701,20 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "Entity: register.EntityBase{\n"
 	template += "Version: Version,\n"
 	template += "Name: Name,\n"
-	template += "Data: s.GetBufferData(),\n"
+	template += "Data: data,\n"
 	template += "},\n"
-	template += "}\n"
-	template += "s.BufferReset()\n\n"
-	template += "resp, err := c.SendReceive(msg)\n"
+	template += "}\n\n"
+	template += "resp, err := c.SendReceive(context.Background(), msg)\n"
 	template += "if err != nil {\n"
 	template += "return err\n"
 	template += "}\n"
-	template += "if resp.Status == model.StatusError {\n"
+	template += "if resp.Status != model.StatusSuccess {\n"
 	template += "return errors.New(resp.String)\n"
 	template += "}\n\n"
 	template += "return nil\n"
 	template += "}\n\n"
 
-	template += "func DbDeleteAll(c *hconn.HConn) error {\n"
+	template += "func DbDeleteAll(c hconn.Requester) error {\n"
 	template += "entities, err := DbGetAll(c)\n"
 	template += "if err != nil {\n"
 	template += "return err\n"
@@ -367,11 +727,12 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "return nil\n"
 	template += "}\n\n"
 
-	template += "func (s *" + s.Name + ") DbUpdate(c *hconn.HConn) error {\n"
+	template += "func (s *" + s.Name + ") DbUpdate(c hconn.Requester) error {\n"
 	template += "if s.Uuid == uuid.Nil {\n"
 	template += `return model.ErrQueryEntityNoUuid` + "\n"
 	template += "}\n"
-	template += "if err := s.Encode(); err != nil {\n"
+	template += "data, err := s.EncodeData()\n"
+	template += "if err != nil {\n"
 	template += "return err\n"
 	template += "}\n\n"
 	template += "msg := model.Message{\n"
@@ -379,21 +740,18 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "Entity: register.EntityBase{\n"
 	template += "Version: Version,\n"
 	template += "Name: Name,\n"
-	template += "Data: s.GetBufferData(),\n"
+	template += "Data: data,\n"
 	template += "},\n"
-	template += "}\n"
-	template += "s.BufferReset()\n\n"
-	template += "resp, err := c.SendReceive(msg)\n"
+	template += "}\n\n"
+	template += "resp, err := c.SendReceive(context.Background(), msg)\n"
 	template += "if err != nil {\n"
 	template += "return err\n"
 	template += "}\n"
-	template += "if resp.Status == model.StatusError {\n"
-	template += "return errors.New(resp.String)\n"
-	template += "}\n\n"
-	template += "return nil\n"
+	template += "// A broken unique constraint is returned as a *model.ConstraintError\n"
+	template += "return resp.Err()\n"
 	template += "}\n\n"
 
-	template += "func DbGetAll(c *hconn.HConn) ([]*" + s.Name + ", error) {\n"
+	template += "func DbGetAll(c hconn.Requester) ([]*" + s.Name + ", error) {\n"
 	template += "msg := model.Message{\n"
 	template += "Type: model.MessageTypeGetAll,\n"
 	template += "Entity: register.EntityBase{\n"
@@ -401,17 +759,17 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "Name: Name,\n"
 	template += "},\n"
 	template += "}\n\n"
-	template += "resp, err := c.SendReceive(msg)\n"
+	template += "resp, err := c.SendReceive(context.Background(), msg)\n"
 	template += "if err != nil {\n"
 	template += "return nil, err\n"
 	template += "}\n\n"
-	template += "if resp.Status == model.StatusError {\n"
+	template += "if resp.Status != model.StatusSuccess {\n"
 	template += "return nil, errors.New(resp.String)\n"
 	template += "}\n\n"
 	template += "return CastTo" + s.Name + "(resp.Models), nil\n"
 	template += "}\n\n"
 
-	template += "func DbQuery(c *hconn.HConn, q *query.Query) ([]*" + s.Name + ", error) {\n"
+	template += "func DbQuery(c hconn.Requester, q *query.Query) ([]*" + s.Name + ", error) {\n"
 	template += "msg := model.Message{\n"
 	template += "Type: model.MessageTypeQuery,\n"
 	template += "Entity: register.EntityBase{\n"
@@ -420,16 +778,79 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "},\n"
 	template += "Query: q,\n"
 	template += "}\n\n"
-	template += "resp, err := c.SendReceive(msg)\n"
+	template += "resp, err := c.SendReceive(context.Background(), msg)\n"
 	template += "if err != nil {\n"
 	template += "return nil, err\n"
 	template += "}\n\n"
-	template += "if resp.Status == model.StatusError {\n"
+	template += "if resp.Status != model.StatusSuccess {\n"
 	template += "return nil, errors.New(resp.String)\n"
 	template += "}\n\n"
 	template += "return CastTo" + s.Name + "(resp.Models), nil\n"
 	template += "}\n\n"
 
+	template += "// DbExplain returns how the node would answer q without running it\n"
+	template += "func DbExplain(c hconn.Requester, q *query.Query) (query.Plan, error) {\n"
+	template += "msg := model.Message{\n"
+	template += "Type: model.MessageTypeExplain,\n"
+	template += "Entity: register.EntityBase{\n"
+	template += "Version: Version,\n"
+	template += "Name: Name,\n"
+	template += "},\n"
+	template += "Query: q,\n"
+	template += "}\n\n"
+	template += "var plan query.Plan\n"
+	template += "resp, err := c.SendReceive(context.Background(), msg)\n"
+	template += "if err != nil {\n"
+	template += "return plan, err\n"
+	template += "}\n\n"
+	template += "if resp.Status != model.StatusSuccess {\n"
+	template += "return plan, errors.New(resp.String)\n"
+	template += "}\n\n"
+	template += "err = json.Unmarshal(resp.Bytes, &plan)\n"
+	template += "return plan, err\n"
+	template += "}\n\n"
+
+	template += "// DbGetAllIter streams every entity in chunks of chunkSize (0 uses the node default), breaking out of the loop cancels the stream\n"
+	template += "func DbGetAllIter(c hconn.Requester, chunkSize int) iter.Seq2[*" + s.Name + ", error] {\n"
+	template += "msg := model.Message{\n"
+	template += "Type: model.MessageTypeGetAll,\n"
+	template += "Entity: register.EntityBase{\n"
+	template += "Version: Version,\n"
+	template += "Name: Name,\n"
+	template += "},\n"
+	template += "Cursor: &model.Cursor{Size: chunkSize},\n"
+	template += "}\n\n"
+	template += "return castIter(hconn.Stream(context.Background(), c, msg))\n"
+	template += "}\n\n"
+
+	template += "// DbQueryIter streams the results of q in chunks of chunkSize (0 uses the node default), breaking out of the loop cancels the stream\n"
+	template += "func DbQueryIter(c hconn.Requester, q *query.Query, chunkSize int) iter.Seq2[*" + s.Name + ", error] {\n"
+	template += "msg := model.Message{\n"
+	template += "Type: model.MessageTypeQuery,\n"
+	template += "Entity: register.EntityBase{\n"
+	template += "Version: Version,\n"
+	template += "Name: Name,\n"
+	template += "},\n"
+	template += "Query: q,\n"
+	template += "Cursor: &model.Cursor{Size: chunkSize},\n"
+	template += "}\n\n"
+	template += "return castIter(hconn.Stream(context.Background(), c, msg))\n"
+	template += "}\n\n"
+
+	template += "func castIter(seq iter.Seq2[register.Model, error]) iter.Seq2[*" + s.Name + ", error] {\n"
+	template += "return func(yield func(*" + s.Name + ", error) bool) {\n"
+	template += "for m, err := range seq {\n"
+	template += "if err != nil {\n"
+	template += "yield(nil, err)\n"
+	template += "return\n"
+	template += "}\n"
+	template += "if !yield(m.(*" + s.Name + "), nil) {\n"
+	template += "return\n"
+	template += "}\n"
+	template += "}\n"
+	template += "}\n"
+	template += "}\n\n"
+
 	template += "func CastTo" + s.Name + "(models []register.Model) []*" + s.Name + " {\n"
 	template += "out := make([]*" + s.Name + ", len(models))\n"
 	template += "for i, m := range models {\n"
@@ -460,6 +881,9 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	template += "func GetFullIndex(field int) []register.Model {\n"
 	template += "idx := Indexes[field]\n"
 	for _, f := range s.Fields {
+		if indexes[f.Name] == indexNone {
+			continue
+		}
 		template += "if typed, ok := idx.(map[" + f.Type + "][]*" + s.Name + "); ok {\n"
 		template += "var all []*" + s.Name + "\n"
 		template += "for _, list := range typed {\n"
@@ -474,6 +898,213 @@ func TemplateEntity(s util.StructDef, v string) (string, error) {
 	return template, nil
 }
 
+// indexKind is how the rows are indexed by a field
+type indexKind int
+
+const (
+	indexNone  indexKind = iota // hyperion:"noindex", filters on the field scan the rows
+	indexValue                  // hyperion:"index", the default: Equal and In are looked up by value
+	indexRange                  // hyperion:"index=range", also kept in order for range filters and orders
+)
+
+// fieldOptions are the options of the hyperion tag of a field, separated by commas
+type fieldOptions struct {
+	index      indexKind
+	unique     string   // Unique constraint of the field, shared by the fields of a composite one
+	composites []string // Composite indexes the field belongs to
+}
+
+/*
+fieldTag returns the options of the hyperion tag of f:
+- index, index=range or noindex, see indexKind
+- unique: no two rows hold the same value of f
+- unique=name: no two rows hold the same values of the fields tagged with that name
+- composite=name: the rows are kept in order of the values of the fields tagged with that name, repeated for every index
+The tag only changes what is built in memory when the rows are loaded,
+so it is not compared to decide whether an entity needs a new version.
+*/
+func fieldTag(f util.StructField) (fieldOptions, error) {
+	o := fieldOptions{index: indexValue}
+	tag, err := strconv.Unquote(f.Tag)
+	if err != nil && f.Tag != "" {
+		return o, fmt.Errorf("%w: %s: %v", model.ErrGeneratorTagInvalid, f.Name, err)
+	}
+	value, ok := reflect.StructTag(tag).Lookup("hyperion")
+	if !ok {
+		return o, nil
+	}
+
+	indexed := false
+	for _, option := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(option, "=")
+		switch {
+		case option == "index" || option == "index=range" || option == "noindex":
+			if indexed {
+				return o, fmt.Errorf("%w: %s: more than one index option in %q", model.ErrGeneratorTagInvalid, f.Name, value)
+			}
+			indexed = true
+			o.index = map[string]indexKind{"index": indexValue, "index=range": indexRange, "noindex": indexNone}[option]
+		case name == "unique":
+			if arg == "" {
+				arg = f.Name
+			}
+			if !token.IsIdentifier(arg) {
+				return o, fmt.Errorf("%w: %s: constraint name %q is not an identifier", model.ErrGeneratorTagInvalid, f.Name, arg)
+			}
+			o.unique = arg
+		case name == "composite":
+			if !token.IsIdentifier(arg) {
+				return o, fmt.Errorf("%w: %s: composite index name %q is not an identifier", model.ErrGeneratorTagInvalid, f.Name, arg)
+			}
+			if slices.Contains(o.composites, arg) {
+				return o, fmt.Errorf("%w: %s: composite index %q repeated", model.ErrGeneratorTagInvalid, f.Name, arg)
+			}
+			if rangeCompare(f) == "" {
+				return o, fmt.Errorf("%w: %s: %s has no order for composite=%s", model.ErrGeneratorTagInvalid, f.Name, f.Type, arg)
+			}
+			o.composites = append(o.composites, arg)
+		default:
+			return o, fmt.Errorf("%w: %s: %q", model.ErrGeneratorTagInvalid, f.Name, option)
+		}
+	}
+	if o.index == indexRange && rangeCompare(f) == "" {
+		return o, fmt.Errorf("%w: %s: %s has no order for index=range", model.ErrGeneratorTagInvalid, f.Name, f.Type)
+	}
+	return o, nil
+}
+
+// fieldGroup is a unique constraint or a composite index of an entity and its fields, in the order of the struct
+type fieldGroup struct {
+	prefix string // Of the variables of the group in the generated code, "unique" or "composite"
+	name   string
+	fields []util.StructField
+}
+
+// fieldGroups returns the groups of s named by names for every field, in the order they first appear
+func fieldGroups(s util.StructDef, prefix string, names func(o fieldOptions) []string, options map[string]fieldOptions) []fieldGroup {
+	var out []fieldGroup
+	for _, f := range s.Fields {
+		for _, name := range names(options[f.Name]) {
+			i := slices.IndexFunc(out, func(g fieldGroup) bool { return g.name == name })
+			if i < 0 {
+				i = len(out)
+				out = append(out, fieldGroup{prefix: prefix, name: name})
+			}
+			out[i].fields = append(out[i].fields, f)
+		}
+	}
+	return out
+}
+
+// uniqueConstraints returns the unique constraints of s, in the order they first appear
+func uniqueConstraints(s util.StructDef, options map[string]fieldOptions) []fieldGroup {
+	return fieldGroups(s, "unique", func(o fieldOptions) []string {
+		if o.unique == "" {
+			return nil
+		}
+		return []string{o.unique}
+	}, options)
+}
+
+// compositeIndexes returns the composite indexes of s, in the order they first appear, each on 2 fields or more
+func compositeIndexes(s util.StructDef, options map[string]fieldOptions) ([]fieldGroup, error) {
+	out := fieldGroups(s, "composite", func(o fieldOptions) []string { return o.composites }, options)
+	for _, c := range out {
+		if len(c.fields) < 2 {
+			return nil, fmt.Errorf("%w: composite index %q has a single field, use index=range", model.ErrGeneratorTagInvalid, c.name)
+		}
+	}
+	return out, nil
+}
+
+// variable returns the name of the variable holding the rows by key of x in the generated code
+func (x fieldGroup) variable() string {
+	return x.prefix + strings.ToUpper(x.name[:1]) + x.name[1:]
+}
+
+// keyType returns the type of the keys of x, a struct of its fields when composite
+func (x fieldGroup) keyType() string {
+	if len(x.fields) == 1 {
+		return x.fields[0].Type
+	}
+	return x.variable() + "Key"
+}
+
+// key returns the key of x of the row held by v in the generated code
+func (x fieldGroup) key(v string) string {
+	if len(x.fields) == 1 {
+		return v + "." + x.fields[0].Name
+	}
+	var values []string
+	for _, f := range x.fields {
+		values = append(values, f.Name+": "+v+"."+f.Name)
+	}
+	return x.keyType() + "{" + strings.Join(values, ", ") + "}"
+}
+
+// rangeCompare returns the function ordering the values of f in Ranges, empty when its type has no order
+func rangeCompare(f util.StructField) string {
+	switch f.Type {
+	case "string", "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+		return "cmp.Compare[" + f.Type + "]"
+	case "time.Time":
+		return "time.Time.Compare"
+	}
+	return ""
+}
+
+// rangeType returns the type of the ordered index of f in Ranges
+func rangeType(s util.StructDef, f util.StructField) string {
+	return "*index.Ordered[" + f.Type + ", *" + s.Name + "]"
+}
+
+// binaryAppend returns the statement appending f to b in the generated AppendFields
+func binaryAppend(f util.StructField) (string, error) {
+	v := "s." + f.Name
+	switch f.Type {
+	case "string":
+		return "b = hconn.AppendString(b, " + v + ")\n", nil
+	case "bool":
+		return "b = hconn.AppendBool(b, " + v + ")\n", nil
+	case "int", "int8", "int16", "int32", "int64":
+		return "b = hconn.AppendInt(b, int64(" + v + "))\n", nil
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		return "b = hconn.AppendUint(b, uint64(" + v + "))\n", nil
+	case "float32":
+		return "b = hconn.AppendFloat32(b, " + v + ")\n", nil
+	case "float64":
+		return "b = hconn.AppendFloat64(b, " + v + ")\n", nil
+	case "uuid.UUID":
+		return "b = hconn.AppendUuid(b, " + v + ")\n", nil
+	case "time.Time":
+		return "if b, err = hconn.AppendTime(b, " + v + "); err != nil {\nreturn b, err\n}\n", nil
+	}
+	return "", errors.New("binary codec: unsupported field type: " + f.Type)
+}
+
+// binaryRead returns the expression reading f in the generated UnmarshalFields, binaryAppend validated the type
+func binaryRead(f util.StructField) string {
+	switch f.Type {
+	case "string":
+		return "r.String()"
+	case "bool":
+		return "r.Bool()"
+	case "int", "int8", "int16", "int32", "int64":
+		return f.Type + "(r.Int())"
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		return f.Type + "(r.Uint())"
+	case "float32":
+		return "r.Float32()"
+	case "float64":
+		return "r.Float64()"
+	case "uuid.UUID":
+		return "r.Uuid()"
+	case "time.Time":
+		return "r.Time()"
+	}
+	return ""
+}
+
 func TemplateMigrations(sPrevious util.StructDef, sCurrent util.StructDef, vPrevious string, vCurrent string) (string, error) {
 	mn, err := util.GetModuleName(pathGoMod)
 	if err != nil {
@@ -0,0 +1,91 @@
+package template
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/rah-0/hyperion/model"
+	"github.com/rah-0/hyperion/util"
+)
+
+func TestFieldTag(t *testing.T) {
+	cases := []struct {
+		name     string
+		tag      string
+		typ      string
+		expected fieldOptions
+		err      error
+	}{
+		{"untagged", "", "string", fieldOptions{index: indexValue}, nil},
+		{"other tags", "`json:\"-\"`", "string", fieldOptions{index: indexValue}, nil},
+		{"index", "`hyperion:\"index\"`", "bool", fieldOptions{index: indexValue}, nil},
+		{"range", "`json:\"-\" hyperion:\"index=range\"`", "time.Time", fieldOptions{index: indexRange}, nil},
+		{"noindex", "`hyperion:\"noindex\"`", "uuid.UUID", fieldOptions{index: indexNone}, nil},
+		{"unique", "`hyperion:\"unique\"`", "string", fieldOptions{index: indexValue, unique: "A"}, nil},
+		{"composite unique", "`hyperion:\"noindex,unique=login\"`", "string", fieldOptions{index: indexNone, unique: "login"}, nil},
+		{"composites", "`hyperion:\"composite=a,index=range,composite=b\"`", "int64", fieldOptions{index: indexRange, composites: []string{"a", "b"}}, nil},
+		{"range without order", "`hyperion:\"index=range\"`", "bool", fieldOptions{}, model.ErrGeneratorTagInvalid},
+		{"composite without order", "`hyperion:\"composite=a\"`", "bool", fieldOptions{}, model.ErrGeneratorTagInvalid},
+		{"composite repeated", "`hyperion:\"composite=a,composite=a\"`", "string", fieldOptions{}, model.ErrGeneratorTagInvalid},
+		{"composite without name", "`hyperion:\"composite\"`", "string", fieldOptions{}, model.ErrGeneratorTagInvalid},
+		{"two index options", "`hyperion:\"index,noindex\"`", "string", fieldOptions{}, model.ErrGeneratorTagInvalid},
+		{"constraint not an identifier", "`hyperion:\"unique=a-b\"`", "string", fieldOptions{}, model.ErrGeneratorTagInvalid},
+		{"unknown", "`hyperion:\"index=hash\"`", "string", fieldOptions{}, model.ErrGeneratorTagInvalid},
+	}
+	for _, c := range cases {
+		o, err := fieldTag(util.StructField{Name: "A", Type: c.typ, Tag: c.tag})
+		if !errors.Is(err, c.err) || err == nil && !reflect.DeepEqual(o, c.expected) {
+			t.Errorf("%s: expected %+v and %v, got %+v and %v", c.name, c.expected, c.err, o, err)
+		}
+	}
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	s := util.StructDef{Name: "S", Fields: []util.StructField{
+		{Name: "Tenant", Type: "string"},
+		{Name: "Email", Type: "string"},
+		{Name: "Login", Type: "string"},
+	}}
+	options := map[string]fieldOptions{"Tenant": {unique: "login"}, "Email": {unique: "Email"}, "Login": {unique: "login"}}
+
+	uniques := uniqueConstraints(s, options)
+	if len(uniques) != 2 || uniques[0].name != "login" || len(uniques[0].fields) != 2 || uniques[1].name != "Email" {
+		t.Fatalf("Unexpected constraints: %+v", uniques)
+	}
+	if key := uniques[0].key("s"); key != "uniqueLoginKey{Tenant: s.Tenant, Login: s.Login}" {
+		t.Errorf("Unexpected composite key: %s", key)
+	}
+	if key := uniques[1].key("s"); key != "s.Email" || uniques[1].keyType() != "string" {
+		t.Errorf("Unexpected key: %s of %s", key, uniques[1].keyType())
+	}
+}
+
+func TestCompositeIndexes(t *testing.T) {
+	s := util.StructDef{Name: "S", Fields: []util.StructField{
+		{Name: "Name", Type: "string"},
+		{Name: "Surname", Type: "string"},
+		{Name: "Birth", Type: "time.Time"},
+	}}
+	options := map[string]fieldOptions{
+		"Name":    {composites: []string{"fullname"}},
+		"Surname": {composites: []string{"fullname", "born"}},
+		"Birth":   {composites: []string{"born"}},
+	}
+
+	composites, err := compositeIndexes(s, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(composites) != 2 || composites[0].name != "fullname" || composites[1].name != "born" {
+		t.Fatalf("Unexpected indexes: %+v", composites)
+	}
+	if key := composites[1].key("s"); key != "compositeBornKey{Surname: s.Surname, Birth: s.Birth}" {
+		t.Errorf("Unexpected key: %s", key)
+	}
+
+	options["Birth"] = fieldOptions{}
+	if _, err := compositeIndexes(s, options); !errors.Is(err, model.ErrGeneratorTagInvalid) {
+		t.Errorf("Expected a single field index to be refused, got %v", err)
+	}
+}
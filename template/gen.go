@@ -23,8 +23,10 @@ import (
 )
 
 var (
-	pathEntities       = filepath.Join("..", "entities")
-	pathGoMod          = filepath.Join("..", "go.mod")
+	pathEntities = filepath.Join("..", "entities")
+	pathGoMod    = filepath.Join("..", "go.mod")
+	// pathTestEntities holds the entities generated from testdata for the tests of other packages, they are not registered
+	pathTestEntities   = filepath.Join("..", "internal", "testentities")
 	entitiesRegistered = false
 )
 
@@ -36,6 +38,8 @@ func RegisterEntities() error {
 	// Types should be registered here
 	gob.Register(time.Time{})
 	gob.Register(uuid.UUID{})
+	gob.Register([]time.Time{})
+	gob.Register([]uuid.UUID{})
 	gob.Register(register.IndexAccessor{})
 
 	//
@@ -54,27 +58,32 @@ func Generate() error {
 		return err
 	}
 
-	structs, err := util.StructsExtractFromPackage(pe, false, 0)
+	err = generateEntities(pe, pe)
 	if err != nil {
 		return err
 	}
 
-	err = createDirectoriesForStructs(pe, structs)
+	err = updateDynamicCode(pe)
 	if err != nil {
 		return err
 	}
 
-	err = createEntities(structs, pe)
+	return nil
+}
+
+// generateEntities creates or migrates in pathOut the entities of the structs defined in pathIn
+func generateEntities(pathIn string, pathOut string) error {
+	structs, err := util.StructsExtractFromPackage(pathIn, false, 0)
 	if err != nil {
 		return err
 	}
 
-	err = updateDynamicCode(pe)
+	err = createDirectoriesForStructs(pathOut, structs)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return createEntities(structs, pathOut)
 }
 
 func updateDynamicCode(pathEntities string) error {
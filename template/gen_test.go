@@ -1,6 +1,7 @@
 package template
 
 import (
+	"path/filepath"
 	"testing"
 )
 
@@ -10,3 +11,10 @@ func TestGenerate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGenerateTestEntities(t *testing.T) {
+	err := generateEntities(filepath.Join("testdata"), pathTestEntities)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
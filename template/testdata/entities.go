@@ -0,0 +1,12 @@
+package testdata
+
+/*
+	Entities generated into internal/testentities by TestGenerateTestEntities, for the tests of other packages.
+	They are not registered by RegisterEntities, tests register the ones they use.
+*/
+
+type Account struct {
+	Tenant string `hyperion:"unique=login"`
+	Login  string `hyperion:"unique=login"`
+	Email  string `hyperion:"unique"`
+}
@@ -0,0 +1,222 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+// FileExporter appends spans to a file as JSON lines, for looking at traces without a collector
+type FileExporter struct {
+	Path string
+
+	file *os.File
+	w    *bufio.Writer
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{Path: path, file: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (x *FileExporter) Export(records []Record) error {
+	enc := json.NewEncoder(x.w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return x.w.Flush()
+}
+
+func (x *FileExporter) Close() error {
+	err := x.w.Flush()
+	if cerr := x.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// DefaultExportTimeout bounds every request made to a collector
+var DefaultExportTimeout = 10 * time.Second
+
+/*
+OTLPExporter sends spans to an OpenTelemetry collector with OTLP over HTTP in its JSON encoding,
+Endpoint is the full URL of the traces receiver, usually http://collector:4318/v1/traces.
+*/
+type OTLPExporter struct {
+	Endpoint string
+	Headers  map[string]string
+	Client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: DefaultExportTimeout},
+	}
+}
+
+func (x *OTLPExporter) WithHeader(key string, value string) *OTLPExporter {
+	if x.Headers == nil {
+		x.Headers = make(map[string]string)
+	}
+	x.Headers[key] = value
+	return x
+}
+
+func (x *OTLPExporter) Export(records []Record) error {
+	data, err := json.Marshal(NewOTLPRequest(records))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, x.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range x.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := x.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s %s", model.ErrTraceExport, resp.Status, body)
+	}
+	return nil
+}
+
+func (x *OTLPExporter) Close() error {
+	x.Client.CloseIdleConnections()
+	return nil
+}
+
+// The following types are the subset of the OTLP JSON encoding of ExportTraceServiceRequest used by OTLPExporter
+
+type OTLPRequest struct {
+	ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+}
+
+type OTLPResourceSpans struct {
+	Resource   OTLPResource     `json:"resource"`
+	ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+}
+
+type OTLPResource struct {
+	Attributes []OTLPAttribute `json:"attributes"`
+}
+
+type OTLPScopeSpans struct {
+	Scope OTLPScope  `json:"scope"`
+	Spans []OTLPSpan `json:"spans"`
+}
+
+type OTLPScope struct {
+	Name string `json:"name"`
+}
+
+type OTLPSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []OTLPAttribute `json:"attributes,omitempty"`
+	Status            OTLPStatus      `json:"status"`
+}
+
+type OTLPAttribute struct {
+	Key   string    `json:"key"`
+	Value OTLPValue `json:"value"`
+}
+
+type OTLPValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type OTLPStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpStatusOk     = 1
+	otlpStatusError  = 2
+	otlpScopeName    = "github.com/rah-0/hyperion"
+	otlpServiceName  = "service.name"
+	otlpServiceGroup = "hyperion"
+)
+
+var otlpKinds = map[Kind]int{
+	KindInternal: 1,
+	KindServer:   2,
+	KindClient:   3,
+}
+
+// NewOTLPRequest groups records by service, each service being an OTLP resource
+func NewOTLPRequest(records []Record) OTLPRequest {
+	var req OTLPRequest
+	index := make(map[string]int)
+	for _, r := range records {
+		i, ok := index[r.Service]
+		if !ok {
+			i = len(req.ResourceSpans)
+			index[r.Service] = i
+			service := r.Service
+			if service == "" {
+				service = otlpServiceGroup
+			}
+			req.ResourceSpans = append(req.ResourceSpans, OTLPResourceSpans{
+				Resource:   OTLPResource{Attributes: []OTLPAttribute{{Key: otlpServiceName, Value: OTLPValue{StringValue: service}}}},
+				ScopeSpans: []OTLPScopeSpans{{Scope: OTLPScope{Name: otlpScopeName}}},
+			})
+		}
+
+		s := OTLPSpan{
+			TraceId:           r.TraceId.String(),
+			SpanId:            r.SpanId.String(),
+			Name:              r.Name,
+			Kind:              otlpKinds[r.Kind],
+			StartTimeUnixNano: strconv.FormatInt(r.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(r.End.UnixNano(), 10),
+			Status:            OTLPStatus{Code: otlpStatusOk},
+		}
+		if !r.ParentId.IsZero() {
+			s.ParentSpanId = r.ParentId.String()
+		}
+		for _, k := range slices.Sorted(maps.Keys(r.Attributes)) {
+			s.Attributes = append(s.Attributes, OTLPAttribute{Key: k, Value: OTLPValue{StringValue: r.Attributes[k]}})
+		}
+		if r.Error != "" {
+			s.Status = OTLPStatus{Code: otlpStatusError, Message: r.Error}
+		}
+
+		scope := &req.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, s)
+	}
+	return req
+}
@@ -0,0 +1,369 @@
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/rah-0/nabu"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+var (
+	// DefaultBatchSize is how many ended spans are buffered before they are exported
+	DefaultBatchSize = 512
+	// DefaultFlushInterval is how often buffered spans are exported even if the batch is not full
+	DefaultFlushInterval = 5 * time.Second
+	// maxBuffered drops spans beyond it while the exporter is failing rather than growing forever
+	maxBuffered = 8 * DefaultBatchSize
+)
+
+type TraceId [16]byte
+
+func (x TraceId) String() string {
+	return hex.EncodeToString(x[:])
+}
+
+func (x TraceId) MarshalText() ([]byte, error) {
+	return []byte(x.String()), nil
+}
+
+type SpanId [8]byte
+
+func (x SpanId) String() string {
+	return hex.EncodeToString(x[:])
+}
+
+func (x SpanId) MarshalText() ([]byte, error) {
+	return []byte(x.String()), nil
+}
+
+// IsZero is true for the parent of root spans
+func (x SpanId) IsZero() bool {
+	return x == SpanId{}
+}
+
+// Kind tells whether a span handles a request from another process, sends one, or neither
+type Kind string
+
+const (
+	KindInternal Kind = "internal"
+	KindServer   Kind = "server"
+	KindClient   Kind = "client"
+)
+
+// Record is an ended span as exported
+type Record struct {
+	TraceId    TraceId
+	SpanId     SpanId
+	ParentId   SpanId
+	Service    string
+	Name       string
+	Kind       Kind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string `json:",omitempty"`
+	Error      string            `json:",omitempty"`
+}
+
+/*
+Span is a timed operation within a trace, such as handling a request or writing it to disk.
+Spans are created by a Tracer or as children of another span and are exported once finished.
+Every method accepts a nil Span and does nothing, which is what a nil Tracer returns,
+so code can be instrumented unconditionally and tracing costs nothing when disabled.
+*/
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	r     Record
+	ended bool
+}
+
+func (x *Span) TraceId() TraceId {
+	if x == nil {
+		return TraceId{}
+	}
+	return x.r.TraceId
+}
+
+func (x *Span) SpanId() SpanId {
+	if x == nil {
+		return SpanId{}
+	}
+	return x.r.SpanId
+}
+
+// Child starts a span within x
+func (x *Span) Child(name string) *Span {
+	if x == nil {
+		return nil
+	}
+	return x.tracer.newSpan(name, x.r.TraceId, x.r.SpanId)
+}
+
+func (x *Span) Set(key string, value string) *Span {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.ended {
+		return x
+	}
+	if x.r.Attributes == nil {
+		x.r.Attributes = make(map[string]string)
+	}
+	x.r.Attributes[key] = value
+	return x
+}
+
+func (x *Span) SetKind(k Kind) *Span {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.r.Kind = k
+	return x
+}
+
+// Fail marks the span as failed, nil errors are ignored
+func (x *Span) Fail(err error) *Span {
+	if x == nil || err == nil {
+		return x
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.ended {
+		x.r.Error = err.Error()
+	}
+	return x
+}
+
+// Finish ends the span and hands it to the tracer for export, later calls do nothing
+func (x *Span) Finish() {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	if x.ended {
+		x.mu.Unlock()
+		return
+	}
+	x.ended = true
+	x.r.End = time.Now()
+	r := x.r
+	x.mu.Unlock()
+
+	x.tracer.add(r)
+}
+
+// Context returns what propagates the span to another process in model.Message, nil for a nil span
+func (x *Span) Context() *model.Trace {
+	if x == nil {
+		return nil
+	}
+	return &model.Trace{TraceId: x.r.TraceId, SpanId: x.r.SpanId}
+}
+
+// Exporter sends ended spans somewhere they can be looked at, Export is never called concurrently
+type Exporter interface {
+	Export(records []Record) error
+	Close() error
+}
+
+/*
+Tracer records the spans of a service and exports them in batches from a background goroutine.
+Requests arriving with a model.Trace continue the trace of their sender, the others start a new trace
+only for the SampleRatio of them. A nil Tracer records nothing.
+*/
+type Tracer struct {
+	Service       string
+	Exporter      Exporter
+	BatchSize     int
+	FlushInterval time.Duration
+	SampleRatio   float64 // Share of new traces recorded, from 0 to 1
+
+	mu      sync.Mutex
+	records []Record
+	flush   chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	started bool
+
+	exportMu sync.Mutex // Serializes calls to the exporter
+}
+
+func NewTracer(service string, e Exporter) *Tracer {
+	return &Tracer{
+		Service:       service,
+		Exporter:      e,
+		BatchSize:     DefaultBatchSize,
+		FlushInterval: DefaultFlushInterval,
+		SampleRatio:   1,
+		flush:         make(chan struct{}, 1),
+	}
+}
+
+func (x *Tracer) WithBatchSize(size int) *Tracer {
+	x.BatchSize = size
+	return x
+}
+
+func (x *Tracer) WithFlushInterval(d time.Duration) *Tracer {
+	x.FlushInterval = d
+	return x
+}
+
+func (x *Tracer) WithSampleRatio(ratio float64) *Tracer {
+	x.SampleRatio = ratio
+	return x
+}
+
+// Start begins exporting in the background, spans ended before are kept until then
+func (x *Tracer) Start() {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.started {
+		return
+	}
+	x.started = true
+	x.stop = make(chan struct{})
+	x.done = make(chan struct{})
+	go x.run(x.stop, x.done)
+}
+
+// Close exports the spans left and closes the exporter
+func (x *Tracer) Close() error {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	started := x.started
+	x.started = false
+	if started {
+		close(x.stop)
+	}
+	x.mu.Unlock()
+	if started {
+		<-x.done
+	}
+
+	err := x.Flush()
+	if cerr := x.Exporter.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Span starts a span continuing the trace of parent, or a new trace if parent is nil and the trace is sampled.
+// It returns nil when the span is not recorded.
+func (x *Tracer) Span(name string, parent *model.Trace) *Span {
+	if x == nil {
+		return nil
+	}
+	if parent != nil {
+		return x.newSpan(name, parent.TraceId, parent.SpanId)
+	}
+	if x.SampleRatio < 1 && rand.Float64() >= x.SampleRatio {
+		return nil
+	}
+	var t TraceId
+	for t == (TraceId{}) {
+		binary.BigEndian.PutUint64(t[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(t[8:], rand.Uint64())
+	}
+	return x.newSpan(name, t, SpanId{})
+}
+
+// Flush exports the buffered spans now
+func (x *Tracer) Flush() error {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	records := x.records
+	x.records = nil
+	x.mu.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+
+	x.exportMu.Lock()
+	defer x.exportMu.Unlock()
+	return x.Exporter.Export(records)
+}
+
+func (x *Tracer) newSpan(name string, traceId TraceId, parent SpanId) *Span {
+	s := &Span{
+		tracer: x,
+		r: Record{
+			TraceId:  traceId,
+			ParentId: parent,
+			Service:  x.Service,
+			Name:     name,
+			Kind:     KindInternal,
+			Start:    time.Now(),
+		},
+	}
+	for s.r.SpanId.IsZero() {
+		binary.BigEndian.PutUint64(s.r.SpanId[:], rand.Uint64())
+	}
+	return s
+}
+
+func (x *Tracer) add(r Record) {
+	x.mu.Lock()
+	if len(x.records) >= maxBuffered {
+		x.mu.Unlock()
+		return
+	}
+	x.records = append(x.records, r)
+	full := len(x.records) >= x.BatchSize
+	x.mu.Unlock()
+
+	if full {
+		select {
+		case x.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (x *Tracer) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(x.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-x.flush:
+		}
+		if err := x.Flush(); err != nil {
+			nabu.FromError(err).Log()
+		}
+	}
+}
+
+type spanKey struct{}
+
+// WithSpan returns a context carrying s, the client continues its trace in the requests sent with that context
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// FromContext returns the span carried by ctx, nil if there is none
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
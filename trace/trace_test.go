@@ -0,0 +1,248 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rah-0/hyperion/model"
+)
+
+// memoryExporter keeps exported records for the tests
+type memoryExporter struct {
+	mu      sync.Mutex
+	records []Record
+	closed  bool
+}
+
+func (x *memoryExporter) Export(records []Record) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.records = append(x.records, records...)
+	return nil
+}
+
+func (x *memoryExporter) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.closed = true
+	return nil
+}
+
+func (x *memoryExporter) byName() map[string]Record {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	out := make(map[string]Record)
+	for _, r := range x.records {
+		out[r.Name] = r
+	}
+	return out
+}
+
+// TestSpanTree checks parents, kinds, attributes and errors of spans, including across a propagated context
+func TestSpanTree(t *testing.T) {
+	e := &memoryExporter{}
+	client := NewTracer("client", e)
+	server := NewTracer("server", e)
+
+	root := client.Span("request", nil)
+	sent := root.Child("send").SetKind(KindClient)
+	received := server.Span("receive", sent.Context()).SetKind(KindServer).Set("type", "query")
+	received.Child("sort").Fail(errors.New("boom")).Finish()
+	received.Finish()
+	sent.Finish()
+	root.Finish()
+	// Finishing twice or changing a finished span does nothing
+	root.Set("late", "true").Finish()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := e.byName()
+	if len(e.records) != 4 {
+		t.Fatalf("Expected 4 spans, got %d", len(e.records))
+	}
+	for name, r := range spans {
+		if r.TraceId != root.TraceId() {
+			t.Errorf("Span %s is not in the trace of the request", name)
+		}
+		if r.End.Before(r.Start) {
+			t.Errorf("Span %s ends before it starts", name)
+		}
+	}
+	if !spans["request"].ParentId.IsZero() || spans["request"].Attributes["late"] != "" {
+		t.Errorf("Unexpected root span: %+v", spans["request"])
+	}
+	if spans["send"].ParentId != spans["request"].SpanId || spans["send"].Kind != KindClient {
+		t.Errorf("Unexpected send span: %+v", spans["send"])
+	}
+	if spans["receive"].ParentId != spans["send"].SpanId || spans["receive"].Service != "server" || spans["receive"].Attributes["type"] != "query" {
+		t.Errorf("Unexpected receive span: %+v", spans["receive"])
+	}
+	if spans["sort"].ParentId != spans["receive"].SpanId || spans["sort"].Error != "boom" || spans["sort"].Kind != KindInternal {
+		t.Errorf("Unexpected sort span: %+v", spans["sort"])
+	}
+	if !e.closed {
+		t.Errorf("Expected Close to close the exporter")
+	}
+}
+
+// TestDisabled checks that a nil tracer and the spans it returns can be used as if tracing was on
+func TestDisabled(t *testing.T) {
+	var x *Tracer
+	s := x.Span("request", nil)
+	s.Child("send").SetKind(KindClient).Set("node", "a").Fail(errors.New("boom")).Finish()
+	s.Finish()
+	if s != nil || s.Context() != nil {
+		t.Errorf("Expected no span")
+	}
+	if err := x.Close(); err != nil {
+		t.Error(err)
+	}
+
+	e := &memoryExporter{}
+	sampled := NewTracer("node", e).WithSampleRatio(0)
+	if sampled.Span("request", nil) != nil {
+		t.Errorf("Expected a new trace not to be sampled")
+	}
+	if sampled.Span("request", NewTracer("client", e).Span("send", nil).Context()) == nil {
+		t.Errorf("Expected the trace of a sender to be continued")
+	}
+}
+
+// TestTracerBatches checks that full batches are exported in the background
+func TestTracerBatches(t *testing.T) {
+	e := &memoryExporter{}
+	x := NewTracer("node", e).WithBatchSize(2).WithFlushInterval(time.Hour)
+	x.Start()
+	defer x.Close()
+
+	x.Span("a", nil).Finish()
+	x.Span("b", nil).Finish()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(e.byName()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a full batch to be exported")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces", "spans.jsonl")
+	f, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewTracer("node", f)
+	s := x.Span("receive", nil)
+	s.Child("decode").Finish()
+	s.Finish()
+	if err = x.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r struct {
+			TraceId string
+			Name    string
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.TraceId != s.TraceId().String() {
+			t.Errorf("Expected trace id %s, got %s", s.TraceId(), r.TraceId)
+		}
+		names = append(names, r.Name)
+	}
+	if len(names) != 2 || names[0] != "decode" || names[1] != "receive" {
+		t.Errorf("Expected decode then receive, got %v", names)
+	}
+}
+
+// collectorStub is an in-process OTLP/HTTP collector
+type collectorStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []OTLPRequest
+	status   int
+}
+
+func newCollectorStub(status int) *collectorStub {
+	c := &collectorStub{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req OTLPRequest
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, req)
+		c.mu.Unlock()
+		w.WriteHeader(c.status)
+	}))
+	return c
+}
+
+func TestOTLPExporter(t *testing.T) {
+	c := newCollectorStub(http.StatusOK)
+	defer c.Close()
+
+	x := NewTracer("node", NewOTLPExporter(c.URL+"/v1/traces"))
+	s := x.Span("receive", nil).SetKind(KindServer).Set("type", "insert")
+	s.Child("disk write").Fail(errors.New("disk full")).Finish()
+	s.Finish()
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.requests) != 1 || len(c.requests[0].ResourceSpans) != 1 {
+		t.Fatalf("Expected a single request for one service, got %+v", c.requests)
+	}
+	rs := c.requests[0].ResourceSpans[0]
+	if a := rs.Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value.StringValue != "node" {
+		t.Errorf("Unexpected resource: %+v", rs.Resource)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	write, receive := spans[0], spans[1]
+	if receive.TraceId != s.TraceId().String() || len(receive.TraceId) != 32 || len(receive.SpanId) != 16 {
+		t.Errorf("Unexpected ids: %+v", receive)
+	}
+	if receive.Kind != 2 || receive.ParentSpanId != "" || receive.Status.Code != 1 || receive.Attributes[0].Value.StringValue != "insert" {
+		t.Errorf("Unexpected receive span: %+v", receive)
+	}
+	if write.ParentSpanId != receive.SpanId || write.Kind != 1 || write.Status.Code != 2 || write.Status.Message != "disk full" {
+		t.Errorf("Unexpected disk write span: %+v", write)
+	}
+
+	rejecting := newCollectorStub(http.StatusServiceUnavailable)
+	defer rejecting.Close()
+	if err := NewOTLPExporter(rejecting.URL + "/v1/traces").Export([]Record{{Name: "a"}}); !errors.Is(err, model.ErrTraceExport) {
+		t.Errorf("Expected an error when the collector rejects the spans")
+	}
+}
@@ -1,10 +1,18 @@
 package util
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 )
 
 func BuildBinary(suffix string) error {
@@ -43,3 +51,80 @@ func Pkill(processName string) error {
 	}
 	return nil
 }
+
+// TestCertificates holds the paths of the PEM files written by GenerateTestCertificates
+type TestCertificates struct {
+	CA   string
+	Cert map[string]string
+	Key  map[string]string
+}
+
+// GenerateTestCertificates writes a self-signed CA to dir and a certificate signed by it for every name,
+// each name is the DNS name of its certificate so it can be verified as a node host name
+func GenerateTestCertificates(dir string, names ...string) (TestCertificates, error) {
+	tc := TestCertificates{
+		CA:   filepath.Join(dir, "ca.pem"),
+		Cert: make(map[string]string),
+		Key:  make(map[string]string),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tc, err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hyperion test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tc, err
+	}
+	if err = writePem(tc.CA, "CERTIFICATE", caDer); err != nil {
+		return tc, err
+	}
+
+	for i, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return tc, err
+		}
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return tc, err
+		}
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return tc, err
+		}
+
+		tc.Cert[name] = filepath.Join(dir, name+".pem")
+		tc.Key[name] = filepath.Join(dir, name+".key")
+		if err = writePem(tc.Cert[name], "CERTIFICATE", der); err != nil {
+			return tc, err
+		}
+		if err = writePem(tc.Key[name], "EC PRIVATE KEY", keyDer); err != nil {
+			return tc, err
+		}
+	}
+
+	return tc, nil
+}
+
+func writePem(path string, blockType string, der []byte) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}